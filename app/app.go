@@ -1,14 +1,28 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"html"
+	"io"
 	"log/slog"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -19,267 +33,3219 @@ var (
 	SomethingWentWrongError = errors.New("something went wrong")
 	// NoteNotFoundError is returned when a note is not found
 	NoteNotFoundError = errors.New("note not found")
+	// ErrInvalidNote is returned when a note fails validation before it is stored
+	ErrInvalidNote = errors.New("invalid note")
+	// ErrVersionConflict is returned when saving a note that was updated
+	// since it was loaded
+	ErrVersionConflict = errors.New("note was updated concurrently")
+	// ErrEmptyTitle is returned when a note's title is empty or only whitespace
+	ErrEmptyTitle = fmt.Errorf("%w: title is empty", ErrInvalidNote)
+	// ErrEmptyContent is returned when a note's content is empty or only whitespace
+	ErrEmptyContent = fmt.Errorf("%w: content is empty", ErrInvalidNote)
+	// ErrTitleTooLong is returned when a note's title exceeds the maximum length
+	ErrTitleTooLong = fmt.Errorf("%w: title is too long", ErrInvalidNote)
+	// ErrInvalidImport is returned when a line of an import isn't a JSON note
+	ErrInvalidImport = errors.New("invalid import")
+	// ErrRequestInProgress is returned when creating a note with an
+	// idempotency key that another request is still creating its note with
+	ErrRequestInProgress = errors.New("request with the same idempotency key is in progress")
+	// ErrTitleTakenByDeletedNote is returned when adding a note with the
+	// title of a soft-deleted note, which keeps its title until it is
+	// purged. The caller may restore the deleted note instead.
+	ErrTitleTakenByDeletedNote = fmt.Errorf("%w: title is taken by a deleted note", DuplicateNoteError)
+	// ErrRateLimited is returned when a client creates more notes than its
+	// rate limit allows
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrLockNotHeld is returned when releasing a lock that expired
+	// before it was released
+	ErrLockNotHeld = errors.New("lock is no longer held")
+	// ErrLockingUnavailable is returned when acquiring a lock through a
+	// repository without a redis client
+	ErrLockingUnavailable = errors.New("locking requires redis")
+	// ErrInvalidLockTTL is returned when acquiring a lock with a ttl that
+	// isn't positive, which would make the lock never expire
+	ErrInvalidLockTTL = errors.New("lock ttl must be positive")
 )
 
+// MaxTitleLength is the maximum number of characters allowed in a note title.
+// Titles are covered by a unique btree index which postgres limits to roughly
+// 2704 bytes per entry, 512 characters keeps even a title made entirely of
+// 4 byte characters within that limit. It must match the varchar bound on Note.Title.
+const MaxTitleLength = 512
+
+// DefaultMaxTitleLength is the maximum number of characters the Application
+// accepts in a note title unless configured otherwise.
+const DefaultMaxTitleLength = 255
+
 // Note represents a note that has a title and the note content
 type Note struct {
 	gorm.Model
+	// AuthorID is the id of the user who owns the note, zero for notes
+	// without an author. Titles are unique per author.
+	AuthorID uint `gorm:"column:author_id;not null;default:0;uniqueIndex:idx_notes_author_title;uniqueIndex:idx_notes_author_normalized_title"`
 	// Title is the title of the note.
-	Title string `gorm:"column:title;not null;unique"`
+	Title string `gorm:"column:title;type:varchar(512);not null;uniqueIndex:idx_notes_author_title"`
+	// NormalizedTitle is the lowercased title, set only by repositories
+	// created WithCaseInsensitiveTitles which keep it unique and look
+	// notes up by it so titles differing only in case are the same title.
+	NormalizedTitle *string `gorm:"column:normalized_title;type:varchar(512);uniqueIndex:idx_notes_author_normalized_title" json:"-"`
 	// Content is the content of the note.
 	Content string `gorm:"column:content;not null"`
+	// WordCount is the number of whitespace separated words in the content.
+	WordCount int `gorm:"column:word_count;not null;default:0"`
+	// Version is incremented on every update and guards against concurrent
+	// updates overwriting each other.
+	Version int `gorm:"column:version;not null;default:0"`
+	// Tags are free-form labels stored in the note_tags table. They are
+	// loaded by the methods that return a single note, BatchGetNotesByIds
+	// and FindNotesByTag.
+	Tags []string `gorm:"-"`
+}
+
+// NoteTag represents a tag attached to a note
+type NoteTag struct {
+	// NoteID is the id of the tagged note.
+	NoteID uint `gorm:"column:note_id;primaryKey"`
+	// Tag is the tag attached to the note.
+	Tag string `gorm:"column:tag;primaryKey;index"`
+}
+
+// normalizeTags will trim the tags and return them sorted without
+// duplicates or empty tags.
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+// replaceTags will replace the tags stored for each of the notes with
+// the notes' tags
+func replaceTags(tx *gorm.DB, notes ...*Note) error {
+	ids := make([]uint, len(notes))
+	noteTags := make([]NoteTag, 0)
+	for i, note := range notes {
+		ids[i] = note.ID
+		for _, tag := range note.Tags {
+			noteTags = append(noteTags, NoteTag{NoteID: note.ID, Tag: tag})
+		}
+	}
+	err := tx.Where("note_id IN ?", ids).Delete(&NoteTag{}).Error
+	if err != nil || len(noteTags) == 0 {
+		return err
+	}
+	return tx.CreateInBatches(noteTags, defaultBatchSize).Error
+}
+
+// pointersTo will return pointers to each of the notes
+func pointersTo(notes []Note) []*Note {
+	pointers := make([]*Note, len(notes))
+	for i := range notes {
+		pointers[i] = &notes[i]
+	}
+	return pointers
+}
+
+// loadTags will load the tags of each of the notes from postgres
+func loadTags(db *gorm.DB, notes ...*Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+	notesByID := make(map[uint]*Note, len(notes))
+	ids := make([]uint, len(notes))
+	for i, note := range notes {
+		note.Tags = nil
+		notesByID[note.ID] = note
+		ids[i] = note.ID
+	}
+	var noteTags []NoteTag
+	err := db.Where("note_id IN ?", ids).Order("note_id, tag").Find(&noteTags).Error
+	if err != nil {
+		return err
+	}
+	for _, noteTag := range noteTags {
+		note := notesByID[noteTag.NoteID]
+		note.Tags = append(note.Tags, noteTag.Tag)
+	}
+	return nil
+}
+
+// countWords will return the number of whitespace separated words in the content
+func countWords(content string) int {
+	return len(strings.Fields(content))
+}
+
+// previewEllipsis is appended to the content of a preview that was truncated
+const previewEllipsis = "…"
+
+// truncateContent will truncate the content to maxLen characters followed by
+// previewEllipsis, or return it as it is when it isn't longer than maxLen.
+// Characters are counted as runes so a multibyte character is never split.
+func truncateContent(content string, maxLen int) string {
+	if utf8.RuneCountInString(content) <= maxLen {
+		return content
+	}
+	runes := 0
+	for i := range content {
+		if runes == maxLen {
+			return content[:i] + previewEllipsis
+		}
+		runes++
+	}
+	return content
+}
+
+// Actions recorded in the audit trail for note mutations
+const (
+	AuditActionCreated  = "created"
+	AuditActionUpdated  = "updated"
+	AuditActionDeleted  = "deleted"
+	AuditActionRestored = "restored"
+)
+
+// AuditEntry represents a single mutation event recorded for a note
+type AuditEntry struct {
+	ID uint `gorm:"primarykey"`
+	// NoteID is the id of the note that was mutated.
+	NoteID uint `gorm:"column:note_id;not null;index"`
+	// Action is the kind of mutation, one of the AuditAction constants.
+	Action string `gorm:"column:action;not null"`
+	// CreatedAt is the time the mutation happened.
+	CreatedAt time.Time `gorm:"column:created_at;not null;index"`
+}
+
+// Validate will check that the note can be stored without violating
+// any of the database constraints.
+// Returns:
+// - error: ErrInvalidNote wrapped with the reason the note is invalid
+func (note *Note) Validate() error {
+	if utf8.RuneCountInString(note.Title) > MaxTitleLength {
+		return fmt.Errorf("%w: title exceeds %d characters", ErrTitleTooLong, MaxTitleLength)
+	}
+	return nil
 }
 
 // NoteRepositoryInterface is the interface for the note repository
 type NoteRepositoryInterface interface {
-	SaveNote(note *Note) error
-	GetNoteById(id int) *Note
-	GetNoteByTitle(title string) *Note
-	DeleteNote(id int) error
+	SaveNote(ctx context.Context, note *Note) error
+	GetNoteById(ctx context.Context, id int) (*Note, error)
+	GetNoteByTitle(ctx context.Context, title string, opts ...TitleOption) (*Note, error)
+	TitleExists(ctx context.Context, title string, opts ...TitleOption) (bool, error)
+	TitlesExist(ctx context.Context, titles []string, opts ...TitleOption) (map[string]bool, error)
+	GetRandomNote(ctx context.Context) (*Note, error)
+	DeleteNote(ctx context.Context, id int) error
+	GetOrCreateNote(ctx context.Context, note *Note) (bool, error)
+	CreateNoteIdempotent(ctx context.Context, key string, note *Note) error
+	GetNoteByIdempotencyKey(ctx context.Context, authorID uint, key string) (*Note, error)
+	ListNotesAfter(ctx context.Context, afterID uint, limit int) ([]Note, error)
+	ListNotesUpdatedSince(ctx context.Context, since time.Time, afterID uint, limit int) ([]Note, error)
+	ListRecentlyUpdated(ctx context.Context, limit int) ([]Note, error)
+	ListNotesCreatedBetween(ctx context.Context, start time.Time, end time.Time) ([]Note, error)
+	ListNotesByIDRange(ctx context.Context, minID uint, maxID uint) ([]Note, error)
+	ForEachNote(ctx context.Context, batchSize int, fn func([]Note) error) error
+	ImportNotes(ctx context.Context, nextBatch func() ([]*Note, error), skipDuplicates bool) (int, error)
+	WarmCache(ctx context.Context, ids []int) (int, error)
+	InvalidateNotes(ctx context.Context, ids []int) error
+	InspectNote(ctx context.Context, id int) (InspectResult, error)
+	CountNotes(ctx context.Context) (int64, error)
+	HealthCheck(ctx context.Context) error
+	Close() error
+	WithTransaction(ctx context.Context, fn func(NoteRepositoryInterface) error) error
+}
+
+// InspectResult holds everything needed to diagnose the caching of a note
+type InspectResult struct {
+	// DbNote is the note as stored in postgres, nil if it isn't in postgres.
+	DbNote *Note
+	// CachedNote is the note as cached under its id, nil if it isn't cached.
+	CachedNote *Note
+	// TitleCachedNote is the note as cached under its title, nil if it
+	// isn't cached. It is only looked up by NoteRepository.InspectNote.
+	TitleCachedNote *Note
+	// Matches reports whether the cached note is identical to the postgres note.
+	Matches bool
+	// CacheTTL is the time left before the cached note expires. It is zero
+	// when the note isn't cached and negative when the entry never expires.
+	CacheTTL time.Duration
 }
 
-// NoteRepository implements the NoteRepositoryInterface
+// NoteRepository implements the NoteRepositoryInterface by caching the
+// notes stored by a dbNoteRepository, or any other repository wrapped by
+// NewCachingNoteRepository, tracing each operation and publishing change
+// events
 type NoteRepository struct {
-	db    *gorm.DB
-	redis *redis.Client
+	// db is the postgres client of the methods outside the
+	// NoteRepositoryInterface, nil when the store isn't postgres backed
+	db *gorm.DB
+	// store persists the notes
+	store noteStore
+	// cache holds the cached notes
+	cache Cache
+	// redis tracks note accesses, it is nil when the repository
+	// is created with a cache that isn't backed by redis
+	redis           redis.UniversalClient
+	renderer        ContentRenderer
+	titleNormalizer TitleNormalizer
+	// cacheTTL is how long a cached note lives, zero means no expiry
+	cacheTTL time.Duration
+	// hotThreshold is the access count from which a note is considered hot
+	hotThreshold int64
+	// hotTTL is the TTL a hot note's cache entry is extended to on read
+	hotTTL time.Duration
+	// cacheWriteStrategy is how SaveNote updates the cache once a note is stored
+	cacheWriteStrategy CacheWriteStrategy
+	// accessTrackingDisabled stops reads from counting towards the view
+	// count of the notes
+	accessTrackingDisabled bool
+	// cacheCodec is the format NewNoteRepository caches notes in, a redis
+	// hash when it is nil
+	cacheCodec CacheCodec
+	// cachingDisabled makes the repository talk only to postgres, it is
+	// set by WithoutCache or by creating the repository without a cache
+	cachingDisabled bool
+	// compressionThreshold is the content size in bytes above which cached
+	// content is gzipped, zero means content is cached uncompressed
+	compressionThreshold int
+	// caseInsensitiveTitles makes titles unique and looked up regardless of case
+	caseInsensitiveTitles bool
+	// cacheAttempts is the number of times a failing cache call is made
+	cacheAttempts int
+	// cacheBackoff is the wait before retrying a failed cache call
+	cacheBackoff time.Duration
+	// cacheTimeout bounds each redis call, zero or less means unbounded
+	cacheTimeout time.Duration
+	// idempotencyTTL is how long the note created with an idempotency key is remembered
+	idempotencyTTL time.Duration
+	// missingNoteTTL is how long a tombstone for a missing note is cached,
+	// zero means missing notes aren't cached
+	missingNoteTTL time.Duration
+	// tracer starts the spans recorded for repository operations
+	tracer trace.Tracer
+	// eventChannel is the redis channel note change events are published to
+	eventChannel string
+	// keyPrefix namespaces the redis keys the repository uses
+	keyPrefix string
+	// logger records cache hits and misses and the outcome of writes
+	logger *slog.Logger
+	// metrics observes the duration of backend calls, it is nil unless
+	// the repository is created with WithMetrics
+	metrics *repositoryMetrics
+	// slowQueryThreshold is the duration past which a postgres call is
+	// logged as slow, zero means slow calls aren't logged
+	slowQueryThreshold time.Duration
+	// poolConfig is applied to the connection pool of db, it is nil
+	// unless the repository is created with WithPoolConfig
+	poolConfig *PoolConfig
+	// callbacks are the in-process listeners notified of mutations
+	callbacks noteCallbacks
+	// changes holds back the cache invalidations and events of the
+	// transaction the repository runs in, it is nil outside of WithTransaction
+	changes *pendingChanges
+}
+
+// ContentRenderer renders the content of a note to HTML
+type ContentRenderer func(content string) string
+
+// TitleNormalizer maps a title to the canonical form used to store
+// and look up notes, e.g. by trimming whitespace or folding case
+type TitleNormalizer func(title string) string
+
+// NoteRepositoryOption configures optional behaviour of a NoteRepository
+type NoteRepositoryOption func(repo *NoteRepository)
+
+// WithRenderer sets the renderer used to precompute the HTML stored
+// alongside each cached note. By default the content is HTML escaped.
+func WithRenderer(renderer ContentRenderer) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.renderer = renderer
+	}
+}
+
+// WithTitleNormalizer sets the normalizer applied to titles before a note
+// is stored or looked up by title, so titles that normalize to the same
+// value are treated as the same title. By default titles are used as is.
+func WithTitleNormalizer(normalizer TitleNormalizer) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.titleNormalizer = normalizer
+	}
+}
+
+// WithCacheTTL sets how long a note stays cached under its id and title.
+// A zero TTL, the default, means cached notes never expire.
+func WithCacheTTL(ttl time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.cacheTTL = ttl
+	}
+}
+
+// WithMissingNoteTTL makes GetNoteById cache a tombstone under the id of a
+// note that doesn't exist for ttl, so repeated reads of the id, e.g. by a
+// bot scanning ids, are answered with NoteNotFoundError without querying
+// postgres. Saving a note, or inserting it with BulkCreateNotes or
+// ImportNotes, deletes the tombstone under its id. By default missing notes
+// aren't cached.
+func WithMissingNoteTTL(ttl time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.missingNoteTTL = ttl
+	}
+}
+
+// WithHotNoteTTL makes reads extend the cache TTL of a note to ttl once
+// the note has been read at least threshold times, so only hot notes are
+// kept alive while notes read once or twice still expire normally.
+// Entries that have no expiry are left as they are.
+func WithHotNoteTTL(threshold int64, ttl time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.hotThreshold = threshold
+		repo.hotTTL = ttl
+	}
+}
+
+// WithAccessTracking sets whether reads by id or title count towards the
+// view count of the note, which GetNoteViewCount, HottestNotes and
+// WithHotNoteTTL rely on. Tracking can be disabled, e.g. in tests, to
+// spare the redis call made on every read. By default reads are tracked.
+func WithAccessTracking(enabled bool) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.accessTrackingDisabled = !enabled
+	}
+}
+
+// CacheWriteStrategy is how SaveNote updates the cache once a note is stored
+type CacheWriteStrategy int
+
+const (
+	// CacheWriteInvalidate deletes the saved note's cache entries so the
+	// next read loads the note from postgres and caches it
+	CacheWriteInvalidate CacheWriteStrategy = iota
+	// CacheWriteThrough caches the saved note under its id and title so
+	// the next read is served by the cache. The entry under the title the
+	// note had before it was renamed is deleted.
+	CacheWriteThrough
+)
+
+// WithCacheWriteStrategy sets how SaveNote updates the cache once a note
+// is stored. By default it is CacheWriteInvalidate.
+func WithCacheWriteStrategy(strategy CacheWriteStrategy) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.cacheWriteStrategy = strategy
+	}
+}
+
+// WithJSONCache makes a repository created with NewNoteRepository cache
+// each note as a single JSON string instead of a redis hash.
+// Repositories created with NewNoteRepositoryWithCache ignore it.
+func WithJSONCache() NoteRepositoryOption {
+	return WithCacheCodec(NewJSONCacheCodec())
+}
+
+// WithCacheCodec makes a repository created with NewNoteRepository cache
+// each note in the format of the codec, e.g. NewHashCacheCodec, the
+// default, or NewJSONCacheCodec. Repositories created with
+// NewNoteRepositoryWithCache ignore it.
+func WithCacheCodec(codec CacheCodec) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.cacheCodec = codec
+	}
+}
+
+// WithCaseInsensitiveTitles makes titles that differ only in case the same
+// title, so a note titled "Groceries" is found by GetNoteByTitle("groceries")
+// and creating a note titled "GROCERIES" fails with DuplicateNoteError. The
+// note keeps the title it was saved with, uniqueness is enforced on its
+// lowercased NormalizedTitle and notes are cached under the lowercased
+// title. Every repository using the notes table must agree on the option,
+// and the notes saved before it was turned on must be backfilled with
+// BackfillNormalizedTitles.
+func WithCaseInsensitiveTitles() NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.caseInsensitiveTitles = true
+	}
+}
+
+// tracerName is the instrumentation name of the repository's default tracer
+const tracerName = "github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+
+// WithTracer sets the tracer used to record a span for each repository
+// operation. By default the tracer is taken from the global otel provider.
+func WithTracer(tracer trace.Tracer) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.tracer = tracer
+	}
+}
+
+// DefaultEventChannel is the redis channel note change events are
+// published to unless WithEventChannel sets another one
+const DefaultEventChannel = "notes:events"
+
+// WithEventChannel sets the redis channel note change events are published to.
+func WithEventChannel(channel string) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.eventChannel = channel
+	}
+}
+
+// DefaultKeyPrefix is the prefix of the redis keys the repository uses
+// unless WithKeyPrefix sets another one
+const DefaultKeyPrefix = "notes"
+
+// WithKeyPrefix sets the prefix of the redis keys the repository uses, so
+// applications sharing a redis instance don't overwrite each other's notes.
+// Notes are cached under <prefix>:id:<id> and <prefix>:title:<title>.
+func WithKeyPrefix(prefix string) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.keyPrefix = prefix
+	}
+}
+
+// WithLogger sets the logger the repository logs cache hits and misses to,
+// at debug level, along with the outcome of writes. By default the
+// repository logs to slog.Default().
+func WithLogger(logger *slog.Logger) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.logger = logger
+	}
+}
+
+// WithoutCache makes the repository talk only to postgres, e.g. where redis
+// isn't available. Every cache call becomes a no-op and nothing else is
+// done through redis either, so reads always query postgres, access
+// tracking and idempotency keys are disabled and no change events are
+// published. Creating the repository with a nil redis client or cache
+// does the same.
+func WithoutCache() NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.cachingDisabled = true
+	}
 }
 
-// NewNoteRepository is the factory function to create a new NoteRepository
+// NewNoteRepository is the factory function to create a new NoteRepository.
+// The cache timeout, see WithCacheTimeout, only bounds a redis call in
+// flight when rd is created with ContextTimeoutEnabled, otherwise rd's read
+// and write timeouts do.
 // Parameters:
 // -  db: gorm database client
-// -  rd: redis client
+// -  rd: redis client, any of the single node, sentinel or cluster clients,
+// or nil to disable caching as WithoutCache does
+// -  opts: optional configuration for the repository
 //
 // Returns:
 // - *NoteRepository: A pointer to the newly created NoteRepository
-func NewNoteRepository(db *gorm.DB, rd *redis.Client) *NoteRepository {
-	return &NoteRepository{
-		db:    db,
-		redis: rd,
+func NewNoteRepository(db *gorm.DB, rd redis.UniversalClient, opts ...NoteRepositoryOption) *NoteRepository {
+	if rd == nil {
+		return NewNoteRepositoryWithCache(db, nil, opts...)
+	}
+	repo := NewNoteRepositoryWithCache(db, NewRedisCache(rd), opts...)
+	if repo.cachingDisabled {
+		return repo
 	}
+	repo.redis = rd
+	if repo.cacheCodec != nil {
+		repo.cache = repo.withRetries(repo.withTimeout(repo.withCompression(NewRedisCacheWithCodec(rd, repo.cacheCodec))))
+	}
+	return repo
 }
 
-// convertMapToNote will convert a map[string]string to a Note object
+// NewNoteRepositoryWithRedisOptions is the factory function to create a new
+// NoteRepository connected to the redis deployment described by redisOpts.
+// Setting MasterName connects through sentinel, with Addrs listing the
+// sentinels, which is how a highly available redis is reached. The client is
+// created with ContextTimeoutEnabled so the cache timeout bounds its calls.
 // Parameters:
-// -    noteMap: map[string]string that holds the note data
+// -  db: gorm database client
+// -  redisOpts: options of the redis client, see redis.NewUniversalClient
+// -  opts: optional configuration for the repository
+//
 // Returns:
-// - Note: the resulting note object
-// - error: any error that arises from this conversion
-func (repo *NoteRepository) convertMapToNote(noteMap map[string]string) (Note, error) {
-	// convert the id from string to integer
-	noteID, err := strconv.Atoi(noteMap["id"])
-	if err != nil {
-		return Note{}, err
+// - *NoteRepository: A pointer to the newly created NoteRepository
+func NewNoteRepositoryWithRedisOptions(db *gorm.DB, redisOpts *redis.UniversalOptions, opts ...NoteRepositoryOption) *NoteRepository {
+	// the caller's options are copied rather than changed
+	clientOpts := *redisOpts
+	clientOpts.ContextTimeoutEnabled = true
+	return NewNoteRepository(db, redis.NewUniversalClient(&clientOpts), opts...)
+}
+
+// NewNoteRepositoryWithCluster is the factory function to create a new
+// NoteRepository connected to a redis cluster. The cluster client follows
+// the MOVED and ASK redirects of the cluster. A note's id and title keys
+// hash to different slots, so the caches never send a command spanning
+// several keys and delete or read several keys with one command per key
+// pipelined in a single round trip instead. The client is created with
+// ContextTimeoutEnabled so the cache timeout bounds its calls.
+// Parameters:
+// -  db: gorm database client
+// -  addrs: addresses of the cluster nodes the slots are discovered from
+// -  opts: optional configuration for the repository
+//
+// Returns:
+// - *NoteRepository: A pointer to the newly created NoteRepository
+func NewNoteRepositoryWithCluster(db *gorm.DB, addrs []string, opts ...NoteRepositoryOption) *NoteRepository {
+	return NewNoteRepository(db, redis.NewClusterClient(&redis.ClusterOptions{Addrs: addrs, ContextTimeoutEnabled: true}), opts...)
+}
+
+// NewNoteRepositoryWithCache is the factory function to create a new
+// NoteRepository that caches notes in the given cache. Access tracking
+// needs redis so it is disabled for repositories created this way.
+// Parameters:
+// -  db: gorm database client
+// -  cache: cache to store the notes in, or nil to disable caching as
+// WithoutCache does
+// -  opts: optional configuration for the repository
+//
+// Returns:
+// - *NoteRepository: A pointer to the newly created NoteRepository
+func NewNoteRepositoryWithCache(db *gorm.DB, cache Cache, opts ...NoteRepositoryOption) *NoteRepository {
+	repo := &NoteRepository{
+		db:             db,
+		cache:          cache,
+		renderer:       html.EscapeString,
+		tracer:         otel.Tracer(tracerName),
+		eventChannel:   DefaultEventChannel,
+		keyPrefix:      DefaultKeyPrefix,
+		logger:         slog.Default(),
+		cacheTimeout:   DefaultCacheTimeout,
+		idempotencyTTL: DefaultIdempotencyTTL,
 	}
-	// parse the created_at time string
-	createdAt, err := time.Parse(time.RFC3339Nano, noteMap["created_at"])
-	if err != nil {
-		return Note{}, err
+	for _, opt := range opts {
+		opt(repo)
 	}
-	// parse the updated_at time string
-	updatedAt, err := time.Parse(time.RFC3339Nano, noteMap["updated_at"])
+	if db != nil && repo.poolConfig != nil {
+		if err := ConfigurePool(db, *repo.poolConfig); err != nil {
+			repo.logger.Error("Error in configuring connection pool", "error", err.Error())
+		}
+	}
+	if cache == nil || repo.cachingDisabled {
+		repo.cachingDisabled = true
+		repo.cache = noCache{}
+	} else {
+		repo.cache = repo.withRetries(repo.withTimeout(repo.withCompression(cache)))
+	}
+	repo.store = &dbNoteRepository{db: db, caseInsensitiveTitles: repo.caseInsensitiveTitles}
+	return repo
+}
+
+// startSpan will start the span of the named repository operation
+func (repo *NoteRepository) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return repo.tracer.Start(ctx, "NoteRepository."+name, trace.WithAttributes(attrs...))
+}
+
+// endSpan will record the error, if any, on the span and end it
+func endSpan(span trace.Span, err error) {
 	if err != nil {
-		return Note{}, err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
+	span.End()
+}
 
-	return Note{
-		Model: gorm.Model{
-			ID:        uint(noteID),
-			CreatedAt: createdAt,
-			UpdatedAt: updatedAt,
-		},
-		Title:   noteMap["title"],
-		Content: noteMap["content"],
-	}, nil
+// normalizeTitle will apply the configured title normalizer to the title
+func (repo *NoteRepository) normalizeTitle(title string) string {
+	if repo.titleNormalizer == nil {
+		return title
+	}
+	return repo.titleNormalizer(title)
 }
 
-// getNoteFromCache will get the note from the redis cache using the id
-func (repo *NoteRepository) getNoteFromCache(id int) *Note {
-	result := repo.redis.HGetAll(context.Background(), fmt.Sprintf("notes:%d", id)).Val()
-	if len(result) == 0 {
-		return nil
+// TitlesCollide will report whether the two titles would be treated as
+// the same title by the uniqueness checks, after applying the configured
+// title normalizer.
+func (repo *NoteRepository) TitlesCollide(a, b string) bool {
+	return repo.comparedTitle(a) == repo.comparedTitle(b)
+}
+
+// comparedTitle will return the normalized title, lowercased when titles
+// are case insensitive, which is the form titles are compared in
+func (repo *NoteRepository) comparedTitle(title string) string {
+	title = repo.normalizeTitle(title)
+	if repo.caseInsensitiveTitles {
+		return foldTitle(title)
 	}
-	note, err := repo.convertMapToNote(result)
-	if err != nil {
-		panic(err)
+	return title
+}
+
+// idKey will return the cache key the note with the id is stored under
+func (repo *NoteRepository) idKey(id uint) string {
+	return fmt.Sprintf("%s:id:%d", repo.keyPrefix, id)
+}
+
+// titleKey will return the cache key the note of the author with the title
+// is stored under. The notes of an author are keyed under the author so a
+// title lookup never returns the note of another author, notes without an
+// author keep the key they had before notes had authors.
+func (repo *NoteRepository) titleKey(authorID uint, title string) string {
+	if repo.caseInsensitiveTitles {
+		title = foldTitle(title)
 	}
-	return &note
+	return authorTitleKey(repo.keyPrefix, authorID, title)
 }
 
-// getNoteByTitleFromCache will get the note from the redis cache using the title
-func (repo *NoteRepository) getNoteByTitleFromCache(title string) *Note {
-	result := repo.redis.HGetAll(context.Background(), fmt.Sprintf("notes:%s", title)).Val()
-	if len(result) == 0 {
-		return nil
+// authorTitleKey will return the cache key under the prefix the note of
+// the author with the title is stored under
+func authorTitleKey(keyPrefix string, authorID uint, title string) string {
+	if authorID != 0 {
+		return fmt.Sprintf("%s:author:%d:title:%s", keyPrefix, authorID, title)
 	}
-	note, err := repo.convertMapToNote(result)
-	if err != nil {
-		panic(err)
+	return fmt.Sprintf("%s:title:%s", keyPrefix, title)
+}
+
+// getNoteFromCache will get the note from the cache using the id.
+// It returns a nil note when the note is not cached.
+func (repo *NoteRepository) getNoteFromCache(ctx context.Context, id int) (*Note, error) {
+	return repo.getCachedNote(ctx, repo.idKey(uint(id)))
+}
+
+// getNoteByTitleFromCache will get the note of the author from the
+// cache using the title. It returns a nil note when the note is not cached.
+func (repo *NoteRepository) getNoteByTitleFromCache(ctx context.Context, authorID uint, title string) (*Note, error) {
+	return repo.getCachedNote(ctx, repo.titleKey(authorID, title))
+}
+
+// getCachedNote will get the note stored in the cache under key. A corrupt
+// entry, or one cached with another schema version, is deleted and
+// reported as a miss so the note is reloaded from postgres and cached
+// again. A tombstone is reported as ErrNoteCachedAsMissing.
+func (repo *NoteRepository) getCachedNote(ctx context.Context, key string) (_ *Note, err error) {
+	ctx, span := repo.tracer.Start(ctx, "cache.lookup", trace.WithAttributes(attribute.String("cache.key", key)))
+	defer func() {
+		if errors.Is(err, ErrNoteCachedAsMissing) {
+			// a tombstone is a hit on a missing note rather than a failed lookup
+			span.SetAttributes(attribute.Bool("cache.tombstone", true))
+			endSpan(span, nil)
+			return
+		}
+		endSpan(span, err)
+	}()
+	cachedNote, err := repo.cache.GetNote(ctx, key)
+	if errors.Is(err, ErrCorruptCacheEntry) {
+		// stale entries are expected once the schema version is bumped
+		if !errors.Is(err, ErrStaleCacheEntry) {
+			repo.logger.Warn("Discarding corrupt cache entry", "key", key, "error", err.Error())
+		}
+		return nil, repo.cache.DeleteKeys(ctx, key)
 	}
-	return &note
+	if err != nil || cachedNote == nil {
+		return nil, err
+	}
+	return &cachedNote.Note, nil
 }
 
-// deleteFromCache will delete the note from redis by
+// deleteFromCache will delete the note from the cache by
 // deleting the entry stored under the notes id and the
 // entry stored under the notes title.
-func (repo *NoteRepository) deleteFromCache(note Note) error {
+func (repo *NoteRepository) deleteFromCache(ctx context.Context, note Note) error {
 	keysToDelete := make([]string, 0)
 	if note.ID > 0 {
-		keysToDelete = append(keysToDelete, fmt.Sprintf("notes:%d", note.ID))
+		keysToDelete = append(keysToDelete, repo.idKey(note.ID))
 	}
 	if note.Title != "" {
-		keysToDelete = append(keysToDelete, fmt.Sprintf("notes:%s", note.Title))
+		keysToDelete = append(keysToDelete, repo.titleKey(note.AuthorID, note.Title))
 	}
-	return repo.redis.Del(context.Background(), keysToDelete...).Err()
+	return repo.cache.DeleteKeys(ctx, keysToDelete...)
 }
 
-// cacheNote will store the note in redis using its id
-// as well as it's title
-func (repo *NoteRepository) cacheNote(note Note) error {
-	idHashKey := fmt.Sprintf("notes:%d", note.ID)
-	titleHashKey := fmt.Sprintf("notes:%s", note.Title)
-	noteMap := map[string]any{
-		"id":         note.ID,
-		"title":      note.Title,
-		"content":    note.Content,
-		"created_at": note.CreatedAt,
-		"updated_at": note.UpdatedAt,
+// uniqueViolationCode is the postgres error code for a unique constraint violation
+const uniqueViolationCode = "23505"
+
+// isUniqueViolation will report whether the error was caused by
+// violating a unique constraint in postgres. The error is either the
+// driver's, or gorm.ErrDuplicatedKey when the database was opened with
+// TranslateError, which replaces the driver's error.
+func isUniqueViolation(err error) bool {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
 	}
-	for key, val := range noteMap {
-		err := repo.redis.HSet(context.Background(), idHashKey, key, val).Err()
-		if err != nil {
-			return err
-		}
-		err = repo.redis.HSet(context.Background(), titleHashKey, key, val).Err()
-		if err != nil {
-			return err
-		}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+// duplicateTitle will extract the conflicting title from the detail of a
+// unique violation, which postgres reports as
+// "Key (author_id, title)=(0, value) already exists." The title is the last
+// column of the unique indexes so it is the value after the author's.
+func duplicateTitle(err error) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return ""
 	}
-	return nil
+	columns, values, found := strings.Cut(pgErr.Detail, ")=(")
+	if !found {
+		return ""
+	}
+	values, _, _ = strings.Cut(values, ") already exists")
+	columnCount := strings.Count(columns, ", ") + 1
+	parts := strings.SplitN(values, ", ", columnCount)
+	return parts[len(parts)-1]
 }
 
-// SaveNote will store the note in the postgres database.
-// This would also invalidate the cache to ensure the next
-// read will update the cache with the latest data
-func (repo *NoteRepository) SaveNote(note *Note) error {
-	err := repo.deleteFromCache(*note)
-	if err != nil {
-		return err
+// persistedTitle will return the title the note currently has in
+// postgres, or an empty title when the note hasn't been stored yet.
+func (repo *NoteRepository) persistedTitle(ctx context.Context, note Note) (string, error) {
+	if note.ID == 0 {
+		return "", nil
 	}
-	result := repo.db.Save(note)
-	if result.Error != nil {
-		return result.Error
+	persisted, err := repo.store.storedNote(ctx, int(note.ID))
+	if err != nil || persisted == nil {
+		return "", err
 	}
-	return nil
+	return persisted.Title, nil
 }
 
-// GetNoteById will attempt to retrieve the note from the
-// redis cache by its id, if it doesn't find the note in redis
-// it will get it from postgres and store it in the cache
-// before returning it to the caller.
-func (repo *NoteRepository) GetNoteById(id int) *Note {
-	cachedNote := repo.getNoteFromCache(id)
-	if cachedNote != nil {
-		return cachedNote
+// invalidateNote will delete the note's cache entries along with the
+// entry stored under its previous title when it differs from the
+// note's title, so renaming a note doesn't leave the old title cached.
+func (repo *NoteRepository) invalidateNote(ctx context.Context, note Note, previousTitle string) error {
+	err := repo.deleteFromCache(ctx, note)
+	if err != nil || previousTitle == "" || previousTitle == note.Title {
+		return err
 	}
-	note := Note{Model: gorm.Model{ID: uint(id)}}
-	result := repo.db.First(&note)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil
+	return repo.deleteFromCache(ctx, Note{AuthorID: note.AuthorID, Title: previousTitle})
+}
+
+// recacheNote will cache the saved note under its id and title, deleting
+// the entry under its previous title when the note was renamed. When a
+// concurrent save has already cached a newer version of the note, the
+// note's entries are invalidated instead of being overwritten with the
+// older version, so the next read loads the latest one from postgres.
+func (repo *NoteRepository) recacheNote(ctx context.Context, note Note, previousTitle string) error {
+	if previousTitle != "" && previousTitle != note.Title {
+		if err := repo.deleteFromCache(ctx, Note{AuthorID: note.AuthorID, Title: previousTitle}); err != nil {
+			return err
 		}
-		panic(result.Error)
 	}
-	err := repo.cacheNote(note)
+	cachedNote, err := repo.getNoteFromCache(ctx, int(note.ID))
+	if err == nil && cachedNote != nil && cachedNote.Version > note.Version {
+		return repo.deleteFromCache(ctx, note)
+	}
+	return repo.cacheNote(ctx, note)
+}
+
+// accessKey will return the redis sorted set that scores note ids by the
+// number of times they have been read.
+func (repo *NoteRepository) accessKey() string {
+	return repo.keyPrefix + ":access"
+}
+
+// recordAccess will increment the access count of the note and extend
+// the TTL of its cache entries once the note is hot. Failing to track an
+// access is logged rather than failing the read. Accesses are only tracked
+// when the repository has a redis client and tracking isn't disabled.
+func (repo *NoteRepository) recordAccess(ctx context.Context, note Note) {
+	if repo.redis == nil || repo.accessTrackingDisabled {
+		return
+	}
+	redisCtx, cancel := repo.redisContext(ctx)
+	defer cancel()
+	count, err := repo.redis.ZIncrBy(redisCtx, repo.accessKey(), 1, strconv.Itoa(int(note.ID))).Result()
 	if err != nil {
-		panic(err)
+		repo.logger.Error("Error in recording note access", "id", note.ID, "error", err.Error())
+		return
+	}
+	if repo.hotThreshold <= 0 || int64(count) < repo.hotThreshold {
+		return
+	}
+	if err := repo.extendTTL(ctx, note); err != nil {
+		repo.logger.Error("Error in extending hot note TTL", "id", note.ID, "error", err.Error())
 	}
-	return &note
 }
 
-// GetNoteByTitle will attempt to retrieve the note from the
-// redis cache by its title, if it doesn't find the note in redis
-// it will get it from postgres and store it in the cache
-// before returning it to the caller.
-func (repo *NoteRepository) GetNoteByTitle(title string) *Note {
-	cachedNote := repo.getNoteByTitleFromCache(title)
-	if cachedNote != nil {
-		return cachedNote
+// NoteEvent is the event published when a note is mutated
+type NoteEvent struct {
+	// Type is the kind of mutation, one of the AuditAction constants.
+	Type  string `json:"type"`
+	ID    uint   `json:"id"`
+	Title string `json:"title"`
+}
+
+// publishEvent will notify the in-process callbacks of the mutation and
+// publish the change event of the note to the event channel, or hold both
+// back until the transaction commits when the repository runs in one. It is
+// called once the mutation is stored in postgres so failing to publish is
+// logged rather than failing the mutation.
+func (repo *NoteRepository) publishEvent(ctx context.Context, eventType string, note Note) {
+	if repo.changes != nil {
+		repo.changes.queue(eventType, note)
+		return
 	}
-	note := Note{Title: title}
-	result := repo.db.First(&note)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil
-		}
-		panic(result.Error)
+	repo.notify(eventType, note)
+	repo.publish(ctx, NoteEvent{Type: eventType, ID: note.ID, Title: note.Title})
+}
+
+// publish will publish the event to the event channel. Events are only
+// published when the repository has a redis client.
+func (repo *NoteRepository) publish(ctx context.Context, event NoteEvent) {
+	if repo.redis == nil {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		repo.logger.Error("Error in encoding note event", "id", event.ID, "error", err.Error())
+		return
 	}
-	err := repo.cacheNote(note)
+	redisCtx, cancel := repo.redisContext(ctx)
+	defer cancel()
+	err = repo.redis.Publish(redisCtx, repo.eventChannel, payload).Err()
 	if err != nil {
-		panic(err)
+		repo.logger.Error("Error in publishing note event", "id", event.ID, "error", err.Error())
 	}
-	return &note
 }
 
-// DeleteNote will delete the note from the cache first and
-// then postgres.
-func (repo *NoteRepository) DeleteNote(id int) error {
-	cachedNote := repo.getNoteFromCache(id)
-	if cachedNote != nil {
-		err := repo.deleteFromCache(*cachedNote)
+// extendTTL will extend the TTL of the note's cache entries to the hot
+// note TTL. Only entries that expire sooner than that are extended.
+func (repo *NoteRepository) extendTTL(ctx context.Context, note Note) error {
+	for _, key := range []string{repo.idKey(note.ID), repo.titleKey(note.AuthorID, note.Title)} {
+		ttl, err := repo.cache.TTL(ctx, key)
 		if err != nil {
 			return err
 		}
+		if ttl <= 0 || ttl >= repo.hotTTL {
+			continue
+		}
+		if err := repo.cache.Expire(ctx, key, repo.hotTTL); err != nil {
+			return err
+		}
 	}
-	result := repo.db.Delete(&Note{}, id)
-	return result.Error
+	return nil
 }
 
-// Application represents the application class
-type Application struct {
-	noteRepository NoteRepositoryInterface
+// cacheNote will store the note and its rendered HTML
+// in the cache using its id as well as it's title with the
+// configured cache TTL, unless cache writes are disabled for ctx.
+// Timestamps are truncated to the microsecond precision
+// postgres stores them with so the cached note is identical
+// to the one in the database.
+func (repo *NoteRepository) cacheNote(ctx context.Context, note Note) (err error) {
+	if cacheWritesDisabled(ctx) {
+		return nil
+	}
+	ctx, span := repo.tracer.Start(ctx, "cache.store")
+	defer func() { endSpan(span, err) }()
+	return repo.cache.SetNote(
+		ctx, repo.toCachedNote(note), repo.cacheTTL, repo.idKey(note.ID), repo.titleKey(note.AuthorID, note.Title),
+	)
 }
 
-// CreateNote is the application use case method to create a new note.
-func (app *Application) CreateNote(title string, content string) (Note, error) {
-	existingNote := app.noteRepository.GetNoteByTitle(title)
-	if existingNote != nil {
-		return Note{}, DuplicateNoteError
+// toCachedNote will return the note as it is cached, with its rendered HTML
+func (repo *NoteRepository) toCachedNote(note Note) CachedNote {
+	return newCachedNote(note, repo.renderer)
+}
+
+// newCachedNote will return the note as it is cached, with its content
+// rendered by the renderer and its timestamps truncated to microseconds
+func newCachedNote(note Note, renderer ContentRenderer) CachedNote {
+	cachedNote := CachedNote{Note: note, HTML: renderer(note.Content)}
+	cachedNote.CreatedAt = note.CreatedAt.Truncate(time.Microsecond)
+	cachedNote.UpdatedAt = note.UpdatedAt.Truncate(time.Microsecond)
+	return cachedNote
+}
+
+// SaveNote will normalize the note's title, count the words in its content,
+// validate the note and store it in the postgres database along with an
+// audit entry for the mutation. It returns DuplicateNoteError when the
+// title is already taken and ErrVersionConflict when an existing note was
+// updated by someone else since it was loaded. The note's tags replace
+// the ones stored for it. The note's cache entries are deleted before
+// the write and again once the transaction commits, so a read that
+// repopulates the cache with the old note while the write is in flight
+// doesn't leave it cached. With CacheWriteThrough the note is cached once
+// the transaction commits instead of being invalidated again.
+func (repo *NoteRepository) SaveNote(ctx context.Context, note *Note) (err error) {
+	ctx, span := repo.startSpan(ctx, "SaveNote", attribute.Int("note.id", int(note.ID)), attribute.String("note.title", note.Title))
+	defer func() { endSpan(span, err) }()
+	note.Title = repo.normalizeTitle(note.Title)
+	if err := repo.store.prepareNote(note); err != nil {
+		return err
 	}
-	note := &Note{Title: title, Content: content}
-	if err := app.noteRepository.SaveNote(note); err != nil {
-		return Note{}, SomethingWentWrongError
+	start := time.Now()
+	previousTitle, err := repo.persistedTitle(ctx, *note)
+	repo.observeQuery(metricsOperationSave, start, err)
+	if err != nil {
+		return err
 	}
-	return *note, nil
+	start = time.Now()
+	err = repo.invalidateNote(ctx, *note, previousTitle)
+	repo.observe(metricsOperationSave, metricsBackendRedis, start)
+	if err != nil {
+		return err
+	}
+	action := AuditActionUpdated
+	if note.ID == 0 {
+		action = AuditActionCreated
+	}
+	start = time.Now()
+	err = repo.store.SaveNote(ctx, note)
+	repo.observeQuery(metricsOperationSave, start, err)
+	if err != nil {
+		repo.logger.Error("Error in saving note", "operation", "SaveNote", "id", note.ID, "error", err.Error())
+		return err
+	}
+	repo.logger.Info("Saved note", "operation", "SaveNote", "id", note.ID, "action", action)
+	// the note is stored at this point so failing to update the
+	// cache is logged rather than reported as a failed save
+	start = time.Now()
+	if repo.cacheWriteStrategy == CacheWriteThrough && !cacheWritesDisabled(ctx) {
+		err = repo.recacheNote(ctx, *note, previousTitle)
+	} else {
+		err = repo.invalidateNote(ctx, *note, previousTitle)
+	}
+	repo.observe(metricsOperationSave, metricsBackendRedis, start)
+	if err != nil {
+		repo.logger.Error("Error in updating the cache of saved note", "id", note.ID, "error", err.Error())
+	}
+	repo.publishEvent(ctx, action, *note)
+	return nil
 }
 
-// UpdateNote is the application use case method to update an existing note.
-func (app *Application) UpdateNote(id int, content string) (Note, error) {
-	note := app.noteRepository.GetNoteById(id)
-	if note == nil {
-		return Note{}, NoteNotFoundError
+// BulkCreateNotes will normalize, count the words of and validate each
+// note and insert them all in batches within a single transaction along
+// with their audit entries. The notes are not cached, and the entries cached
+// under their ids and titles before they existed, such as the tombstone of
+// a lookup of a missing note, are deleted.
+// Parameters:
+// -    ctx: context for the database call
+// -    notes: the new notes to insert
+//
+// Returns:
+// - error: DuplicateNoteError wrapped with the offending title when any title
+// is already taken, in which case none of the notes are inserted
+func (repo *NoteRepository) BulkCreateNotes(ctx context.Context, notes []*Note) (err error) {
+	ctx, span := repo.startSpan(ctx, "BulkCreateNotes", attribute.Int("notes.count", len(notes)))
+	defer func() { endSpan(span, err) }()
+	if len(notes) == 0 {
+		return nil
 	}
-	note.Content = content
-	if err := app.noteRepository.SaveNote(note); err != nil {
-		slog.Error("Error in saving note", "error", err.Error())
-		return Note{}, SomethingWentWrongError
+	if err := repo.prepareNewNotes(notes); err != nil {
+		return err
 	}
-	return *note, nil
+	err = repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return createNotes(tx, notes)
+	})
+	if err != nil {
+		repo.logger.Error("Error in bulk creating notes", "operation", "BulkCreateNotes", "error", err.Error())
+		return err
+	}
+	repo.logger.Info("Bulk created notes", "operation", "BulkCreateNotes", "count", len(notes))
+	repo.invalidateCreatedNotes(ctx, "BulkCreateNotes", repo.createdNoteKeys(notes))
+	return nil
 }
 
-// GetNoteById is the application use case method to get a note by its id.
-func (app *Application) GetNoteById(id int) (Note, error) {
-	note := app.noteRepository.GetNoteById(id)
-	if note == nil {
-		return Note{}, NoteNotFoundError
+// createdNoteKeys will return the cache keys under the ids and titles of the
+// notes inserted in bulk. Notes that weren't inserted, e.g. skipped
+// duplicates, have no id and are ignored.
+func (repo *NoteRepository) createdNoteKeys(notes []*Note) []string {
+	keys := make([]string, 0, 2*len(notes))
+	for _, note := range notes {
+		if note.ID == 0 {
+			continue
+		}
+		keys = append(keys, repo.idKey(note.ID), repo.titleKey(note.AuthorID, note.Title))
 	}
-	return *note, nil
+	return keys
 }
 
-// DeleteNote is the application use case method to delete a note.
-func (app *Application) DeleteNote(id int) error {
-	note := app.noteRepository.GetNoteById(id)
-	if note == nil {
-		return NoteNotFoundError
+// invalidateCreatedNotes will delete the cache entries under the keys of
+// the notes inserted in bulk, so a tombstone cached before a note was
+// created doesn't hide it. The notes are stored at this point so failing
+// to invalidate them is logged rather than reported as a failure.
+func (repo *NoteRepository) invalidateCreatedNotes(ctx context.Context, operation string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := repo.cache.DeleteKeys(ctx, keys...); err != nil {
+		repo.logger.Error("Error in invalidating created notes", "operation", operation, "error", err.Error())
+	}
+}
+
+// prepareNewNotes will normalize, count the words of and validate each
+// of the notes before they are inserted
+func (repo *NoteRepository) prepareNewNotes(notes []*Note) error {
+	for _, note := range notes {
+		note.Title = repo.normalizeTitle(note.Title)
+		if err := repo.store.prepareNote(note); err != nil {
+			return err
+		}
 	}
-	return app.noteRepository.DeleteNote(id)
+	return nil
+}
+
+// ImportNotes will insert the batches of notes returned by nextBatch until
+// it returns an empty batch, all within a single transaction so a failed
+// import inserts nothing. Each note is normalized and validated like in
+// BulkCreateNotes and the notes are not cached, but the entries cached under
+// their ids and titles before they existed are deleted as BulkCreateNotes
+// deletes them.
+// Parameters:
+// -    ctx: context for the database calls
+// -    nextBatch: returns the next batch of notes to insert, an empty batch ends the import
+// -    skipDuplicates: skip notes whose title is already taken, including by
+// an earlier note of the import, instead of failing the import
+//
+// Returns:
+// - int: the number of notes inserted
+// - error: DuplicateNoteError wrapped with the offending title when a title
+// is taken and duplicates aren't skipped, or any error returned by nextBatch
+func (repo *NoteRepository) ImportNotes(ctx context.Context, nextBatch func() ([]*Note, error), skipDuplicates bool) (_ int, err error) {
+	ctx, span := repo.startSpan(ctx, "ImportNotes")
+	defer func() { endSpan(span, err) }()
+	// titles are normalized as each batch is read, the store does the rest.
+	// The previous batch is inserted by the time the next one is read, so
+	// only the cache keys of its notes are kept rather than the notes.
+	var keys []string
+	var previous []*Note
+	normalizedBatch := func() ([]*Note, error) {
+		keys = append(keys, repo.createdNoteKeys(previous)...)
+		notes, err := nextBatch()
+		for _, note := range notes {
+			note.Title = repo.normalizeTitle(note.Title)
+		}
+		previous = notes
+		return notes, err
+	}
+	imported, err := repo.store.ImportNotes(ctx, normalizedBatch, skipDuplicates)
+	if err != nil {
+		repo.logger.Error("Error in importing notes", "operation", "ImportNotes", "error", err.Error())
+		return 0, err
+	}
+	repo.logger.Info("Imported notes", "operation", "ImportNotes", "count", imported)
+	repo.invalidateCreatedNotes(ctx, "ImportNotes", keys)
+	return imported, nil
+}
+
+// GetOrCreateNote will insert the note unless a note with its title
+// already exists, in which case the existing note is loaded into note.
+// The insert skips conflicting titles rather than checking for the title
+// first, so concurrent calls with the same title create the note once.
+// Parameters:
+// -    ctx: context for the database call
+// -    note: the note to create, holds the stored note on return
+//
+// Returns:
+// - bool: true when the note was created
+// - error: DuplicateNoteError when the title belongs to a deleted note
+func (repo *NoteRepository) GetOrCreateNote(ctx context.Context, note *Note) (created bool, err error) {
+	ctx, span := repo.startSpan(ctx, "GetOrCreateNote", attribute.String("note.title", note.Title))
+	defer func() { endSpan(span, err) }()
+	note.Title = repo.normalizeTitle(note.Title)
+	created, err = repo.store.GetOrCreateNote(ctx, note)
+	if err != nil {
+		repo.logger.Error("Error in getting or creating note", "operation", "GetOrCreateNote", "title", note.Title, "error", err.Error())
+		return false, err
+	}
+	if !created {
+		return false, nil
+	}
+	repo.logger.Info("Saved note", "operation", "GetOrCreateNote", "id", note.ID, "action", AuditActionCreated)
+	if err := repo.invalidateNote(ctx, *note, ""); err != nil {
+		repo.logger.Error("Error in invalidating saved note", "id", note.ID, "error", err.Error())
+	}
+	repo.publishEvent(ctx, AuditActionCreated, *note)
+	return true, nil
+}
+
+// GetNoteById will attempt to retrieve the note from the
+// cache by its id, if it doesn't find the note in the cache
+// it will get it from postgres and store it in the cache
+// before returning it to the caller. Concurrent reads that miss the
+// cache load the note from postgres once, see loadNoteOnce. A cache that
+// can't be read is logged and treated as a miss and failing to cache the
+// loaded note is logged rather than failing the read. It returns
+// NoteNotFoundError when the note doesn't exist, without querying postgres
+// when the note is cached as missing, see WithMissingNoteTTL. Cancelling
+// ctx aborts the postgres call in flight and the read returns ctx's error.
+// go-redis only checks ctx before sending a command, so a redis call
+// already in flight isn't aborted. It runs until it is bounded by the cache
+// timeout, see WithCacheTimeout, when the client is created with
+// ContextTimeoutEnabled, or by the client's read timeout otherwise.
+func (repo *NoteRepository) GetNoteById(ctx context.Context, id int) (_ *Note, err error) {
+	ctx, span := repo.startSpan(ctx, "GetNoteById", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+	cachedNote, err := repo.getNoteFromCache(ctx, id)
+	repo.observe(metricsOperationGetByID, metricsBackendRedis, start)
+	if errors.Is(err, ErrNoteCachedAsMissing) {
+		repo.logger.Debug("Cache hit on missing note", "operation", "GetNoteById", "id", id)
+		return nil, NoteNotFoundError
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// the caller has given up so the note isn't loaded from postgres either
+			return nil, ctx.Err()
+		}
+		// the note is served by postgres while the cache is unavailable
+		repo.logger.Error("Error in reading cached note", "operation", "GetNoteById", "id", id, "error", err.Error())
+	}
+	if cachedNote != nil {
+		repo.logger.Debug("Cache hit", "operation", "GetNoteById", "id", id)
+		repo.recordAccess(ctx, *cachedNote)
+		return cachedNote, nil
+	}
+	repo.logger.Debug("Cache miss", "operation", "GetNoteById", "id", id)
+	note, err := repo.loadNoteOnce(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	repo.recordAccess(ctx, *note)
+	return note, nil
+}
+
+// loadNote will load the note with the id from postgres and cache it
+func (repo *NoteRepository) loadNote(ctx context.Context, id int) (*Note, error) {
+	queryCtx, querySpan := repo.tracer.Start(ctx, "postgres.query")
+	start := time.Now()
+	note, err := repo.store.GetNoteById(queryCtx, id)
+	repo.observeQuery(metricsOperationGetByID, start, err)
+	endSpan(querySpan, err)
+	if errors.Is(err, NoteNotFoundError) {
+		repo.cacheMissing(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	start = time.Now()
+	err = repo.cacheNote(ctx, *note)
+	repo.observe(metricsOperationGetByID, metricsBackendRedis, start)
+	if err != nil {
+		// the note is loaded at this point so failing to cache it
+		// is logged rather than failing the read
+		repo.logger.Error("Error in caching note", "operation", "GetNoteById", "id", id, "error", err.Error())
+	}
+	return note, nil
+}
+
+// cacheMissing will cache a tombstone under the id of a note that doesn't
+// exist, when missing notes are cached, so reads of the id don't query
+// postgres until it expires. Failing to cache it is logged.
+func (repo *NoteRepository) cacheMissing(ctx context.Context, id int) {
+	if repo.missingNoteTTL <= 0 || cacheWritesDisabled(ctx) {
+		return
+	}
+	if err := repo.cache.SetMissing(ctx, repo.idKey(uint(id)), repo.missingNoteTTL); err != nil {
+		repo.logger.Error("Error in caching missing note", "id", id, "error", err.Error())
+	}
+}
+
+// Settings of the lock that guards loading a note that isn't cached
+const (
+	// loadLockTTL is how long a lock lives if its holder never releases it
+	loadLockTTL = 2 * time.Second
+	// loadLockWait is how long a read waits for the lock holder to cache the note
+	loadLockWait = time.Second
+	// loadLockPollInterval is how often a waiting read checks the cache
+	loadLockPollInterval = 10 * time.Millisecond
+)
+
+// lockKey will return the redis key of the lock on loading the note with the id
+func (repo *NoteRepository) lockKey(id uint) string {
+	return fmt.Sprintf("%s:lock:%d", repo.keyPrefix, id)
+}
+
+// loadNoteOnce will load the note with the id from postgres and cache it
+// without letting concurrent reads that miss the cache all query postgres.
+// The read that acquires the note's lock loads the note while the others
+// poll the cache until it is cached. A read that still misses the cache
+// once the lock is released or after loadLockWait loads the note itself.
+// The lock is a redis key, so without a redis client, or when cache writes
+// are disabled and nothing would be cached, every read loads the note.
+func (repo *NoteRepository) loadNoteOnce(ctx context.Context, id int) (*Note, error) {
+	if repo.redis == nil || cacheWritesDisabled(ctx) {
+		return repo.loadNote(ctx, id)
+	}
+	lockKey := repo.lockKey(uint(id))
+	redisCtx, cancel := repo.redisContext(ctx)
+	token, acquired, err := acquireLock(redisCtx, repo.redis, lockKey, loadLockTTL)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		repo.logger.Error("Error in acquiring note load lock", "id", id, "error", err.Error())
+		return repo.loadNote(ctx, id)
+	}
+	if acquired {
+		defer func() {
+			redisCtx, cancel := repo.redisContext(ctx)
+			defer cancel()
+			if err := releaseLock(redisCtx, repo.redis, lockKey, token); err != nil {
+				repo.logger.Error("Error in releasing note load lock", "id", id, "error", err.Error())
+			}
+		}()
+		return repo.loadNote(ctx, id)
+	}
+	ticker := time.NewTicker(loadLockPollInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(loadLockWait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		cachedNote, err := repo.getNoteFromCache(ctx, id)
+		if errors.Is(err, ErrNoteCachedAsMissing) {
+			// the holder found the note doesn't exist
+			return nil, NoteNotFoundError
+		}
+		if err != nil {
+			// stop waiting on a cache that is unavailable
+			break
+		}
+		if cachedNote != nil {
+			return cachedNote, nil
+		}
+		// the holder released the lock without caching the note, e.g.
+		// because it doesn't exist, so stop waiting for it
+		redisCtx, cancel := repo.redisContext(ctx)
+		locked, err := repo.redis.Exists(redisCtx, lockKey).Result()
+		cancel()
+		if err != nil || locked == 0 {
+			break
+		}
+	}
+	return repo.loadNote(ctx, id)
+}
+
+// GetNoteByTitle will attempt to retrieve the note from the
+// cache by its title, if it doesn't find the note in the cache
+// it will get it from postgres and store it in the cache
+// before returning it to the caller. A cache that can't be read is logged
+// and treated as a miss and failing to cache the loaded note is logged
+// rather than failing the read. It returns NoteNotFoundError when the note
+// doesn't exist or has been deleted. The note is looked up among the notes
+// without an author unless ForAuthor is given.
+func (repo *NoteRepository) GetNoteByTitle(ctx context.Context, title string, opts ...TitleOption) (_ *Note, err error) {
+	ctx, span := repo.startSpan(ctx, "GetNoteByTitle", attribute.String("note.title", title))
+	defer func() { endSpan(span, err) }()
+	title = repo.normalizeTitle(title)
+	config := newTitleConfig(opts)
+	cachedNote, err := repo.getNoteByTitleFromCache(ctx, config.authorID, title)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the caller has given up so the note isn't loaded from postgres either
+			return nil, ctx.Err()
+		}
+		// the note is served by postgres while the cache is unavailable
+		repo.logger.Error("Error in reading cached note", "operation", "GetNoteByTitle", "title", title, "error", err.Error())
+	}
+	if cachedNote != nil {
+		repo.logger.Debug("Cache hit", "operation", "GetNoteByTitle", "title", title)
+		repo.recordAccess(ctx, *cachedNote)
+		return cachedNote, nil
+	}
+	repo.logger.Debug("Cache miss", "operation", "GetNoteByTitle", "title", title)
+	queryCtx, querySpan := repo.tracer.Start(ctx, "postgres.query")
+	note, err := repo.store.GetNoteByTitle(queryCtx, title, opts...)
+	endSpan(querySpan, err)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.cacheNote(ctx, *note); err != nil {
+		// the note is loaded at this point so failing to cache it
+		// is logged rather than failing the read
+		repo.logger.Error("Error in caching note", "operation", "GetNoteByTitle", "title", title, "error", err.Error())
+	}
+	repo.recordAccess(ctx, *note)
+	return note, nil
+}
+
+// TitleExists will report whether a note has the title without loading
+// the note from postgres. Deleted notes keep their titles, so a title held
+// by a deleted note exists too and can't be given to a new note. A note
+// cached under the title answers the check without querying postgres,
+// otherwise only the existence of a matching row is queried. Failing to
+// read the cache is logged rather than failing the check.
+func (repo *NoteRepository) TitleExists(ctx context.Context, title string, opts ...TitleOption) (_ bool, err error) {
+	ctx, span := repo.startSpan(ctx, "TitleExists", attribute.String("note.title", title))
+	defer func() { endSpan(span, err) }()
+	title = repo.normalizeTitle(title)
+	config := newTitleConfig(opts)
+	cachedNote, err := repo.getNoteByTitleFromCache(ctx, config.authorID, title)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the caller has given up so postgres isn't queried either
+			return false, ctx.Err()
+		}
+		// the check is answered by postgres while the cache is unavailable
+		repo.logger.Error("Error in reading cached note", "operation", "TitleExists", "title", title, "error", err.Error())
+	}
+	if cachedNote != nil {
+		return true, nil
+	}
+	queryCtx, querySpan := repo.tracer.Start(ctx, "postgres.query")
+	exists, err := repo.store.TitleExists(queryCtx, title, opts...)
+	endSpan(querySpan, err)
+	return exists, err
+}
+
+// TitlesExist will report which of the titles are held by a note, deleted
+// or not as for TitleExists, checking them in a single query per 10000
+// titles rather than one query per title, e.g. for an import's duplicate
+// check. The cache isn't consulted since postgres is queried regardless.
+// Parameters:
+// -    ctx: context for the database call
+// -    titles: the titles to check
+// -    opts: ForAuthor to check the titles of the author's notes
+//
+// Returns:
+// - map[string]bool: whether each of the titles exists, keyed by the titles as given
+// - error: any error returned by postgres
+func (repo *NoteRepository) TitlesExist(ctx context.Context, titles []string, opts ...TitleOption) (_ map[string]bool, err error) {
+	ctx, span := repo.startSpan(ctx, "TitlesExist", attribute.Int("titles.count", len(titles)))
+	defer func() { endSpan(span, err) }()
+	normalized := make([]string, len(titles))
+	for i, title := range titles {
+		normalized[i] = repo.normalizeTitle(title)
+	}
+	queryCtx, querySpan := repo.tracer.Start(ctx, "postgres.query")
+	existing, err := repo.store.TitlesExist(queryCtx, normalized, opts...)
+	endSpan(querySpan, err)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(titles))
+	for i, title := range titles {
+		exists[title] = existing[normalized[i]]
+	}
+	return exists, nil
+}
+
+// GetRandomNote will get a note picked at random from postgres, e.g. for
+// a note of the day, bypassing the cache. Deleted notes aren't picked.
+// It returns NoteNotFoundError when there are no notes.
+func (repo *NoteRepository) GetRandomNote(ctx context.Context) (_ *Note, err error) {
+	ctx, span := repo.startSpan(ctx, "GetRandomNote")
+	defer func() { endSpan(span, err) }()
+	return repo.store.GetRandomNote(ctx)
+}
+
+// GetNoteByIdRendered will return the rendered HTML of the note's
+// content. The HTML is served from the note's cache entry and when the
+// note is not cached it is loaded through GetNoteById, which caches
+// the note along with its rendered HTML.
+func (repo *NoteRepository) GetNoteByIdRendered(ctx context.Context, id int) (_ string, err error) {
+	ctx, span := repo.startSpan(ctx, "GetNoteByIdRendered", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	lookupCtx, lookupSpan := repo.tracer.Start(ctx, "cache.lookup")
+	cachedNote, err := repo.cache.GetNote(lookupCtx, repo.idKey(uint(id)))
+	endSpan(lookupSpan, err)
+	// the note is loaded by GetNoteById when its entry is corrupt or
+	// the cache can't be read
+	if err == nil && cachedNote != nil && cachedNote.HTML != "" {
+		return cachedNote.HTML, nil
+	}
+	note, err := repo.GetNoteById(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return repo.renderer(note.Content), nil
+}
+
+// BatchGetNotesByIds will get the notes with the given ids. The notes are
+// looked up in the cache all at once and the ones that aren't cached are
+// loaded from postgres with a single query and cached.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    ids: ids of the notes to get
+//
+// Returns:
+// - map[int]*Note: the notes found keyed by id, ids that don't exist are absent
+// - error: any error returned by postgres or redis
+func (repo *NoteRepository) BatchGetNotesByIds(ctx context.Context, ids []int) (_ map[int]*Note, err error) {
+	ctx, span := repo.startSpan(ctx, "BatchGetNotesByIds", attribute.IntSlice("note.ids", ids))
+	defer func() { endSpan(span, err) }()
+	notes := make(map[int]*Note, len(ids))
+	if len(ids) == 0 {
+		return notes, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = repo.idKey(uint(id))
+	}
+	lookupCtx, lookupSpan := repo.tracer.Start(ctx, "cache.lookup")
+	cachedNotes, err := repo.cache.GetNotes(lookupCtx, keys...)
+	endSpan(lookupSpan, err)
+	if err != nil {
+		// every note is loaded from postgres while the cache is unavailable
+		repo.logger.Error("Error in reading cached notes", "operation", "BatchGetNotesByIds", "error", err.Error())
+		cachedNotes = make([]*CachedNote, len(ids))
+	}
+	missingIds := make([]int, 0)
+	for i, cachedNote := range cachedNotes {
+		if cachedNote == nil {
+			missingIds = append(missingIds, ids[i])
+			continue
+		}
+		notes[ids[i]] = &cachedNote.Note
+	}
+	if len(missingIds) == 0 {
+		return notes, nil
+	}
+	var dbNotes []Note
+	queryCtx, querySpan := repo.tracer.Start(ctx, "postgres.query")
+	err = repo.db.WithContext(queryCtx).Where("id IN ?", missingIds).Find(&dbNotes).Error
+	if err == nil {
+		err = loadTags(repo.db.WithContext(queryCtx), pointersTo(dbNotes)...)
+	}
+	endSpan(querySpan, err)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dbNotes {
+		if err := repo.cacheNote(ctx, dbNotes[i]); err != nil {
+			repo.logger.Error("Error in caching note", "operation", "BatchGetNotesByIds", "id", dbNotes[i].ID, "error", err.Error())
+		}
+		notes[int(dbNotes[i].ID)] = &dbNotes[i]
+	}
+	return notes, nil
+}
+
+// GetNotesByIdsOrdered will get the notes with the given ids as
+// BatchGetNotesByIds does, in the order of the ids, e.g. to render a list
+// of notes arranged by the user.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    ids: ids of the notes to get
+//
+// Returns:
+// - []*Note: the note with each of the ids at the id's position, nil for
+// ids that don't exist
+// - error: any error returned by postgres or redis
+func (repo *NoteRepository) GetNotesByIdsOrdered(ctx context.Context, ids []int) ([]*Note, error) {
+	notesByID, err := repo.BatchGetNotesByIds(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	notes := make([]*Note, len(ids))
+	for i, id := range ids {
+		notes[i] = notesByID[id]
+	}
+	return notes, nil
+}
+
+// WarmCache will load the notes with the ids from postgres in a single
+// query and cache them all at once, e.g. to prime the cache on startup.
+// A repository wrapped by NewCachingNoteRepository is instead asked for
+// each note in turn, one round trip per id.
+// Ids of notes that don't exist are skipped. Nothing is cached while
+// cache writes are disabled for ctx.
+// Parameters:
+// -    ctx: context for the database and cache calls
+// -    ids: ids of the notes to cache
+//
+// Returns:
+// - int: the number of notes cached
+// - error: any error returned by postgres or the cache
+func (repo *NoteRepository) WarmCache(ctx context.Context, ids []int) (_ int, err error) {
+	ctx, span := repo.startSpan(ctx, "WarmCache", attribute.IntSlice("note.ids", ids))
+	defer func() { endSpan(span, err) }()
+	if len(ids) == 0 || cacheWritesDisabled(ctx) {
+		return 0, nil
+	}
+	queryCtx, querySpan := repo.tracer.Start(ctx, "postgres.query")
+	notes, err := repo.store.notesByIds(queryCtx, ids)
+	endSpan(querySpan, err)
+	if err != nil {
+		return 0, err
+	}
+	entries := make(map[string]CachedNote, 2*len(notes))
+	for _, note := range notes {
+		cachedNote := repo.toCachedNote(note)
+		entries[repo.idKey(note.ID)] = cachedNote
+		entries[repo.titleKey(note.AuthorID, note.Title)] = cachedNote
+	}
+	storeCtx, storeSpan := repo.tracer.Start(ctx, "cache.store")
+	err = repo.cache.SetNotes(storeCtx, entries, repo.cacheTTL)
+	endSpan(storeSpan, err)
+	if err != nil {
+		return 0, err
+	}
+	repo.logger.Info("Warmed cache", "operation", "WarmCache", "count", len(notes))
+	return len(notes), nil
+}
+
+// InvalidateNotes will delete the cache entries of the notes with the ids,
+// e.g. after the notes were updated in postgres without going through the
+// repository. The notes cached under the ids are looked up first so the
+// entries under their titles are deleted along with the ones under their
+// ids, all in a single round trip. Ids of notes that aren't cached are ignored.
+// Parameters:
+// -    ctx: context for the cache calls
+// -    ids: ids of the notes to invalidate
+//
+// Returns:
+// - error: any error returned by the cache
+func (repo *NoteRepository) InvalidateNotes(ctx context.Context, ids []int) (err error) {
+	ctx, span := repo.startSpan(ctx, "InvalidateNotes", attribute.IntSlice("note.ids", ids))
+	defer func() { endSpan(span, err) }()
+	if len(ids) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(ids))
+	for _, id := range ids {
+		keys = append(keys, repo.idKey(uint(id)))
+	}
+	lookupCtx, lookupSpan := repo.tracer.Start(ctx, "cache.lookup")
+	cachedNotes, err := repo.cache.GetNotes(lookupCtx, keys...)
+	endSpan(lookupSpan, err)
+	if err != nil {
+		return err
+	}
+	for _, cachedNote := range cachedNotes {
+		if cachedNote != nil && cachedNote.Title != "" {
+			keys = append(keys, repo.titleKey(cachedNote.AuthorID, cachedNote.Title))
+		}
+	}
+	if err := repo.cache.DeleteKeys(ctx, keys...); err != nil {
+		return err
+	}
+	repo.logger.Info("Invalidated notes", "operation", "InvalidateNotes", "count", len(ids))
+	return nil
+}
+
+// DeleteNote will delete the note and its access count from the
+// cache first and then postgres, recording the deletion in the audit trail.
+// The note's title is loaded from postgres so both its id and title cache
+// entries are deleted whether or not the note is cached under its id.
+func (repo *NoteRepository) DeleteNote(ctx context.Context, id int) (err error) {
+	ctx, span := repo.startSpan(ctx, "DeleteNote", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+	stored, err := repo.store.storedNote(ctx, id)
+	repo.observeQuery(metricsOperationDelete, start, err)
+	if err != nil {
+		return err
+	}
+	note := Note{Model: gorm.Model{ID: uint(id)}}
+	if stored != nil {
+		note = *stored
+	}
+	start = time.Now()
+	err = repo.deleteFromCache(ctx, note)
+	if err == nil && repo.redis != nil {
+		redisCtx, cancel := repo.redisContext(ctx)
+		err = repo.redis.ZRem(redisCtx, repo.accessKey(), strconv.Itoa(id)).Err()
+		cancel()
+	}
+	repo.observe(metricsOperationDelete, metricsBackendRedis, start)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	deleted, err := repo.store.deleteNote(ctx, id)
+	repo.observeQuery(metricsOperationDelete, start, err)
+	if err != nil {
+		repo.logger.Error("Error in deleting note", "operation", "DeleteNote", "id", id, "error", err.Error())
+		return err
+	}
+	if deleted {
+		repo.logger.Info("Deleted note", "operation", "DeleteNote", "id", id)
+		repo.publishEvent(ctx, AuditActionDeleted, note)
+	}
+	return nil
+}
+
+// RestoreNote will revive a soft-deleted note, recording the restoration
+// in the audit trail, and cache the restored note. Restoring a note that
+// isn't deleted returns it as it is.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    id: id of the note to restore
+//
+// Returns:
+// - *Note: the restored note
+// - error: NoteNotFoundError when no note, deleted or not, has the id
+func (repo *NoteRepository) RestoreNote(ctx context.Context, id int) (_ *Note, err error) {
+	ctx, span := repo.startSpan(ctx, "RestoreNote", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	var note Note
+	restored := false
+	err = repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().
+			Model(&Note{}).
+			Where("id = ? AND deleted_at IS NOT NULL", id).
+			Update("deleted_at", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		restored = result.RowsAffected > 0
+		if restored {
+			err := tx.Create(&AuditEntry{NoteID: uint(id), Action: AuditActionRestored}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.First(&note, id).Error; err != nil {
+			return err
+		}
+		return loadTags(tx, &note)
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, NoteNotFoundError
+		}
+		repo.logger.Error("Error in restoring note", "operation", "RestoreNote", "id", id, "error", err.Error())
+		return nil, err
+	}
+	if restored {
+		repo.logger.Info("Restored note", "operation", "RestoreNote", "id", id)
+		repo.publishEvent(ctx, AuditActionRestored, note)
+	}
+	// the note is restored at this point so failing to cache it
+	// is logged rather than reported as a failed restore
+	if err := repo.cacheNote(ctx, note); err != nil {
+		repo.logger.Error("Error in caching note", "operation", "RestoreNote", "id", id, "error", err.Error())
+	}
+	return &note, nil
+}
+
+// AppendToNote will append the text to the content of the note in a single
+// UPDATE, so concurrent appends are all kept rather than racing through a
+// read-modify-write, and record the update in the audit trail. The note's
+// word count and version are updated along with its content and its cache
+// entries are invalidated once the update commits.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    id: id of the note to append to
+// -    text: the text appended to the note's content as it is
+//
+// Returns:
+// - Note: the note with the text appended
+// - error: NoteNotFoundError when the note doesn't exist or has been deleted
+func (repo *NoteRepository) AppendToNote(ctx context.Context, id int, text string) (_ Note, err error) {
+	ctx, span := repo.startSpan(ctx, "AppendToNote", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	var note Note
+	start := time.Now()
+	err = repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Note{}).Where("id = ?", id).Updates(map[string]any{
+			"content": gorm.Expr("content || ?", text),
+			"version": gorm.Expr("version + 1"),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return NoteNotFoundError
+		}
+		// the row stays locked by the update until the transaction
+		// commits so the word count is of the content as appended here
+		if err := tx.First(&note, id).Error; err != nil {
+			return err
+		}
+		note.WordCount = countWords(note.Content)
+		if err := tx.Model(&note).UpdateColumn("word_count", note.WordCount).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&AuditEntry{NoteID: uint(id), Action: AuditActionUpdated}).Error; err != nil {
+			return err
+		}
+		return loadTags(tx, &note)
+	})
+	repo.observeQuery(metricsOperationAppend, start, err)
+	if err != nil {
+		if !errors.Is(err, NoteNotFoundError) {
+			repo.logger.Error("Error in appending to note", "operation", "AppendToNote", "id", id, "error", err.Error())
+		}
+		return Note{}, err
+	}
+	repo.logger.Info("Appended to note", "operation", "AppendToNote", "id", id)
+	// the note is updated at this point so failing to invalidate it
+	// is logged rather than reported as a failed append
+	if err := repo.invalidateNote(ctx, note, ""); err != nil {
+		repo.logger.Error("Error in invalidating note", "operation", "AppendToNote", "id", id, "error", err.Error())
+	}
+	repo.publishEvent(ctx, AuditActionUpdated, note)
+	return note, nil
+}
+
+// UpdateNoteContentByTitle will set the content of the note without an
+// author that has the title. The note is looked up as GetNoteByTitle looks
+// it up, from the cache before postgres, and saved with SaveNote, so the
+// update is guarded by the note's version and its cache entries are
+// invalidated.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    title: title of the note to update
+// -    content: the note's new content
+//
+// Returns:
+// - Note: the updated note
+// - error: NoteNotFoundError when no note has the title and
+// ErrVersionConflict when the note is updated concurrently
+func (repo *NoteRepository) UpdateNoteContentByTitle(ctx context.Context, title string, content string) (_ Note, err error) {
+	ctx, span := repo.startSpan(ctx, "UpdateNoteContentByTitle", attribute.String("note.title", title))
+	defer func() { endSpan(span, err) }()
+	note, err := repo.GetNoteByTitle(ctx, title)
+	if err != nil {
+		return Note{}, err
+	}
+	note.Content = content
+	if err := repo.SaveNote(ctx, note); err != nil {
+		return Note{}, err
+	}
+	return *note, nil
+}
+
+// defaultBatchSize is the number of notes loaded per page when
+// sweeping through the whole notes table.
+const defaultBatchSize = 100
+
+// StaleCachedNoteIds will page through the notes in postgres and compare
+// the updated_at stored in each note's cache entry with the one in the
+// database. It returns the ids of notes whose cached updated_at is older
+// than the database's, which indicates a missed cache invalidation.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    limit: maximum number of ids to return, zero or less means no limit
+//
+// Returns:
+// - []int: ids of the notes with a stale cache entry
+// - error: any error that arises while reading postgres or redis
+func (repo *NoteRepository) StaleCachedNoteIds(ctx context.Context, limit int) (_ []int, err error) {
+	ctx, span := repo.startSpan(ctx, "StaleCachedNoteIds")
+	defer func() { endSpan(span, err) }()
+	staleIds := make([]int, 0)
+	var lastID uint
+	for {
+		var notes []Note
+		result := repo.db.WithContext(ctx).
+			Where("id > ?", lastID).
+			Order("id").
+			Limit(defaultBatchSize).
+			Find(&notes)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, note := range notes {
+			cachedNote, err := repo.getNoteFromCache(ctx, int(note.ID))
+			if err != nil && !errors.Is(err, ErrNoteCachedAsMissing) {
+				return nil, err
+			}
+			if cachedNote == nil {
+				continue
+			}
+			if cachedNote.UpdatedAt.Before(note.UpdatedAt) {
+				staleIds = append(staleIds, int(note.ID))
+				if limit > 0 && len(staleIds) >= limit {
+					return staleIds, nil
+				}
+			}
+		}
+		if len(notes) < defaultBatchSize {
+			return staleIds, nil
+		}
+		lastID = notes[len(notes)-1].ID
+	}
+}
+
+// ListAuditTrail will return the mutation events recorded across all notes
+// between from (inclusive) and to (exclusive), most recent first.
+// Parameters:
+// -    ctx: context for the database call
+// -    from: start of the time range
+// -    to: end of the time range
+// -    limit: maximum number of entries to return
+// -    offset: number of entries to skip
+//
+// Returns:
+// - []AuditEntry: the audit entries within the time range
+// - error: any error returned by the database
+func (repo *NoteRepository) ListAuditTrail(ctx context.Context, from, to time.Time, limit, offset int) (_ []AuditEntry, err error) {
+	ctx, span := repo.startSpan(ctx, "ListAuditTrail")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	entries := make([]AuditEntry, 0)
+	result := repo.db.WithContext(ctx).
+		Where("created_at >= ? AND created_at < ?", from, to).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
+
+// ListAllNotes will return a page of notes straight from postgres,
+// bypassing the cache. When includeDeleted is true soft-deleted notes
+// are included with their DeletedAt populated, for use in a trash view.
+// Parameters:
+// -    ctx: context for the database call
+// -    includeDeleted: whether soft-deleted notes should be returned
+// -    limit: maximum number of notes to return
+// -    offset: number of notes to skip
+//
+// Returns:
+// - []Note: the notes ordered by id
+// - error: any error returned by the database
+func (repo *NoteRepository) ListAllNotes(ctx context.Context, includeDeleted bool, limit, offset int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListAllNotes")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	query := repo.db.WithContext(ctx)
+	if includeDeleted {
+		query = query.Unscoped()
+	}
+	notes := make([]Note, 0)
+	result := query.Order("id").Limit(limit).Offset(offset).Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// ListNotePreviews will return a page of notes straight from postgres with
+// their content truncated to maxContentLen characters followed by an
+// ellipsis, for list views that don't need the full content. Postgres
+// truncates the content so the full content isn't transferred, counting
+// characters rather than bytes so multibyte characters aren't split.
+// Parameters:
+// -    ctx: context for the database call
+// -    offset: number of notes to skip
+// -    limit: maximum number of notes to return
+// -    maxContentLen: maximum number of characters of content in a preview
+//
+// Returns:
+// - []Note: the notes ordered by id, with their content truncated
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotePreviews(ctx context.Context, offset, limit, maxContentLen int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotePreviews")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	notes := make([]Note, 0)
+	// one character more than the preview holds tells whether the content was truncated
+	result := repo.db.WithContext(ctx).
+		Select("id, created_at, updated_at, deleted_at, author_id, title, LEFT(content, ?) AS content, word_count, version", maxContentLen+1).
+		Order("id").Limit(limit).Offset(offset).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for i := range notes {
+		notes[i].Content = truncateContent(notes[i].Content, maxContentLen)
+	}
+	return notes, nil
+}
+
+// ListDeletedNotes will return a page of the soft-deleted notes, most
+// recently deleted first, for use in a trash view. A note in the trash can
+// be brought back with RestoreNote or removed for good with PurgeDeletedNotes.
+// Parameters:
+// -    ctx: context for the database call
+// -    limit: maximum number of notes to return
+// -    offset: number of notes to skip
+//
+// Returns:
+// - []Note: the deleted notes ordered by deleted_at, newest first
+// - error: any error returned by the database
+func (repo *NoteRepository) ListDeletedNotes(ctx context.Context, limit, offset int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListDeletedNotes")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC, id DESC").
+		Limit(limit).Offset(offset).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// ListNotesByAuthor will return a page of the notes of the author, oldest
+// first. Deleted notes aren't listed.
+// Parameters:
+// -    ctx: context for the database call
+// -    authorID: id of the author whose notes are listed
+// -    limit: maximum number of notes to return
+// -    offset: number of notes to skip
+//
+// Returns:
+// - []Note: the author's notes ordered by id
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotesByAuthor(ctx context.Context, authorID uint, limit, offset int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotesByAuthor", attribute.Int("note.author_id", int(authorID)))
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("author_id = ?", authorID).
+		Order("id").
+		Limit(limit).Offset(offset).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// PurgeDeletedNotes will permanently delete the notes that were
+// soft-deleted before olderThan and clear any cache entries left for them.
+// The notes are selected FOR UPDATE and only deleted while they are still
+// soft-deleted, so a note restored concurrently isn't purged.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    olderThan: notes soft-deleted before this time are purged
+//
+// Returns:
+// - int: the number of notes purged
+// - error: any error returned by postgres or redis
+func (repo *NoteRepository) PurgeDeletedNotes(ctx context.Context, olderThan time.Time) (_ int, err error) {
+	ctx, span := repo.startSpan(ctx, "PurgeDeletedNotes")
+	defer func() { endSpan(span, err) }()
+	purged := 0
+	start := time.Now()
+	err = repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the notes are locked until the transaction commits so a note
+		// restored concurrently is either restored first and not purged,
+		// or waits for the purge
+		var notes []Note
+		result := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", olderThan).
+			Find(&notes)
+		if result.Error != nil || len(notes) == 0 {
+			return result.Error
+		}
+		for _, note := range notes {
+			if err := repo.deleteFromCache(ctx, note); err != nil {
+				return err
+			}
+		}
+		ids := make([]uint, len(notes))
+		for i, note := range notes {
+			ids[i] = note.ID
+		}
+		if err := tx.Where("note_id IN ?", ids).Delete(&NoteTag{}).Error; err != nil {
+			return err
+		}
+		result = tx.Unscoped().
+			Where("id IN ? AND deleted_at IS NOT NULL AND deleted_at < ?", ids, olderThan).
+			Delete(&Note{})
+		purged = int(result.RowsAffected)
+		return result.Error
+	})
+	repo.observeQuery(metricsOperationPurge, start, err)
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// PurgeDeletedBefore will permanently delete the notes that were
+// soft-deleted before the cutoff, as PurgeDeletedNotes does, and log how
+// many were removed. It is meant to be called from a scheduled maintenance
+// task so soft-deleted notes don't accumulate forever.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    cutoff: notes soft-deleted before this time are purged
+//
+// Returns:
+// - int64: the number of notes purged
+// - error: any error returned by postgres or redis
+func (repo *NoteRepository) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (_ int64, err error) {
+	purged, err := repo.PurgeDeletedNotes(ctx, cutoff)
+	if err != nil {
+		repo.logger.Error("Error in purging deleted notes", "operation", "PurgeDeletedBefore", "cutoff", cutoff, "error", err.Error())
+		return 0, err
+	}
+	repo.logger.Info("Purged deleted notes", "operation", "PurgeDeletedBefore", "cutoff", cutoff, "purged", purged)
+	return int64(purged), nil
+}
+
+// HottestNotes will return the ids of the n most read notes,
+// most read first. It returns no ids when accesses aren't tracked.
+// Parameters:
+// -    ctx: context for the redis call
+// -    n: the number of note ids to return
+//
+// Returns:
+// - []int: ids of the most read notes
+// - error: any error returned by redis
+func (repo *NoteRepository) HottestNotes(ctx context.Context, n int) (_ []int, err error) {
+	ctx, span := repo.startSpan(ctx, "HottestNotes")
+	defer func() { endSpan(span, err) }()
+	if n <= 0 || repo.redis == nil {
+		return []int{}, nil
+	}
+	redisCtx, cancel := repo.redisContext(ctx)
+	defer cancel()
+	members, err := repo.redis.ZRevRange(redisCtx, repo.accessKey(), 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// GetNoteViewCount will return the number of times the note was read by
+// id or title, as counted in the access sorted set HottestNotes ranks.
+// Parameters:
+// -    ctx: context for the redis call
+// -    id: the id of the note
+//
+// Returns:
+// - int64: the number of reads of the note, zero when it was never read
+// or the repository has no redis client
+// - error: any error returned by redis
+func (repo *NoteRepository) GetNoteViewCount(ctx context.Context, id int) (_ int64, err error) {
+	ctx, span := repo.startSpan(ctx, "GetNoteViewCount", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	if repo.redis == nil {
+		return 0, nil
+	}
+	redisCtx, cancel := repo.redisContext(ctx)
+	defer cancel()
+	count, err := repo.redis.ZScore(redisCtx, repo.accessKey(), strconv.Itoa(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(count), nil
+}
+
+// TransformAllContent will page through all the notes, apply fn to the
+// content of each note and save the notes whose content changed. Every
+// page is saved in a single transaction and the cache of the changed
+// notes is invalidated once the page is committed.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    fn: the transformation applied to each note's content
+// -    batchSize: number of notes per page, defaults to 100 when zero or less
+//
+// Returns:
+// - int: the number of notes whose content changed
+// - error: any error returned by postgres or redis
+func (repo *NoteRepository) TransformAllContent(ctx context.Context, fn func(string) string, batchSize int) (_ int, err error) {
+	ctx, span := repo.startSpan(ctx, "TransformAllContent")
+	defer func() { endSpan(span, err) }()
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	changed := 0
+	var lastID uint
+	for {
+		var notes []Note
+		result := repo.db.WithContext(ctx).
+			Where("id > ?", lastID).
+			Order("id").
+			Limit(batchSize).
+			Find(&notes)
+		if result.Error != nil {
+			return changed, result.Error
+		}
+		changedNotes := make([]Note, 0)
+		for _, note := range notes {
+			content := fn(note.Content)
+			if content != note.Content {
+				note.Content = content
+				note.WordCount = countWords(content)
+				changedNotes = append(changedNotes, note)
+			}
+		}
+		if len(changedNotes) > 0 {
+			err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				for i := range changedNotes {
+					result := tx.Model(&changedNotes[i]).Updates(map[string]any{
+						"content":    changedNotes[i].Content,
+						"word_count": changedNotes[i].WordCount,
+						"version":    gorm.Expr("version + 1"),
+					})
+					if result.Error != nil {
+						return result.Error
+					}
+					err := tx.Create(&AuditEntry{NoteID: changedNotes[i].ID, Action: AuditActionUpdated}).Error
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return changed, err
+			}
+			for _, note := range changedNotes {
+				if err := repo.deleteFromCache(ctx, note); err != nil {
+					return changed, err
+				}
+			}
+			changed += len(changedNotes)
+		}
+		if len(notes) < batchSize {
+			return changed, nil
+		}
+		lastID = notes[len(notes)-1].ID
+	}
+}
+
+// ListNotesBefore will return up to limit notes with an id lower than
+// beforeID in descending id order, for paginating backward through the
+// notes newest first. The id of the last note returned is the cursor for
+// the next page and a beforeID of zero starts from the newest note.
+// Parameters:
+// -    ctx: context for the database call
+// -    beforeID: only notes with a lower id are returned, zero for no bound
+// -    limit: maximum number of notes to return
+//
+// Returns:
+// - []Note: the notes in descending id order
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotesBefore(ctx context.Context, beforeID uint, limit int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotesBefore")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	query := repo.db.WithContext(ctx)
+	if beforeID > 0 {
+		query = query.Where("id < ?", beforeID)
+	}
+	notes := make([]Note, 0)
+	result := query.Order("id DESC").Limit(limit).Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// ListNotesAfter will return up to limit notes with an id greater than
+// afterID in ascending id order, for iterating through every note. Unlike
+// offset pagination, notes inserted or deleted mid-iteration don't shift the
+// pages. The id of the last note returned is the cursor for the next page,
+// an afterID of zero starts from the oldest note and an empty page means
+// the iteration is over. The tags of the page are loaded in a single query.
+// Parameters:
+// -    ctx: context for the database call
+// -    afterID: only notes with a greater id are returned
+// -    limit: maximum number of notes to return
+//
+// Returns:
+// - []Note: the notes in ascending id order
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotesAfter(ctx context.Context, afterID uint, limit int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotesAfter")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	return repo.store.ListNotesAfter(ctx, afterID, limit)
+}
+
+// ListNotesUpdatedSince will return up to limit notes updated after the
+// cursor made of since and afterID, oldest update first, e.g. for a client
+// syncing the notes changed since its last sync. Notes are ordered by their
+// updated_at and then their id, and a note is after the cursor when it comes
+// after (since, afterID) in that order, so a client resuming from the
+// updated_at and id of the last note it got neither skips nor repeats the
+// notes updated at the same instant. The notes are read from postgres,
+// bypassing the cache.
+// Parameters:
+// -    ctx: context for the database call
+// -    since: updated_at of the cursor
+// -    afterID: id of the cursor, notes updated exactly at since are only
+// returned when their id is greater
+// -    limit: maximum number of notes to return
+//
+// Returns:
+// - []Note: the notes in ascending updated_at and id order
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotesUpdatedSince(ctx context.Context, since time.Time, afterID uint, limit int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotesUpdatedSince")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	return repo.store.ListNotesUpdatedSince(ctx, since, afterID, limit)
+}
+
+// ListRecentlyUpdated will return up to limit notes, most recently updated
+// first, e.g. for a recent activity feed. Deleted notes aren't returned.
+// The notes are read from postgres, bypassing the cache.
+// Parameters:
+// -    ctx: context for the database call
+// -    limit: maximum number of notes to return
+//
+// Returns:
+// - []Note: the notes in descending updated_at order
+// - error: any error returned by the database
+func (repo *NoteRepository) ListRecentlyUpdated(ctx context.Context, limit int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListRecentlyUpdated")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	return repo.store.ListRecentlyUpdated(ctx, limit)
+}
+
+// ListNotesCreatedBetween will return the notes created from start up to,
+// but excluding, end in ascending created_at order, so consecutive windows
+// don't overlap. The notes are read from postgres, bypassing the cache.
+// Parameters:
+// -    ctx: context for the database call
+// -    start: only notes created at or after it are returned
+// -    end: only notes created before it are returned
+//
+// Returns:
+// - []Note: the notes in ascending created_at order
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotesCreatedBetween(ctx context.Context, start time.Time, end time.Time) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotesCreatedBetween")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	return repo.store.ListNotesCreatedBetween(ctx, start, end)
+}
+
+// ListNotesByIDRange will return the notes whose id is from minID up to and
+// including maxID in ascending id order, so a backfill can split the table
+// into id ranges processed in parallel. Ids in the range that have no note,
+// or whose note was deleted, are skipped. The notes are read from postgres,
+// bypassing the cache, with their tags loaded in a single query.
+// Parameters:
+// -    ctx: context for the database call
+// -    minID: lowest id returned
+// -    maxID: highest id returned
+//
+// Returns:
+// - []Note: the notes in ascending id order
+// - error: any error returned by the database
+func (repo *NoteRepository) ListNotesByIDRange(ctx context.Context, minID uint, maxID uint) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "ListNotesByIDRange", attribute.Int("note.min_id", int(minID)), attribute.Int("note.max_id", int(maxID)))
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationList, time.Now(), &err)
+	return repo.store.ListNotesByIDRange(ctx, minID, maxID)
+}
+
+// ForEachNote will page through all the notes in ascending id order,
+// with their tags loaded, and call fn with each page. Pages are loaded
+// one at a time so only a single page is held in memory. It stops at the
+// first error returned by fn.
+// Parameters:
+// -    ctx: context for the database calls
+// -    batchSize: number of notes per page, defaults to 100 when zero or less
+// -    fn: called with each page of notes
+//
+// Returns:
+// - error: any error returned by the database or fn
+func (repo *NoteRepository) ForEachNote(ctx context.Context, batchSize int, fn func([]Note) error) (err error) {
+	ctx, span := repo.startSpan(ctx, "ForEachNote")
+	defer func() { endSpan(span, err) }()
+	return repo.store.ForEachNote(ctx, batchSize, fn)
+}
+
+// cacheWritesDisabledKey is the context key marking the calls made with
+// the context WithCacheWritesDisabled passes to its fn
+type cacheWritesDisabledKey struct{}
+
+// cacheWritesDisabled will report whether ctx is, or derives from, the
+// context of a WithCacheWritesDisabled scope
+func cacheWritesDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(cacheWritesDisabledKey{}).(bool)
+	return disabled
+}
+
+// WithCacheWritesDisabled will run fn with cache writes disabled for the
+// calls made with the context passed to fn, so notes read with it are not
+// cached, WarmCache caches nothing and notes saved with it are
+// invalidated rather than cached. It is meant for bulk operations after
+// which the caller rebuilds the cache. Invalidation is never skipped, and
+// calls made with any other context, e.g. by concurrent requests, use the
+// cache as usual.
+// Parameters:
+// -    ctx: context of the bulk operation
+// -    fn: the bulk operation to run, to make its calls with the ctx it is given
+//
+// Returns:
+// - error: the error returned by fn or ctx's error if it is already done
+func (repo *NoteRepository) WithCacheWritesDisabled(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	ctx, span := repo.startSpan(ctx, "WithCacheWritesDisabled")
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn(context.WithValue(ctx, cacheWritesDisabledKey{}, true))
+}
+
+// TotalWordCount will return the sum of the word counts of all the notes
+func (repo *NoteRepository) TotalWordCount(ctx context.Context) (_ int64, err error) {
+	ctx, span := repo.startSpan(ctx, "TotalWordCount")
+	defer func() { endSpan(span, err) }()
+	var total int64
+	result := repo.db.WithContext(ctx).Model(&Note{}).Select("COALESCE(SUM(word_count), 0)").Scan(&total)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return total, nil
+}
+
+// notesMatch will report whether the two notes hold the same data
+func notesMatch(a, b Note) bool {
+	return a.ID == b.ID &&
+		a.AuthorID == b.AuthorID &&
+		a.Title == b.Title &&
+		a.Content == b.Content &&
+		a.WordCount == b.WordCount &&
+		a.Version == b.Version &&
+		slices.Equal(a.Tags, b.Tags) &&
+		a.CreatedAt.Equal(b.CreatedAt) &&
+		a.UpdatedAt.Equal(b.UpdatedAt)
+}
+
+// InspectNote will load the note from both postgres and the cache, without
+// populating the cache, and report whether they match along with the TTL
+// left on the cache entry. The entry cached under the note's title is
+// loaded too, but only the entry under its id is compared.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    id: the id of the note to inspect
+//
+// Returns:
+// - InspectResult: the postgres and cached versions of the note
+// - error: NoteNotFoundError when the note is neither in postgres nor
+// cached, or any error returned by postgres or redis
+func (repo *NoteRepository) InspectNote(ctx context.Context, id int) (_ InspectResult, err error) {
+	ctx, span := repo.startSpan(ctx, "InspectNote", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	inspectResult, err := repo.store.InspectNote(ctx, id)
+	if err != nil && !errors.Is(err, NoteNotFoundError) {
+		return InspectResult{}, err
+	}
+	cachedNote, err := repo.getNoteFromCache(ctx, id)
+	if err != nil && !errors.Is(err, ErrNoteCachedAsMissing) {
+		return InspectResult{}, err
+	}
+	inspectResult.CachedNote = cachedNote
+	if inspectResult.DbNote == nil && inspectResult.CachedNote == nil {
+		return InspectResult{}, NoteNotFoundError
+	}
+	titled := inspectResult.DbNote
+	if titled == nil {
+		titled = inspectResult.CachedNote
+	}
+	inspectResult.TitleCachedNote, err = repo.getNoteByTitleFromCache(ctx, titled.AuthorID, titled.Title)
+	if err != nil && !errors.Is(err, ErrNoteCachedAsMissing) {
+		return InspectResult{}, err
+	}
+	if inspectResult.CachedNote != nil {
+		ttl, err := repo.cache.TTL(ctx, repo.idKey(uint(id)))
+		if err != nil {
+			return InspectResult{}, err
+		}
+		inspectResult.CacheTTL = ttl
+	}
+	inspectResult.Matches = inspectResult.DbNote != nil &&
+		inspectResult.CachedNote != nil &&
+		notesMatch(*inspectResult.DbNote, *inspectResult.CachedNote)
+	return inspectResult, nil
+}
+
+// VerifyOption configures what VerifyCache does with a diverged cache entry
+type VerifyOption func(*verifyConfig)
+
+// verifyConfig holds the configuration set by the VerifyOptions
+type verifyConfig struct {
+	repair bool
+}
+
+// WithRepair makes VerifyCache repair the cache entries that diverged from
+// postgres by deleting them, so the note is cached again as it is in
+// postgres on its next read. The entries aren't rewritten with the note
+// VerifyCache loaded since the note may be updated in the meantime.
+func WithRepair() VerifyOption {
+	return func(config *verifyConfig) {
+		config.repair = true
+	}
+}
+
+// VerifyCache will load the note from both postgres and the cache and
+// compare them field by field, checking the entries under both the note's
+// id and its title. A note that isn't cached is consistent, as is a missing
+// note cached as missing, whereas a tombstone cached for a note in postgres
+// isn't. See WithRepair for repairing the cache entries when they diverged.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    id: the id of the note to verify
+// -    opts: optional configuration of the verification
+//
+// Returns:
+// - bool: whether the cache entry matched postgres, before any repair
+// - error: NoteNotFoundError when the note is neither in postgres nor
+// cached, or any error returned by postgres or redis
+func (repo *NoteRepository) VerifyCache(ctx context.Context, id int, opts ...VerifyOption) (_ bool, err error) {
+	ctx, span := repo.startSpan(ctx, "VerifyCache", attribute.Int("note.id", id))
+	defer func() { endSpan(span, err) }()
+	config := verifyConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	dbNote, err := repo.store.GetNoteById(ctx, id)
+	if err != nil && !errors.Is(err, NoteNotFoundError) {
+		return false, err
+	}
+	cachedNote, err := repo.getNoteFromCache(ctx, id)
+	cachedAsMissing := errors.Is(err, ErrNoteCachedAsMissing)
+	if err != nil && !cachedAsMissing {
+		return false, err
+	}
+	var consistent bool
+	switch {
+	case dbNote == nil && cachedNote == nil && !cachedAsMissing:
+		return false, NoteNotFoundError
+	case dbNote == nil:
+		consistent = cachedNote == nil
+	case cachedNote == nil:
+		consistent = !cachedAsMissing
+	default:
+		consistent = notesMatch(*dbNote, *cachedNote)
+	}
+	if consistent && dbNote != nil {
+		titleNote, err := repo.getNoteByTitleFromCache(ctx, dbNote.AuthorID, dbNote.Title)
+		if err != nil && !errors.Is(err, ErrNoteCachedAsMissing) {
+			return false, err
+		}
+		// a tombstone under the title of a note in postgres diverged too
+		consistent = err == nil && (titleNote == nil || notesMatch(*dbNote, *titleNote))
+	}
+	if consistent {
+		return true, nil
+	}
+	repo.logger.Warn("Cache diverged from postgres", "operation", "VerifyCache", "id", id)
+	if !config.repair {
+		return false, nil
+	}
+	// delete the entries under the id, the title the note was cached with,
+	// which is the stale title when the note was renamed, and its title
+	keys := []string{repo.idKey(uint(id))}
+	if cachedNote != nil {
+		keys = append(keys, repo.titleKey(cachedNote.AuthorID, cachedNote.Title))
+	}
+	if dbNote != nil {
+		keys = append(keys, repo.titleKey(dbNote.AuthorID, dbNote.Title))
+	}
+	if err := repo.cache.DeleteKeys(ctx, keys...); err != nil {
+		return false, err
+	}
+	repo.logger.Info("Repaired cache", "operation", "VerifyCache", "id", id)
+	return false, nil
+}
+
+// CountNotes will return the number of notes that haven't been deleted
+func (repo *NoteRepository) CountNotes(ctx context.Context) (_ int64, err error) {
+	ctx, span := repo.startSpan(ctx, "CountNotes")
+	defer func() { endSpan(span, err) }()
+	return repo.store.CountNotes(ctx)
+}
+
+// likeEscaper escapes the LIKE metacharacters so they are matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SearchNotes will return the notes whose title or content contains the
+// query, ignoring case, most recently created first. The search runs
+// against postgres and bypasses the cache. Any % or _ in the query is
+// matched literally.
+// Parameters:
+// -    ctx: context for the database call
+// -    query: the text to search for
+// -    limit: maximum number of notes to return
+//
+// Returns:
+// - []Note: the matching notes
+// - error: any error returned by the database
+func (repo *NoteRepository) SearchNotes(ctx context.Context, query string, limit int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "SearchNotes")
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationSearch, time.Now(), &err)
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("title ILIKE ? OR content ILIKE ?", pattern, pattern).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// GetNotesByTitlePrefix will return the notes whose title starts with the
+// prefix, ordered alphabetically by title, e.g. for title autocompletion.
+// It runs against postgres and bypasses the cache. Any % or _ in the prefix
+// is matched literally and an empty prefix matches every note. The prefix
+// is matched regardless of case when titles are case insensitive.
+// Parameters:
+// -    ctx: context for the database call
+// -    prefix: the start of the titles to match
+// -    limit: maximum number of notes to return
+//
+// Returns:
+// - []Note: the matching notes
+// - error: any error returned by the database
+func (repo *NoteRepository) GetNotesByTitlePrefix(ctx context.Context, prefix string, limit int) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "GetNotesByTitlePrefix", attribute.String("note.title_prefix", prefix))
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationSearch, time.Now(), &err)
+	column := "title"
+	if repo.caseInsensitiveTitles {
+		column, prefix = "normalized_title", foldTitle(prefix)
+	}
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where(column+" LIKE ?", likeEscaper.Replace(prefix)+"%").
+		Order("title, id").
+		Limit(limit).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// FindNotesByTag will return the notes tagged with the tag, with their
+// tags loaded, ordered by id. It runs against postgres and bypasses the cache.
+// Parameters:
+// -    ctx: context for the database call
+// -    tag: the tag to match
+//
+// Returns:
+// - []Note: the tagged notes
+// - error: any error returned by the database
+func (repo *NoteRepository) FindNotesByTag(ctx context.Context, tag string) (_ []Note, err error) {
+	ctx, span := repo.startSpan(ctx, "FindNotesByTag", attribute.String("note.tag", tag))
+	defer func() { endSpan(span, err) }()
+	defer repo.observeQueryResult(metricsOperationSearch, time.Now(), &err)
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("id IN (?)", repo.db.Model(&NoteTag{}).Select("note_id").Where("tag = ?", strings.TrimSpace(tag))).
+		Order("id").
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if err := loadTags(repo.db.WithContext(ctx), pointersTo(notes)...); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// tagCount is a row of the per tag note counts
+type tagCount struct {
+	Tag   string
+	Count int64
+}
+
+// CountNotesByTag will return how many notes carry each tag. Deleted notes
+// aren't counted and tags no note carries are left out. It runs against
+// postgres and bypasses the cache.
+// Parameters:
+// -    ctx: context for the database call
+//
+// Returns:
+// - map[string]int64: the number of notes carrying each tag
+// - error: any error returned by the database
+func (repo *NoteRepository) CountNotesByTag(ctx context.Context) (_ map[string]int64, err error) {
+	ctx, span := repo.startSpan(ctx, "CountNotesByTag")
+	defer func() { endSpan(span, err) }()
+	rows := make([]tagCount, 0)
+	result := repo.db.WithContext(ctx).
+		Model(&NoteTag{}).
+		Select("note_tags.tag, COUNT(*) AS count").
+		Joins("JOIN notes ON notes.id = note_tags.note_id AND notes.deleted_at IS NULL").
+		Group("note_tags.tag").
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Tag] = row.Count
+	}
+	return counts, nil
+}
+
+// HealthCheck will ping postgres and, when the repository has a redis
+// client, redis. It returns an error naming the backend that failed.
+func (repo *NoteRepository) HealthCheck(ctx context.Context) (err error) {
+	ctx, span := repo.startSpan(ctx, "HealthCheck")
+	defer func() { endSpan(span, err) }()
+	if err := repo.store.HealthCheck(ctx); err != nil {
+		return err
+	}
+	if repo.redis == nil {
+		return nil
+	}
+	if err := repo.redis.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+// Close will close the postgres connection pool and the redis client,
+// e.g. on a graceful shutdown. Both are closed even if closing the first
+// fails and the errors are joined. Operations called after Close return
+// an error.
+func (repo *NoteRepository) Close() error {
+	err := repo.store.Close()
+	if repo.redis != nil {
+		if redisErr := repo.redis.Close(); redisErr != nil {
+			err = errors.Join(err, fmt.Errorf("closing redis: %w", redisErr))
+		}
+	}
+	return err
+}
+
+// Application represents the application class
+type Application struct {
+	noteRepository NoteRepositoryInterface
+	// maxTitleLength is the maximum number of characters accepted in a
+	// title, zero means DefaultMaxTitleLength
+	maxTitleLength int
+	// rateLimiter limits the creates of each client, it is nil unless
+	// the application is created with WithRateLimiter
+	rateLimiter RateLimiter
+}
+
+// ApplicationOption configures optional behaviour of the Application
+type ApplicationOption func(*Application)
+
+// WithMaxTitleLength will set the maximum number of characters accepted in a
+// title. It defaults to DefaultMaxTitleLength.
+func WithMaxTitleLength(length int) ApplicationOption {
+	return func(app *Application) {
+		app.maxTitleLength = length
+	}
+}
+
+// NewApplication is the factory function to create a new Application
+// Parameters:
+// -  repo: the note repository the use cases are carried out against
+// -  opts: optional configuration of the application
+//
+// Returns:
+// - *Application: A pointer to the newly created Application
+func NewApplication(repo NoteRepositoryInterface, opts ...ApplicationOption) *Application {
+	app := &Application{noteRepository: repo}
+	for _, opt := range opts {
+		opt(app)
+	}
+	return app
+}
+
+// validateTitle will trim the surrounding whitespace from the title and
+// check that it is neither empty nor longer than the maximum title length.
+// Returns:
+// - string: the trimmed title
+// - error: ErrEmptyTitle or ErrTitleTooLong when the title is invalid
+func (app *Application) validateTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return "", ErrEmptyTitle
+	}
+	maxTitleLength := app.maxTitleLength
+	if maxTitleLength <= 0 {
+		maxTitleLength = DefaultMaxTitleLength
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return "", fmt.Errorf("%w: title exceeds %d characters", ErrTitleTooLong, maxTitleLength)
+	}
+	return title, nil
+}
+
+// validateContent will check that the content isn't empty once the
+// surrounding whitespace is trimmed.
+// Returns:
+// - error: ErrEmptyContent when the content is empty
+func validateContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return ErrEmptyContent
+	}
+	return nil
+}
+
+// CreateOption configures how CreateNote creates the note
+type CreateOption func(*createConfig)
+
+// createConfig holds the configuration set by the CreateOptions
+type createConfig struct {
+	idempotencyKey string
+	// clientID is the client the create is rate limited for
+	clientID string
+	// authorID is the author the note is created for
+	authorID uint
+}
+
+// WithAuthor makes CreateNote create the note for the author. Titles are
+// unique per author, so authors can each have a note with the same title.
+func WithAuthor(authorID uint) CreateOption {
+	return func(config *createConfig) {
+		config.authorID = authorID
+	}
+}
+
+// UpdateOption configures how UpdateNote updates the note
+type UpdateOption func(*updateConfig)
+
+// updateConfig holds the configuration set by the UpdateOptions
+type updateConfig struct {
+	// authorID is the author the note must belong to, zero when any note can be updated
+	authorID uint
+}
+
+// WithOwner makes UpdateNote only update the note when it belongs to the
+// author. The note of another author is reported as NoteNotFoundError so
+// its existence isn't disclosed.
+func WithOwner(authorID uint) UpdateOption {
+	return func(config *updateConfig) {
+		config.authorID = authorID
+	}
+}
+
+// TitleOption configures whose notes a title is looked up among
+type TitleOption func(*titleConfig)
+
+// titleConfig holds the configuration set by the TitleOptions
+type titleConfig struct {
+	// authorID is the author whose notes hold the titles, zero for the
+	// notes without an author
+	authorID uint
+}
+
+// newTitleConfig will apply the options to an empty titleConfig
+func newTitleConfig(opts []TitleOption) titleConfig {
+	config := titleConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// ForAuthor makes a title lookup or check consider the notes of the author.
+// Titles are unique per author, so without it only the notes without an
+// author are considered.
+func ForAuthor(authorID uint) TitleOption {
+	return func(config *titleConfig) {
+		config.authorID = authorID
+	}
+}
+
+// WithIdempotencyKey makes CreateNote return the note created by an earlier
+// call with the same key instead of creating the note again, so a client can
+// safely retry a create whose response it didn't get.
+func WithIdempotencyKey(key string) CreateOption {
+	return func(config *createConfig) {
+		config.idempotencyKey = key
+	}
+}
+
+// CreateNote is the application use case method to create a new note.
+// The title is trimmed and both the title and content are validated before
+// the note is stored. The unique title constraint in postgres is the source
+// of truth for duplicates, so concurrent creates with the same title can't
+// both succeed. ErrTitleTakenByDeletedNote, which is a DuplicateNoteError,
+// is returned when the title belongs to a deleted note that could be
+// restored instead. Titles are unique per author, see WithAuthor. See
+// WithIdempotencyKey for deduplicating retried creates and WithClientID for
+// rate limiting the creates of a client.
+func (app *Application) CreateNote(ctx context.Context, title string, content string, opts ...CreateOption) (Note, error) {
+	config := createConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	title, err := app.validateTitle(title)
+	if err != nil {
+		return Note{}, err
+	}
+	if err := validateContent(content); err != nil {
+		return Note{}, err
+	}
+	if !app.allowCreate(ctx, config) {
+		return Note{}, ErrRateLimited
+	}
+	note := &Note{AuthorID: config.authorID, Title: title, Content: content}
+	if config.idempotencyKey != "" {
+		err = app.noteRepository.CreateNoteIdempotent(ctx, config.idempotencyKey, note)
+	} else {
+		err = app.noteRepository.SaveNote(ctx, note)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidNote) || errors.Is(err, DuplicateNoteError) || errors.Is(err, ErrRequestInProgress) {
+			return Note{}, err
+		}
+		slog.Error("Error in saving note", "error", err.Error())
+		return Note{}, SomethingWentWrongError
+	}
+	return *note, nil
+}
+
+// WithTransaction is the application use case method to carry out several
+// use cases atomically, e.g. splitting a note into two. fn is given an
+// Application whose repository runs in a transaction that is committed when
+// fn returns nil and rolled back when it returns an error, in which case
+// none of the notes fn created, updated or deleted are changed. Cache
+// invalidations are only applied once the transaction commits.
+// Returns:
+// - error: the error returned by fn, or SomethingWentWrongError when the
+// transaction can't be committed
+func (app *Application) WithTransaction(ctx context.Context, fn func(txApp *Application) error) error {
+	var fnErr error
+	err := app.noteRepository.WithTransaction(ctx, func(tx NoteRepositoryInterface) error {
+		txApp := *app
+		txApp.noteRepository = tx
+		fnErr = fn(&txApp)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		slog.Error("Error in running transaction", "error", err.Error())
+		return SomethingWentWrongError
+	}
+	return nil
+}
+
+// ValidateNewNote is the application use case method to check a proposed
+// title before the note is created, e.g. as the user types it. The title is
+// validated as CreateNote validates it and checked against the existing
+// notes, without persisting anything. It returns DuplicateNoteError when a
+// note, including a deleted one, already has the title. ForAuthor checks
+// the title against the notes of the author the note would be created for.
+func (app *Application) ValidateNewNote(ctx context.Context, title string, opts ...TitleOption) error {
+	title, err := app.validateTitle(title)
+	if err != nil {
+		return err
+	}
+	exists, err := app.noteRepository.TitleExists(ctx, title, opts...)
+	if err != nil {
+		slog.Error("Error in validating new note", "error", err.Error())
+		return SomethingWentWrongError
+	}
+	if exists {
+		return DuplicateNoteError
+	}
+	return nil
+}
+
+// GetOrCreateNote is the application use case method to get the note with
+// the title, creating it with the content when it doesn't exist. It returns
+// the note and whether it was created.
+func (app *Application) GetOrCreateNote(ctx context.Context, title string, content string) (Note, bool, error) {
+	title, err := app.validateTitle(title)
+	if err != nil {
+		return Note{}, false, err
+	}
+	if err := validateContent(content); err != nil {
+		return Note{}, false, err
+	}
+	note := &Note{Title: title, Content: content}
+	created, err := app.noteRepository.GetOrCreateNote(ctx, note)
+	if err != nil {
+		if errors.Is(err, ErrInvalidNote) || errors.Is(err, DuplicateNoteError) {
+			return Note{}, false, err
+		}
+		slog.Error("Error in getting or creating note", "error", err.Error())
+		return Note{}, false, SomethingWentWrongError
+	}
+	return *note, created, nil
+}
+
+// UpdateNote is the application use case method to update an existing note.
+// The note keeps its author. It returns ErrEmptyContent when the content is
+// empty and ErrVersionConflict when the note is updated concurrently. See
+// WithOwner for only updating the notes of an author.
+func (app *Application) UpdateNote(ctx context.Context, id int, content string, opts ...UpdateOption) (Note, error) {
+	config := updateConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := validateContent(content); err != nil {
+		return Note{}, err
+	}
+	note, err := app.getNote(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+	if config.authorID != 0 && note.AuthorID != config.authorID {
+		return Note{}, NoteNotFoundError
+	}
+	note.Content = content
+	if err := app.noteRepository.SaveNote(ctx, note); err != nil {
+		if errors.Is(err, ErrInvalidNote) || errors.Is(err, ErrVersionConflict) || errors.Is(err, NoteNotFoundError) {
+			return Note{}, err
+		}
+		slog.Error("Error in saving note", "error", err.Error())
+		return Note{}, SomethingWentWrongError
+	}
+	return *note, nil
+}
+
+// RenameNote is the application use case method to change the title of an
+// existing note. The note's cache entries under both its old and new title
+// are invalidated. It returns ErrInvalidNote when the new title is invalid,
+// DuplicateNoteError when another note has the title and NoteNotFoundError
+// when the note doesn't exist.
+func (app *Application) RenameNote(ctx context.Context, id int, newTitle string) (Note, error) {
+	newTitle, err := app.validateTitle(newTitle)
+	if err != nil {
+		return Note{}, err
+	}
+	note, err := app.getNote(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+	note.Title = newTitle
+	if err := app.noteRepository.SaveNote(ctx, note); err != nil {
+		if errors.Is(err, ErrInvalidNote) || errors.Is(err, DuplicateNoteError) ||
+			errors.Is(err, ErrVersionConflict) || errors.Is(err, NoteNotFoundError) {
+			return Note{}, err
+		}
+		slog.Error("Error in renaming note", "error", err.Error())
+		return Note{}, SomethingWentWrongError
+	}
+	return *note, nil
+}
+
+// GetNoteById is the application use case method to get a note by its id.
+func (app *Application) GetNoteById(ctx context.Context, id int) (Note, error) {
+	note, err := app.getNote(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+	return *note, nil
+}
+
+// GetNoteByTitle is the application use case method to get a note by its
+// title, among the notes of the author when ForAuthor is given.
+func (app *Application) GetNoteByTitle(ctx context.Context, title string, opts ...TitleOption) (Note, error) {
+	note, err := app.noteRepository.GetNoteByTitle(ctx, title, opts...)
+	if err != nil {
+		if errors.Is(err, NoteNotFoundError) {
+			return Note{}, err
+		}
+		slog.Error("Error in getting note by title", "error", err.Error())
+		return Note{}, SomethingWentWrongError
+	}
+	return *note, nil
+}
+
+// GetNote is the application use case method to get a note by a reference
+// that is either its id or its title. A ref made up only of digits is
+// looked up as an id and any other ref as a title. As titles can be
+// numeric too, a numeric ref that matches no id is then looked up as a
+// title, so the note titled "42" is found by GetNote unless a note has
+// the id 42, in which case that note is returned instead.
+func (app *Application) GetNote(ctx context.Context, ref string) (Note, error) {
+	if id, err := strconv.ParseUint(ref, 10, strconv.IntSize-1); err == nil {
+		note, err := app.getNote(ctx, int(id))
+		if err == nil {
+			return *note, nil
+		}
+		if !errors.Is(err, NoteNotFoundError) {
+			return Note{}, err
+		}
+	}
+	return app.GetNoteByTitle(ctx, ref)
+}
+
+// DeleteNote is the application use case method to delete a note.
+func (app *Application) DeleteNote(ctx context.Context, id int) error {
+	if _, err := app.getNote(ctx, id); err != nil {
+		return err
+	}
+	if err := app.noteRepository.DeleteNote(ctx, id); err != nil {
+		slog.Error("Error in deleting note", "error", err.Error())
+		return SomethingWentWrongError
+	}
+	return nil
+}
+
+// getNote will get the note by its id, mapping any error other
+// than NoteNotFoundError to SomethingWentWrongError.
+func (app *Application) getNote(ctx context.Context, id int) (*Note, error) {
+	note, err := app.noteRepository.GetNoteById(ctx, id)
+	if err != nil {
+		if errors.Is(err, NoteNotFoundError) {
+			return nil, err
+		}
+		slog.Error("Error in getting note", "error", err.Error())
+		return nil, SomethingWentWrongError
+	}
+	return note, nil
+}
+
+// ListNotes is the application use case method to list up to limit notes
+// with an id greater than afterID in ascending id order, with their tags.
+// The id of the last note listed is the afterID of the next page.
+func (app *Application) ListNotes(ctx context.Context, afterID uint, limit int) ([]Note, error) {
+	notes, err := app.noteRepository.ListNotesAfter(ctx, afterID, limit)
+	if err != nil {
+		slog.Error("Error in listing notes", "error", err.Error())
+		return nil, SomethingWentWrongError
+	}
+	return notes, nil
+}
+
+// WarmCache is the application use case method to cache the notes with
+// the ids ahead of them being read, skipping ids that don't exist.
+func (app *Application) WarmCache(ctx context.Context, ids []int) error {
+	if _, err := app.noteRepository.WarmCache(ctx, ids); err != nil {
+		slog.Error("Error in warming cache", "error", err.Error())
+		return SomethingWentWrongError
+	}
+	return nil
+}
+
+// ExportNotes is the application use case method to write every note to w
+// as newline delimited JSON, one note per line in ascending id order. The
+// notes are read from postgres a page at a time so exporting a large
+// number of notes doesn't load them all into memory.
+func (app *Application) ExportNotes(ctx context.Context, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	err := app.noteRepository.ForEachNote(ctx, defaultBatchSize, func(notes []Note) error {
+		for _, note := range notes {
+			if err := encoder.Encode(note); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error in exporting notes", "error", err.Error())
+		return SomethingWentWrongError
+	}
+	return nil
+}
+
+// ImportOption configures how ImportNotes handles the notes it reads
+type ImportOption func(*importConfig)
+
+// importConfig holds the configuration of an import
+type importConfig struct {
+	skipDuplicates bool
+}
+
+// SkipDuplicateTitles will make ImportNotes skip notes whose title is
+// already taken instead of failing the import with DuplicateNoteError
+func SkipDuplicateTitles() ImportOption {
+	return func(config *importConfig) {
+		config.skipDuplicates = true
+	}
+}
+
+// ImportNotes is the application use case method to create the notes read
+// from r as newline delimited JSON, such as the output of ExportNotes. Only
+// the author, title, content and tags of each note are imported, the notes
+// get new ids and timestamps. Titles are unique per author, so a title is
+// only a duplicate of a title of the same author. The notes are inserted in batches within a single
+// transaction so nothing is imported when any line is invalid.
+// Parameters:
+// -    ctx: context for the database calls
+// -    r: the notes to import, one JSON note per line
+// -    opts: optional configuration of the import
+//
+// Returns:
+// - int: the number of notes imported
+// - error: ErrInvalidImport or ErrInvalidNote wrapped with the line number
+// when a line isn't a valid note, and DuplicateNoteError when a title is
+// taken unless duplicates are skipped
+func (app *Application) ImportNotes(ctx context.Context, r io.Reader, opts ...ImportOption) (int, error) {
+	var config importConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	reader := bufio.NewReader(r)
+	line := 0
+	nextBatch := func() ([]*Note, error) {
+		notes := make([]*Note, 0, defaultBatchSize)
+		for len(notes) < defaultBatchSize {
+			raw, readErr := reader.ReadBytes('\n')
+			if readErr != nil && !errors.Is(readErr, io.EOF) {
+				return nil, readErr
+			}
+			if len(raw) > 0 {
+				line++
+			}
+			if raw = bytes.TrimSpace(raw); len(raw) > 0 {
+				note, err := app.decodeImportedNote(raw)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				notes = append(notes, note)
+			}
+			if readErr != nil {
+				break
+			}
+		}
+		return notes, nil
+	}
+	imported, err := app.noteRepository.ImportNotes(ctx, nextBatch, config.skipDuplicates)
+	if err != nil {
+		if errors.Is(err, ErrInvalidImport) || errors.Is(err, ErrInvalidNote) || errors.Is(err, DuplicateNoteError) {
+			return 0, err
+		}
+		slog.Error("Error in importing notes", "error", err.Error())
+		return 0, SomethingWentWrongError
+	}
+	return imported, nil
+}
+
+// decodeImportedNote will decode and validate a line of an import
+func (app *Application) decodeImportedNote(raw []byte) (*Note, error) {
+	var decoded Note
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImport, err)
+	}
+	title, err := app.validateTitle(decoded.Title)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateContent(decoded.Content); err != nil {
+		return nil, err
+	}
+	return &Note{AuthorID: decoded.AuthorID, Title: title, Content: decoded.Content, Tags: decoded.Tags}, nil
+}
+
+// InspectNote is the application use case method to inspect the postgres and
+// cached versions of a note for debugging caching issues.
+func (app *Application) InspectNote(ctx context.Context, id int) (InspectResult, error) {
+	inspectResult, err := app.noteRepository.InspectNote(ctx, id)
+	if err != nil {
+		if errors.Is(err, NoteNotFoundError) {
+			return InspectResult{}, err
+		}
+		slog.Error("Error in inspecting note", "error", err.Error())
+		return InspectResult{}, SomethingWentWrongError
+	}
+	return inspectResult, nil
+}
+
+// CountNotes is the application use case method to get the total number
+// of notes, e.g. for pagination metadata.
+func (app *Application) CountNotes(ctx context.Context) (int64, error) {
+	count, err := app.noteRepository.CountNotes(ctx)
+	if err != nil {
+		slog.Error("Error in counting notes", "error", err.Error())
+		return 0, SomethingWentWrongError
+	}
+	return count, nil
+}
+
+// HealthCheck is the application use case method to check that the
+// application's backends are reachable, e.g. for a readiness probe.
+// The error names the backend that failed.
+func (app *Application) HealthCheck(ctx context.Context) error {
+	return app.noteRepository.HealthCheck(ctx)
+}
+
+// Close is the application's teardown method, it releases the connections
+// held by the note repository. The application can't be used afterwards.
+func (app *Application) Close() error {
+	return app.noteRepository.Close()
 }
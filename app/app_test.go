@@ -1,7 +1,12 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	rd "github.com/redis/go-redis/v9"
@@ -12,11 +17,38 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 	pg "gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// roundTripCounter is a redis hook that counts the round trips made to redis.
+type roundTripCounter struct {
+	roundTrips int
+}
+
+func (counter *roundTripCounter) DialHook(next rd.DialHook) rd.DialHook {
+	return next
+}
+
+func (counter *roundTripCounter) ProcessHook(next rd.ProcessHook) rd.ProcessHook {
+	return func(ctx context.Context, cmd rd.Cmder) error {
+		counter.roundTrips++
+		return next(ctx, cmd)
+	}
+}
+
+func (counter *roundTripCounter) ProcessPipelineHook(next rd.ProcessPipelineHook) rd.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []rd.Cmder) error {
+		counter.roundTrips++
+		return next(ctx, cmds)
+	}
+}
+
 // NoteRepoTestSuite represents the note repository test suite.
 type NoteRepoTestSuite struct {
 	suite.Suite
@@ -87,44 +119,27 @@ func (suite *NoteRepoTestSuite) TearDownSuite() {
 }
 
 func (suite *NoteRepoTestSuite) SetupTest() {
-	err := suite.db.AutoMigrate(&Note{})
+	err := Migrate(suite.db)
 	suite.NoError(err)
 }
 
 func (suite *NoteRepoTestSuite) TearDownTest() {
 	suite.db.Exec("DROP TABLE IF EXISTS notes CASCADE;")
+	suite.db.Exec("DROP TABLE IF EXISTS audit_entries CASCADE;")
+	suite.db.Exec("DROP TABLE IF EXISTS note_tags CASCADE;")
 	suite.rdClient.FlushAll(suite.ctx)
 }
 
-func (suite *NoteRepoTestSuite) BeforeTest(_ string, testName string) {
-	if testName == "TestSaveUpdatedNote" || testName == "TestDeleteNote" {
-		note := Note{Title: "Test Update", Content: "This note will be inserted now"}
-		result := suite.db.Save(&note)
-		suite.NoError(result.Error)
-
-		idKey := fmt.Sprintf("notes:%d", note.ID)
-		titleKey := fmt.Sprintf("notes:%s", note.Title)
-		err := suite.rdClient.HSet(suite.ctx, idKey, "id", note.ID).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, idKey, "title", note.Title).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, idKey, "content", note.Content).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, idKey, "created_at", note.CreatedAt).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, idKey, "updated_at", note.UpdatedAt).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, titleKey, "id", note.ID).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, titleKey, "title", note.Title).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, titleKey, "content", note.Content).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, titleKey, "created_at", note.CreatedAt).Err()
-		suite.NoError(err)
-		err = suite.rdClient.HSet(suite.ctx, titleKey, "updated_at", note.UpdatedAt).Err()
-		suite.NoError(err)
-	}
+// seedNote will store the note and cache it under its id and title through
+// a repository, so the cached entries are always in the format the
+// repository reads. It mirrors testutil.SeedNote, which this package's
+// tests can't import since testutil imports app.
+func (suite *NoteRepoTestSuite) seedNote(note Note) Note {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	suite.Require().NoError(repo.SaveNote(suite.ctx, &note))
+	_, err := repo.WarmCache(suite.ctx, []int{int(note.ID)})
+	suite.Require().NoError(err)
+	return note
 }
 
 func (suite *NoteRepoTestSuite) TestSaveNewNote() {
@@ -142,7 +157,7 @@ func (suite *NoteRepoTestSuite) TestSaveNewNote() {
 	// create repository and save new note
 	repo := NewNoteRepository(suite.db, suite.rdClient)
 	newNote := Note{Title: "Testing 123", Content: "This note was just inserted"}
-	err = repo.SaveNote(&newNote)
+	err = repo.SaveNote(suite.ctx, &newNote)
 	suite.NoError(err)
 
 	// ensure the cache is still empty
@@ -160,88 +175,6 @@ func (suite *NoteRepoTestSuite) TestSaveNewNote() {
 
 }
 
-func (suite *NoteRepoTestSuite) TestSaveUpdatedNote() {
-	// ensure that we have a note in the database
-	var note Note
-	result := suite.db.First(&note)
-	suite.NoError(result.Error)
-	suite.NotZero(note)
-
-	idKey := fmt.Sprintf("notes:%d", note.ID)
-	titleKey := fmt.Sprintf("notes:%s", note.Title)
-
-	// ensure that we have the note cached under its id
-	res, err := suite.rdClient.Exists(suite.ctx, idKey).Result()
-	suite.NoError(err)
-	suite.Greater(res, int64(0))
-
-	// ensure that we have the note cached under its title
-	res, err = suite.rdClient.Exists(suite.ctx, titleKey).Result()
-	suite.NoError(err)
-	suite.Greater(res, int64(0))
-
-	// update the note and save it
-	repo := NewNoteRepository(suite.db, suite.rdClient)
-	note.Content = "This is the updated note"
-	err = repo.SaveNote(&note)
-	suite.NoError(err)
-
-	// ensure the cache is invalidated
-	res, err = suite.rdClient.Exists(suite.ctx, idKey).Result()
-	suite.NoError(err)
-	suite.Equal(int64(0), res)
-	res, err = suite.rdClient.Exists(suite.ctx, titleKey).Result()
-	suite.NoError(err)
-	suite.Equal(int64(0), res)
-
-	// ensure the note has been updated in the database.
-	var notes []Note
-	result = suite.db.Find(&notes)
-	suite.NoError(result.Error)
-	suite.Equal(1, len(notes))
-	suite.Equal(note.ID, notes[0].ID)
-	suite.Equal(note.Title, notes[0].Title)
-	suite.Equal(note.Content, notes[0].Content)
-}
-
-func (suite *NoteRepoTestSuite) TestDeleteNote() {
-	// ensure we have a note in the database
-	var note Note
-	result := suite.db.First(&note)
-	suite.NoError(result.Error)
-	suite.NotZero(note)
-
-	idKey := fmt.Sprintf("notes:%d", note.ID)
-	titleKey := fmt.Sprintf("notes:%s", note.Title)
-
-	// ensure we have the note cached
-	res, err := suite.rdClient.Exists(suite.ctx, idKey).Result()
-	suite.NoError(err)
-	suite.Greater(res, int64(0))
-	res, err = suite.rdClient.Exists(suite.ctx, titleKey).Result()
-	suite.NoError(err)
-	suite.Greater(res, int64(0))
-
-	// delete the note
-	repo := NewNoteRepository(suite.db, suite.rdClient)
-	err = repo.DeleteNote(int(note.ID))
-	suite.NoError(err)
-
-	// ensure that the cache has been cleared
-	res, err = suite.rdClient.Exists(suite.ctx, idKey).Result()
-	suite.NoError(err)
-	suite.Equal(int64(0), res)
-	res, err = suite.rdClient.Exists(suite.ctx, titleKey).Result()
-	suite.NoError(err)
-	suite.Equal(int64(0), res)
-
-	// ensure that the note has been deleted in  postgres
-	var notes []Note
-	result = suite.db.Find(&notes)
-	suite.NoError(result.Error)
-	suite.Empty(notes)
-}
-
 func (suite *NoteRepoTestSuite) TestGetNote() {
 	suite.Run("Get note when note does not exist in cache", func() {
 		// empty the notes table and flush the cache
@@ -259,34 +192,35 @@ func (suite *NoteRepoTestSuite) TestGetNote() {
 		suite.NoError(result.Error)
 
 		// ensure that the cache is empty
-		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:%d", dbNote.ID)).Result()
+		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID)).Result()
 		suite.NoError(err)
 		suite.Equal(int64(0), res)
-		res, err = suite.rdClient.Exists(suite.ctx, "notes:Testing 123").Result()
+		res, err = suite.rdClient.Exists(suite.ctx, "notes:title:Testing 123").Result()
 		suite.NoError(err)
 		suite.Equal(int64(0), res)
 
 		// get a note by its id
 		repo := NewNoteRepository(suite.db, suite.rdClient)
-		note := repo.GetNoteById(int(dbNote.ID))
+		note, err := repo.GetNoteById(suite.ctx, int(dbNote.ID))
+		suite.NoError(err)
 		suite.NotNil(note)
 
 		// ensure that the note is now cached
-		res, err = suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:%d", dbNote.ID)).Result()
+		res, err = suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID)).Result()
 		suite.NoError(err)
 		suite.Greater(res, int64(0))
 
-		res, err = suite.rdClient.Exists(suite.ctx, "notes:Testing 123").Result()
+		res, err = suite.rdClient.Exists(suite.ctx, "notes:title:Testing 123").Result()
 		suite.NoError(err)
 		suite.Greater(res, int64(0))
 
-		noteMap, err := suite.rdClient.HGetAll(suite.ctx, fmt.Sprintf("notes:%d", dbNote.ID)).Result()
+		noteMap, err := suite.rdClient.HGetAll(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID)).Result()
 		suite.NoError(err)
 		suite.Equal(strconv.Itoa(int(dbNote.ID)), noteMap["id"])
 		suite.Equal("Testing 123", noteMap["title"])
 		suite.Equal("This is a test content", noteMap["content"])
 
-		noteMap, err = suite.rdClient.HGetAll(suite.ctx, "notes:Testing 123").Result()
+		noteMap, err = suite.rdClient.HGetAll(suite.ctx, "notes:title:Testing 123").Result()
 		suite.NoError(err)
 		suite.Equal(strconv.Itoa(int(dbNote.ID)), noteMap["id"])
 		suite.Equal("Testing 123", noteMap["title"])
@@ -306,9 +240,11 @@ func (suite *NoteRepoTestSuite) TestGetNote() {
 		}
 		result := suite.db.Save(&dbNote)
 		suite.NoError(result.Error)
+		// reload the note so its timestamps have the precision postgres stores
+		suite.NoError(suite.db.First(&dbNote, dbNote.ID).Error)
 
-		idKey := fmt.Sprintf("notes:%d", dbNote.ID)
-		titleKey := fmt.Sprintf("notes:%s", dbNote.Title)
+		idKey := fmt.Sprintf("notes:id:%d", dbNote.ID)
+		titleKey := fmt.Sprintf("notes:title:%s", dbNote.Title)
 
 		// cache the note
 		suite.rdClient.HSet(suite.ctx, idKey, "id", dbNote.ID)
@@ -338,11 +274,14 @@ func (suite *NoteRepoTestSuite) TestGetNote() {
 
 		// get the note by id and ensure the note was successfully retrieved
 		repo := NewNoteRepository(db, suite.rdClient)
-		note := repo.GetNoteById(int(dbNote.ID))
+		note, err := repo.GetNoteById(suite.ctx, int(dbNote.ID))
+		suite.NoError(err)
 		suite.NotNil(note)
 		suite.Equal(dbNote.ID, note.ID)
 		suite.Equal(dbNote.Title, note.Title)
 		suite.Equal(dbNote.Content, note.Content)
+		suite.True(dbNote.CreatedAt.Equal(note.CreatedAt), "created_at %s != %s", dbNote.CreatedAt, note.CreatedAt)
+		suite.True(dbNote.UpdatedAt.Equal(note.UpdatedAt), "updated_at %s != %s", dbNote.UpdatedAt, note.UpdatedAt)
 
 		// ensure all query expectations were met
 		// since we didn't set any expectations
@@ -369,38 +308,46 @@ func (suite *NoteRepoTestSuite) TestGetNote() {
 		suite.NoError(result.Error)
 
 		// ensure note is not cached
-		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:%d", dbNote.ID)).Result()
+		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID)).Result()
 		suite.NoError(err)
 		suite.Equal(int64(0), res)
-		res, err = suite.rdClient.Exists(suite.ctx, "notes:Testing 1234").Result()
+		res, err = suite.rdClient.Exists(suite.ctx, "notes:title:Testing 1234").Result()
 		suite.NoError(err)
 		suite.Equal(int64(0), res)
 
 		// get a note by its title
 		repo := NewNoteRepository(suite.db, suite.rdClient)
-		note := repo.GetNoteByTitle(dbNote.Title)
+		note, err := repo.GetNoteByTitle(suite.ctx, dbNote.Title)
+		suite.NoError(err)
 		suite.NotNil(note)
 
 		// ensure the note is now cached
-		res, err = suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:%d", dbNote.ID)).Result()
+		res, err = suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID)).Result()
 		suite.NoError(err)
 		suite.Greater(res, int64(0))
 
-		res, err = suite.rdClient.Exists(suite.ctx, "notes:Testing 1234").Result()
+		res, err = suite.rdClient.Exists(suite.ctx, "notes:title:Testing 1234").Result()
 		suite.NoError(err)
 		suite.Greater(res, int64(0))
 
-		noteMap, err := suite.rdClient.HGetAll(suite.ctx, fmt.Sprintf("notes:%d", dbNote.ID)).Result()
+		noteMap, err := suite.rdClient.HGetAll(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID)).Result()
 		suite.NoError(err)
 		suite.Equal(strconv.Itoa(int(dbNote.ID)), noteMap["id"])
 		suite.Equal("Testing 1234", noteMap["title"])
 		suite.Equal("This is a test content", noteMap["content"])
 
-		noteMap, err = suite.rdClient.HGetAll(suite.ctx, "notes:Testing 1234").Result()
+		noteMap, err = suite.rdClient.HGetAll(suite.ctx, "notes:title:Testing 1234").Result()
 		suite.NoError(err)
 		suite.Equal(strconv.Itoa(int(dbNote.ID)), noteMap["id"])
 		suite.Equal("Testing 1234", noteMap["title"])
 		suite.Equal("This is a test content", noteMap["content"])
+
+		// ensure the note served from the cache has the timestamps stored in postgres
+		suite.NoError(suite.db.First(&dbNote, dbNote.ID).Error)
+		cachedNote, err := repo.GetNoteByTitle(suite.ctx, dbNote.Title)
+		suite.NoError(err)
+		suite.True(dbNote.CreatedAt.Equal(cachedNote.CreatedAt), "created_at %s != %s", dbNote.CreatedAt, cachedNote.CreatedAt)
+		suite.True(dbNote.UpdatedAt.Equal(cachedNote.UpdatedAt), "updated_at %s != %s", dbNote.UpdatedAt, cachedNote.UpdatedAt)
 	})
 	suite.Run("Get note by title when note exists in cache", func() {
 		// empty the notes table and flush the cache
@@ -414,9 +361,11 @@ func (suite *NoteRepoTestSuite) TestGetNote() {
 		}
 		result := suite.db.Save(&dbNote)
 		suite.NoError(result.Error)
+		// reload the note so its timestamps have the precision postgres stores
+		suite.NoError(suite.db.First(&dbNote, dbNote.ID).Error)
 
-		idKey := fmt.Sprintf("notes:%d", dbNote.ID)
-		titleKey := fmt.Sprintf("notes:%s", dbNote.Title)
+		idKey := fmt.Sprintf("notes:id:%d", dbNote.ID)
+		titleKey := fmt.Sprintf("notes:title:%s", dbNote.Title)
 
 		// store note in cache
 		suite.rdClient.HSet(suite.ctx, idKey, "id", dbNote.ID)
@@ -445,17 +394,3646 @@ func (suite *NoteRepoTestSuite) TestGetNote() {
 		suite.NoError(err)
 
 		repo := NewNoteRepository(db, suite.rdClient)
-		note := repo.GetNoteByTitle(dbNote.Title)
+		note, err := repo.GetNoteByTitle(suite.ctx, dbNote.Title)
+		suite.NoError(err)
 		suite.NotNil(note)
 		suite.Equal(dbNote.ID, note.ID)
 		suite.Equal(dbNote.Title, note.Title)
 		suite.Equal(dbNote.Content, note.Content)
+		suite.True(dbNote.CreatedAt.Equal(note.CreatedAt), "created_at %s != %s", dbNote.CreatedAt, note.CreatedAt)
+		suite.True(dbNote.UpdatedAt.Equal(note.UpdatedAt), "updated_at %s != %s", dbNote.UpdatedAt, note.UpdatedAt)
 
 		err = mock.ExpectationsWereMet()
 		suite.NoError(err)
 	})
 }
 
-func TestNoteRepository(t *testing.T) {
-	suite.Run(t, new(NoteRepoTestSuite))
+func (suite *NoteRepoTestSuite) TestStaleCachedNoteIds() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	// insert three notes in the database
+	staleNote := Note{Title: "Stale", Content: "This note will be updated behind the cache"}
+	freshNote := Note{Title: "Fresh", Content: "This note is cached and up to date"}
+	uncachedNote := Note{Title: "Uncached", Content: "This note is never cached"}
+	for _, note := range []*Note{&staleNote, &freshNote, &uncachedNote} {
+		result := suite.db.Save(note)
+		suite.NoError(result.Error)
+	}
+
+	// cache the stale and fresh notes by reading them
+	_, err := repo.GetNoteById(suite.ctx, int(staleNote.ID))
+	suite.NoError(err)
+	_, err = repo.GetNoteById(suite.ctx, int(freshNote.ID))
+	suite.NoError(err)
+
+	// update the stale note directly in the database so the cache is not invalidated
+	result := suite.db.Model(&staleNote).Update("content", "Updated without invalidating the cache")
+	suite.NoError(result.Error)
+
+	// ensure only the stale note is reported
+	ids, err := repo.StaleCachedNoteIds(suite.ctx, 0)
+	suite.NoError(err)
+	suite.Equal([]int{int(staleNote.ID)}, ids)
+}
+
+func (suite *NoteRepoTestSuite) TestSaveNoteWithOverLengthTitle() {
+	// setup database mock without expectations so any query fails the test
+	mockDb, mock, err := sqlmock.New()
+	suite.NoError(err)
+	defer mockDb.Close()
+
+	dialector := pg.New(pg.Config{
+		Conn:       mockDb,
+		DriverName: "postgres",
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	suite.NoError(err)
+
+	// save a note whose title is one character too long
+	repo := NewNoteRepository(db, suite.rdClient)
+	note := Note{Title: strings.Repeat("é", MaxTitleLength+1), Content: "This note should never be stored"}
+	err = repo.SaveNote(suite.ctx, &note)
+	suite.ErrorIs(err, ErrInvalidNote)
+
+	// ensure the database was never queried
+	err = mock.ExpectationsWereMet()
+	suite.NoError(err)
+
+	// ensure a title at the limit is accepted by the database
+	note = Note{Title: strings.Repeat("é", MaxTitleLength), Content: "This note fits"}
+	err = NewNoteRepository(suite.db, suite.rdClient).SaveNote(suite.ctx, &note)
+	suite.NoError(err)
+}
+
+func (suite *NoteRepoTestSuite) TestListAuditTrail() {
+	suite.Run("Audit trail is ordered by time desc", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		// create, update and delete a note
+		repo := NewNoteRepository(suite.db, suite.rdClient)
+		start := time.Now().Add(-time.Minute)
+		note := Note{Title: "Audited", Content: "This note will be audited"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		note.Content = "This note has been updated"
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+
+		// ensure the mutations are returned most recent first
+		entries, err := repo.ListAuditTrail(suite.ctx, start, time.Now().Add(time.Minute), 10, 0)
+		suite.NoError(err)
+		suite.Equal(3, len(entries))
+		suite.Equal(AuditActionDeleted, entries[0].Action)
+		suite.Equal(AuditActionUpdated, entries[1].Action)
+		suite.Equal(AuditActionCreated, entries[2].Action)
+		for _, entry := range entries {
+			suite.Equal(note.ID, entry.NoteID)
+		}
+
+		// ensure limit and offset page through the trail
+		entries, err = repo.ListAuditTrail(suite.ctx, start, time.Now().Add(time.Minute), 1, 1)
+		suite.NoError(err)
+		suite.Equal(1, len(entries))
+		suite.Equal(AuditActionUpdated, entries[0].Action)
+	})
+	suite.Run("Audit trail is filtered by time range", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM audit_entries;")
+		})
+
+		// insert audit entries at controlled times
+		base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		for i := 0; i < 4; i++ {
+			entry := AuditEntry{NoteID: uint(i + 1), Action: AuditActionCreated, CreatedAt: base.Add(time.Duration(i) * time.Hour)}
+			result := suite.db.Create(&entry)
+			suite.NoError(result.Error)
+		}
+
+		// ensure only the entries from the second and third hour are returned
+		repo := NewNoteRepository(suite.db, suite.rdClient)
+		entries, err := repo.ListAuditTrail(suite.ctx, base.Add(time.Hour), base.Add(3*time.Hour), 10, 0)
+		suite.NoError(err)
+		suite.Equal(2, len(entries))
+		suite.Equal(uint(3), entries[0].NoteID)
+		suite.Equal(uint(2), entries[1].NoteID)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestGetNoteByIdRendered() {
+	// insert a note in the database
+	dbNote := Note{Title: "Rendered", Content: "This is the original content"}
+	result := suite.db.Save(&dbNote)
+	suite.NoError(result.Error)
+
+	// get the rendered note and ensure it was rendered with the configured renderer
+	repo := NewNoteRepository(suite.db, suite.rdClient, WithRenderer(func(content string) string {
+		return "<p>" + content + "</p>"
+	}))
+	renderedHTML, err := repo.GetNoteByIdRendered(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+	suite.Equal("<p>This is the original content</p>", renderedHTML)
+
+	// ensure the rendered HTML is now cached with the note
+	cachedHTML, err := suite.rdClient.HGet(suite.ctx, fmt.Sprintf("notes:id:%d", dbNote.ID), "html").Result()
+	suite.NoError(err)
+	suite.Equal(renderedHTML, cachedHTML)
+
+	// update the note content and ensure the rendered HTML is refreshed
+	dbNote.Content = "This is the updated content"
+	err = repo.SaveNote(suite.ctx, &dbNote)
+	suite.NoError(err)
+	renderedHTML, err = repo.GetNoteByIdRendered(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+	suite.Equal("<p>This is the updated content</p>", renderedHTML)
+
+	// ensure rendering a note that does not exist returns not found
+	_, err = repo.GetNoteByIdRendered(suite.ctx, int(dbNote.ID)+1)
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func (suite *NoteRepoTestSuite) TestListAllNotes() {
+	// insert two notes and soft-delete one of them
+	liveNote := Note{Title: "Live", Content: "This note is live"}
+	deletedNote := Note{Title: "Trashed", Content: "This note is in the trash"}
+	for _, note := range []*Note{&liveNote, &deletedNote} {
+		result := suite.db.Save(note)
+		suite.NoError(result.Error)
+	}
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	err := repo.DeleteNote(suite.ctx, int(deletedNote.ID))
+	suite.NoError(err)
+
+	// ensure only the live note is listed when deleted notes are excluded
+	notes, err := repo.ListAllNotes(suite.ctx, false, 10, 0)
+	suite.NoError(err)
+	suite.Equal(1, len(notes))
+	suite.Equal(liveNote.ID, notes[0].ID)
+	suite.False(notes[0].DeletedAt.Valid)
+
+	// ensure the soft-deleted note is listed with its DeletedAt when included
+	notes, err = repo.ListAllNotes(suite.ctx, true, 10, 0)
+	suite.NoError(err)
+	suite.Equal(2, len(notes))
+	suite.Equal(liveNote.ID, notes[0].ID)
+	suite.False(notes[0].DeletedAt.Valid)
+	suite.Equal(deletedNote.ID, notes[1].ID)
+	suite.True(notes[1].DeletedAt.Valid)
+
+	// ensure the listing bypasses the cache
+	keys, err := suite.rdClient.Keys(suite.ctx, "*").Result()
+	suite.NoError(err)
+	suite.Empty(keys)
+}
+
+func (suite *NoteRepoTestSuite) TestPurgeDeletedNotes() {
+	// insert a note and soft-delete it
+	note := Note{Title: "Purge me", Content: "This note will be purged"}
+	result := suite.db.Save(&note)
+	suite.NoError(result.Error)
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	err := repo.DeleteNote(suite.ctx, int(note.ID))
+	suite.NoError(err)
+
+	// leave a lingering cache entry for the deleted note
+	err = suite.rdClient.HSet(suite.ctx, fmt.Sprintf("notes:title:%s", note.Title), "id", note.ID).Err()
+	suite.NoError(err)
+
+	// ensure nothing is purged when the note was deleted after the cutoff
+	purged, err := repo.PurgeDeletedNotes(suite.ctx, time.Now().Add(-time.Hour))
+	suite.NoError(err)
+	suite.Equal(0, purged)
+
+	// advance past the cutoff and ensure the note is purged
+	purged, err = repo.PurgeDeletedNotes(suite.ctx, time.Now().Add(time.Second))
+	suite.NoError(err)
+	suite.Equal(1, purged)
+
+	// ensure the row is gone even when including soft-deleted rows
+	var count int64
+	result = suite.db.Unscoped().Model(&Note{}).Where("id = ?", note.ID).Count(&count)
+	suite.NoError(result.Error)
+	suite.Equal(int64(0), count)
+
+	// ensure the lingering cache entry was cleared
+	res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:title:%s", note.Title)).Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), res)
+}
+
+func (suite *NoteRepoTestSuite) TestPurgeDeletedBefore() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	now := time.Now()
+	// soft-delete three notes, two days, two hours and a minute ago
+	deletedAt := []time.Time{now.Add(-48 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Minute)}
+	notes := make([]Note, len(deletedAt))
+	for i := range notes {
+		notes[i] = Note{Title: fmt.Sprintf("Note %d", i), Content: "My content"}
+		suite.NoError(repo.SaveNote(suite.ctx, &notes[i]))
+		suite.NoError(repo.DeleteNote(suite.ctx, int(notes[i].ID)))
+		result := suite.db.Unscoped().Model(&Note{}).Where("id = ?", notes[i].ID).Update("deleted_at", deletedAt[i])
+		suite.NoError(result.Error)
+	}
+	live := Note{Title: "Live", Content: "My content"}
+	suite.NoError(repo.SaveNote(suite.ctx, &live))
+
+	// ensure only the notes deleted before the cutoff are removed
+	purged, err := repo.PurgeDeletedBefore(suite.ctx, now.Add(-time.Hour))
+	suite.NoError(err)
+	suite.Equal(int64(2), purged)
+	var ids []uint
+	result := suite.db.Unscoped().Model(&Note{}).Order("id").Pluck("id", &ids)
+	suite.NoError(result.Error)
+	suite.Equal([]uint{notes[2].ID, live.ID}, ids)
+
+	// ensure purging again with the same cutoff removes nothing
+	purged, err = repo.PurgeDeletedBefore(suite.ctx, now.Add(-time.Hour))
+	suite.NoError(err)
+	suite.Equal(int64(0), purged)
+}
+
+func (suite *NoteRepoTestSuite) TestHottestNotes() {
+	// insert three notes in the database
+	notes := []*Note{
+		{Title: "Cold", Content: "This note is read once"},
+		{Title: "Warm", Content: "This note is read twice"},
+		{Title: "Hot", Content: "This note is read three times"},
+	}
+	for _, note := range notes {
+		result := suite.db.Save(note)
+		suite.NoError(result.Error)
+	}
+
+	// read each note at a different frequency, from both the db and the cache
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	for i, note := range notes {
+		for j := 0; j <= i; j++ {
+			_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+		}
+	}
+
+	// ensure the notes are ranked by how often they were read
+	ids, err := repo.HottestNotes(suite.ctx, 2)
+	suite.NoError(err)
+	suite.Equal([]int{int(notes[2].ID), int(notes[1].ID)}, ids)
+
+	ids, err = repo.HottestNotes(suite.ctx, 10)
+	suite.NoError(err)
+	suite.Equal([]int{int(notes[2].ID), int(notes[1].ID), int(notes[0].ID)}, ids)
+}
+
+func (suite *NoteRepoTestSuite) TestGetNoteViewCount() {
+	note := Note{Title: "Viewed", Content: "This note is read twice"}
+	suite.NoError(suite.db.Save(&note).Error)
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	// a note that was never read has no views
+	count, err := repo.GetNoteViewCount(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal(int64(0), count)
+
+	// read the note by id from postgres and then by title from the cache
+	_, err = repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	_, err = repo.GetNoteByTitle(suite.ctx, note.Title)
+	suite.NoError(err)
+	count, err = repo.GetNoteViewCount(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal(int64(2), count)
+
+	suite.Run("Reads aren't counted when tracking is disabled", func() {
+		untracked := NewNoteRepository(suite.db, suite.rdClient, WithAccessTracking(false))
+		_, err := untracked.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+		count, err := repo.GetNoteViewCount(suite.ctx, int(note.ID))
+		suite.NoError(err)
+		suite.Equal(int64(2), count)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestTransformAllContent() {
+	// insert notes in the database, one of which is already uppercase
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	notes := []*Note{
+		{Title: "First", Content: "first content"},
+		{Title: "Second", Content: "second content"},
+		{Title: "Third", Content: "third content"},
+		{Title: "Shouting", Content: "ALREADY UPPERCASE"},
+	}
+	for _, note := range notes {
+		result := suite.db.Save(note)
+		suite.NoError(result.Error)
+		// cache the note by reading it
+		_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+	}
+
+	// uppercase all the note contents in batches smaller than the number of notes
+	changed, err := repo.TransformAllContent(suite.ctx, strings.ToUpper, 2)
+	suite.NoError(err)
+	suite.Equal(3, changed)
+
+	// ensure all the notes were updated in the database and their caches cleared
+	for _, note := range notes {
+		var dbNote Note
+		result := suite.db.First(&dbNote, note.ID)
+		suite.NoError(result.Error)
+		suite.Equal(strings.ToUpper(note.Content), dbNote.Content)
+
+		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID), fmt.Sprintf("notes:title:%s", note.Title)).Result()
+		suite.NoError(err)
+		if note.Title == "Shouting" {
+			suite.Equal(int64(2), res)
+		} else {
+			suite.Equal(int64(0), res)
+		}
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestTitlesCollide() {
+	testCases := []struct {
+		name       string
+		normalizer TitleNormalizer
+		a          string
+		b          string
+		collide    bool
+	}{
+		{"Identical titles collide", nil, "Groceries", "Groceries", true},
+		{"Case differs without normalizer", nil, "Groceries", "groceries", false},
+		{"Whitespace differs without normalizer", nil, "Groceries", " Groceries ", false},
+		{"Whitespace differs with trimming", strings.TrimSpace, "Groceries", " Groceries ", true},
+		{"Case differs with trimming", strings.TrimSpace, "Groceries", "groceries", false},
+		{"Case differs with case folding", strings.ToLower, "Groceries", "groceries", true},
+		{"Different titles with case folding", strings.ToLower, "Groceries", "Chores", false},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			// empty the notes table and flush the cache
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+
+			repo := NewNoteRepository(suite.db, suite.rdClient, WithTitleNormalizer(tc.normalizer))
+			suite.Equal(tc.collide, repo.TitlesCollide(tc.a, tc.b))
+
+			// ensure CreateNote treats the titles the same way once it has trimmed them
+			app := NewApplication(repo)
+			_, err := app.CreateNote(suite.ctx, tc.a, "This is the first note")
+			suite.NoError(err)
+			_, err = app.CreateNote(suite.ctx, tc.b, "This is the second note")
+			if repo.TitlesCollide(strings.TrimSpace(tc.a), strings.TrimSpace(tc.b)) {
+				suite.ErrorIs(err, DuplicateNoteError)
+			} else {
+				suite.NoError(err)
+			}
+		})
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestListNotesBefore() {
+	// insert five notes in the database
+	ids := make([]uint, 0)
+	for i := 0; i < 5; i++ {
+		note := Note{Title: fmt.Sprintf("Note %d", i), Content: "This is a test content"}
+		result := suite.db.Save(&note)
+		suite.NoError(result.Error)
+		ids = append(ids, note.ID)
+	}
+
+	// get the first page starting from the newest note
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	page, err := repo.ListNotesBefore(suite.ctx, 0, 2)
+	suite.NoError(err)
+	suite.Equal(2, len(page))
+	suite.Equal(ids[4], page[0].ID)
+	suite.Equal(ids[3], page[1].ID)
+
+	// insert a new note mid-iteration
+	newNote := Note{Title: "Newer note", Content: "This note is inserted during pagination"}
+	result := suite.db.Save(&newNote)
+	suite.NoError(result.Error)
+
+	// ensure the following pages continue from the cursor without gaps or overlaps
+	page, err = repo.ListNotesBefore(suite.ctx, page[1].ID, 2)
+	suite.NoError(err)
+	suite.Equal(2, len(page))
+	suite.Equal(ids[2], page[0].ID)
+	suite.Equal(ids[1], page[1].ID)
+
+	page, err = repo.ListNotesBefore(suite.ctx, page[1].ID, 2)
+	suite.NoError(err)
+	suite.Equal(1, len(page))
+	suite.Equal(ids[0], page[0].ID)
+
+	// ensure the page after the oldest note is empty
+	page, err = repo.ListNotesBefore(suite.ctx, page[0].ID, 2)
+	suite.NoError(err)
+	suite.Empty(page)
+}
+
+func (suite *NoteRepoTestSuite) TestListNotesAfter() {
+	// insert five notes in the database
+	ids := make([]uint, 0)
+	for i := 0; i < 5; i++ {
+		note := Note{Title: fmt.Sprintf("Note %d", i), Content: "This is a test content"}
+		result := suite.db.Save(&note)
+		suite.NoError(result.Error)
+		ids = append(ids, note.ID)
+	}
+
+	// get the first page starting from the oldest note
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	suite.NoError(suite.db.Create(&NoteTag{NoteID: ids[1], Tag: "work"}).Error)
+	page, err := repo.ListNotesAfter(suite.ctx, 0, 2)
+	suite.NoError(err)
+	suite.Equal(2, len(page))
+	suite.Equal(ids[0], page[0].ID)
+	suite.Equal(ids[1], page[1].ID)
+	// the tags of the page are loaded
+	suite.Empty(page[0].Tags)
+	suite.Equal([]string{"work"}, page[1].Tags)
+
+	// delete a note that hasn't been listed yet mid-iteration
+	suite.NoError(repo.DeleteNote(suite.ctx, int(ids[2])))
+
+	// ensure the middle page continues from the cursor without gaps or overlaps
+	page, err = repo.ListNotesAfter(suite.ctx, page[1].ID, 2)
+	suite.NoError(err)
+	suite.Equal(2, len(page))
+	suite.Equal(ids[3], page[0].ID)
+	suite.Equal(ids[4], page[1].ID)
+
+	// ensure the page after the newest note is empty
+	page, err = repo.ListNotesAfter(suite.ctx, page[1].ID, 2)
+	suite.NoError(err)
+	suite.Empty(page)
+}
+
+func (suite *NoteRepoTestSuite) TestListNotesByTimestamps() {
+	// insert five notes created and last updated an hour apart
+	base := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	ids := make([]uint, 0)
+	for i := 0; i < 5; i++ {
+		at := base.Add(time.Duration(i) * time.Hour)
+		note := Note{
+			Model:   gorm.Model{CreatedAt: at, UpdatedAt: at},
+			Title:   fmt.Sprintf("Note %d", i),
+			Content: "This is a test content",
+		}
+		suite.NoError(suite.db.Create(&note).Error)
+		ids = append(ids, note.ID)
+	}
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	noteIDs := func(notes []Note) []uint {
+		listed := make([]uint, 0, len(notes))
+		for _, note := range notes {
+			listed = append(listed, note.ID)
+		}
+		return listed
+	}
+
+	suite.Run("Updated since excludes the note at the cursor", func() {
+		notes, err := repo.ListNotesUpdatedSince(suite.ctx, base.Add(time.Hour), ids[1], 10)
+		suite.NoError(err)
+		suite.Equal([]uint{ids[2], ids[3], ids[4]}, noteIDs(notes))
+
+		notes, err = repo.ListNotesUpdatedSince(suite.ctx, base.Add(time.Hour), ids[1], 2)
+		suite.NoError(err)
+		suite.Equal([]uint{ids[2], ids[3]}, noteIDs(notes))
+
+		notes, err = repo.ListNotesUpdatedSince(suite.ctx, base.Add(4*time.Hour), ids[4], 10)
+		suite.NoError(err)
+		suite.Empty(notes)
+	})
+
+	suite.Run("Updated since pages through notes updated at the same instant", func() {
+		// give the last two notes the same updated_at
+		result := suite.db.Model(&Note{}).Where("id IN ?", []uint{ids[3], ids[4]}).Update("updated_at", base.Add(3*time.Hour))
+		suite.NoError(result.Error)
+		suite.T().Cleanup(func() {
+			suite.db.Model(&Note{}).Where("id = ?", ids[4]).Update("updated_at", base.Add(4*time.Hour))
+		})
+
+		notes, err := repo.ListNotesUpdatedSince(suite.ctx, base.Add(2*time.Hour), ids[2], 1)
+		suite.NoError(err)
+		suite.Equal([]uint{ids[3]}, noteIDs(notes))
+		notes, err = repo.ListNotesUpdatedSince(suite.ctx, notes[0].UpdatedAt, notes[0].ID, 1)
+		suite.NoError(err)
+		suite.Equal([]uint{ids[4]}, noteIDs(notes))
+		notes, err = repo.ListNotesUpdatedSince(suite.ctx, notes[0].UpdatedAt, notes[0].ID, 1)
+		suite.NoError(err)
+		suite.Empty(notes)
+	})
+
+	suite.Run("Created between includes start and excludes end", func() {
+		notes, err := repo.ListNotesCreatedBetween(suite.ctx, base.Add(time.Hour), base.Add(3*time.Hour))
+		suite.NoError(err)
+		suite.Equal([]uint{ids[1], ids[2]}, noteIDs(notes))
+
+		// consecutive windows don't overlap
+		notes, err = repo.ListNotesCreatedBetween(suite.ctx, base.Add(3*time.Hour), base.Add(5*time.Hour))
+		suite.NoError(err)
+		suite.Equal([]uint{ids[3], ids[4]}, noteIDs(notes))
+	})
+
+	suite.Run("The cache is bypassed", func() {
+		_, err := repo.GetNoteById(suite.ctx, int(ids[4]))
+		suite.NoError(err)
+		// update the note behind the cache's back
+		result := suite.db.Model(&Note{}).Where("id = ?", ids[4]).
+			Updates(map[string]any{"content": "Updated content", "updated_at": base.Add(5 * time.Hour)})
+		suite.NoError(result.Error)
+
+		notes, err := repo.ListNotesUpdatedSince(suite.ctx, base.Add(4*time.Hour), ids[4], 10)
+		suite.NoError(err)
+		suite.Len(notes, 1)
+		suite.Equal("Updated content", notes[0].Content)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestAcquireLock() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	other := NewNoteRepository(suite.db, suite.rdClient)
+
+	suite.Run("Acquire, contend and release", func() {
+		release, ok, err := repo.AcquireLock(suite.ctx, "rename", time.Minute)
+		suite.Require().NoError(err)
+		suite.Require().True(ok)
+		ttl, err := suite.rdClient.PTTL(suite.ctx, "notes:lock:app:rename").Result()
+		suite.NoError(err)
+		suite.Greater(ttl, time.Duration(0))
+
+		// the lock can't be acquired while it is held
+		otherRelease, ok, err := other.AcquireLock(suite.ctx, "rename", time.Minute)
+		suite.NoError(err)
+		suite.False(ok)
+		suite.Nil(otherRelease)
+		// locks are independent of each other
+		otherRelease, ok, err = other.AcquireLock(suite.ctx, "merge", time.Minute)
+		suite.NoError(err)
+		suite.True(ok)
+		suite.NoError(otherRelease())
+
+		suite.NoError(release())
+		otherRelease, ok, err = other.AcquireLock(suite.ctx, "rename", time.Minute)
+		suite.NoError(err)
+		suite.True(ok)
+		suite.NoError(otherRelease())
+	})
+
+	suite.Run("The lock expires after its TTL", func() {
+		release, ok, err := repo.AcquireLock(suite.ctx, "expiring", 100*time.Millisecond)
+		suite.Require().NoError(err)
+		suite.Require().True(ok)
+		time.Sleep(200 * time.Millisecond)
+
+		otherRelease, ok, err := other.AcquireLock(suite.ctx, "expiring", time.Minute)
+		suite.Require().NoError(err)
+		suite.Require().True(ok)
+
+		// releasing the expired lock doesn't release the new holder's lock
+		suite.ErrorIs(release(), ErrLockNotHeld)
+		exists, err := suite.rdClient.Exists(suite.ctx, "notes:lock:app:expiring").Result()
+		suite.NoError(err)
+		suite.Equal(int64(1), exists)
+		suite.NoError(otherRelease())
+	})
+
+	suite.Run("Release outlives the context", func() {
+		ctx, cancel := context.WithCancel(suite.ctx)
+		release, ok, err := repo.AcquireLock(ctx, "cancelled", time.Minute)
+		suite.Require().NoError(err)
+		suite.Require().True(ok)
+		cancel()
+		suite.NoError(release())
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestListRecentlyUpdated() {
+	// insert four notes last updated an hour apart
+	base := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	ids := make([]uint, 0)
+	for i := 0; i < 4; i++ {
+		at := base.Add(time.Duration(i) * time.Hour)
+		note := Note{
+			Model:   gorm.Model{CreatedAt: at, UpdatedAt: at},
+			Title:   fmt.Sprintf("Note %d", i),
+			Content: "This is a test content",
+		}
+		suite.NoError(suite.db.Create(&note).Error)
+		ids = append(ids, note.ID)
+	}
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	noteIDs := func(notes []Note) []uint {
+		listed := make([]uint, 0, len(notes))
+		for _, note := range notes {
+			listed = append(listed, note.ID)
+		}
+		return listed
+	}
+
+	notes, err := repo.ListRecentlyUpdated(suite.ctx, 10)
+	suite.NoError(err)
+	suite.Equal([]uint{ids[3], ids[2], ids[1], ids[0]}, noteIDs(notes))
+
+	// updating the two oldest notes bubbles them to the top
+	for _, id := range []uint{ids[1], ids[0]} {
+		note, err := repo.GetNoteById(suite.ctx, int(id))
+		suite.Require().NoError(err)
+		note.Content = "Updated content"
+		suite.Require().NoError(repo.SaveNote(suite.ctx, note))
+	}
+	// deleted notes aren't listed
+	suite.NoError(repo.DeleteNote(suite.ctx, int(ids[3])))
+
+	notes, err = repo.ListRecentlyUpdated(suite.ctx, 3)
+	suite.NoError(err)
+	suite.Equal([]uint{ids[0], ids[1], ids[2]}, noteIDs(notes))
+	suite.Equal("Updated content", notes[0].Content)
+}
+
+func (suite *NoteRepoTestSuite) TestListNotesByIDRange() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	ids := make([]uint, 0)
+	for i := 0; i < 6; i++ {
+		note := Note{Title: fmt.Sprintf("Note %d", i), Content: "This is a test content", Tags: []string{fmt.Sprintf("tag %d", i)}}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		ids = append(ids, note.ID)
+	}
+	// leave a gap in the ids by deleting the two middle notes
+	suite.NoError(repo.DeleteNote(suite.ctx, int(ids[2])))
+	suite.NoError(repo.DeleteNote(suite.ctx, int(ids[3])))
+	noteIDs := func(notes []Note) []uint {
+		listed := make([]uint, 0, len(notes))
+		for _, note := range notes {
+			listed = append(listed, note.ID)
+		}
+		return listed
+	}
+
+	suite.Run("Boundaries are inclusive", func() {
+		notes, err := repo.ListNotesByIDRange(suite.ctx, ids[0], ids[1])
+		suite.NoError(err)
+		suite.Equal([]uint{ids[0], ids[1]}, noteIDs(notes))
+		suite.Equal([]string{"tag 1"}, notes[1].Tags)
+
+		notes, err = repo.ListNotesByIDRange(suite.ctx, ids[5], ids[5])
+		suite.NoError(err)
+		suite.Equal([]uint{ids[5]}, noteIDs(notes))
+	})
+
+	suite.Run("Gaps are skipped", func() {
+		notes, err := repo.ListNotesByIDRange(suite.ctx, ids[1], ids[4])
+		suite.NoError(err)
+		suite.Equal([]uint{ids[1], ids[4]}, noteIDs(notes))
+
+		notes, err = repo.ListNotesByIDRange(suite.ctx, ids[2], ids[3])
+		suite.NoError(err)
+		suite.Empty(notes)
+
+		notes, err = repo.ListNotesByIDRange(suite.ctx, ids[5]+1, ids[5]+10)
+		suite.NoError(err)
+		suite.Empty(notes)
+	})
+
+	suite.Run("Partitions cover every note once", func() {
+		listed := make([]uint, 0)
+		for minID := ids[0]; minID <= ids[5]; minID += 2 {
+			notes, err := repo.ListNotesByIDRange(suite.ctx, minID, minID+1)
+			suite.NoError(err)
+			listed = append(listed, noteIDs(notes)...)
+		}
+		suite.Equal([]uint{ids[0], ids[1], ids[4], ids[5]}, listed)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestWithCacheWritesDisabled() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	// save and read notes inside the scope
+	notes := []*Note{
+		{Title: "Imported 1", Content: "This note was imported"},
+		{Title: "Imported 2", Content: "This note was also imported"},
+	}
+	cached := suite.seedNote(Note{Title: "Cached", Content: "This note is cached"})
+	err := repo.WithCacheWritesDisabled(suite.ctx, func(ctx context.Context) error {
+		for _, note := range notes {
+			if err := repo.SaveNote(ctx, note); err != nil {
+				return err
+			}
+			if _, err := repo.GetNoteById(ctx, int(note.ID)); err != nil {
+				return err
+			}
+		}
+		// a cached note saved within the scope is still invalidated
+		cached.Content = "This note was updated"
+		if err := repo.SaveNote(ctx, &cached); err != nil {
+			return err
+		}
+		// calls made without the scope's context cache as usual
+		_, err := repo.GetNoteById(suite.ctx, int(cached.ID))
+		return err
+	})
+	suite.NoError(err)
+	cachedNote, err := repo.GetNoteById(suite.ctx, int(cached.ID))
+	suite.NoError(err)
+	suite.Equal("This note was updated", cachedNote.Content)
+	res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", cached.ID)).Result()
+	suite.NoError(err)
+	suite.Equal(int64(1), res)
+
+	// ensure the notes were saved but no cache entries were created
+	for _, note := range notes {
+		suite.NotZero(note.ID)
+		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID), fmt.Sprintf("notes:title:%s", note.Title)).Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), res)
+	}
+
+	// ensure the notes are cached again once outside the scope
+	_, err = repo.GetNoteById(suite.ctx, int(notes[0].ID))
+	suite.NoError(err)
+	res, err = suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", notes[0].ID)).Result()
+	suite.NoError(err)
+	suite.Equal(int64(1), res)
+}
+
+func (suite *NoteRepoTestSuite) TestWordCount() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	// save notes and ensure their word counts are computed
+	first := Note{Title: "Words", Content: "one two  three\nfour"}
+	err := repo.SaveNote(suite.ctx, &first)
+	suite.NoError(err)
+	suite.Equal(4, first.WordCount)
+	second := Note{Title: "More words", Content: "  five six  "}
+	err = repo.SaveNote(suite.ctx, &second)
+	suite.NoError(err)
+	suite.Equal(2, second.WordCount)
+
+	// ensure the word count is stored in postgres and served from the cache
+	note, err := repo.GetNoteById(suite.ctx, int(first.ID))
+	suite.NoError(err)
+	suite.NotNil(note)
+	suite.Equal(4, note.WordCount)
+	wordCount, err := suite.rdClient.HGet(suite.ctx, fmt.Sprintf("notes:id:%d", first.ID), "word_count").Result()
+	suite.NoError(err)
+	suite.Equal("4", wordCount)
+	note, err = repo.GetNoteById(suite.ctx, int(first.ID))
+	suite.NoError(err)
+	suite.NotNil(note)
+	suite.Equal(4, note.WordCount)
+
+	// ensure the aggregate covers all the notes
+	total, err := repo.TotalWordCount(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(int64(6), total)
+
+	// update the content and ensure the word count follows
+	first.Content = "just one"
+	err = repo.SaveNote(suite.ctx, &first)
+	suite.NoError(err)
+	note, err = repo.GetNoteById(suite.ctx, int(first.ID))
+	suite.NoError(err)
+	suite.NotNil(note)
+	suite.Equal(2, note.WordCount)
+	total, err = repo.TotalWordCount(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(int64(4), total)
+}
+
+func (suite *NoteRepoTestSuite) TestHotNoteTTL() {
+	// insert a note in the database
+	dbNote := Note{Title: "Hot note", Content: "This note will be read a lot"}
+	result := suite.db.Save(&dbNote)
+	suite.NoError(result.Error)
+	idKey := fmt.Sprintf("notes:id:%d", dbNote.ID)
+	titleKey := fmt.Sprintf("notes:title:%s", dbNote.Title)
+
+	// read the note once to cache it and give the cache entries a short TTL
+	repo := NewNoteRepository(suite.db, suite.rdClient, WithHotNoteTTL(3, time.Hour))
+	_, err := repo.GetNoteById(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+	suite.NoError(suite.rdClient.Expire(suite.ctx, idKey, time.Minute).Err())
+	suite.NoError(suite.rdClient.Expire(suite.ctx, titleKey, time.Minute).Err())
+
+	// read the note a second time and ensure the TTL is not extended below the threshold
+	_, err = repo.GetNoteById(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+	ttl, err := suite.rdClient.TTL(suite.ctx, idKey).Result()
+	suite.NoError(err)
+	suite.LessOrEqual(ttl, time.Minute)
+
+	// read the note a third time and ensure the TTL is extended once it is hot
+	_, err = repo.GetNoteById(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+	ttl, err = suite.rdClient.TTL(suite.ctx, idKey).Result()
+	suite.NoError(err)
+	suite.Greater(ttl, time.Minute)
+	ttl, err = suite.rdClient.TTL(suite.ctx, titleKey).Result()
+	suite.NoError(err)
+	suite.Greater(ttl, time.Minute)
+}
+
+func (suite *NoteRepoTestSuite) TestCachedTimestampPrecision() {
+	// save a note, its timestamps carry nanoseconds in memory
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	savedNote := Note{Title: "Precise", Content: "This note has precise timestamps"}
+	err := repo.SaveNote(suite.ctx, &savedNote)
+	suite.NoError(err)
+
+	// cache the note exactly as it is in memory
+	err = repo.cacheNote(suite.ctx, savedNote)
+	suite.NoError(err)
+
+	// read the note from both the cache and the database
+	cachedNote, err := repo.getNoteFromCache(suite.ctx, int(savedNote.ID))
+	suite.NoError(err)
+	suite.NotNil(cachedNote)
+	var dbNote Note
+	result := suite.db.First(&dbNote, savedNote.ID)
+	suite.NoError(result.Error)
+
+	// ensure the timestamps are identical
+	suite.True(dbNote.CreatedAt.Equal(cachedNote.CreatedAt), "%s != %s", dbNote.CreatedAt, cachedNote.CreatedAt)
+	suite.True(dbNote.UpdatedAt.Equal(cachedNote.UpdatedAt), "%s != %s", dbNote.UpdatedAt, cachedNote.UpdatedAt)
+
+	// ensure a note cached from the database round-trips identically too
+	suite.NoError(suite.rdClient.FlushAll(suite.ctx).Err())
+	fromDb, err := repo.GetNoteById(suite.ctx, int(savedNote.ID))
+	suite.NoError(err)
+	suite.NotNil(fromDb)
+	fromCache, err := repo.GetNoteById(suite.ctx, int(savedNote.ID))
+	suite.NoError(err)
+	suite.NotNil(fromCache)
+	suite.True(fromDb.CreatedAt.Equal(fromCache.CreatedAt))
+	suite.True(fromDb.UpdatedAt.Equal(fromCache.UpdatedAt))
+	suite.True(dbNote.CreatedAt.Equal(fromCache.CreatedAt))
+	suite.True(dbNote.UpdatedAt.Equal(fromCache.UpdatedAt))
+}
+
+func (suite *NoteRepoTestSuite) TestInspectNote() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	app := NewApplication(repo)
+
+	// insert notes in the database
+	matchingNote := Note{Title: "Matching", Content: "This note is cached and up to date"}
+	staleNote := Note{Title: "Stale", Content: "This note will be updated behind the cache"}
+	uncachedNote := Note{Title: "Uncached", Content: "This note is never cached"}
+	for _, note := range []*Note{&matchingNote, &staleNote, &uncachedNote} {
+		result := suite.db.Save(note)
+		suite.NoError(result.Error)
+	}
+
+	// cache the matching and stale notes and update the stale note behind the cache
+	_, err := repo.GetNoteById(suite.ctx, int(matchingNote.ID))
+	suite.NoError(err)
+	_, err = repo.GetNoteById(suite.ctx, int(staleNote.ID))
+	suite.NoError(err)
+	suite.NoError(suite.rdClient.Expire(suite.ctx, fmt.Sprintf("notes:id:%d", matchingNote.ID), time.Minute).Err())
+	result := suite.db.Model(&staleNote).Update("content", "Updated without invalidating the cache")
+	suite.NoError(result.Error)
+
+	suite.Run("Matching note", func() {
+		inspectResult, err := app.InspectNote(suite.ctx, int(matchingNote.ID))
+		suite.NoError(err)
+		suite.NotNil(inspectResult.DbNote)
+		suite.NotNil(inspectResult.CachedNote)
+		suite.True(inspectResult.Matches)
+		suite.Greater(inspectResult.CacheTTL, time.Duration(0))
+		suite.LessOrEqual(inspectResult.CacheTTL, time.Minute)
+	})
+	suite.Run("Stale note", func() {
+		inspectResult, err := app.InspectNote(suite.ctx, int(staleNote.ID))
+		suite.NoError(err)
+		suite.NotNil(inspectResult.DbNote)
+		suite.NotNil(inspectResult.CachedNote)
+		suite.False(inspectResult.Matches)
+		suite.Equal("Updated without invalidating the cache", inspectResult.DbNote.Content)
+		suite.Equal(staleNote.Title, inspectResult.CachedNote.Title)
+		suite.Less(inspectResult.CacheTTL, time.Duration(0))
+	})
+	suite.Run("Uncached note", func() {
+		inspectResult, err := app.InspectNote(suite.ctx, int(uncachedNote.ID))
+		suite.NoError(err)
+		suite.NotNil(inspectResult.DbNote)
+		suite.Nil(inspectResult.CachedNote)
+		suite.False(inspectResult.Matches)
+		suite.Equal(time.Duration(0), inspectResult.CacheTTL)
+
+		// ensure inspecting the note didn't cache it
+		res, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", uncachedNote.ID)).Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), res)
+	})
+	suite.Run("Missing note", func() {
+		_, err := app.InspectNote(suite.ctx, int(uncachedNote.ID)+100)
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestVerifyCache() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Verified", Content: "This note will diverge in the cache"}
+	result := suite.db.Save(&note)
+	suite.NoError(result.Error)
+	_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	consistent, err := repo.VerifyCache(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.True(consistent)
+
+	// write a divergent cache entry
+	idKey := fmt.Sprintf("notes:id:%d", note.ID)
+	suite.NoError(suite.rdClient.HSet(suite.ctx, idKey, "content", "Diverged content").Err())
+	consistent, err = repo.VerifyCache(suite.ctx, int(note.ID), WithRepair())
+	suite.NoError(err)
+	suite.False(consistent)
+
+	// the cache entries were deleted
+	exists, err := suite.rdClient.Exists(suite.ctx, idKey, "notes:title:Verified").Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), exists)
+	consistent, err = repo.VerifyCache(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.True(consistent)
+
+	_, err = repo.VerifyCache(suite.ctx, int(note.ID)+100)
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func (suite *NoteRepoTestSuite) TestGetNoteErrors() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	app := NewApplication(repo)
+
+	suite.Run("Missing note returns not found", func() {
+		note, err := repo.GetNoteById(suite.ctx, 1000)
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Nil(note)
+		note, err = repo.GetNoteByTitle(suite.ctx, "Missing")
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Nil(note)
+		_, err = app.GetNoteById(suite.ctx, 1000)
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+	suite.Run("Malformed cache entry is discarded instead of panicking", func() {
+		suite.T().Cleanup(func() {
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		// cache a malformed note
+		suite.rdClient.HSet(suite.ctx, "notes:id:5", "id", "not-a-number")
+		suite.rdClient.HSet(suite.ctx, "notes:title:Malformed", "id", "not-a-number")
+
+		// the entries are treated as misses and the notes aren't in postgres
+		note, err := repo.GetNoteById(suite.ctx, 5)
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Nil(note)
+		note, err = repo.GetNoteByTitle(suite.ctx, "Malformed")
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Nil(note)
+		exists, err := suite.rdClient.Exists(suite.ctx, "notes:id:5", "notes:title:Malformed").Result()
+		suite.NoError(err)
+		suite.Zero(exists)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestSaveRenamedNote() {
+	// insert a note in the database and cache it by reading it
+	note := Note{Title: "Old title", Content: "This note will be renamed"}
+	result := suite.db.Save(&note)
+	suite.NoError(result.Error)
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	cachedNote, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+
+	// ensure the note is cached under its old title
+	res, err := suite.rdClient.Exists(suite.ctx, "notes:title:Old title").Result()
+	suite.NoError(err)
+	suite.Equal(int64(1), res)
+
+	// rename the note
+	cachedNote.Title = "New title"
+	err = repo.SaveNote(suite.ctx, cachedNote)
+	suite.NoError(err)
+
+	// ensure the old title key no longer exists in redis
+	res, err = suite.rdClient.Exists(suite.ctx, "notes:title:Old title", fmt.Sprintf("notes:id:%d", note.ID)).Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), res)
+
+	// ensure the note can no longer be found by its old title
+	_, err = repo.GetNoteByTitle(suite.ctx, "Old title")
+	suite.ErrorIs(err, NoteNotFoundError)
+	renamedNote, err := repo.GetNoteByTitle(suite.ctx, "New title")
+	suite.NoError(err)
+	suite.Equal(note.ID, renamedNote.ID)
+}
+
+func (suite *NoteRepoTestSuite) TestDeleteNoteCachedOnlyByTitle() {
+	// insert a note in the database
+	note := Note{Title: "Cached by title", Content: "This note is only cached under its title"}
+	result := suite.db.Save(&note)
+	suite.NoError(result.Error)
+
+	idKey := fmt.Sprintf("notes:id:%d", note.ID)
+	titleKey := fmt.Sprintf("notes:title:%s", note.Title)
+
+	// cache the note under its title only
+	suite.rdClient.HSet(suite.ctx, titleKey, "id", note.ID)
+	suite.rdClient.HSet(suite.ctx, titleKey, "title", note.Title)
+	suite.rdClient.HSet(suite.ctx, titleKey, "content", note.Content)
+	suite.rdClient.HSet(suite.ctx, titleKey, "created_at", note.CreatedAt)
+	suite.rdClient.HSet(suite.ctx, titleKey, "updated_at", note.UpdatedAt)
+
+	// delete the note
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	err := repo.DeleteNote(suite.ctx, int(note.ID))
+	suite.NoError(err)
+
+	// ensure both keys are gone
+	res, err := suite.rdClient.Exists(suite.ctx, idKey, titleKey).Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), res)
+
+	// ensure the deleted note is no longer served by its title
+	_, err = repo.GetNoteByTitle(suite.ctx, note.Title)
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func (suite *NoteRepoTestSuite) TestCacheTTL() {
+	suite.Run("Cached note expires after the TTL", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		// insert a note and cache it by reading it
+		note := Note{Title: "Expiring", Content: "This note will expire from the cache"}
+		result := suite.db.Save(&note)
+		suite.NoError(result.Error)
+		repo := NewNoteRepository(suite.db, suite.rdClient, WithCacheTTL(time.Second))
+		_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+
+		// ensure both keys are cached with the TTL
+		idKey := fmt.Sprintf("notes:id:%d", note.ID)
+		titleKey := fmt.Sprintf("notes:title:%s", note.Title)
+		for _, key := range []string{idKey, titleKey} {
+			ttl, err := suite.rdClient.TTL(suite.ctx, key).Result()
+			suite.NoError(err)
+			suite.Greater(ttl, time.Duration(0))
+			suite.LessOrEqual(ttl, time.Second)
+		}
+
+		// ensure both keys are gone once the TTL elapses
+		suite.Eventually(func() bool {
+			res, err := suite.rdClient.Exists(suite.ctx, idKey, titleKey).Result()
+			return err == nil && res == 0
+		}, 3*time.Second, 100*time.Millisecond)
+	})
+	suite.Run("Cached note never expires without a TTL", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		note := Note{Title: "Forever", Content: "This note never expires from the cache"}
+		result := suite.db.Save(&note)
+		suite.NoError(result.Error)
+		repo := NewNoteRepository(suite.db, suite.rdClient)
+		_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+
+		ttl, err := suite.rdClient.TTL(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID)).Result()
+		suite.NoError(err)
+		suite.Less(ttl, time.Duration(0))
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestCacheNoteRoundTrips() {
+	// use a dedicated client so only the round trips made by cacheNote are counted
+	counter := &roundTripCounter{}
+	rdClient := rd.NewClient(suite.rdClient.Options())
+	defer rdClient.Close()
+	rdClient.AddHook(counter)
+
+	// cache a note with a TTL
+	repo := NewNoteRepository(suite.db, rdClient, WithCacheTTL(time.Minute))
+	note := Note{
+		Model:   gorm.Model{ID: 7, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		Title:   "Round trips",
+		Content: "This note is cached in one round trip",
+	}
+	err := repo.cacheNote(suite.ctx, note)
+	suite.NoError(err)
+
+	// ensure both keys and their TTLs were written in a single round trip
+	// instead of one per field per key
+	suite.Equal(1, counter.roundTrips)
+
+	// ensure the cached fields still parse back to the note
+	for _, key := range []string{"notes:id:7", "notes:title:Round trips"} {
+		cachedNote, err := repo.getCachedNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.NotNil(cachedNote)
+		suite.Equal(note.ID, cachedNote.ID)
+		suite.Equal(note.Title, cachedNote.Title)
+		suite.Equal(note.Content, cachedNote.Content)
+		suite.True(note.CreatedAt.Truncate(time.Microsecond).Equal(cachedNote.CreatedAt))
+
+		ttl, err := suite.rdClient.TTL(suite.ctx, key).Result()
+		suite.NoError(err)
+		suite.Greater(ttl, time.Duration(0))
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestCountNotes() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	app := NewApplication(repo)
+
+	// ensure there are no notes to begin with
+	count, err := app.CountNotes(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(int64(0), count)
+
+	// insert five notes and delete one of them
+	ids := make([]int, 0)
+	for i := 0; i < 5; i++ {
+		note, err := app.CreateNote(suite.ctx, fmt.Sprintf("Note %d", i), "This is a test content")
+		suite.NoError(err)
+		ids = append(ids, int(note.ID))
+	}
+	err = app.DeleteNote(suite.ctx, ids[2])
+	suite.NoError(err)
+
+	// ensure the count only reflects the remaining notes
+	count, err = repo.CountNotes(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(int64(4), count)
+	count, err = app.CountNotes(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(int64(4), count)
+}
+
+func (suite *NoteRepoTestSuite) TestSearchNotes() {
+	// insert notes with known content
+	notes := []*Note{
+		{Title: "Groceries", Content: "Buy milk and eggs"},
+		{Title: "Chores", Content: "Take out the trash"},
+		{Title: "Milkshake recipe", Content: "Blend ice cream"},
+		{Title: "Discount", Content: "Save 100% on everything"},
+		{Title: "Snake case", Content: "use some_variable names"},
+		{Title: "Votes", Content: "One vote each"},
+	}
+	for _, note := range notes {
+		result := suite.db.Save(note)
+		suite.NoError(result.Error)
+	}
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	titles := func(notes []Note) []string {
+		result := make([]string, 0)
+		for _, note := range notes {
+			result = append(result, note.Title)
+		}
+		return result
+	}
+
+	suite.Run("Matches title and content ignoring case", func() {
+		found, err := repo.SearchNotes(suite.ctx, "MILK", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"Milkshake recipe", "Groceries"}, titles(found))
+	})
+	suite.Run("Respects the limit", func() {
+		found, err := repo.SearchNotes(suite.ctx, "milk", 1)
+		suite.NoError(err)
+		suite.Equal([]string{"Milkshake recipe"}, titles(found))
+	})
+	suite.Run("Matches wildcards literally", func() {
+		found, err := repo.SearchNotes(suite.ctx, "100%", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"Discount"}, titles(found))
+
+		found, err = repo.SearchNotes(suite.ctx, "%", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"Discount"}, titles(found))
+
+		found, err = repo.SearchNotes(suite.ctx, "e_v", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"Snake case"}, titles(found))
+	})
+	suite.Run("Returns nothing when there is no match", func() {
+		found, err := repo.SearchNotes(suite.ctx, "nothing matches this", 10)
+		suite.NoError(err)
+		suite.Empty(found)
+	})
+	suite.Run("Bypasses the cache", func() {
+		keys, err := suite.rdClient.Keys(suite.ctx, "*").Result()
+		suite.NoError(err)
+		suite.Empty(keys)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestCreateNoteConcurrently() {
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+
+	// create two notes with the same title at the same time
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := app.CreateNote(suite.ctx, "Racing", "Only one of these notes is created")
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	// ensure exactly one create succeeded and the other was a duplicate
+	succeeded := 0
+	duplicates := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if errors.Is(err, DuplicateNoteError) {
+			duplicates++
+		}
+	}
+	suite.Equal(1, succeeded)
+	suite.Equal(1, duplicates)
+
+	var count int64
+	result := suite.db.Model(&Note{}).Where("title = ?", "Racing").Count(&count)
+	suite.NoError(result.Error)
+	suite.Equal(int64(1), count)
+}
+
+func (suite *NoteRepoTestSuite) TestJSONCache() {
+	// save a note straight to the database
+	dbNote := Note{Title: "JSON", Content: "This note is cached as <b>JSON</b>"}
+	result := suite.db.Save(&dbNote)
+	suite.NoError(result.Error)
+
+	// get the note so it is cached as JSON with a TTL
+	repo := NewNoteRepository(suite.db, suite.rdClient, WithJSONCache(), WithCacheTTL(time.Minute))
+	_, err := repo.GetNoteById(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+
+	for _, key := range []string{fmt.Sprintf("notes:id:%d", dbNote.ID), "notes:title:JSON"} {
+		// ensure the note is stored under a single string key
+		keyType, err := suite.rdClient.Type(suite.ctx, key).Result()
+		suite.NoError(err)
+		suite.Equal("string", keyType)
+		ttl, err := suite.rdClient.TTL(suite.ctx, key).Result()
+		suite.NoError(err)
+		suite.Greater(ttl, time.Duration(0))
+
+		// ensure every field round trips
+		cachedNote, err := repo.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.NotNil(cachedNote)
+		suite.Equal(dbNote.ID, cachedNote.ID)
+		suite.Equal(dbNote.Title, cachedNote.Title)
+		suite.Equal(dbNote.Content, cachedNote.Content)
+		suite.Equal(dbNote.WordCount, cachedNote.WordCount)
+		suite.True(dbNote.CreatedAt.Equal(cachedNote.CreatedAt))
+		suite.True(dbNote.UpdatedAt.Equal(cachedNote.UpdatedAt))
+		suite.Equal("This note is cached as &lt;b&gt;JSON&lt;/b&gt;", cachedNote.HTML)
+	}
+
+	// ensure the note is served from the JSON cache
+	note, err := repo.GetNoteByTitle(suite.ctx, "JSON")
+	suite.NoError(err)
+	suite.Equal(dbNote.ID, note.ID)
+	rendered, err := repo.GetNoteByIdRendered(suite.ctx, int(dbNote.ID))
+	suite.NoError(err)
+	suite.Equal("This note is cached as &lt;b&gt;JSON&lt;/b&gt;", rendered)
+}
+
+func (suite *NoteRepoTestSuite) TestContextCancellation() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Cancellable", Content: "Stored before the context is cancelled"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+	suite.Run("Cancelled before the call", func() {
+		ctx, cancel := context.WithCancel(suite.ctx)
+		cancel()
+		start := time.Now()
+		loaded, err := repo.GetNoteById(ctx, int(note.ID))
+		suite.ErrorIs(err, context.Canceled)
+		suite.Nil(loaded)
+		err = repo.SaveNote(ctx, &Note{Title: "Never saved", Content: "Cancelled"})
+		suite.ErrorIs(err, context.Canceled)
+		suite.Less(time.Since(start), time.Second)
+
+		// nothing was cached or stored
+		exists, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID)).Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), exists)
+		_, err = repo.GetNoteByTitle(suite.ctx, "Never saved")
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+
+	suite.Run("Cancelled during a postgres query", func() {
+		// hold a lock on the notes table so the query blocks until cancelled
+		lockTx := suite.db.Begin()
+		suite.NoError(lockTx.Exec("LOCK TABLE notes IN ACCESS EXCLUSIVE MODE").Error)
+		defer lockTx.Rollback()
+		suite.rdClient.FlushAll(suite.ctx)
+
+		ctx, cancel := context.WithCancel(suite.ctx)
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		loaded, err := repo.GetNoteById(ctx, int(note.ID))
+		suite.ErrorIs(err, context.Canceled)
+		suite.Nil(loaded)
+		suite.Less(time.Since(start), 2*time.Second)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestCacheSchemaVersion() {
+	for _, tc := range []struct {
+		name string
+		v1   CacheCodec
+		v2   CacheCodec
+		// version will return the schema version cached under key
+		version func(key string) (string, error)
+	}{
+		{"Hash", NewHashCacheCodec(), hashCacheCodec{schemaVersion: 2}, func(key string) (string, error) {
+			return suite.rdClient.HGet(suite.ctx, key, schemaVersionField).Result()
+		}},
+		{"JSON", NewJSONCacheCodec(), jsonCacheCodec{schemaVersion: 2}, func(key string) (string, error) {
+			payload, err := suite.rdClient.Get(suite.ctx, key).Bytes()
+			if err != nil {
+				return "", err
+			}
+			var cached jsonNote
+			if err := json.Unmarshal(payload, &cached); err != nil {
+				return "", err
+			}
+			return strconv.Itoa(cached.SchemaVersion), nil
+		}},
+	} {
+		suite.Run(tc.name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			note := Note{Title: "Versioned", Content: "Cached by the previous deploy"}
+			suite.NoError(suite.db.Save(&note).Error)
+			idKey := fmt.Sprintf("notes:id:%d", note.ID)
+
+			// the previous deploy caches the note with version 1
+			v1Repo := NewNoteRepository(suite.db, suite.rdClient, WithCacheCodec(tc.v1))
+			_, err := v1Repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			version, err := tc.version(idKey)
+			suite.NoError(err)
+			suite.Equal("1", version)
+			// the note changes without the cache knowing, so a stale entry
+			// served by the new deploy would show the old content
+			suite.NoError(suite.db.Model(&note).Update("content", "Updated since").Error)
+			suite.NoError(suite.db.First(&note, note.ID).Error)
+
+			// the new deploy treats the entry as a miss and caches the note again
+			v2Repo := NewNoteRepository(suite.db, suite.rdClient, WithCacheCodec(tc.v2))
+			loaded, err := v2Repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Equal("Updated since", loaded.Content)
+			version, err = tc.version(idKey)
+			suite.NoError(err)
+			suite.Equal("2", version)
+			inspectResult, err := v2Repo.InspectNote(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.True(inspectResult.Matches)
+		})
+	}
+}
+
+// gobCacheCodec is a CacheCodec that caches each note as a gob encoded string
+type gobCacheCodec struct{}
+
+func (gobCacheCodec) Format() CacheFormat {
+	return CacheFormatString
+}
+
+func (gobCacheCodec) Encode(note CachedNote) (CacheValue, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(note); err != nil {
+		return CacheValue{}, err
+	}
+	return CacheValue{Payload: payload.Bytes()}, nil
+}
+
+func (gobCacheCodec) Decode(value CacheValue) (CachedNote, error) {
+	var note CachedNote
+	if err := gob.NewDecoder(bytes.NewReader(value.Payload)).Decode(&note); err != nil {
+		return CachedNote{}, fmt.Errorf("%w: %w", ErrCorruptCacheEntry, err)
+	}
+	return note, nil
+}
+
+func (suite *NoteRepoTestSuite) TestCacheCodecs() {
+	for _, tc := range []struct {
+		name    string
+		codec   CacheCodec
+		keyType string
+	}{
+		{"Hash", NewHashCacheCodec(), "hash"},
+		{"JSON", NewJSONCacheCodec(), "string"},
+		{"Custom", gobCacheCodec{}, "string"},
+	} {
+		suite.Run(tc.name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.db.Exec("DELETE FROM note_tags;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			repo := NewNoteRepository(suite.db, suite.rdClient, WithCacheCodec(tc.codec), WithMissingNoteTTL(time.Minute))
+
+			note := &Note{Title: "Codec", Content: "Cached <i>as is</i>", Tags: []string{"codec"}}
+			suite.NoError(repo.SaveNote(suite.ctx, note))
+			// the first read caches the note, the second is served from the cache
+			for i := 0; i < 2; i++ {
+				cached, err := repo.GetNoteById(suite.ctx, int(note.ID))
+				suite.NoError(err)
+				suite.Equal(note.Content, cached.Content)
+				suite.Equal([]string{"codec"}, cached.Tags)
+			}
+			keyType, err := suite.rdClient.Type(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID)).Result()
+			suite.NoError(err)
+			suite.Equal(tc.keyType, keyType)
+			inspectResult, err := repo.InspectNote(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.True(inspectResult.Matches)
+			rendered, err := repo.GetNoteByIdRendered(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Equal("Cached &lt;i&gt;as is&lt;/i&gt;", rendered)
+
+			// updating the note invalidates the cached note
+			note.Content = "Updated content"
+			suite.NoError(repo.SaveNote(suite.ctx, note))
+			byTitle, err := repo.GetNoteByTitle(suite.ctx, "Codec")
+			suite.NoError(err)
+			suite.Equal("Updated content", byTitle.Content)
+
+			// a missing note is cached as missing
+			for i := 0; i < 2; i++ {
+				_, err = repo.GetNoteById(suite.ctx, int(note.ID)+100)
+				suite.ErrorIs(err, NoteNotFoundError)
+			}
+			keyType, err = suite.rdClient.Type(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID+100)).Result()
+			suite.NoError(err)
+			suite.Equal(tc.keyType, keyType)
+		})
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestGetNoteByTitleSoftDeleted() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	suite.Run("Soft-deleted note is not found", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		// cache a note then soft-delete it and flush the cache
+		note := Note{Title: "Deleted", Content: "This note is soft-deleted"}
+		suite.NoError(suite.db.Save(&note).Error)
+		_, err := repo.GetNoteByTitle(suite.ctx, "Deleted")
+		suite.NoError(err)
+		suite.NoError(suite.db.Delete(&note).Error)
+		suite.NoError(suite.rdClient.FlushAll(suite.ctx).Err())
+
+		// ensure the deleted note is neither returned nor cached again
+		deletedNote, err := repo.GetNoteByTitle(suite.ctx, "Deleted")
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Nil(deletedNote)
+		exists, err := suite.rdClient.Exists(suite.ctx, "notes:title:Deleted").Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), exists)
+	})
+
+	suite.Run("Note deleted through the repository is not served from the cache", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		note := Note{Title: "Deleted", Content: "This note is deleted through the repository"}
+		suite.NoError(suite.db.Save(&note).Error)
+		_, err := repo.GetNoteByTitle(suite.ctx, "Deleted")
+		suite.NoError(err)
+		suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+
+		_, err = repo.GetNoteByTitle(suite.ctx, "Deleted")
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestRestoreNote() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	suite.Run("Restore deleted note", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		// save then delete a note
+		note := Note{Title: "Restored", Content: "This note is deleted then restored"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+		_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.ErrorIs(err, NoteNotFoundError)
+
+		// restore the note and ensure it is returned and cached
+		restoredNote, err := repo.RestoreNote(suite.ctx, int(note.ID))
+		suite.NoError(err)
+		suite.Equal(note.ID, restoredNote.ID)
+		suite.Equal("Restored", restoredNote.Title)
+		suite.False(restoredNote.DeletedAt.Valid)
+		cachedNote, err := repo.getNoteFromCache(suite.ctx, int(note.ID))
+		suite.NoError(err)
+		suite.NotNil(cachedNote)
+
+		// ensure the note can be read again and the restoration was audited
+		fetchedNote, err := repo.GetNoteByTitle(suite.ctx, "Restored")
+		suite.NoError(err)
+		suite.Equal(note.ID, fetchedNote.ID)
+		var entry AuditEntry
+		result := suite.db.Order("id DESC").First(&entry)
+		suite.NoError(result.Error)
+		suite.Equal(AuditActionRestored, entry.Action)
+		suite.Equal(note.ID, entry.NoteID)
+	})
+
+	suite.Run("Restore note that never existed", func() {
+		note, err := repo.RestoreNote(suite.ctx, 4242)
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Nil(note)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestSaveNoteConcurrentRead() {
+	// save a note straight to the database
+	note := Note{Title: "Concurrent", Content: "Old content"}
+	suite.NoError(suite.db.Save(&note).Error)
+
+	// open a dedicated gorm db sharing the suite's connection pool so the
+	// callback below doesn't affect the other tests
+	sqlDB, err := suite.db.DB()
+	suite.NoError(err)
+	db, err := gorm.Open(pg.New(pg.Config{Conn: sqlDB}), &gorm.Config{})
+	suite.NoError(err)
+	repo := NewNoteRepository(db, suite.rdClient)
+
+	// read the note while the update is in flight, which caches the old
+	// content since the transaction hasn't committed yet
+	var readDuringWrite *Note
+	err = db.Callback().Update().After("gorm:update").Register("test:concurrent_read", func(tx *gorm.DB) {
+		if readDuringWrite != nil {
+			return
+		}
+		readDuringWrite, err = repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+	})
+	suite.NoError(err)
+
+	// update the note
+	note.Content = "New content"
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.NotNil(readDuringWrite)
+	suite.Equal("Old content", readDuringWrite.Content)
+
+	// ensure the stale note was removed from the cache once the write committed
+	cachedNote, err := repo.getNoteFromCache(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+	fetchedNote, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal("New content", fetchedNote.Content)
+}
+
+func (suite *NoteRepoTestSuite) TestBatchGetNotesByIds() {
+	// save two notes and cache the first one
+	first := Note{Title: "First", Content: "The first note"}
+	second := Note{Title: "Second", Content: "The second note"}
+	suite.NoError(suite.db.Save(&first).Error)
+	suite.NoError(suite.db.Save(&second).Error)
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	_, err := repo.GetNoteById(suite.ctx, int(first.ID))
+	suite.NoError(err)
+
+	// use a dedicated client to count the round trips made to look up the cache
+	counter := &roundTripCounter{}
+	rdClient := rd.NewClient(suite.rdClient.Options())
+	defer rdClient.Close()
+	rdClient.AddHook(counter)
+	repo = NewNoteRepository(suite.db, rdClient)
+
+	missingID := int(second.ID) + 100
+	notes, err := repo.BatchGetNotesByIds(suite.ctx, []int{int(first.ID), int(second.ID), missingID})
+	suite.NoError(err)
+	suite.Len(notes, 2)
+	suite.Equal("First", notes[int(first.ID)].Title)
+	suite.Equal("Second", notes[int(second.ID)].Title)
+	suite.NotContains(notes, missingID)
+
+	// ensure the cache was looked up in one round trip and the miss was cached in another
+	suite.Equal(2, counter.roundTrips)
+	cachedNote, err := repo.getNoteFromCache(suite.ctx, int(second.ID))
+	suite.NoError(err)
+	suite.NotNil(cachedNote)
+}
+
+func (suite *NoteRepoTestSuite) TestNoteEvents() {
+	// subscribe to the default channel and wait for the subscription to be confirmed
+	pubsub := suite.rdClient.Subscribe(suite.ctx, DefaultEventChannel)
+	defer pubsub.Close()
+	_, err := pubsub.Receive(suite.ctx)
+	suite.NoError(err)
+
+	receiveEvent := func() NoteEvent {
+		ctx, cancel := context.WithTimeout(suite.ctx, 5*time.Second)
+		defer cancel()
+		message, err := pubsub.ReceiveMessage(ctx)
+		suite.NoError(err)
+		var event NoteEvent
+		suite.NoError(json.Unmarshal([]byte(message.Payload), &event))
+		return event
+	}
+
+	// create, update then delete a note
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Events", Content: "This note publishes events"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.Equal(NoteEvent{Type: AuditActionCreated, ID: note.ID, Title: "Events"}, receiveEvent())
+	note.Content = "This note published events"
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.Equal(NoteEvent{Type: AuditActionUpdated, ID: note.ID, Title: "Events"}, receiveEvent())
+	suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+	suite.Equal(NoteEvent{Type: AuditActionDeleted, ID: note.ID, Title: "Events"}, receiveEvent())
+
+	// ensure events can be published to another channel
+	otherPubsub := suite.rdClient.Subscribe(suite.ctx, "other:events")
+	defer otherPubsub.Close()
+	_, err = otherPubsub.Receive(suite.ctx)
+	suite.NoError(err)
+	repo = NewNoteRepository(suite.db, suite.rdClient, WithEventChannel("other:events"))
+	_, err = repo.RestoreNote(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	ctx, cancel := context.WithTimeout(suite.ctx, 5*time.Second)
+	defer cancel()
+	message, err := otherPubsub.ReceiveMessage(ctx)
+	suite.NoError(err)
+	suite.JSONEq(fmt.Sprintf(`{"type":"restored","id":%d,"title":"Events"}`, note.ID), message.Payload)
+}
+
+func (suite *NoteRepoTestSuite) TestVersionConflict() {
+	// save a note and load it twice
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Versioned", Content: "Version zero"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.Equal(0, note.Version)
+	var first, second Note
+	suite.NoError(suite.db.First(&first, note.ID).Error)
+	suite.NoError(suite.db.First(&second, note.ID).Error)
+
+	// the first save bumps the version
+	first.Content = "Version one"
+	suite.NoError(repo.SaveNote(suite.ctx, &first))
+	suite.Equal(1, first.Version)
+
+	// the second save was loaded at the old version and must not clobber the first
+	second.Content = "Also version one"
+	err := repo.SaveNote(suite.ctx, &second)
+	suite.ErrorIs(err, ErrVersionConflict)
+	var dbNote Note
+	suite.NoError(suite.db.First(&dbNote, note.ID).Error)
+	suite.Equal("Version one", dbNote.Content)
+	suite.Equal(1, dbNote.Version)
+
+	// the note read through the cache carries the current version so it can be saved
+	cachedNote, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal(1, cachedNote.Version)
+	cachedNote.Content = "Version two"
+	suite.NoError(repo.SaveNote(suite.ctx, cachedNote))
+	suite.Equal(2, cachedNote.Version)
+
+	// saving a note that no longer exists is not a conflict
+	suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+	err = repo.SaveNote(suite.ctx, cachedNote)
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func (suite *NoteRepoTestSuite) TestBulkCreateNotes() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	suite.Run("Bulk create notes", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		notes := make([]*Note, 0, 150)
+		for i := 0; i < 150; i++ {
+			notes = append(notes, &Note{Title: fmt.Sprintf("Bulk %d", i), Content: "A bulk created note"})
+		}
+		err := repo.BulkCreateNotes(suite.ctx, notes)
+		suite.NoError(err)
+
+		// ensure every note landed in postgres with its audit entry
+		var count int64
+		suite.NoError(suite.db.Model(&Note{}).Count(&count).Error)
+		suite.Equal(int64(150), count)
+		suite.NoError(suite.db.Model(&AuditEntry{}).Where("action = ?", AuditActionCreated).Count(&count).Error)
+		suite.Equal(int64(150), count)
+		for _, note := range notes {
+			suite.NotZero(note.ID)
+			suite.Equal(4, note.WordCount)
+		}
+
+		// ensure the notes were not cached
+		keys, err := suite.rdClient.Keys(suite.ctx, "notes:*").Result()
+		suite.NoError(err)
+		suite.Empty(keys)
+	})
+
+	suite.Run("Duplicate title rolls back the batch", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		existing := Note{Title: "Existing", Content: "This note already exists"}
+		suite.NoError(suite.db.Save(&existing).Error)
+
+		notes := []*Note{
+			{Title: "New", Content: "This note is new"},
+			{Title: "Existing", Content: "This note duplicates an existing title"},
+		}
+		err := repo.BulkCreateNotes(suite.ctx, notes)
+		suite.ErrorIs(err, DuplicateNoteError)
+		suite.ErrorContains(err, "Existing")
+
+		// ensure none of the notes were inserted
+		var count int64
+		suite.NoError(suite.db.Model(&Note{}).Count(&count).Error)
+		suite.Equal(int64(1), count)
+		suite.NoError(suite.db.Model(&AuditEntry{}).Count(&count).Error)
+		suite.Equal(int64(0), count)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestHealthCheck() {
+	suite.Run("Healthy backends", func() {
+		app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+		suite.NoError(app.HealthCheck(suite.ctx))
+	})
+
+	suite.Run("Postgres unreachable", func() {
+		// open a separate connection pool and close it
+		db, err := gorm.Open(pg.Open(suite.pgConnectionString), &gorm.Config{})
+		suite.NoError(err)
+		sqlDB, err := db.DB()
+		suite.NoError(err)
+		suite.NoError(sqlDB.Close())
+
+		app := NewApplication(NewNoteRepository(db, suite.rdClient))
+		err = app.HealthCheck(suite.ctx)
+		suite.Error(err)
+		suite.ErrorContains(err, "postgres")
+	})
+
+	suite.Run("Redis unreachable", func() {
+		rdClient := rd.NewClient(suite.rdClient.Options())
+		suite.NoError(rdClient.Close())
+
+		app := NewApplication(NewNoteRepository(suite.db, rdClient))
+		err := app.HealthCheck(suite.ctx)
+		suite.Error(err)
+		suite.ErrorContains(err, "redis")
+	})
+
+	suite.Run("Expired context", func() {
+		ctx, cancel := context.WithCancel(suite.ctx)
+		cancel()
+
+		app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+		err := app.HealthCheck(ctx)
+		suite.ErrorIs(err, context.Canceled)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestGetNotesByTitlePrefix() {
+	for _, title := range []string{"Recipes: soup", "Recipe", "Recipes: bread", "Reading list", "100% done", "100 things"} {
+		note := Note{Title: title, Content: "A note titled " + title}
+		suite.NoError(suite.db.Save(&note).Error)
+	}
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	titles := func(notes []Note) []string {
+		titles := make([]string, 0, len(notes))
+		for _, note := range notes {
+			titles = append(titles, note.Title)
+		}
+		return titles
+	}
+
+	suite.Run("Matching prefix", func() {
+		notes, err := repo.GetNotesByTitlePrefix(suite.ctx, "Recipe", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"Recipe", "Recipes: bread", "Recipes: soup"}, titles(notes))
+	})
+
+	suite.Run("Limit", func() {
+		notes, err := repo.GetNotesByTitlePrefix(suite.ctx, "Recipes", 1)
+		suite.NoError(err)
+		suite.Equal([]string{"Recipes: bread"}, titles(notes))
+	})
+
+	suite.Run("Metacharacters are matched literally", func() {
+		notes, err := repo.GetNotesByTitlePrefix(suite.ctx, "100%", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"100% done"}, titles(notes))
+		notes, err = repo.GetNotesByTitlePrefix(suite.ctx, "Re_", 10)
+		suite.NoError(err)
+		suite.Empty(notes)
+	})
+
+	suite.Run("Empty prefix", func() {
+		notes, err := repo.GetNotesByTitlePrefix(suite.ctx, "", 2)
+		suite.NoError(err)
+		suite.Len(notes, 2)
+	})
+
+	suite.Run("No match", func() {
+		notes, err := repo.GetNotesByTitlePrefix(suite.ctx, "recipe", 10)
+		suite.NoError(err)
+		suite.Empty(notes)
+	})
+
+	suite.Run("Case insensitive titles", func() {
+		// the notes were saved without normalized titles
+		suite.NoError(BackfillNormalizedTitles(suite.db))
+		repo := NewNoteRepository(suite.db, suite.rdClient, WithCaseInsensitiveTitles())
+		notes, err := repo.GetNotesByTitlePrefix(suite.ctx, "recipe", 10)
+		suite.NoError(err)
+		suite.Equal([]string{"Recipe", "Recipes: bread", "Recipes: soup"}, titles(notes))
+		note, err := repo.GetNoteByTitle(suite.ctx, "reading LIST")
+		suite.NoError(err)
+		suite.Equal("Reading list", note.Title)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestCacheKeyNamespaces() {
+	// save five notes so the last one has the id 5, then a sixth note titled "5"
+	var fifth Note
+	for i := 1; i <= 5; i++ {
+		fifth = Note{Title: fmt.Sprintf("Note %d", i), Content: "Filler note"}
+		suite.NoError(suite.db.Save(&fifth).Error)
+	}
+	suite.Equal(uint(5), fifth.ID)
+	titledFive := Note{Title: "5", Content: "This note is titled 5"}
+	suite.NoError(suite.db.Save(&titledFive).Error)
+
+	// cache both notes
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	_, err := repo.GetNoteById(suite.ctx, 5)
+	suite.NoError(err)
+	_, err = repo.GetNoteByTitle(suite.ctx, "5")
+	suite.NoError(err)
+
+	// ensure each lookup is served the right note from the cache
+	note, err := repo.GetNoteById(suite.ctx, 5)
+	suite.NoError(err)
+	suite.Equal("Note 5", note.Title)
+	note, err = repo.GetNoteByTitle(suite.ctx, "5")
+	suite.NoError(err)
+	suite.Equal(titledFive.ID, note.ID)
+	exists, err := suite.rdClient.Exists(suite.ctx, "notes:id:5", "notes:title:5").Result()
+	suite.NoError(err)
+	suite.Equal(int64(2), exists)
+
+	// ensure a different prefix keeps the notes apart
+	otherRepo := NewNoteRepository(suite.db, suite.rdClient, WithKeyPrefix("other"))
+	_, err = otherRepo.GetNoteById(suite.ctx, 5)
+	suite.NoError(err)
+	exists, err = suite.rdClient.Exists(suite.ctx, "other:id:5", "other:title:Note 5").Result()
+	suite.NoError(err)
+	suite.Equal(int64(2), exists)
+	suite.NoError(repo.DeleteNote(suite.ctx, 5))
+	exists, err = suite.rdClient.Exists(suite.ctx, "other:id:5").Result()
+	suite.NoError(err)
+	suite.Equal(int64(1), exists)
+}
+
+func (suite *NoteRepoTestSuite) TestGetNoteByIdStampede() {
+	note := Note{Title: "Popular", Content: "Everyone reads this note at once"}
+	suite.NoError(suite.db.Save(&note).Error)
+
+	// open a dedicated gorm db sharing the suite's connection pool so the
+	// query counting callback doesn't affect the other tests
+	sqlDB, err := suite.db.DB()
+	suite.NoError(err)
+	db, err := gorm.Open(pg.New(pg.Config{Conn: sqlDB}), &gorm.Config{})
+	suite.NoError(err)
+	var queries atomic.Int32
+	err = db.Callback().Query().After("gorm:query").Register("test:count_queries", func(tx *gorm.DB) {
+		queries.Add(1)
+	})
+	suite.NoError(err)
+	repo := NewNoteRepository(db, suite.rdClient)
+
+	// read the uncached note concurrently
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetchedNote, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			if err == nil && fetchedNote.Title != "Popular" {
+				err = fmt.Errorf("unexpected note %q", fetchedNote.Title)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		suite.NoError(err)
+	}
+
+	// ensure postgres was queried far fewer times than there were reads
+	suite.Less(queries.Load(), int32(5))
+	exists, err := suite.rdClient.Exists(suite.ctx, repo.lockKey(note.ID)).Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), exists)
+
+	suite.Run("Missing note does not keep readers waiting", func() {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := repo.GetNoteById(suite.ctx, int(note.ID)+100)
+				suite.ErrorIs(err, NoteNotFoundError)
+			}()
+		}
+		wg.Wait()
+		suite.Less(time.Since(start), loadLockWait)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestGetOrCreateNote() {
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+
+	suite.Run("Creates missing note", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		note, created, err := app.GetOrCreateNote(suite.ctx, "New note", "Brand new content")
+		suite.NoError(err)
+		suite.True(created)
+		suite.NotZero(note.ID)
+		suite.Equal("Brand new content", note.Content)
+
+		var count int64
+		suite.NoError(suite.db.Model(&AuditEntry{}).Where("note_id = ? AND action = ?", note.ID, AuditActionCreated).Count(&count).Error)
+		suite.Equal(int64(1), count)
+	})
+
+	suite.Run("Returns existing note", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		existing := Note{Title: "Existing", Content: "Existing content"}
+		suite.NoError(suite.db.Save(&existing).Error)
+
+		note, created, err := app.GetOrCreateNote(suite.ctx, "Existing", "Ignored content")
+		suite.NoError(err)
+		suite.False(created)
+		suite.Equal(existing.ID, note.ID)
+		suite.Equal("Existing content", note.Content)
+
+		// ensure nothing was written
+		var count int64
+		suite.NoError(suite.db.Model(&Note{}).Count(&count).Error)
+		suite.Equal(int64(1), count)
+		suite.NoError(suite.db.Model(&AuditEntry{}).Count(&count).Error)
+		suite.Equal(int64(0), count)
+	})
+
+	suite.Run("Concurrent calls create once", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		const callers = 10
+		var wg sync.WaitGroup
+		var creates atomic.Int32
+		ids := make([]uint, callers)
+		errs := make([]error, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				note, created, err := app.GetOrCreateNote(suite.ctx, "Raced", "Raced content")
+				if created {
+					creates.Add(1)
+				}
+				ids[i], errs[i] = note.ID, err
+			}(i)
+		}
+		wg.Wait()
+
+		suite.Equal(int32(1), creates.Load())
+		for i := 0; i < callers; i++ {
+			suite.NoError(errs[i])
+			suite.Equal(ids[0], ids[i])
+		}
+		var count int64
+		suite.NoError(suite.db.Model(&Note{}).Count(&count).Error)
+		suite.Equal(int64(1), count)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestNoteTags() {
+	for _, tc := range []struct {
+		name string
+		opts []NoteRepositoryOption
+	}{
+		{"Hash cache", nil},
+		{"JSON cache", []NoteRepositoryOption{WithJSONCache()}},
+	} {
+		suite.Run(tc.name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.db.Exec("DELETE FROM note_tags;")
+				suite.db.Exec("DELETE FROM audit_entries;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			repo := NewNoteRepository(suite.db, suite.rdClient, tc.opts...)
+
+			recipe := &Note{Title: "Recipe", Content: "Jollof rice", Tags: []string{"food", " home ", "food", ""}}
+			shopping := &Note{Title: "Shopping", Content: "Rice and tomatoes", Tags: []string{"home", "errands"}}
+			meeting := &Note{Title: "Meeting", Content: "Quarterly planning", Tags: []string{"work"}}
+			for _, note := range []*Note{recipe, shopping, meeting} {
+				suite.NoError(repo.SaveNote(suite.ctx, note))
+			}
+			// ensure the tags were trimmed, deduplicated and sorted
+			suite.Equal([]string{"food", "home"}, recipe.Tags)
+
+			notes, err := repo.FindNotesByTag(suite.ctx, "home")
+			suite.NoError(err)
+			suite.Len(notes, 2)
+			suite.Equal(recipe.ID, notes[0].ID)
+			suite.Equal([]string{"food", "home"}, notes[0].Tags)
+			suite.Equal(shopping.ID, notes[1].ID)
+			suite.Equal([]string{"errands", "home"}, notes[1].Tags)
+
+			notes, err = repo.FindNotesByTag(suite.ctx, "missing")
+			suite.NoError(err)
+			suite.Empty(notes)
+
+			// load the note twice so the second read is served from the cache
+			for i := 0; i < 2; i++ {
+				note, err := repo.GetNoteById(suite.ctx, int(recipe.ID))
+				suite.NoError(err)
+				suite.Equal([]string{"food", "home"}, note.Tags)
+			}
+			note, err := repo.GetNoteByTitle(suite.ctx, "Recipe")
+			suite.NoError(err)
+			suite.Equal([]string{"food", "home"}, note.Tags)
+
+			// changing the tags clears the cached note
+			note.Tags = []string{"food"}
+			suite.NoError(repo.SaveNote(suite.ctx, note))
+			exists, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", recipe.ID), "notes:title:Recipe").Result()
+			suite.NoError(err)
+			suite.Equal(int64(0), exists)
+			note, err = repo.GetNoteById(suite.ctx, int(recipe.ID))
+			suite.NoError(err)
+			suite.Equal([]string{"food"}, note.Tags)
+			notes, err = repo.FindNotesByTag(suite.ctx, "home")
+			suite.NoError(err)
+			suite.Len(notes, 1)
+			suite.Equal(shopping.ID, notes[0].ID)
+
+			inspectResult, err := repo.InspectNote(suite.ctx, int(recipe.ID))
+			suite.NoError(err)
+			suite.True(inspectResult.Matches)
+		})
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestCountNotesByTag() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	counts, err := repo.CountNotesByTag(suite.ctx)
+	suite.NoError(err)
+	suite.Empty(counts)
+
+	notes := []*Note{
+		{Title: "Recipe", Content: "Jollof rice", Tags: []string{"food", "home"}},
+		{Title: "Shopping", Content: "Rice and tomatoes", Tags: []string{"home", "errands", "food"}},
+		{Title: "Meeting", Content: "Quarterly planning", Tags: []string{"work"}},
+		{Title: "Chores", Content: "Laundry", Tags: []string{"home"}},
+		{Title: "Untagged", Content: "No tags"},
+	}
+	for _, note := range notes {
+		suite.NoError(repo.SaveNote(suite.ctx, note))
+	}
+	counts, err = repo.CountNotesByTag(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(map[string]int64{"food": 2, "home": 3, "errands": 1, "work": 1}, counts)
+
+	// deleted notes aren't counted and a tag left on no note is dropped
+	suite.NoError(repo.DeleteNote(suite.ctx, int(notes[2].ID)))
+	suite.NoError(repo.DeleteNote(suite.ctx, int(notes[3].ID)))
+	counts, err = repo.CountNotesByTag(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(map[string]int64{"food": 2, "home": 2, "errands": 1}, counts)
+}
+
+func (suite *NoteRepoTestSuite) TestCorruptCacheEntry() {
+	for _, tc := range []struct {
+		name    string
+		opts    []NoteRepositoryOption
+		corrupt func(key string) error
+	}{
+		{"Partially written hash", nil, func(key string) error {
+			return suite.rdClient.HSet(suite.ctx, key, "html", "Partial").Err()
+		}},
+		{"Malformed hash field", nil, func(key string) error {
+			return suite.rdClient.HSet(suite.ctx, key, "id", "abc", "title", "Corrupt", "content", "Corrupt",
+				"created_at", "yesterday", "updated_at", "today").Err()
+		}},
+		{"Malformed JSON", []NoteRepositoryOption{WithJSONCache()}, func(key string) error {
+			return suite.rdClient.Set(suite.ctx, key, "{", 0).Err()
+		}},
+	} {
+		suite.Run(tc.name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.db.Exec("DELETE FROM audit_entries;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			repo := NewNoteRepository(suite.db, suite.rdClient, tc.opts...)
+			note := Note{Title: "Corrupt", Content: "Cached content"}
+			suite.NoError(suite.db.Save(&note).Error)
+			idKey := fmt.Sprintf("notes:id:%d", note.ID)
+			suite.NoError(tc.corrupt(idKey))
+			suite.NoError(tc.corrupt("notes:title:Corrupt"))
+
+			// the corrupt entries are read as misses and the note is reloaded and cached again
+			fetched, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Equal(note.ID, fetched.ID)
+			fetched, err = repo.GetNoteByTitle(suite.ctx, "Corrupt")
+			suite.NoError(err)
+			suite.Equal(note.ID, fetched.ID)
+			inspectResult, err := repo.InspectNote(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.True(inspectResult.Matches)
+
+			suite.NoError(suite.rdClient.Del(suite.ctx, idKey).Err())
+			suite.NoError(tc.corrupt(idKey))
+			notes, err := repo.BatchGetNotesByIds(suite.ctx, []int{int(note.ID)})
+			suite.NoError(err)
+			suite.Equal("Cached content", notes[int(note.ID)].Content)
+		})
+	}
+}
+
+// countingClient is a redis.UniversalClient that counts the hashes read
+// through it
+type countingClient struct {
+	rd.UniversalClient
+	hashReads atomic.Int32
+}
+
+func (client *countingClient) HGetAll(ctx context.Context, key string) *rd.MapStringStringCmd {
+	client.hashReads.Add(1)
+	return client.UniversalClient.HGetAll(ctx, key)
+}
+
+func (suite *NoteRepoTestSuite) TestUniversalClient() {
+	suite.Run("Client from universal options", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+		repo := NewNoteRepositoryWithRedisOptions(suite.db, &rd.UniversalOptions{
+			Addrs: []string{suite.rdClient.Options().Addr},
+		})
+		suite.T().Cleanup(func() {
+			repo.redis.Close()
+		})
+
+		note := Note{Title: "Universal", Content: "Cached through a universal client"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+		exists, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID)).Result()
+		suite.NoError(err)
+		suite.Equal(int64(1), exists)
+	})
+
+	suite.Run("Cache timeout bounds a hung redis", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+		repo := NewNoteRepositoryWithRedisOptions(suite.db, &rd.UniversalOptions{
+			Addrs: []string{suite.rdClient.Options().Addr},
+		}, WithCacheTimeout(50*time.Millisecond))
+		suite.T().Cleanup(func() {
+			repo.redis.Close()
+		})
+		note := Note{Title: "Hung", Content: "Read while redis hangs"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+		// redis holds every command sent while it is paused
+		pause := time.Second
+		paused := time.Now()
+		suite.NoError(suite.rdClient.Do(suite.ctx, "CLIENT", "PAUSE", pause.Milliseconds()).Err())
+		suite.T().Cleanup(func() {
+			time.Sleep(time.Until(paused.Add(pause)))
+		})
+
+		start := time.Now()
+		read, err := repo.GetNoteById(suite.ctx, int(note.ID))
+		suite.NoError(err)
+		suite.Equal(note.Content, read.Content)
+		suite.Less(time.Since(start), pause/2)
+	})
+
+	suite.Run("Wrapped client", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+		client := &countingClient{UniversalClient: suite.rdClient}
+		repo := NewNoteRepository(suite.db, client)
+
+		note := Note{Title: "Wrapped", Content: "Cached through a wrapped client"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		for i := 0; i < 2; i++ {
+			fetched, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Equal("Wrapped", fetched.Title)
+		}
+		// ensure the cache reads went through the wrapped client
+		suite.Positive(client.hashReads.Load())
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestExportNotes() {
+	suite.T().Cleanup(func() {
+		suite.db.Exec("DELETE FROM notes;")
+		suite.db.Exec("DELETE FROM note_tags;")
+		suite.db.Exec("DELETE FROM audit_entries;")
+		suite.rdClient.FlushAll(suite.ctx)
+	})
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	app := NewApplication(repo)
+
+	// export more notes than fit in a page
+	notes := make([]*Note, 0, 150)
+	for i := 0; i < 150; i++ {
+		note := &Note{Title: fmt.Sprintf("Export %d", i), Content: fmt.Sprintf("Exported note number %d", i)}
+		if i%2 == 0 {
+			note.Tags = []string{"even"}
+		}
+		notes = append(notes, note)
+	}
+	suite.NoError(repo.BulkCreateNotes(suite.ctx, notes))
+	suite.NoError(repo.DeleteNote(suite.ctx, int(notes[10].ID)))
+
+	var buffer bytes.Buffer
+	suite.NoError(app.ExportNotes(suite.ctx, &buffer))
+
+	expected := make([]*Note, 0, len(notes)-1)
+	for i, note := range notes {
+		if i != 10 {
+			expected = append(expected, note)
+		}
+	}
+	scanner := bufio.NewScanner(&buffer)
+	lines := 0
+	for scanner.Scan() {
+		suite.Require().Less(lines, len(expected))
+		var exported Note
+		suite.NoError(json.Unmarshal(scanner.Bytes(), &exported))
+		want := expected[lines]
+		suite.Equal(want.ID, exported.ID)
+		suite.Equal(want.Title, exported.Title)
+		suite.Equal(want.Content, exported.Content)
+		suite.Equal(want.WordCount, exported.WordCount)
+		suite.Equal(want.Tags, exported.Tags)
+		suite.True(want.CreatedAt.Truncate(time.Microsecond).Equal(exported.CreatedAt))
+		lines++
+	}
+	suite.NoError(scanner.Err())
+	suite.Equal(len(expected), lines)
+}
+
+func (suite *NoteRepoTestSuite) TestImportNotes() {
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+	countNotes := func() int64 {
+		var count int64
+		suite.NoError(suite.db.Unscoped().Model(&Note{}).Count(&count).Error)
+		return count
+	}
+
+	suite.Run("Clean import", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM note_tags;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		// more notes than fit in a batch, with a blank line in between
+		var lines []string
+		for i := 0; i < 120; i++ {
+			lines = append(lines, fmt.Sprintf(`{"ID": 999, "Title": "Imported %d", "Content": "Imported content", "Tags": ["imported"]}`, i))
+		}
+		lines = append(lines[:60], append([]string{""}, lines[60:]...)...)
+		imported, err := app.ImportNotes(suite.ctx, strings.NewReader(strings.Join(lines, "\n")))
+		suite.NoError(err)
+		suite.Equal(120, imported)
+		suite.Equal(int64(120), countNotes())
+
+		// ensure the notes got new ids, their word counts, tags and audit entries
+		note, err := app.GetNoteByTitle(suite.ctx, "Imported 119")
+		suite.NoError(err)
+		suite.NotEqual(uint(999), note.ID)
+		suite.Equal(2, note.WordCount)
+		suite.Equal([]string{"imported"}, note.Tags)
+		var count int64
+		suite.NoError(suite.db.Model(&AuditEntry{}).Where("action = ?", AuditActionCreated).Count(&count).Error)
+		suite.Equal(int64(120), count)
+	})
+
+	suite.Run("Import an export", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM note_tags;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		for _, title := range []string{"First", "Second"} {
+			_, err := app.CreateNote(suite.ctx, title, "Exported content")
+			suite.NoError(err)
+		}
+		var buffer bytes.Buffer
+		suite.NoError(app.ExportNotes(suite.ctx, &buffer))
+		suite.db.Exec("DELETE FROM notes;")
+
+		imported, err := app.ImportNotes(suite.ctx, &buffer)
+		suite.NoError(err)
+		suite.Equal(2, imported)
+		_, err = app.GetNoteByTitle(suite.ctx, "Second")
+		suite.NoError(err)
+	})
+
+	suite.Run("Duplicate title", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM note_tags;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		_, err := app.CreateNote(suite.ctx, "Existing", "Existing content")
+		suite.NoError(err)
+		input := strings.Join([]string{
+			`{"Title": "New", "Content": "New content"}`,
+			`{"Title": "Existing", "Content": "Duplicate content"}`,
+			`{"Title": "Repeated", "Content": "Repeated content"}`,
+			`{"Title": "Repeated", "Content": "Repeated again"}`,
+			`{"AuthorID": 7, "Title": "Existing", "Content": "Another author's content"}`,
+		}, "\n")
+
+		// duplicates fail the whole import by default
+		imported, err := app.ImportNotes(suite.ctx, strings.NewReader(input))
+		suite.ErrorIs(err, DuplicateNoteError)
+		suite.ErrorContains(err, "Existing")
+		suite.Equal(0, imported)
+		suite.Equal(int64(1), countNotes())
+
+		// and are skipped when asked to, titles of another author aren't duplicates
+		imported, err = app.ImportNotes(suite.ctx, strings.NewReader(input), SkipDuplicateTitles())
+		suite.NoError(err)
+		suite.Equal(3, imported)
+		suite.Equal(int64(4), countNotes())
+		note, err := app.GetNoteByTitle(suite.ctx, "Repeated")
+		suite.NoError(err)
+		suite.Equal("Repeated content", note.Content)
+		note, err = app.GetNoteByTitle(suite.ctx, "Existing", ForAuthor(7))
+		suite.NoError(err)
+		suite.Equal("Another author's content", note.Content)
+	})
+
+	suite.Run("Malformed line", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM note_tags;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		input := strings.Join([]string{
+			`{"Title": "Valid", "Content": "Valid content"}`,
+			`{"Title": "Broken", "Content": `,
+		}, "\n")
+		imported, err := app.ImportNotes(suite.ctx, strings.NewReader(input))
+		suite.ErrorIs(err, ErrInvalidImport)
+		suite.ErrorContains(err, "line 2")
+		suite.Equal(0, imported)
+		suite.Equal(int64(0), countNotes())
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestRenameNote() {
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+
+	suite.Run("Rename note", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		created, err := app.CreateNote(suite.ctx, "Old title", "Renamed content")
+		suite.NoError(err)
+		// cache the note under its old title
+		_, err = app.GetNoteByTitle(suite.ctx, "Old title")
+		suite.NoError(err)
+
+		renamed, err := app.RenameNote(suite.ctx, int(created.ID), " New title ")
+		suite.NoError(err)
+		suite.Equal("New title", renamed.Title)
+		suite.Equal("Renamed content", renamed.Content)
+
+		// ensure the old title is neither cached nor found
+		exists, err := suite.rdClient.Exists(suite.ctx, "notes:title:Old title").Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), exists)
+		_, err = app.GetNoteByTitle(suite.ctx, "Old title")
+		suite.ErrorIs(err, NoteNotFoundError)
+		fetched, err := app.GetNoteByTitle(suite.ctx, "New title")
+		suite.NoError(err)
+		suite.Equal(created.ID, fetched.ID)
+		fetched, err = app.GetNoteById(suite.ctx, int(created.ID))
+		suite.NoError(err)
+		suite.Equal("New title", fetched.Title)
+	})
+
+	suite.Run("Rename to an existing title", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+
+		_, err := app.CreateNote(suite.ctx, "Taken", "Taken content")
+		suite.NoError(err)
+		created, err := app.CreateNote(suite.ctx, "Mine", "My content")
+		suite.NoError(err)
+
+		_, err = app.RenameNote(suite.ctx, int(created.ID), "Taken")
+		suite.ErrorIs(err, DuplicateNoteError)
+		fetched, err := app.GetNoteById(suite.ctx, int(created.ID))
+		suite.NoError(err)
+		suite.Equal("Mine", fetched.Title)
+	})
+
+	suite.Run("Rename missing note", func() {
+		_, err := app.RenameNote(suite.ctx, 12345, "Anything")
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+
+	suite.Run("Rename to an invalid title", func() {
+		_, err := app.RenameNote(suite.ctx, 1, "   ")
+		suite.ErrorIs(err, ErrEmptyTitle)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestWarmCache() {
+	for _, tc := range []struct {
+		name string
+		opts []NoteRepositoryOption
+	}{
+		{"Hash cache", nil},
+		{"JSON cache", []NoteRepositoryOption{WithJSONCache()}},
+	} {
+		suite.Run(tc.name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.db.Exec("DELETE FROM audit_entries;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			repo := NewNoteRepository(suite.db, suite.rdClient, append(tc.opts, WithCacheTTL(time.Hour))...)
+			app := NewApplication(repo)
+
+			ids := make([]int, 0)
+			keys := make([]string, 0)
+			for i := 0; i < 3; i++ {
+				note := Note{Title: fmt.Sprintf("Warm %d", i), Content: "A note to warm"}
+				suite.NoError(suite.db.Save(&note).Error)
+				ids = append(ids, int(note.ID))
+				keys = append(keys, fmt.Sprintf("notes:id:%d", note.ID), "notes:title:"+note.Title)
+			}
+
+			// warm the notes along with an id that doesn't exist
+			suite.NoError(app.WarmCache(suite.ctx, append(ids, 12345)))
+
+			exists, err := suite.rdClient.Exists(suite.ctx, keys...).Result()
+			suite.NoError(err)
+			suite.Equal(int64(len(keys)), exists)
+			exists, err = suite.rdClient.Exists(suite.ctx, "notes:id:12345").Result()
+			suite.NoError(err)
+			suite.Equal(int64(0), exists)
+			ttl, err := suite.rdClient.TTL(suite.ctx, keys[0]).Result()
+			suite.NoError(err)
+			suite.Greater(ttl, time.Duration(0))
+
+			// ensure the warmed notes match postgres
+			for _, id := range ids {
+				inspectResult, err := repo.InspectNote(suite.ctx, id)
+				suite.NoError(err)
+				suite.True(inspectResult.Matches)
+			}
+		})
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestDBNoteRepository() {
+	repo := NewDBNoteRepository(suite.db)
+
+	note := Note{Title: "Uncached", Content: "Stored in postgres only", Tags: []string{"db"}}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.NotZero(note.ID)
+	suite.Equal(3, note.WordCount)
+
+	dbNote, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal("Stored in postgres only", dbNote.Content)
+	suite.Equal([]string{"db"}, dbNote.Tags)
+	dbNote, err = repo.GetNoteByTitle(suite.ctx, "Uncached")
+	suite.NoError(err)
+	suite.Equal(note.ID, dbNote.ID)
+
+	duplicate := Note{Title: "Uncached", Content: "Other content"}
+	suite.ErrorIs(repo.SaveNote(suite.ctx, &duplicate), DuplicateNoteError)
+
+	suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+	_, err = repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.ErrorIs(err, NoteNotFoundError)
+	_, err = repo.GetNoteByTitle(suite.ctx, "Uncached")
+	suite.ErrorIs(err, NoteNotFoundError)
+
+	// ensure nothing was written to redis
+	keys, err := suite.rdClient.DBSize(suite.ctx).Result()
+	suite.NoError(err)
+	suite.Zero(keys)
+}
+
+func (suite *NoteRepoTestSuite) TestCaseInsensitiveTitles() {
+	repo := NewNoteRepository(suite.db, suite.rdClient, WithCaseInsensitiveTitles())
+	app := NewApplication(repo)
+
+	created, err := app.CreateNote(suite.ctx, "Foo", "My content")
+	suite.NoError(err)
+
+	// the note is found regardless of case and keeps its display title
+	note, err := app.GetNoteByTitle(suite.ctx, "foo")
+	suite.NoError(err)
+	suite.Equal(created.ID, note.ID)
+	suite.Equal("Foo", note.Title)
+	exists, err := suite.rdClient.Exists(suite.ctx, "notes:title:foo").Result()
+	suite.NoError(err)
+	suite.Equal(int64(1), exists)
+	note, err = app.GetNoteByTitle(suite.ctx, "FOO")
+	suite.NoError(err)
+	suite.Equal(created.ID, note.ID)
+
+	// the normalized title is stored alongside the display title
+	var dbNote Note
+	suite.NoError(suite.db.First(&dbNote, created.ID).Error)
+	suite.Equal("Foo", dbNote.Title)
+	suite.Equal("foo", *dbNote.NormalizedTitle)
+
+	_, err = app.CreateNote(suite.ctx, "FOO", "Other content")
+	suite.ErrorIs(err, DuplicateNoteError)
+
+	suite.Run("Case sensitive by default", func() {
+		suite.T().Cleanup(func() {
+			suite.db.Exec("DELETE FROM notes;")
+			suite.db.Exec("DELETE FROM audit_entries;")
+			suite.rdClient.FlushAll(suite.ctx)
+		})
+		app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+		_, err := app.CreateNote(suite.ctx, "Bar", "My content")
+		suite.NoError(err)
+		_, err = app.GetNoteByTitle(suite.ctx, "bar")
+		suite.ErrorIs(err, NoteNotFoundError)
+		_, err = app.CreateNote(suite.ctx, "BAR", "Other content")
+		suite.NoError(err)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestInvalidateNotes() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	titles := []string{"First", "Second", "Third", "Fourth"}
+	ids := make([]int, len(titles))
+	for i, title := range titles {
+		note := Note{Title: title, Content: "My content"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		ids[i] = int(note.ID)
+	}
+	_, err := repo.WarmCache(suite.ctx, ids)
+	suite.NoError(err)
+
+	// use a dedicated client to count the round trips made to invalidate the notes
+	counter := &roundTripCounter{}
+	rdClient := rd.NewClient(suite.rdClient.Options())
+	defer rdClient.Close()
+	rdClient.AddHook(counter)
+	repo = NewNoteRepository(suite.db, rdClient)
+
+	// the id of a note that was never cached is ignored
+	suite.NoError(repo.InvalidateNotes(suite.ctx, []int{ids[0], ids[2], ids[3] + 100}))
+	// one round trip to look up the titles and one to delete every key
+	suite.Equal(2, counter.roundTrips)
+
+	for i, title := range titles {
+		expected := int64(1)
+		if i == 0 || i == 2 {
+			expected = 0
+		}
+		exists, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", ids[i])).Result()
+		suite.NoError(err)
+		suite.Equal(expected, exists, title)
+		exists, err = suite.rdClient.Exists(suite.ctx, "notes:title:"+title).Result()
+		suite.NoError(err)
+		suite.Equal(expected, exists, title)
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestIdempotentCreate() {
+	repo := NewNoteRepository(suite.db, suite.rdClient, WithIdempotencyTTL(time.Second))
+	app := NewApplication(repo)
+
+	// the first call creates the note and remembers its id under the key
+	created, err := app.CreateNote(suite.ctx, "Idempotent", "My content", WithIdempotencyKey("request-1"))
+	suite.NoError(err)
+	suite.NotZero(created.ID)
+	id, err := suite.rdClient.Get(suite.ctx, "notes:idempotency:0:request-1").Int()
+	suite.NoError(err)
+	suite.Equal(int(created.ID), id)
+
+	// a retry gets the same note back, even with a different title
+	retried, err := app.CreateNote(suite.ctx, "Idempotent retry", "Other content", WithIdempotencyKey("request-1"))
+	suite.NoError(err)
+	suite.Equal(created.ID, retried.ID)
+	suite.Equal("Idempotent", retried.Title)
+	var count int64
+	suite.NoError(suite.db.Model(&Note{}).Count(&count).Error)
+	suite.Equal(int64(1), count)
+
+	suite.Run("Request in progress", func() {
+		suite.NoError(suite.rdClient.Set(suite.ctx, "notes:idempotency:0:request-2", idempotencyPending, time.Minute).Err())
+		_, err := app.CreateNote(suite.ctx, "In progress", "My content", WithIdempotencyKey("request-2"))
+		suite.ErrorIs(err, ErrRequestInProgress)
+	})
+
+	suite.Run("Failed create releases the key", func() {
+		_, err := app.CreateNote(suite.ctx, "Idempotent", "My content", WithIdempotencyKey("request-3"))
+		suite.ErrorIs(err, DuplicateNoteError)
+		exists, err := suite.rdClient.Exists(suite.ctx, "notes:idempotency:0:request-3").Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), exists)
+	})
+
+	suite.Run("Authors don't share keys", func() {
+		first, err := app.CreateNote(suite.ctx, "First author", "My content", WithAuthor(1), WithIdempotencyKey("request-4"))
+		suite.NoError(err)
+		second, err := app.CreateNote(suite.ctx, "Second author", "My content", WithAuthor(2), WithIdempotencyKey("request-4"))
+		suite.NoError(err)
+		suite.NotEqual(first.ID, second.ID)
+		suite.Equal(uint(2), second.AuthorID)
+		suite.Equal("Second author", second.Title)
+
+		replayed, err := repo.GetNoteByIdempotencyKey(suite.ctx, 1, "request-4")
+		suite.NoError(err)
+		suite.Equal(first.ID, replayed.ID)
+		_, err = repo.GetNoteByIdempotencyKey(suite.ctx, 3, "request-4")
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+
+	suite.Run("Expired key creates the note again", func() {
+		time.Sleep(1100 * time.Millisecond)
+		recreated, err := app.CreateNote(suite.ctx, "Idempotent retry", "Other content", WithIdempotencyKey("request-1"))
+		suite.NoError(err)
+		suite.NotEqual(created.ID, recreated.ID)
+		suite.Equal("Idempotent retry", recreated.Title)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestMissingNoteCache() {
+	for name, opts := range map[string][]NoteRepositoryOption{
+		"Hash cache": {WithMissingNoteTTL(time.Minute)},
+		"JSON cache": {WithMissingNoteTTL(time.Minute), WithJSONCache()},
+	} {
+		suite.Run(name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.db.Exec("DELETE FROM audit_entries;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			repo := NewNoteRepository(suite.db, suite.rdClient, opts...)
+			first := Note{Title: "First", Content: "My content"}
+			suite.NoError(repo.SaveNote(suite.ctx, &first))
+
+			// the next note will get the next id, which is cached as missing until then
+			nextID := int(first.ID) + 1
+			_, err := repo.GetNoteById(suite.ctx, nextID)
+			suite.ErrorIs(err, NoteNotFoundError)
+			ttl, err := suite.rdClient.TTL(suite.ctx, fmt.Sprintf("notes:id:%d", nextID)).Result()
+			suite.NoError(err)
+			suite.Greater(ttl, time.Duration(0))
+			_, err = repo.GetNoteById(suite.ctx, nextID)
+			suite.ErrorIs(err, NoteNotFoundError)
+
+			second := Note{Title: "Second", Content: "My content"}
+			suite.NoError(repo.SaveNote(suite.ctx, &second))
+			suite.Equal(nextID, int(second.ID))
+			note, err := repo.GetNoteById(suite.ctx, nextID)
+			suite.NoError(err)
+			suite.Equal("Second", note.Title)
+
+			// restoring a deleted note replaces the tombstone cached after its deletion
+			suite.NoError(repo.DeleteNote(suite.ctx, int(first.ID)))
+			_, err = repo.GetNoteById(suite.ctx, int(first.ID))
+			suite.ErrorIs(err, NoteNotFoundError)
+			_, err = repo.RestoreNote(suite.ctx, int(first.ID))
+			suite.NoError(err)
+			note, err = repo.GetNoteById(suite.ctx, int(first.ID))
+			suite.NoError(err)
+			suite.Equal("First", note.Title)
+		})
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestGetRandomNote() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+
+	// an empty table has no note to pick
+	_, err := repo.GetRandomNote(suite.ctx)
+	suite.ErrorIs(err, NoteNotFoundError)
+
+	ids := map[uint]bool{}
+	for i := 0; i < 5; i++ {
+		note := Note{Title: fmt.Sprintf("Note %d", i), Content: "My content"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		ids[note.ID] = true
+	}
+	deleted := Note{Title: "Deleted", Content: "My content"}
+	suite.NoError(repo.SaveNote(suite.ctx, &deleted))
+	suite.NoError(repo.DeleteNote(suite.ctx, int(deleted.ID)))
+
+	// every pick is one of the notes that weren't deleted
+	for i := 0; i < 20; i++ {
+		note, err := repo.GetRandomNote(suite.ctx)
+		suite.NoError(err)
+		suite.True(ids[note.ID], note.ID)
+	}
+}
+
+// preAuthorNote is the schema notes had before they had authors, when
+// titles were unique across all the notes
+type preAuthorNote struct {
+	gorm.Model
+	Title           string  `gorm:"column:title;type:varchar(512);not null;unique"`
+	NormalizedTitle *string `gorm:"column:normalized_title;type:varchar(512);unique"`
+	Content         string  `gorm:"column:content;not null"`
+	WordCount       int     `gorm:"column:word_count;not null;default:0"`
+	Version         int     `gorm:"column:version;not null;default:0"`
+}
+
+func (preAuthorNote) TableName() string {
+	return "notes"
+}
+
+func (suite *NoteRepoTestSuite) TestMigratePreAuthorSchema() {
+	// recreate the notes table with the schema from before notes had authors
+	suite.NoError(suite.db.Migrator().DropTable(&Note{}))
+	suite.NoError(suite.db.AutoMigrate(&preAuthorNote{}))
+	suite.True(suite.db.Migrator().HasConstraint(&Note{}, "notes_title_key"))
+	existing := preAuthorNote{Title: "Todo", Content: "Written before notes had authors"}
+	suite.NoError(suite.db.Create(&existing).Error)
+
+	suite.NoError(Migrate(suite.db))
+	for _, name := range []string{"notes_title_key", "notes_normalized_title_key"} {
+		suite.False(suite.db.Migrator().HasConstraint(&Note{}, name), name)
+	}
+	for _, name := range []string{"idx_notes_author_title", "idx_notes_author_normalized_title"} {
+		suite.True(suite.db.Migrator().HasIndex(&Note{}, name), name)
+	}
+	// migrating an up to date database changes nothing
+	suite.NoError(Migrate(suite.db))
+
+	// titles are now unique per author
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	authored := Note{AuthorID: 1, Title: "Todo", Content: "Written by an author"}
+	suite.NoError(repo.SaveNote(suite.ctx, &authored))
+	duplicate := Note{Title: "Todo", Content: "Same title without an author"}
+	suite.ErrorIs(repo.SaveNote(suite.ctx, &duplicate), DuplicateNoteError)
+	note, err := repo.GetNoteById(suite.ctx, int(existing.ID))
+	suite.NoError(err)
+	suite.Equal(uint(0), note.AuthorID)
+}
+
+func (suite *NoteRepoTestSuite) TestTitleExists() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Existing", Content: "My content"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+	exists, err := repo.TitleExists(suite.ctx, "Existing")
+	suite.NoError(err)
+	suite.True(exists)
+
+	exists, err = repo.TitleExists(suite.ctx, "Non-existing")
+	suite.NoError(err)
+	suite.False(exists)
+
+	// a deleted note keeps its title, which can't be given to a new note
+	suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+	exists, err = repo.TitleExists(suite.ctx, "Existing")
+	suite.NoError(err)
+	suite.True(exists)
+	suite.ErrorIs(repo.SaveNote(suite.ctx, &Note{Title: "Existing", Content: "My content"}), DuplicateNoteError)
+}
+
+func (suite *NoteRepoTestSuite) TestTitlesExist() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	for _, title := range []string{"First", "Second", "Deleted"} {
+		note := Note{Title: title, Content: "My content"}
+		suite.NoError(repo.SaveNote(suite.ctx, &note))
+		if title == "Deleted" {
+			suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+		}
+	}
+
+	exists, err := repo.TitlesExist(suite.ctx, []string{"First", "New", "Second", "Deleted"})
+	suite.NoError(err)
+	// the deleted note keeps its title taken
+	suite.Equal(map[string]bool{"First": true, "New": false, "Second": true, "Deleted": true}, exists)
+}
+
+func (suite *NoteRepoTestSuite) TestTitleLookupsForAuthor() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	unauthored := Note{Title: "Shared", Content: "Without an author"}
+	suite.NoError(repo.SaveNote(suite.ctx, &unauthored))
+	authored := Note{AuthorID: 7, Title: "Shared", Content: "Of author 7"}
+	suite.NoError(repo.SaveNote(suite.ctx, &authored))
+	own := Note{AuthorID: 7, Title: "Own", Content: "Only of author 7"}
+	suite.NoError(repo.SaveNote(suite.ctx, &own))
+
+	// twice so the second lookup is served by the cache
+	for i := 0; i < 2; i++ {
+		note, err := repo.GetNoteByTitle(suite.ctx, "Shared", ForAuthor(7))
+		suite.NoError(err)
+		suite.Equal(authored.ID, note.ID)
+		note, err = repo.GetNoteByTitle(suite.ctx, "Shared")
+		suite.NoError(err)
+		suite.Equal(unauthored.ID, note.ID)
+	}
+
+	exists, err := repo.TitleExists(suite.ctx, "Own", ForAuthor(7))
+	suite.NoError(err)
+	suite.True(exists)
+	exists, err = repo.TitleExists(suite.ctx, "Own")
+	suite.NoError(err)
+	suite.False(exists)
+
+	existing, err := repo.TitlesExist(suite.ctx, []string{"Shared", "Own"}, ForAuthor(8))
+	suite.NoError(err)
+	suite.Equal(map[string]bool{"Shared": false, "Own": false}, existing)
+	existing, err = repo.TitlesExist(suite.ctx, []string{"Shared", "Own"}, ForAuthor(7))
+	suite.NoError(err)
+	suite.Equal(map[string]bool{"Shared": true, "Own": true}, existing)
+}
+
+func (suite *NoteRepoTestSuite) TestListNotePreviews() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	notes := []*Note{
+		{Title: "Short", Content: "Fits"},
+		{AuthorID: 7, Title: "Accented", Content: "Crème brûlée"},
+		{Title: "Emoji", Content: "😀😃😄😁😆"},
+	}
+	for _, note := range notes {
+		suite.NoError(repo.SaveNote(suite.ctx, note))
+	}
+
+	previews, err := repo.ListNotePreviews(suite.ctx, 0, 10, 4)
+	suite.NoError(err)
+	suite.Len(previews, 3)
+	suite.Equal("Fits", previews[0].Content)
+	suite.Equal("Crèm…", previews[1].Content)
+	suite.Equal("😀😃😄😁…", previews[2].Content)
+	// the other columns are loaded as they are
+	suite.Equal(notes[1].ID, previews[1].ID)
+	suite.Equal("Accented", previews[1].Title)
+	suite.Equal(uint(7), previews[1].AuthorID)
+	suite.Equal(2, previews[1].WordCount)
+
+	// ensure the offset and limit page through the notes
+	previews, err = repo.ListNotePreviews(suite.ctx, 1, 1, 100)
+	suite.NoError(err)
+	suite.Len(previews, 1)
+	suite.Equal("Crème brûlée", previews[0].Content)
+}
+
+func (suite *NoteRepoTestSuite) TestCreateNoteWithDeletedTitle() {
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+	deleted, err := app.CreateNote(suite.ctx, "Recycled", "Deleted content")
+	suite.NoError(err)
+	suite.NoError(app.DeleteNote(suite.ctx, int(deleted.ID)))
+
+	// ensure the create reports the title is held by a deleted note
+	_, err = app.CreateNote(suite.ctx, "Recycled", "New content")
+	suite.ErrorIs(err, ErrTitleTakenByDeletedNote)
+	suite.ErrorIs(err, DuplicateNoteError)
+
+	// ensure a title held by a live note is a plain duplicate
+	_, err = app.CreateNote(suite.ctx, "Live", "Live content")
+	suite.NoError(err)
+	_, err = app.CreateNote(suite.ctx, "Live", "Other content")
+	suite.ErrorIs(err, DuplicateNoteError)
+	suite.NotErrorIs(err, ErrTitleTakenByDeletedNote)
+
+	// the caller may restore the deleted note instead
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	restored, err := repo.RestoreNote(suite.ctx, int(deleted.ID))
+	suite.NoError(err)
+	suite.Equal("Deleted content", restored.Content)
+}
+
+func (suite *NoteRepoTestSuite) TestNoteAuthors() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	app := NewApplication(repo)
+
+	// ensure two authors can each have a note titled Todo
+	first, err := app.CreateNote(suite.ctx, "Todo", "First author's todo", WithAuthor(1))
+	suite.NoError(err)
+	second, err := app.CreateNote(suite.ctx, "Todo", "Second author's todo", WithAuthor(2))
+	suite.NoError(err)
+	suite.NotEqual(first.ID, second.ID)
+
+	// ensure the title is still unique for each author
+	_, err = app.CreateNote(suite.ctx, "Todo", "Another todo", WithAuthor(1))
+	suite.ErrorIs(err, DuplicateNoteError)
+
+	// ensure each author lists only their own notes
+	notes, err := repo.ListNotesByAuthor(suite.ctx, 1, 10, 0)
+	suite.NoError(err)
+	suite.Len(notes, 1)
+	suite.Equal(first.ID, notes[0].ID)
+	notes, err = repo.ListNotesByAuthor(suite.ctx, 2, 10, 0)
+	suite.NoError(err)
+	suite.Len(notes, 1)
+	suite.Equal(second.ID, notes[0].ID)
+
+	// ensure the notes are cached under their author's title key
+	_, err = repo.GetNoteById(suite.ctx, int(first.ID))
+	suite.NoError(err)
+	_, err = repo.GetNoteById(suite.ctx, int(second.ID))
+	suite.NoError(err)
+	for _, note := range []Note{first, second} {
+		cached, err := repo.cache.GetNote(suite.ctx, fmt.Sprintf("notes:author:%d:title:Todo", note.AuthorID))
+		suite.NoError(err)
+		suite.Require().NotNil(cached)
+		suite.Equal(note.ID, cached.ID)
+	}
+	exists, err := suite.rdClient.Exists(suite.ctx, "notes:title:Todo").Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), exists)
+
+	// ensure a note without an author can have the title too
+	_, err = app.CreateNote(suite.ctx, "Todo", "Shared todo")
+	suite.NoError(err)
+	shared, err := app.GetNoteByTitle(suite.ctx, "Todo")
+	suite.NoError(err)
+	suite.Equal(uint(0), shared.AuthorID)
+}
+
+func (suite *NoteRepoTestSuite) TestUpdateNoteContentByTitle() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Groceries", Content: "Rice"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+	suite.Run("Cached note", func() {
+		// cache the note under its title before updating it
+		_, err := repo.GetNoteByTitle(suite.ctx, "Groceries")
+		suite.NoError(err)
+
+		updated, err := repo.UpdateNoteContentByTitle(suite.ctx, "Groceries", "Rice and beans")
+		suite.NoError(err)
+		suite.Equal(note.ID, updated.ID)
+		suite.Equal("Rice and beans", updated.Content)
+		suite.Equal(3, updated.WordCount)
+		suite.Equal(note.Version+1, updated.Version)
+
+		exists, err := suite.rdClient.Exists(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID), "notes:title:Groceries").Result()
+		suite.NoError(err)
+		suite.Equal(int64(0), exists)
+		loaded, err := repo.GetNoteByTitle(suite.ctx, "Groceries")
+		suite.NoError(err)
+		suite.Equal("Rice and beans", loaded.Content)
+	})
+
+	suite.Run("Missing title", func() {
+		_, err := repo.UpdateNoteContentByTitle(suite.ctx, "Missing", "Some content")
+		suite.ErrorIs(err, NoteNotFoundError)
+	})
+}
+
+func (suite *NoteRepoTestSuite) TestAppendToNote() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	note := Note{Title: "Log", Content: "start"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	// cache the note so the appends have entries to invalidate
+	_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+
+	// append fragments concurrently
+	const appends = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, appends)
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := repo.AppendToNote(suite.ctx, int(note.ID), fmt.Sprintf(" fragment-%d", i))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		suite.NoError(err)
+	}
+
+	// ensure every fragment is in the final content and the version counts every append
+	stored, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.True(strings.HasPrefix(stored.Content, "start"))
+	for i := 0; i < appends; i++ {
+		suite.Contains(stored.Content, fmt.Sprintf(" fragment-%d", i))
+	}
+	suite.Equal(appends+1, stored.WordCount)
+	suite.Equal(appends, stored.Version)
+
+	// ensure appending to a missing note fails
+	_, err = repo.AppendToNote(suite.ctx, int(note.ID)+1, " lost")
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func (suite *NoteRepoTestSuite) TestCacheCompression() {
+	content := strings.Repeat("All work and no play makes Jack a dull boy. ", 200)
+	for _, tc := range []struct {
+		name string
+		opts []NoteRepositoryOption
+		// size will return the size of the entry redis stores under key
+		size func(key string) (int64, error)
+	}{
+		{"Hash", nil, func(key string) (int64, error) {
+			fields, err := suite.rdClient.HMGet(suite.ctx, key, "content", "html").Result()
+			if err != nil {
+				return 0, err
+			}
+			return int64(len(fmt.Sprint(fields[0])) + len(fmt.Sprint(fields[1]))), nil
+		}},
+		{"JSON", []NoteRepositoryOption{WithJSONCache()}, func(key string) (int64, error) {
+			return suite.rdClient.StrLen(suite.ctx, key).Result()
+		}},
+	} {
+		suite.Run(tc.name, func() {
+			suite.T().Cleanup(func() {
+				suite.db.Exec("DELETE FROM notes;")
+				suite.rdClient.FlushAll(suite.ctx)
+			})
+			repo := NewNoteRepository(suite.db, suite.rdClient, append(tc.opts, WithCacheCompression(1024))...)
+			note := Note{Title: "Large", Content: content}
+			suite.NoError(repo.SaveNote(suite.ctx, &note))
+			_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+
+			// ensure redis holds less than the plaintext
+			size, err := tc.size(fmt.Sprintf("notes:id:%d", note.ID))
+			suite.NoError(err)
+			suite.Less(size, int64(len(content)))
+
+			// ensure the note is read back from the cache as it was saved
+			inspectResult, err := repo.InspectNote(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Require().NotNil(inspectResult.CachedNote)
+			suite.True(inspectResult.Matches)
+			cached, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Equal(content, cached.Content)
+
+			// ensure a repository without compression reads the compressed note
+			plain := NewNoteRepository(suite.db, suite.rdClient, tc.opts...)
+			cached, err = plain.GetNoteByTitle(suite.ctx, "Large")
+			suite.NoError(err)
+			suite.Equal(content, cached.Content)
+		})
+	}
+}
+
+func (suite *NoteRepoTestSuite) TestListDeletedNotes() {
+	repo := NewNoteRepository(suite.db, suite.rdClient)
+	notes := make([]Note, 4)
+	for i := range notes {
+		notes[i] = Note{Title: fmt.Sprintf("Note %d", i), Content: "My content"}
+		suite.NoError(repo.SaveNote(suite.ctx, &notes[i]))
+	}
+	// delete every note but the first, one after the other
+	for _, note := range notes[1:] {
+		suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ensure the deleted notes are listed most recently deleted first
+	deleted, err := repo.ListDeletedNotes(suite.ctx, 10, 0)
+	suite.NoError(err)
+	suite.Equal(3, len(deleted))
+	suite.Equal(notes[3].ID, deleted[0].ID)
+	suite.Equal(notes[2].ID, deleted[1].ID)
+	suite.Equal(notes[1].ID, deleted[2].ID)
+	for _, note := range deleted {
+		suite.True(note.DeletedAt.Valid)
+	}
+
+	// ensure the deleted notes aren't in the normal listing
+	live, err := repo.ListNotesAfter(suite.ctx, 0, 10)
+	suite.NoError(err)
+	suite.Equal(1, len(live))
+	suite.Equal(notes[0].ID, live[0].ID)
+
+	// ensure the limit and offset page through the trash
+	deleted, err = repo.ListDeletedNotes(suite.ctx, 1, 1)
+	suite.NoError(err)
+	suite.Equal(1, len(deleted))
+	suite.Equal(notes[2].ID, deleted[0].ID)
+
+	// ensure a restored note leaves the trash
+	_, err = repo.RestoreNote(suite.ctx, int(notes[3].ID))
+	suite.NoError(err)
+	deleted, err = repo.ListDeletedNotes(suite.ctx, 10, 0)
+	suite.NoError(err)
+	suite.Equal(2, len(deleted))
+	suite.Equal(notes[2].ID, deleted[0].ID)
+	live, err = repo.ListNotesAfter(suite.ctx, 0, 10)
+	suite.NoError(err)
+	suite.Equal(2, len(live))
+}
+
+func (suite *NoteRepoTestSuite) TestWithTransaction() {
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient))
+	original, err := app.CreateNote(suite.ctx, "Original", "First half. Second half.")
+	suite.NoError(err)
+	_, err = app.GetNoteById(suite.ctx, int(original.ID))
+	suite.NoError(err)
+
+	// split the note in two but fail partway through
+	splitErr := errors.New("split failed")
+	err = app.WithTransaction(suite.ctx, func(txApp *Application) error {
+		if _, err := txApp.CreateNote(suite.ctx, "First", "First half."); err != nil {
+			return err
+		}
+		if _, err := txApp.UpdateNote(suite.ctx, int(original.ID), "Second half."); err != nil {
+			return err
+		}
+		return splitErr
+	})
+	suite.ErrorIs(err, splitErr)
+
+	// ensure no rows were written and the cached note is untouched
+	var count int64
+	suite.NoError(suite.db.Model(&Note{}).Where("title = ?", "First").Count(&count).Error)
+	suite.Equal(int64(0), count)
+	note, err := app.GetNoteById(suite.ctx, int(original.ID))
+	suite.NoError(err)
+	suite.Equal("First half. Second half.", note.Content)
+	var stored Note
+	suite.NoError(suite.db.First(&stored, original.ID).Error)
+	suite.Equal("First half. Second half.", stored.Content)
+
+	// split the note in two and ensure both changes are committed
+	err = app.WithTransaction(suite.ctx, func(txApp *Application) error {
+		if _, err := txApp.CreateNote(suite.ctx, "First", "First half."); err != nil {
+			return err
+		}
+		_, err := txApp.UpdateNote(suite.ctx, int(original.ID), "Second half.")
+		return err
+	})
+	suite.NoError(err)
+	first, err := app.GetNoteByTitle(suite.ctx, "First")
+	suite.NoError(err)
+	suite.Equal("First half.", first.Content)
+	// the cached note was invalidated on commit
+	note, err = app.GetNoteById(suite.ctx, int(original.ID))
+	suite.NoError(err)
+	suite.Equal("Second half.", note.Content)
+}
+
+func (suite *NoteRepoTestSuite) TestPoolConfig() {
+	// use a dedicated connection pool so shrinking it doesn't affect the other tests
+	db, err := gorm.Open(pg.Open(suite.pgConnectionString), &gorm.Config{})
+	suite.NoError(err)
+	sqlDB, err := db.DB()
+	suite.NoError(err)
+	defer sqlDB.Close()
+	repo := NewNoteRepository(db, suite.rdClient, WithPoolConfig(PoolConfig{MaxOpenConns: 2, MaxIdleConns: 1}))
+	suite.Equal(2, sqlDB.Stats().MaxOpenConnections)
+
+	// ensure concurrent queries wait for a connection rather than failing
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.CountNotes(suite.ctx)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		suite.NoError(err)
+	}
+	suite.LessOrEqual(sqlDB.Stats().OpenConnections, 2)
+}
+
+func (suite *NoteRepoTestSuite) TestCreateNoteRateLimit() {
+	window := time.Second
+	limiter, err := NewRedisRateLimiter(suite.rdClient, 3, window)
+	suite.Require().NoError(err)
+	app := NewApplication(NewNoteRepository(suite.db, suite.rdClient), WithRateLimiter(limiter))
+
+	// start at the beginning of a window so the creates below fall in the same one
+	time.Sleep(window - time.Duration(time.Now().UnixNano()%int64(window)))
+	created, limited := 0, 0
+	for i := 0; i < 10; i++ {
+		_, err := app.CreateNote(suite.ctx, fmt.Sprintf("Note %d", i), "My content", WithClientID("client-1"))
+		if errors.Is(err, ErrRateLimited) {
+			limited++
+			continue
+		}
+		suite.NoError(err)
+		created++
+	}
+	suite.Equal(3, created)
+	suite.Equal(7, limited)
+
+	// another client has its own limit
+	_, err = app.CreateNote(suite.ctx, "Other client", "My content", WithClientID("client-2"))
+	suite.NoError(err)
+
+	// the client may create notes again once the window elapses
+	time.Sleep(window)
+	_, err = app.CreateNote(suite.ctx, "After window", "My content", WithClientID("client-1"))
+	suite.NoError(err)
+}
+
+func (suite *NoteRepoTestSuite) TestCacheWriteThrough() {
+	repo := NewNoteRepository(suite.db, suite.rdClient, WithCacheWriteStrategy(CacheWriteThrough))
+	note := Note{Title: "Written", Content: "First content"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+	note.Content = "Second content"
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+	// ensure the id key holds the new content without the note being read
+	content, err := suite.rdClient.HGet(suite.ctx, fmt.Sprintf("notes:id:%d", note.ID), "content").Result()
+	suite.NoError(err)
+	suite.Equal("Second content", content)
+	cachedNote, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal(note.Version, cachedNote.Version)
+}
+
+func (suite *NoteRepoTestSuite) TestClose() {
+	// use a dedicated connection pool and client so closing them
+	// doesn't affect the other tests
+	db, err := gorm.Open(pg.Open(suite.pgConnectionString), &gorm.Config{})
+	suite.NoError(err)
+	rdClient := rd.NewClient(suite.rdClient.Options())
+	app := NewApplication(NewNoteRepository(db, rdClient))
+	note, err := app.CreateNote(suite.ctx, "Closing", "My content")
+	suite.NoError(err)
+
+	suite.NoError(app.Close())
+
+	// ensure the operations fail instead of panicking
+	_, err = app.GetNoteById(suite.ctx, int(note.ID))
+	suite.Error(err)
+	_, err = app.CreateNote(suite.ctx, "Closed", "My content")
+	suite.Error(err)
+	suite.Error(app.HealthCheck(suite.ctx))
+	suite.ErrorIs(rdClient.Ping(suite.ctx).Err(), rd.ErrClosed)
+}
+
+func (suite *NoteRepoTestSuite) TestUnreachableRedis() {
+	note := Note{Title: "Offline", Content: "Served by postgres"}
+	suite.NoError(suite.db.Create(&note).Error)
+	// nothing listens on this port so every redis call fails
+	rdClient := rd.NewClient(&rd.Options{Addr: "localhost:1", MaxRetries: -1})
+	defer rdClient.Close()
+	repo := NewNoteRepository(suite.db, rdClient)
+
+	fetched, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal("Served by postgres", fetched.Content)
+
+	fetched, err = repo.GetNoteByTitle(suite.ctx, "Offline")
+	suite.NoError(err)
+	suite.Equal(note.ID, fetched.ID)
+
+	notes, err := repo.BatchGetNotesByIds(suite.ctx, []int{int(note.ID)})
+	suite.NoError(err)
+	suite.Equal("Offline", notes[int(note.ID)].Title)
+
+	rendered, err := repo.GetNoteByIdRendered(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal("Served by postgres", rendered)
+}
+
+func TestNoteRepository(t *testing.T) {
+	suite.Run(t, new(NoteRepoTestSuite))
+}
+
+// UncachedNoteRepoTestSuite runs the repository with caching disabled
+// against postgres alone, without a redis container.
+type UncachedNoteRepoTestSuite struct {
+	suite.Suite
+	ctx         context.Context
+	db          *gorm.DB
+	pgContainer *postgres.PostgresContainer
+}
+
+func (suite *UncachedNoteRepoTestSuite) SetupSuite() {
+	suite.ctx = context.Background()
+	pgContainer, err := postgres.RunContainer(
+		suite.ctx,
+		testcontainers.WithImage("postgres:15.3-alpine"),
+		postgres.WithDatabase("notesdb"),
+		postgres.WithUsername("postgres"),
+		postgres.WithPassword("postgres"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).WithStartupTimeout(5*time.Second)),
+	)
+	suite.Require().NoError(err)
+	suite.pgContainer = pgContainer
+
+	connStr, err := pgContainer.ConnectionString(suite.ctx, "sslmode=disable")
+	suite.Require().NoError(err)
+	db, err := gorm.Open(pg.Open(connStr), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+}
+
+func (suite *UncachedNoteRepoTestSuite) TearDownSuite() {
+	if suite.pgContainer != nil {
+		suite.NoError(suite.pgContainer.Terminate(suite.ctx))
+	}
+}
+
+func (suite *UncachedNoteRepoTestSuite) SetupTest() {
+	suite.NoError(Migrate(suite.db))
+}
+
+func (suite *UncachedNoteRepoTestSuite) TearDownTest() {
+	suite.db.Exec("DROP TABLE IF EXISTS notes CASCADE;")
+	suite.db.Exec("DROP TABLE IF EXISTS audit_entries CASCADE;")
+	suite.db.Exec("DROP TABLE IF EXISTS note_tags CASCADE;")
+}
+
+// repositories will return the repositories with caching disabled, by
+// each of the ways caching can be disabled. No redis server is listening
+// on the address of the client given along with WithoutCache, so any call
+// made to redis would fail.
+func (suite *UncachedNoteRepoTestSuite) repositories() map[string]*NoteRepository {
+	client := rd.NewClient(&rd.Options{Addr: "localhost:1"})
+	suite.T().Cleanup(func() {
+		client.Close()
+	})
+	return map[string]*NoteRepository{
+		"Nil redis client": NewNoteRepository(suite.db, nil),
+		"Nil cache":        NewNoteRepositoryWithCache(suite.db, nil),
+		"WithoutCache":     NewNoteRepository(suite.db, client, WithoutCache()),
+	}
+}
+
+func (suite *UncachedNoteRepoTestSuite) TestNoteLifecycle() {
+	for name, repo := range suite.repositories() {
+		suite.Run(name, func() {
+			app := NewApplication(repo)
+			note, err := app.CreateNote(suite.ctx, name, "My content")
+			suite.Require().NoError(err)
+
+			fetched, err := repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Equal("My content", fetched.Content)
+
+			// updates are read back straight away since nothing is cached
+			suite.NoError(suite.db.Model(&Note{}).Where("id = ?", note.ID).Update("content", "Updated content").Error)
+			fetched, err = repo.GetNoteByTitle(suite.ctx, name)
+			suite.NoError(err)
+			suite.Equal("Updated content", fetched.Content)
+
+			exists, err := repo.TitleExists(suite.ctx, name)
+			suite.NoError(err)
+			suite.True(exists)
+			_, err = app.CreateNote(suite.ctx, name, "Duplicate content")
+			suite.ErrorIs(err, DuplicateNoteError)
+
+			inspectResult, err := repo.InspectNote(suite.ctx, int(note.ID))
+			suite.NoError(err)
+			suite.Nil(inspectResult.CachedNote)
+
+			suite.NoError(repo.DeleteNote(suite.ctx, int(note.ID)))
+			_, err = repo.GetNoteById(suite.ctx, int(note.ID))
+			suite.ErrorIs(err, NoteNotFoundError)
+			suite.NoError(repo.HealthCheck(suite.ctx))
+		})
+	}
+}
+
+func (suite *UncachedNoteRepoTestSuite) TestWithTransaction() {
+	for name, repo := range suite.repositories() {
+		suite.Run(name, func() {
+			err := repo.WithTransaction(suite.ctx, func(txRepo NoteRepositoryInterface) error {
+				note := Note{Title: name, Content: "Rolled back"}
+				if err := txRepo.SaveNote(suite.ctx, &note); err != nil {
+					return err
+				}
+				return errors.New("rollback")
+			})
+			suite.EqualError(err, "rollback")
+			exists, err := repo.TitleExists(suite.ctx, name)
+			suite.NoError(err)
+			suite.False(exists)
+		})
+	}
+}
+
+func TestUncachedNoteRepository(t *testing.T) {
+	suite.Run(t, new(UncachedNoteRepoTestSuite))
+}
+
+// MockedNoteRepoTestSuite runs the repository over a database mocked with
+// sqlmock and a memory cache, to check the queries it makes without a
+// postgres or redis container.
+type MockedNoteRepoTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *MockedNoteRepoTestSuite) TestAppendToNote() {
+	repo, mock := suite.newMockRepo()
+	now := time.Now()
+	cached := CachedNote{Note: Note{Model: gorm.Model{ID: 1, CreatedAt: now, UpdatedAt: now}, Title: "Log", Content: "first"}}
+	suite.NoError(suite.cache.SetNote(suite.ctx, cached, 0, "notes:id:1", "notes:title:Log"))
+
+	// the text is appended by postgres rather than by rewriting the content
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "content"=content || $1,"version"=version + 1,"updated_at"=$2 WHERE id = $3`)).
+		WithArgs(" second", sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count", "version"}).
+			AddRow(1, now, now, nil, "Log", "first second", 1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "word_count"=$1`)).
+		WithArgs(2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectTags(mock)
+	mock.ExpectCommit()
+	note, err := repo.AppendToNote(suite.ctx, 1, " second")
+	suite.NoError(err)
+	suite.Equal("first second", note.Content)
+	suite.Equal(2, note.WordCount)
+	suite.Equal(1, note.Version)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	// ensure the note's cache entries were invalidated
+	for _, key := range []string{"notes:id:1", "notes:title:Log"} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.Nil(cachedNote, key)
+	}
+
+	suite.Run("Missing note", func() {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "content"=content || $1`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+		_, err := repo.AppendToNote(suite.ctx, 2, " more")
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func (suite *MockedNoteRepoTestSuite) TestCountNotesByTag() {
+	repo, mock := suite.newMockRepo()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT note_tags.tag, COUNT(*) AS count FROM "note_tags" JOIN notes ON notes.id = note_tags.note_id AND notes.deleted_at IS NULL GROUP BY "note_tags"."tag"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"tag", "count"}).
+			AddRow("home", 2).
+			AddRow("work", 1))
+	counts, err := repo.CountNotesByTag(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(map[string]int64{"home": 2, "work": 1}, counts)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MockedNoteRepoTestSuite) TestPurgeDeletedNotes() {
+	cutoff := time.Now()
+	deletedAt := cutoff.Add(-time.Hour)
+	// expectPurge will expect the note to be locked and purged, with
+	// purged being the number of rows the delete removes
+	expectPurge := func(mock sqlmock.Sqlmock, purged int64) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes" WHERE deleted_at IS NOT NULL AND deleted_at < $1 FOR UPDATE`)).
+			WithArgs(cutoff).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "deleted_at", "title"}).AddRow(1, deletedAt, "Purged"))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags" WHERE note_id IN ($1)`)).
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "notes" WHERE id IN ($1) AND deleted_at IS NOT NULL AND deleted_at < $2`)).
+			WithArgs(1, cutoff).
+			WillReturnResult(sqlmock.NewResult(0, purged))
+		mock.ExpectCommit()
+	}
+
+	suite.Run("Deleted notes are purged", func() {
+		repo, mock := suite.newMockRepo()
+		expectPurge(mock, 1)
+		purged, err := repo.PurgeDeletedNotes(suite.ctx, cutoff)
+		suite.NoError(err)
+		suite.Equal(1, purged)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Restored note isn't purged", func() {
+		// the delete only removes the notes that are still soft-deleted
+		repo, mock := suite.newMockRepo()
+		expectPurge(mock, 0)
+		purged, err := repo.PurgeDeletedNotes(suite.ctx, cutoff)
+		suite.NoError(err)
+		suite.Equal(0, purged)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func TestMockedNoteRepository(t *testing.T) {
+	suite.Run(t, new(MockedNoteRepoTestSuite))
 }
@@ -0,0 +1,421 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockNoteRepository is a hand-written NoteRepositoryInterface that
+// returns the configured error from SaveNote and records the notes it saved.
+type mockNoteRepository struct {
+	NoteRepositoryInterface
+	saveErr error
+	saved   []Note
+	// idempotencyKeys maps the idempotency keys of each author to the ids
+	// of their notes
+	idempotencyKeys map[mockIdempotencyKey]uint
+}
+
+// mockIdempotencyKey is an idempotency key scoped to its author
+type mockIdempotencyKey struct {
+	authorID uint
+	key      string
+}
+
+func (repo *mockNoteRepository) SaveNote(_ context.Context, note *Note) error {
+	if repo.saveErr != nil {
+		return repo.saveErr
+	}
+	if note.ID != 0 {
+		repo.saved[note.ID-1] = *note
+		return nil
+	}
+	note.ID = uint(len(repo.saved) + 1)
+	repo.saved = append(repo.saved, *note)
+	return nil
+}
+
+func (repo *mockNoteRepository) GetNoteById(_ context.Context, id int) (*Note, error) {
+	if id < 1 || id > len(repo.saved) {
+		return nil, NoteNotFoundError
+	}
+	note := repo.saved[id-1]
+	return &note, nil
+}
+
+func (repo *mockNoteRepository) GetNoteByIdempotencyKey(ctx context.Context, authorID uint, key string) (*Note, error) {
+	id, ok := repo.idempotencyKeys[mockIdempotencyKey{authorID, key}]
+	if !ok {
+		return nil, NoteNotFoundError
+	}
+	return repo.GetNoteById(ctx, int(id))
+}
+
+func (repo *mockNoteRepository) CreateNoteIdempotent(ctx context.Context, key string, note *Note) error {
+	if id, ok := repo.idempotencyKeys[mockIdempotencyKey{note.AuthorID, key}]; ok {
+		*note = repo.saved[id-1]
+		return nil
+	}
+	if err := repo.SaveNote(ctx, note); err != nil {
+		return err
+	}
+	if repo.idempotencyKeys == nil {
+		repo.idempotencyKeys = map[mockIdempotencyKey]uint{}
+	}
+	repo.idempotencyKeys[mockIdempotencyKey{note.AuthorID, key}] = note.ID
+	return nil
+}
+
+func (repo *mockNoteRepository) TitleExists(_ context.Context, title string, _ ...TitleOption) (bool, error) {
+	for _, note := range repo.saved {
+		if note.Title == title {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (repo *mockNoteRepository) ImportNotes(_ context.Context, nextBatch func() ([]*Note, error), _ bool) (int, error) {
+	imported := 0
+	for {
+		notes, err := nextBatch()
+		if err != nil || len(notes) == 0 {
+			return imported, err
+		}
+		for _, note := range notes {
+			repo.saved = append(repo.saved, *note)
+		}
+		imported += len(notes)
+	}
+}
+
+// countingRateLimiter is a RateLimiter that allows limit requests per
+// client, or fails every request with err when it is set
+type countingRateLimiter struct {
+	limit    int
+	err      error
+	requests map[string]int
+}
+
+func (limiter *countingRateLimiter) Allow(_ context.Context, clientID string) (bool, error) {
+	if limiter.err != nil {
+		return false, limiter.err
+	}
+	if limiter.requests == nil {
+		limiter.requests = map[string]int{}
+	}
+	limiter.requests[clientID]++
+	return limiter.requests[clientID] <= limiter.limit, nil
+}
+
+// ApplicationTestSuite tests the application use cases that don't
+// need postgres or redis.
+type ApplicationTestSuite struct {
+	suite.Suite
+	ctx context.Context
+}
+
+func (suite *ApplicationTestSuite) SetupTest() {
+	suite.ctx = context.Background()
+}
+
+func (suite *ApplicationTestSuite) TestCreateNoteValidation() {
+	testCases := []struct {
+		name    string
+		title   string
+		content string
+		err     error
+	}{
+		{"Empty title", "", "Some content", ErrEmptyTitle},
+		{"Whitespace only title", " \t\n ", "Some content", ErrEmptyTitle},
+		{"Empty content", "A title", "", ErrEmptyContent},
+		{"Whitespace only content", "A title", "  \n", ErrEmptyContent},
+		{"Title too long", strings.Repeat("é", DefaultMaxTitleLength+1), "Some content", ErrTitleTooLong},
+		{"Title too long once trimmed", " " + strings.Repeat("a", DefaultMaxTitleLength+1) + " ", "Some content", ErrTitleTooLong},
+	}
+	// the application has no repository so these pass only if validation
+	// rejects the note before the repository is used
+	app := &Application{}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			_, err := app.CreateNote(suite.ctx, tc.title, tc.content)
+			suite.ErrorIs(err, tc.err)
+			suite.ErrorIs(err, ErrInvalidNote)
+		})
+	}
+}
+
+func (suite *ApplicationTestSuite) TestMaxTitleLength() {
+	app := NewApplication(&mockNoteRepository{}, WithMaxTitleLength(10))
+	_, err := app.CreateNote(suite.ctx, strings.Repeat("a", 11), "Some content")
+	suite.ErrorIs(err, ErrTitleTooLong)
+
+	title, err := app.validateTitle("  " + strings.Repeat("a", 10) + "  ")
+	suite.NoError(err)
+	suite.Equal(strings.Repeat("a", 10), title)
+}
+
+func (suite *ApplicationTestSuite) TestUpdateNoteValidation() {
+	app := &Application{}
+	_, err := app.UpdateNote(suite.ctx, 1, "   ")
+	suite.ErrorIs(err, ErrEmptyContent)
+}
+
+func (suite *ApplicationTestSuite) TestCreateNoteWithMockRepository() {
+	repo := &mockNoteRepository{}
+	app := NewApplication(repo)
+
+	note, err := app.CreateNote(suite.ctx, " My note ", "My content")
+	suite.NoError(err)
+	suite.Equal(uint(1), note.ID)
+	suite.Equal("My note", note.Title)
+	suite.Len(repo.saved, 1)
+
+	suite.Run("Duplicate note", func() {
+		repo.saveErr = DuplicateNoteError
+		_, err := app.CreateNote(suite.ctx, "My note", "Other content")
+		suite.ErrorIs(err, DuplicateNoteError)
+		suite.Len(repo.saved, 1)
+	})
+
+	suite.Run("Unexpected repository error", func() {
+		repo.saveErr = errors.New("connection reset")
+		_, err := app.CreateNote(suite.ctx, "Another note", "Other content")
+		suite.ErrorIs(err, SomethingWentWrongError)
+	})
+}
+
+func (suite *ApplicationTestSuite) TestCreateNoteWithIdempotencyKey() {
+	repo := &mockNoteRepository{}
+	app := NewApplication(repo)
+
+	first, err := app.CreateNote(suite.ctx, "My note", "My content", WithIdempotencyKey("request-1"))
+	suite.NoError(err)
+	retried, err := app.CreateNote(suite.ctx, "My note", "My content", WithIdempotencyKey("request-1"))
+	suite.NoError(err)
+	suite.Equal(first.ID, retried.ID)
+	suite.Len(repo.saved, 1)
+
+	// creates without a key or with another key aren't deduplicated
+	_, err = app.CreateNote(suite.ctx, "Other note", "My content")
+	suite.NoError(err)
+	_, err = app.CreateNote(suite.ctx, "Third note", "My content", WithIdempotencyKey("request-2"))
+	suite.NoError(err)
+	suite.Len(repo.saved, 3)
+}
+
+func (suite *ApplicationTestSuite) TestCreateNoteRateLimit() {
+	repo := &mockNoteRepository{}
+	limiter := &countingRateLimiter{limit: 2}
+	app := NewApplication(repo, WithRateLimiter(limiter))
+
+	for i := 0; i < 2; i++ {
+		_, err := app.CreateNote(suite.ctx, fmt.Sprintf("Note %d", i), "My content", WithClientID("client-1"))
+		suite.NoError(err)
+	}
+	_, err := app.CreateNote(suite.ctx, "Limited", "My content", WithClientID("client-1"))
+	suite.ErrorIs(err, ErrRateLimited)
+	suite.Len(repo.saved, 2)
+
+	// other clients and creates without a client id aren't limited
+	_, err = app.CreateNote(suite.ctx, "Other client", "My content", WithClientID("client-2"))
+	suite.NoError(err)
+	_, err = app.CreateNote(suite.ctx, "No client", "My content")
+	suite.NoError(err)
+	suite.Len(repo.saved, 4)
+
+	suite.Run("Invalid notes aren't counted", func() {
+		limiter := &countingRateLimiter{limit: 1}
+		app := NewApplication(&mockNoteRepository{}, WithRateLimiter(limiter))
+		_, err := app.CreateNote(suite.ctx, "", "My content", WithClientID("client-1"))
+		suite.ErrorIs(err, ErrEmptyTitle)
+		_, err = app.CreateNote(suite.ctx, "My note", "My content", WithClientID("client-1"))
+		suite.NoError(err)
+	})
+
+	suite.Run("Retried idempotent creates aren't counted", func() {
+		repo := &mockNoteRepository{}
+		app := NewApplication(repo, WithRateLimiter(&countingRateLimiter{limit: 1}))
+		created, err := app.CreateNote(suite.ctx, "My note", "My content", WithClientID("client-1"), WithIdempotencyKey("key-1"))
+		suite.NoError(err)
+		for i := 0; i < 3; i++ {
+			replayed, err := app.CreateNote(suite.ctx, "My note", "My content", WithClientID("client-1"), WithIdempotencyKey("key-1"))
+			suite.NoError(err)
+			suite.Equal(created.ID, replayed.ID)
+		}
+		_, err = app.CreateNote(suite.ctx, "Another note", "My content", WithClientID("client-1"), WithIdempotencyKey("key-2"))
+		suite.ErrorIs(err, ErrRateLimited)
+		suite.Len(repo.saved, 1)
+	})
+
+	suite.Run("Another author's key isn't a replay", func() {
+		repo := &mockNoteRepository{}
+		app := NewApplication(repo, WithRateLimiter(&countingRateLimiter{limit: 1}))
+		_, err := app.CreateNote(suite.ctx, "My note", "My content", WithClientID("client-1"), WithAuthor(1), WithIdempotencyKey("key-1"))
+		suite.NoError(err)
+		_, err = app.CreateNote(suite.ctx, "My note", "My content", WithClientID("client-1"), WithAuthor(2), WithIdempotencyKey("key-1"))
+		suite.ErrorIs(err, ErrRateLimited)
+		suite.Len(repo.saved, 1)
+	})
+
+	suite.Run("Limits must be positive", func() {
+		_, err := NewRedisRateLimiter(nil, 0, time.Second)
+		suite.Error(err)
+		_, err = NewRedisRateLimiter(nil, 1, 0)
+		suite.Error(err)
+		_, err = NewRedisRateLimiter(nil, 1, time.Second)
+		suite.NoError(err)
+	})
+
+	suite.Run("Failing limiter allows the create", func() {
+		repo := &mockNoteRepository{}
+		app := NewApplication(repo, WithRateLimiter(&countingRateLimiter{err: errors.New("connection refused")}))
+		_, err := app.CreateNote(suite.ctx, "My note", "My content", WithClientID("client-1"))
+		suite.NoError(err)
+		suite.Len(repo.saved, 1)
+	})
+
+	suite.Run("Creates aren't limited by default", func() {
+		app := NewApplication(&mockNoteRepository{})
+		for i := 0; i < 5; i++ {
+			_, err := app.CreateNote(suite.ctx, fmt.Sprintf("Note %d", i), "My content", WithClientID("client-1"))
+			suite.NoError(err)
+		}
+	})
+}
+
+func (suite *ApplicationTestSuite) TestNoteAuthors() {
+	repo := &mockNoteRepository{}
+	app := NewApplication(repo)
+
+	first, err := app.CreateNote(suite.ctx, "Todo", "First author's todo", WithAuthor(1))
+	suite.NoError(err)
+	suite.Equal(uint(1), first.AuthorID)
+	second, err := app.CreateNote(suite.ctx, "Todo", "Second author's todo", WithAuthor(2))
+	suite.NoError(err)
+	suite.Equal(uint(2), second.AuthorID)
+
+	suite.Run("Another author's note isn't updated", func() {
+		_, err := app.UpdateNote(suite.ctx, int(first.ID), "Hijacked", WithOwner(2))
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.Equal("First author's todo", repo.saved[first.ID-1].Content)
+	})
+
+	suite.Run("Owner updates the note", func() {
+		updated, err := app.UpdateNote(suite.ctx, int(first.ID), "Updated todo", WithOwner(1))
+		suite.NoError(err)
+		suite.Equal("Updated todo", updated.Content)
+		suite.Equal(uint(1), updated.AuthorID)
+	})
+}
+
+func (suite *ApplicationTestSuite) TestValidateNewNote() {
+	repo := &mockNoteRepository{}
+	app := NewApplication(repo)
+	_, err := app.CreateNote(suite.ctx, "Taken", "Some content")
+	suite.NoError(err)
+
+	suite.NoError(app.ValidateNewNote(suite.ctx, "Available"))
+	// the title is trimmed before it is compared, as CreateNote trims it
+	suite.ErrorIs(app.ValidateNewNote(suite.ctx, " Taken "), DuplicateNoteError)
+	err = app.ValidateNewNote(suite.ctx, "")
+	suite.ErrorIs(err, ErrEmptyTitle)
+	suite.ErrorIs(err, ErrInvalidNote)
+	// only the note created above was saved
+	suite.Len(repo.saved, 1)
+}
+
+func (suite *ApplicationTestSuite) TestGetNote() {
+	app := NewApplication(NewInMemoryNoteRepository())
+	first, err := app.CreateNote(suite.ctx, "Groceries", "Rice and beans")
+	suite.NoError(err)
+	// a note whose title is another note's id
+	numeric, err := app.CreateNote(suite.ctx, strconv.Itoa(int(first.ID)), "Titled with the first note's id")
+	suite.NoError(err)
+	// a note whose title is an id no note has
+	unmatched, err := app.CreateNote(suite.ctx, "42", "Titled with an unused id")
+	suite.NoError(err)
+
+	suite.Run("Numeric ref", func() {
+		note, err := app.GetNote(suite.ctx, strconv.Itoa(int(numeric.ID)))
+		suite.NoError(err)
+		suite.Equal(numeric.ID, note.ID)
+	})
+
+	suite.Run("Title ref", func() {
+		note, err := app.GetNote(suite.ctx, "Groceries")
+		suite.NoError(err)
+		suite.Equal(first.ID, note.ID)
+	})
+
+	suite.Run("Ambiguous ref is looked up by id first", func() {
+		note, err := app.GetNote(suite.ctx, strconv.Itoa(int(first.ID)))
+		suite.NoError(err)
+		suite.Equal(first.ID, note.ID)
+	})
+
+	suite.Run("Numeric ref falls back to the title", func() {
+		note, err := app.GetNote(suite.ctx, "42")
+		suite.NoError(err)
+		suite.Equal(unmatched.ID, note.ID)
+	})
+
+	suite.Run("Not found", func() {
+		for _, ref := range []string{"100", "Missing", "-1", "99999999999999999999"} {
+			_, err := app.GetNote(suite.ctx, ref)
+			suite.ErrorIs(err, NoteNotFoundError, ref)
+		}
+	})
+}
+
+func (suite *ApplicationTestSuite) TestImportNotesValidation() {
+	testCases := []struct {
+		name  string
+		input string
+		err   error
+		line  string
+	}{
+		{"Malformed JSON", "{\"Title\": \"Valid\", \"Content\": \"Valid\"}\nnot json", ErrInvalidImport, "line 2"},
+		{"Wrong type", `{"Title": 1, "Content": "Valid"}`, ErrInvalidImport, "line 1"},
+		{"Empty title", "\n\n{\"Title\": \" \", \"Content\": \"Valid\"}", ErrEmptyTitle, "line 3"},
+		{"Empty content", `{"Title": "Valid"}`, ErrEmptyContent, "line 1"},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			app := NewApplication(&mockNoteRepository{})
+			imported, err := app.ImportNotes(suite.ctx, strings.NewReader(tc.input))
+			suite.ErrorIs(err, tc.err)
+			suite.ErrorContains(err, tc.line)
+			suite.Equal(0, imported)
+		})
+	}
+
+	suite.Run("Trims titles", func() {
+		repo := &mockNoteRepository{}
+		app := NewApplication(repo)
+		imported, err := app.ImportNotes(suite.ctx, strings.NewReader(`{"Title": " Padded ", "Content": "Valid", "Tags": ["a"]}`+"\n"))
+		suite.NoError(err)
+		suite.Equal(1, imported)
+		suite.Equal("Padded", repo.saved[0].Title)
+		suite.Equal([]string{"a"}, repo.saved[0].Tags)
+	})
+
+	suite.Run("Keeps authors", func() {
+		repo := &mockNoteRepository{}
+		app := NewApplication(repo)
+		imported, err := app.ImportNotes(suite.ctx, strings.NewReader(`{"AuthorID": 7, "Title": "Authored", "Content": "Valid"}`+"\n"))
+		suite.NoError(err)
+		suite.Equal(1, imported)
+		suite.Equal(uint(7), repo.saved[0].AuthorID)
+	})
+}
+
+func TestApplication(t *testing.T) {
+	suite.Run(t, new(ApplicationTestSuite))
+}
@@ -0,0 +1,472 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+// ErrCorruptCacheEntry is returned when a cache entry is incomplete or
+// can't be decoded, e.g. because the write that cached it was interrupted.
+// The repository treats such an entry as a cache miss.
+var ErrCorruptCacheEntry = errors.New("corrupt cache entry")
+
+// ErrNoteCachedAsMissing is returned by a cache lookup that finds the
+// tombstone cached by SetMissing, meaning the note is known not to exist.
+var ErrNoteCachedAsMissing = errors.New("note cached as missing")
+
+// missingNoteMarker is the value a tombstone is cached as in redis
+const missingNoteMarker = "__missing__"
+
+// CachedNote is a note as stored in the cache along with its rendered HTML
+type CachedNote struct {
+	Note
+	// HTML is the note's content rendered by the repository's renderer.
+	HTML string
+	// ContentEncoding is how the content is encoded in the cache, empty
+	// when it is stored as it is. See WithCacheCompression.
+	ContentEncoding string
+}
+
+// Cache is the storage the NoteRepository caches notes in
+type Cache interface {
+	// GetNote returns the note cached under key, or nil when it isn't cached.
+	// It returns ErrCorruptCacheEntry when the entry can't be decoded and
+	// ErrNoteCachedAsMissing when a tombstone is cached under key.
+	GetNote(ctx context.Context, key string) (*CachedNote, error)
+	// GetNotes returns the notes cached under each of the keys, in the
+	// order of the keys, with a nil note for each key that isn't cached,
+	// holds a tombstone or whose entry can't be decoded.
+	GetNotes(ctx context.Context, keys ...string) ([]*CachedNote, error)
+	// SetNote caches the note under each of the keys, replacing whatever
+	// was cached under them. A zero ttl means the cached entries never expire.
+	SetNote(ctx context.Context, note CachedNote, ttl time.Duration, keys ...string) error
+	// SetMissing caches a tombstone under key recording that the note
+	// doesn't exist, until ttl elapses.
+	SetMissing(ctx context.Context, key string, ttl time.Duration) error
+	// SetNotes caches each of the notes under its key, as SetNote would,
+	// with as few round trips as the cache allows.
+	SetNotes(ctx context.Context, notes map[string]CachedNote, ttl time.Duration) error
+	// DeleteKeys deletes the entries cached under the keys, ignoring missing keys.
+	DeleteKeys(ctx context.Context, keys ...string) error
+	// TTL returns the time left before the entry cached under key expires.
+	// Like redis, it returns -1 when the entry never expires and -2 when
+	// there is no entry under key.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Expire sets the time left before the entry cached under key expires.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// redisCache implements the Cache interface on top of redis, caching each
+// note in the format of its codec: a redis hash or a redis string
+type redisCache struct {
+	client redis.UniversalClient
+	codec  CacheCodec
+}
+
+// NewRedisCache is the factory function to create a Cache backed by redis
+// that stores each note in a redis hash
+// Parameters:
+// -  client: redis client, any of the single node, sentinel or cluster clients
+//
+// Returns:
+// - Cache: the redis backed cache
+func NewRedisCache(client redis.UniversalClient) Cache {
+	return NewRedisCacheWithCodec(client, NewHashCacheCodec())
+}
+
+// NewRedisJSONCache is the factory function to create a Cache backed by
+// redis that stores each note as a JSON string
+// Parameters:
+// -  client: redis client, any of the single node, sentinel or cluster clients
+//
+// Returns:
+// - Cache: the redis backed cache
+func NewRedisJSONCache(client redis.UniversalClient) Cache {
+	return NewRedisCacheWithCodec(client, NewJSONCacheCodec())
+}
+
+// NewRedisCacheWithCodec is the factory function to create a Cache backed
+// by redis that stores each note as encoded by the codec
+// Parameters:
+// -  client: redis client, any of the single node, sentinel or cluster clients
+// -  codec: converts notes to and from the values they are cached as
+//
+// Returns:
+// - Cache: the redis backed cache
+func NewRedisCacheWithCodec(client redis.UniversalClient, codec CacheCodec) Cache {
+	return &redisCache{client: client, codec: codec}
+}
+
+// GetNote will get the note stored under key
+func (cache *redisCache) GetNote(ctx context.Context, key string) (*CachedNote, error) {
+	cmd := cache.get(ctx, cache.client, key)
+	value, err := cache.cachedValue(cmd)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if value.missing() {
+		return nil, ErrNoteCachedAsMissing
+	}
+	note, err := cache.codec.Decode(*value)
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// GetNotes will get the notes stored under the keys with one read per key
+// in a single pipelined round trip. Like DEL, an MGET of keys that hash to
+// different slots fails on a redis cluster.
+func (cache *redisCache) GetNotes(ctx context.Context, keys ...string) ([]*CachedNote, error) {
+	notes := make([]*CachedNote, len(keys))
+	if len(keys) == 0 {
+		return notes, nil
+	}
+	cmds := make([]redis.Cmder, len(keys))
+	_, err := cache.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = cache.get(ctx, pipe, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		value, err := cache.cachedValue(cmd)
+		if err != nil || value == nil || value.missing() {
+			continue
+		}
+		note, err := cache.codec.Decode(*value)
+		if err != nil {
+			// a corrupt entry is left as a miss so the note is reloaded
+			continue
+		}
+		notes[i] = &note
+	}
+	return notes, nil
+}
+
+// get will queue the read of the value stored under key in the format of
+// the codec
+func (cache *redisCache) get(ctx context.Context, client redis.Cmdable, key string) redis.Cmder {
+	if cache.codec.Format() == CacheFormatHash {
+		return client.HGetAll(ctx, key)
+	}
+	return client.Get(ctx, key)
+}
+
+// cachedValue will return the value read by the command, or nil when
+// nothing is stored under its key
+func (cache *redisCache) cachedValue(cmd redis.Cmder) (*CacheValue, error) {
+	switch cmd := cmd.(type) {
+	case *redis.MapStringStringCmd:
+		fields, err := cmd.Result()
+		if err != nil || len(fields) == 0 {
+			return nil, err
+		}
+		return &CacheValue{Fields: fields}, nil
+	case *redis.StringCmd:
+		payload, err := cmd.Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &CacheValue{Payload: payload}, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis command %s", cmd.Name())
+	}
+}
+
+// set will queue the write of the value under key. A hash is deleted
+// before it is written so no field of what was cached before, such as a
+// tombstone, is left.
+func (cache *redisCache) set(ctx context.Context, pipe redis.Pipeliner, key string, value CacheValue, ttl time.Duration) {
+	if cache.codec.Format() == CacheFormatHash {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, value.Fields)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return
+	}
+	pipe.Set(ctx, key, value.Payload, ttl)
+}
+
+// SetNote will store the note under each of the keys. All the keys are
+// written in a single transaction pipeline so caching a note takes one
+// round trip.
+func (cache *redisCache) SetNote(ctx context.Context, note CachedNote, ttl time.Duration, keys ...string) error {
+	value, err := cache.codec.Encode(note)
+	if err != nil {
+		return err
+	}
+	_, err = cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			cache.set(ctx, pipe, key, value, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// SetNotes will store each of the notes under its key in a single
+// pipelined round trip
+func (cache *redisCache) SetNotes(ctx context.Context, notes map[string]CachedNote, ttl time.Duration) error {
+	values := make(map[string]CacheValue, len(notes))
+	for key, note := range notes {
+		value, err := cache.codec.Encode(note)
+		if err != nil {
+			return err
+		}
+		values[key] = value
+	}
+	_, err := cache.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, value := range values {
+			cache.set(ctx, pipe, key, value, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// SetMissing will store a tombstone under key, a hash with the marker as
+// its only field or the marker as a plain string
+func (cache *redisCache) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+	tombstone := CacheValue{Payload: []byte(missingNoteMarker)}
+	if cache.codec.Format() == CacheFormatHash {
+		tombstone = CacheValue{Fields: map[string]string{missingNoteMarker: "1"}}
+	}
+	_, err := cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		cache.set(ctx, pipe, key, tombstone, ttl)
+		return nil
+	})
+	return err
+}
+
+// DeleteKeys will delete the keys from redis, see deleteKeys
+func (cache *redisCache) DeleteKeys(ctx context.Context, keys ...string) error {
+	return deleteKeys(ctx, cache.client, keys...)
+}
+
+// deleteKeys will delete the keys from redis with one DEL per key, all sent
+// in a single pipelined round trip. A DEL of several keys fails with
+// CROSSSLOT on a redis cluster unless the keys hash to the same slot, which
+// a note's id and title keys don't, whereas the cluster client routes each
+// pipelined DEL to the node serving its key's slot.
+func deleteKeys(ctx context.Context, client redis.UniversalClient, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	return err
+}
+
+// TTL will return the TTL of the key in redis
+func (cache *redisCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return cache.client.TTL(ctx, key).Result()
+}
+
+// Expire will set the TTL of the key in redis
+func (cache *redisCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return cache.client.Expire(ctx, key, ttl).Err()
+}
+
+// memoryCacheEntry is a note held by the MemoryCache
+type memoryCacheEntry struct {
+	note CachedNote
+	// missing marks the entry as a tombstone
+	missing bool
+	// expiresAt is when the entry expires, the zero time means never
+	expiresAt time.Time
+}
+
+// expired will report whether the entry has expired at now
+func (entry memoryCacheEntry) expired(now time.Time) bool {
+	return !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt)
+}
+
+// MemoryCache implements the Cache interface with an in-memory map.
+// It is safe for concurrent use and is meant for tests that don't
+// need a redis server.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+// NewMemoryCache is the factory function to create a new empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryCacheEntry)}
+}
+
+// getEntry will return the entry under key, deleting it if it has expired.
+// The caller must hold the lock.
+func (cache *MemoryCache) getEntry(key string) (memoryCacheEntry, bool) {
+	entry, ok := cache.entries[key]
+	if ok && entry.expired(time.Now()) {
+		delete(cache.entries, key)
+		return memoryCacheEntry{}, false
+	}
+	return entry, ok
+}
+
+// GetNote will get the note stored under key
+func (cache *MemoryCache) GetNote(_ context.Context, key string) (*CachedNote, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.getEntry(key)
+	if !ok {
+		return nil, nil
+	}
+	if entry.missing {
+		return nil, ErrNoteCachedAsMissing
+	}
+	note := entry.note
+	return &note, nil
+}
+
+// GetNotes will get the notes stored under the keys
+func (cache *MemoryCache) GetNotes(_ context.Context, keys ...string) ([]*CachedNote, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	notes := make([]*CachedNote, len(keys))
+	for i, key := range keys {
+		if entry, ok := cache.getEntry(key); ok && !entry.missing {
+			note := entry.note
+			notes[i] = &note
+		}
+	}
+	return notes, nil
+}
+
+// SetNote will store the note under each of the keys
+func (cache *MemoryCache) SetNote(_ context.Context, note CachedNote, ttl time.Duration, keys ...string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry := memoryCacheEntry{note: note}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	for _, key := range keys {
+		cache.entries[key] = entry
+	}
+	return nil
+}
+
+// SetMissing will store a tombstone under key
+func (cache *MemoryCache) SetMissing(_ context.Context, key string, ttl time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry := memoryCacheEntry{missing: true}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	cache.entries[key] = entry
+	return nil
+}
+
+// SetNotes will store each of the notes under its key
+func (cache *MemoryCache) SetNotes(_ context.Context, notes map[string]CachedNote, ttl time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	for key, note := range notes {
+		cache.entries[key] = memoryCacheEntry{note: note, expiresAt: expiresAt}
+	}
+	return nil
+}
+
+// DeleteKeys will delete the entries stored under the keys
+func (cache *MemoryCache) DeleteKeys(_ context.Context, keys ...string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, key := range keys {
+		delete(cache.entries, key)
+	}
+	return nil
+}
+
+// TTL will return the time left before the entry under key expires
+func (cache *MemoryCache) TTL(_ context.Context, key string) (time.Duration, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.getEntry(key)
+	if !ok {
+		return -2, nil
+	}
+	if entry.expiresAt.IsZero() {
+		return -1, nil
+	}
+	return time.Until(entry.expiresAt), nil
+}
+
+// Expire will set the time left before the entry under key expires
+func (cache *MemoryCache) Expire(_ context.Context, key string, ttl time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.getEntry(key)
+	if !ok {
+		return nil
+	}
+	entry.expiresAt = time.Now().Add(ttl)
+	cache.entries[key] = entry
+	return nil
+}
+
+// noCache is the Cache of a repository with caching disabled, nothing is
+// ever cached so every call is a no-op
+type noCache struct{}
+
+// GetNote will report that nothing is cached under key
+func (noCache) GetNote(context.Context, string) (*CachedNote, error) {
+	return nil, nil
+}
+
+// GetNotes will report that nothing is cached under any of the keys
+func (noCache) GetNotes(_ context.Context, keys ...string) ([]*CachedNote, error) {
+	return make([]*CachedNote, len(keys)), nil
+}
+
+// SetNote will do nothing
+func (noCache) SetNote(context.Context, CachedNote, time.Duration, ...string) error {
+	return nil
+}
+
+// SetMissing will do nothing
+func (noCache) SetMissing(context.Context, string, time.Duration) error {
+	return nil
+}
+
+// SetNotes will do nothing
+func (noCache) SetNotes(context.Context, map[string]CachedNote, time.Duration) error {
+	return nil
+}
+
+// DeleteKeys will do nothing
+func (noCache) DeleteKeys(context.Context, ...string) error {
+	return nil
+}
+
+// TTL will report that there is no entry under key
+func (noCache) TTL(context.Context, string) (time.Duration, error) {
+	return -2, nil
+}
+
+// Expire will do nothing
+func (noCache) Expire(context.Context, string, time.Duration) error {
+	return nil
+}
@@ -0,0 +1,350 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"strconv"
+	"time"
+)
+
+// CacheFormat is the redis type a CacheCodec caches notes as
+type CacheFormat int
+
+const (
+	// CacheFormatHash caches each note as a redis hash with a field per
+	// attribute, which stays readable with HGETALL when debugging
+	CacheFormatHash CacheFormat = iota
+	// CacheFormatString caches each note as a redis string holding the
+	// encoded note, which is read and written with a single GET or SET
+	CacheFormatString
+)
+
+// CacheValue is a note as encoded by a CacheCodec. Fields is set for the
+// codecs whose format is CacheFormatHash and Payload for the others.
+type CacheValue struct {
+	// Fields are the fields of the note's redis hash
+	Fields map[string]string
+	// Payload is the content of the note's redis string
+	Payload []byte
+}
+
+// missing will report whether the value is the tombstone cached by SetMissing
+func (value CacheValue) missing() bool {
+	if value.Fields != nil {
+		_, ok := value.Fields[missingNoteMarker]
+		return ok
+	}
+	return string(value.Payload) == missingNoteMarker
+}
+
+// cacheSchemaVersion is the version of the shape notes are cached in. It
+// is cached with every note and must be bumped whenever a change to the
+// cached fields would make the entries cached before it decode wrongly,
+// so those entries are treated as misses and cached again rather than
+// flushed by hand. Entries cached before notes carried a version are
+// version 1.
+const cacheSchemaVersion = 1
+
+// schemaVersionField is the field the schema version is cached in
+const schemaVersionField = "v"
+
+// ErrStaleCacheEntry is returned when a cache entry was cached with
+// another schema version. It is an ErrCorruptCacheEntry so the entry is
+// discarded and the note reloaded from postgres.
+var ErrStaleCacheEntry = fmt.Errorf("%w: stale schema version", ErrCorruptCacheEntry)
+
+// checkSchemaVersion will return ErrStaleCacheEntry unless the entry was
+// cached with the schema version
+func checkSchemaVersion(cached int, schemaVersion int) error {
+	if cached == 0 {
+		cached = 1
+	}
+	if cached != schemaVersion {
+		return fmt.Errorf("%w %d, want %d", ErrStaleCacheEntry, cached, schemaVersion)
+	}
+	return nil
+}
+
+// CacheCodec converts notes to and from the values the redis cache stores
+// them as, see NewRedisCacheWithCodec and WithCacheCodec.
+type CacheCodec interface {
+	// Format is the redis type the notes are cached as
+	Format() CacheFormat
+	// Encode converts the note to the value it is cached as
+	Encode(note CachedNote) (CacheValue, error)
+	// Decode converts a cached value back to the note. It returns
+	// ErrCorruptCacheEntry when the value can't be decoded.
+	Decode(value CacheValue) (CachedNote, error)
+}
+
+// hashCacheCodec caches each note as a redis hash
+type hashCacheCodec struct {
+	// schemaVersion is the schema version notes are cached and read with
+	schemaVersion int
+}
+
+// NewHashCacheCodec is the factory function to create the codec that
+// caches each note as a redis hash, the format used by NewRedisCache
+func NewHashCacheCodec() CacheCodec {
+	return hashCacheCodec{schemaVersion: cacheSchemaVersion}
+}
+
+// Format will return CacheFormatHash
+func (hashCacheCodec) Format() CacheFormat {
+	return CacheFormatHash
+}
+
+// Encode will convert the note to the fields of its redis hash
+func (codec hashCacheCodec) Encode(note CachedNote) (CacheValue, error) {
+	fields, err := convertNoteToMap(note)
+	if err != nil {
+		return CacheValue{}, err
+	}
+	fields[schemaVersionField] = strconv.Itoa(codec.schemaVersion)
+	return CacheValue{Fields: fields}, nil
+}
+
+// Decode will convert the fields of a redis hash back to the note. It
+// returns ErrStaleCacheEntry when the hash has another schema version.
+func (codec hashCacheCodec) Decode(value CacheValue) (CachedNote, error) {
+	cachedVersion := 0
+	if rawVersion, ok := value.Fields[schemaVersionField]; ok {
+		var err error
+		cachedVersion, err = strconv.Atoi(rawVersion)
+		if err != nil || cachedVersion <= 0 {
+			return CachedNote{}, fmt.Errorf("%w: invalid schema version %q", ErrCorruptCacheEntry, rawVersion)
+		}
+	}
+	if err := checkSchemaVersion(cachedVersion, codec.schemaVersion); err != nil {
+		return CachedNote{}, err
+	}
+	return convertMapToNote(value.Fields)
+}
+
+// jsonCacheCodec caches each note as a JSON string
+type jsonCacheCodec struct {
+	// schemaVersion is the schema version notes are cached and read with
+	schemaVersion int
+}
+
+// NewJSONCacheCodec is the factory function to create the codec that
+// caches each note as a JSON string, the format used by NewRedisJSONCache.
+// Reading a note back doesn't depend on how redis stringifies each field.
+func NewJSONCacheCodec() CacheCodec {
+	return jsonCacheCodec{schemaVersion: cacheSchemaVersion}
+}
+
+// Format will return CacheFormatString
+func (jsonCacheCodec) Format() CacheFormat {
+	return CacheFormatString
+}
+
+// Encode will convert the note to the JSON payload it is cached as
+func (codec jsonCacheCodec) Encode(note CachedNote) (CacheValue, error) {
+	payload, err := encodeJSONNote(note, codec.schemaVersion)
+	if err != nil {
+		return CacheValue{}, err
+	}
+	return CacheValue{Payload: payload}, nil
+}
+
+// Decode will convert the JSON payload back to the note. It returns
+// ErrStaleCacheEntry when the payload has another schema version.
+func (codec jsonCacheCodec) Decode(value CacheValue) (CachedNote, error) {
+	note, err := decodeJSONNote(value.Payload, codec.schemaVersion)
+	if err != nil {
+		return CachedNote{}, err
+	}
+	return *note, nil
+}
+
+// requiredNoteFields are the hash fields every cached note has. A hash
+// missing any of them was only partially written.
+var requiredNoteFields = []string{"id", "title", "content", "created_at", "updated_at"}
+
+// convertMapToNote will convert a map[string]string to a CachedNote object
+// Parameters:
+// -    noteMap: map[string]string that holds the note data
+// Returns:
+// - CachedNote: the resulting note object
+// - error: ErrCorruptCacheEntry wrapped with the reason when a required
+// field is missing or a field can't be converted
+func convertMapToNote(noteMap map[string]string) (CachedNote, error) {
+	for _, field := range requiredNoteFields {
+		if _, ok := noteMap[field]; !ok {
+			return CachedNote{}, fmt.Errorf("%w: missing field %s", ErrCorruptCacheEntry, field)
+		}
+	}
+	// convert the id from string to integer
+	noteID, err := strconv.Atoi(noteMap["id"])
+	if err != nil || noteID <= 0 {
+		return CachedNote{}, fmt.Errorf("%w: invalid id %q", ErrCorruptCacheEntry, noteMap["id"])
+	}
+	// parse the created_at time string
+	createdAt, err := time.Parse(time.RFC3339Nano, noteMap["created_at"])
+	if err != nil {
+		return CachedNote{}, fmt.Errorf("%w: invalid created_at: %w", ErrCorruptCacheEntry, err)
+	}
+	// parse the updated_at time string
+	updatedAt, err := time.Parse(time.RFC3339Nano, noteMap["updated_at"])
+	if err != nil {
+		return CachedNote{}, fmt.Errorf("%w: invalid updated_at: %w", ErrCorruptCacheEntry, err)
+	}
+	// convert the word count, entries cached before it was tracked don't have one
+	wordCount := 0
+	if rawWordCount, ok := noteMap["word_count"]; ok {
+		wordCount, err = strconv.Atoi(rawWordCount)
+		if err != nil {
+			return CachedNote{}, fmt.Errorf("%w: invalid word_count: %w", ErrCorruptCacheEntry, err)
+		}
+	}
+	// convert the version, entries cached before it was tracked don't have one
+	version := 0
+	if rawVersion, ok := noteMap["version"]; ok {
+		version, err = strconv.Atoi(rawVersion)
+		if err != nil {
+			return CachedNote{}, fmt.Errorf("%w: invalid version: %w", ErrCorruptCacheEntry, err)
+		}
+	}
+	// convert the author, entries cached before notes had authors don't have one
+	authorID := 0
+	if rawAuthorID, ok := noteMap["author_id"]; ok {
+		authorID, err = strconv.Atoi(rawAuthorID)
+		if err != nil || authorID < 0 {
+			return CachedNote{}, fmt.Errorf("%w: invalid author_id %q", ErrCorruptCacheEntry, rawAuthorID)
+		}
+	}
+	// decode the tags, entries cached before notes were tagged don't have any
+	var tags []string
+	if rawTags, ok := noteMap["tags"]; ok {
+		if err := json.Unmarshal([]byte(rawTags), &tags); err != nil {
+			return CachedNote{}, fmt.Errorf("%w: invalid tags: %w", ErrCorruptCacheEntry, err)
+		}
+	}
+
+	note := CachedNote{
+		Note: Note{
+			Model: gorm.Model{
+				ID:        uint(noteID),
+				CreatedAt: createdAt,
+				UpdatedAt: updatedAt,
+			},
+			AuthorID:  uint(authorID),
+			Title:     noteMap["title"],
+			Content:   noteMap["content"],
+			WordCount: wordCount,
+			Version:   version,
+			Tags:      tags,
+		},
+		HTML:            noteMap["html"],
+		ContentEncoding: noteMap["content_encoding"],
+	}
+	// decompress the content of a note cached compressed
+	if err := decompressContent(&note); err != nil {
+		return CachedNote{}, err
+	}
+	return note, nil
+}
+
+// convertNoteToMap will convert the note to the fields of its redis hash.
+// Timestamps are stored as RFC3339Nano strings in UTC so they are read
+// back by convertMapToNote to the nanosecond.
+func convertNoteToMap(note CachedNote) (map[string]string, error) {
+	// hash fields are flat strings so the tags are stored as a JSON array
+	tags, err := json.Marshal(note.Tags)
+	if err != nil {
+		return nil, err
+	}
+	noteMap := map[string]string{
+		"id":         strconv.FormatUint(uint64(note.ID), 10),
+		"author_id":  strconv.FormatUint(uint64(note.AuthorID), 10),
+		"title":      note.Title,
+		"content":    note.Content,
+		"word_count": strconv.Itoa(note.WordCount),
+		"version":    strconv.Itoa(note.Version),
+		"tags":       string(tags),
+		"created_at": note.CreatedAt.UTC().Format(time.RFC3339Nano),
+		"updated_at": note.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		"html":       note.HTML,
+	}
+	if note.ContentEncoding != "" {
+		noteMap["content_encoding"] = note.ContentEncoding
+	}
+	return noteMap, nil
+}
+
+// jsonNote is the JSON payload a note is cached as. It is kept separate
+// from Note so the cached format doesn't change with the Note struct.
+type jsonNote struct {
+	// SchemaVersion is the schema version the note was cached with
+	SchemaVersion int       `json:"v,omitempty"`
+	ID            uint      `json:"id"`
+	AuthorID      uint      `json:"author_id,omitempty"`
+	Title         string    `json:"title"`
+	Content       string    `json:"content"`
+	WordCount     int       `json:"word_count"`
+	Version       int       `json:"version"`
+	Tags          []string  `json:"tags,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	HTML          string    `json:"html"`
+	// ContentEncoding is set when the content is compressed
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// decodeJSONNote will convert the JSON payload a note is cached as
+// back to a CachedNote, provided it was cached with the schema version
+func decodeJSONNote(payload []byte, schemaVersion int) (*CachedNote, error) {
+	var cached jsonNote
+	if err := json.Unmarshal(payload, &cached); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptCacheEntry, err)
+	}
+	if err := checkSchemaVersion(cached.SchemaVersion, schemaVersion); err != nil {
+		return nil, err
+	}
+	if cached.ID == 0 {
+		return nil, fmt.Errorf("%w: missing id", ErrCorruptCacheEntry)
+	}
+	note := &CachedNote{
+		Note: Note{
+			Model: gorm.Model{
+				ID:        cached.ID,
+				CreatedAt: cached.CreatedAt,
+				UpdatedAt: cached.UpdatedAt,
+			},
+			AuthorID:  cached.AuthorID,
+			Title:     cached.Title,
+			Content:   cached.Content,
+			WordCount: cached.WordCount,
+			Version:   cached.Version,
+			Tags:      cached.Tags,
+		},
+		HTML:            cached.HTML,
+		ContentEncoding: cached.ContentEncoding,
+	}
+	// decompress the content of a note cached compressed
+	if err := decompressContent(note); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// encodeJSONNote will convert the note to the JSON payload it is cached
+// as with the schema version
+func encodeJSONNote(note CachedNote, schemaVersion int) ([]byte, error) {
+	return json.Marshal(jsonNote{
+		SchemaVersion:   schemaVersion,
+		ID:              note.ID,
+		AuthorID:        note.AuthorID,
+		Title:           note.Title,
+		Content:         note.Content,
+		WordCount:       note.WordCount,
+		Version:         note.Version,
+		Tags:            note.Tags,
+		CreatedAt:       note.CreatedAt,
+		UpdatedAt:       note.UpdatedAt,
+		HTML:            note.HTML,
+		ContentEncoding: note.ContentEncoding,
+	})
+}
@@ -0,0 +1,192 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+)
+
+// contentEncodingGzip is the ContentEncoding of a cached note whose content
+// and HTML are gzipped and base64 encoded, base64 so they survive the JSON
+// cache format
+const contentEncodingGzip = "gzip"
+
+// compressingCache decorates a Cache by gzipping the content, and the HTML
+// rendered from it, of the notes larger than threshold before they are
+// cached and decompressing them when they are read, so large notes take
+// less redis memory. Smaller notes are cached as they are since compressing
+// them saves little. The redis caches decompress the entries they read
+// themselves, so a repository created without compression still reads the
+// notes compressed by one created with it.
+type compressingCache struct {
+	cache Cache
+	// threshold is the content size in bytes above which content is compressed
+	threshold int
+}
+
+// WithCacheCompression makes the repository gzip the content and rendered
+// HTML of the notes whose content is larger than threshold bytes before
+// caching them. They are decompressed transparently when the note is read
+// from the cache. Entries cached without compression are still read as
+// they are.
+// By default content is cached uncompressed.
+func WithCacheCompression(threshold int) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.compressionThreshold = threshold
+	}
+}
+
+// withCompression will wrap the cache so large contents are compressed as
+// configured by WithCacheCompression, or return it as it is when they aren't
+func (repo *NoteRepository) withCompression(cache Cache) Cache {
+	if repo.compressionThreshold <= 0 {
+		return cache
+	}
+	return &compressingCache{cache: cache, threshold: repo.compressionThreshold}
+}
+
+// compress will gzip the note's content and HTML when the content is
+// larger than the threshold
+func (cache *compressingCache) compress(note CachedNote) (CachedNote, error) {
+	if len(note.Content) <= cache.threshold || note.ContentEncoding != "" {
+		return note, nil
+	}
+	content, err := gzipString(note.Content)
+	if err != nil {
+		return CachedNote{}, err
+	}
+	html, err := gzipString(note.HTML)
+	if err != nil {
+		return CachedNote{}, err
+	}
+	note.Content, note.HTML = content, html
+	note.ContentEncoding = contentEncodingGzip
+	return note, nil
+}
+
+// gzipString will return the base64 encoding of the gzipped text
+func gzipString(text string) (string, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// gunzipString will return the text gzipString encoded
+func gunzipString(encoded string) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", err
+	}
+	text, err := io.ReadAll(reader)
+	return string(text), err
+}
+
+// decompressContent will restore the content and HTML of a note cached
+// compressed
+// Returns:
+// - error: ErrCorruptCacheEntry when the encoding is unknown or the
+// content can't be decompressed
+func decompressContent(note *CachedNote) error {
+	switch note.ContentEncoding {
+	case "":
+		return nil
+	case contentEncodingGzip:
+	default:
+		return fmt.Errorf("%w: unknown content_encoding %q", ErrCorruptCacheEntry, note.ContentEncoding)
+	}
+	content, err := gunzipString(note.Content)
+	if err != nil {
+		return fmt.Errorf("%w: invalid compressed content: %w", ErrCorruptCacheEntry, err)
+	}
+	html, err := gunzipString(note.HTML)
+	if err != nil {
+		return fmt.Errorf("%w: invalid compressed html: %w", ErrCorruptCacheEntry, err)
+	}
+	note.Content, note.HTML = content, html
+	note.ContentEncoding = ""
+	return nil
+}
+
+// GetNote will get the note stored under key with its content decompressed
+func (cache *compressingCache) GetNote(ctx context.Context, key string) (*CachedNote, error) {
+	note, err := cache.cache.GetNote(ctx, key)
+	if err != nil || note == nil {
+		return note, err
+	}
+	if err := decompressContent(note); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// GetNotes will get the notes stored under the keys with their contents
+// decompressed, with a nil note for each note that can't be decompressed
+func (cache *compressingCache) GetNotes(ctx context.Context, keys ...string) ([]*CachedNote, error) {
+	notes, err := cache.cache.GetNotes(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	for i, note := range notes {
+		if note != nil && decompressContent(note) != nil {
+			notes[i] = nil
+		}
+	}
+	return notes, nil
+}
+
+// SetNote will store the note under the keys, compressing its content
+// when it is large
+func (cache *compressingCache) SetNote(ctx context.Context, note CachedNote, ttl time.Duration, keys ...string) error {
+	note, err := cache.compress(note)
+	if err != nil {
+		return err
+	}
+	return cache.cache.SetNote(ctx, note, ttl, keys...)
+}
+
+// SetMissing will store a tombstone under key
+func (cache *compressingCache) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+	return cache.cache.SetMissing(ctx, key, ttl)
+}
+
+// SetNotes will store the notes under their keys, compressing the large contents
+func (cache *compressingCache) SetNotes(ctx context.Context, notes map[string]CachedNote, ttl time.Duration) error {
+	compressed := make(map[string]CachedNote, len(notes))
+	for key, note := range notes {
+		note, err := cache.compress(note)
+		if err != nil {
+			return err
+		}
+		compressed[key] = note
+	}
+	return cache.cache.SetNotes(ctx, compressed, ttl)
+}
+
+// DeleteKeys will delete the keys
+func (cache *compressingCache) DeleteKeys(ctx context.Context, keys ...string) error {
+	return cache.cache.DeleteKeys(ctx, keys...)
+}
+
+// TTL will get the time left before the entry under key expires
+func (cache *compressingCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return cache.cache.TTL(ctx, key)
+}
+
+// Expire will set the time left before the entry under key expires
+func (cache *compressingCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return cache.cache.Expire(ctx, key, ttl)
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// retryingCache decorates a Cache by retrying the calls that fail, waiting
+// an exponentially growing backoff between attempts, so a momentary redis
+// blip doesn't fail the call. Corrupt entries, tombstones and cancelled
+// contexts aren't retried since retrying can't change the outcome.
+type retryingCache struct {
+	cache Cache
+	// attempts is the number of times a call is made before giving up
+	attempts int
+	// backoff is the wait before the second attempt, it doubles for
+	// every attempt after that
+	backoff time.Duration
+}
+
+// WithCacheRetry makes the repository make each cache call up to attempts
+// times, waiting backoff before the second attempt and twice as long before
+// every attempt after that. Reads that still fail are served by postgres
+// instead. By default cache calls are made once.
+func WithCacheRetry(attempts int, backoff time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.cacheAttempts = attempts
+		repo.cacheBackoff = backoff
+	}
+}
+
+// withRetries will wrap the cache so its calls are retried as configured
+// by WithCacheRetry, or return it as it is when calls aren't retried
+func (repo *NoteRepository) withRetries(cache Cache) Cache {
+	if repo.cacheAttempts <= 1 {
+		return cache
+	}
+	return &retryingCache{cache: cache, attempts: repo.cacheAttempts, backoff: repo.cacheBackoff}
+}
+
+// retry will call fn until it succeeds or the attempts run out and return
+// the error of the last attempt
+func (cache *retryingCache) retry(ctx context.Context, fn func() error) error {
+	backoff := cache.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= cache.attempts || errors.Is(err, ErrCorruptCacheEntry) || errors.Is(err, ErrNoteCachedAsMissing) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// GetNote will get the note stored under key, retrying failed attempts
+func (cache *retryingCache) GetNote(ctx context.Context, key string) (note *CachedNote, err error) {
+	err = cache.retry(ctx, func() error {
+		note, err = cache.cache.GetNote(ctx, key)
+		return err
+	})
+	return note, err
+}
+
+// GetNotes will get the notes stored under the keys, retrying failed attempts
+func (cache *retryingCache) GetNotes(ctx context.Context, keys ...string) (notes []*CachedNote, err error) {
+	err = cache.retry(ctx, func() error {
+		notes, err = cache.cache.GetNotes(ctx, keys...)
+		return err
+	})
+	return notes, err
+}
+
+// SetNote will store the note under each of the keys, retrying failed attempts
+func (cache *retryingCache) SetNote(ctx context.Context, note CachedNote, ttl time.Duration, keys ...string) error {
+	return cache.retry(ctx, func() error {
+		return cache.cache.SetNote(ctx, note, ttl, keys...)
+	})
+}
+
+// SetMissing will store a tombstone under key, retrying failed attempts
+func (cache *retryingCache) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+	return cache.retry(ctx, func() error {
+		return cache.cache.SetMissing(ctx, key, ttl)
+	})
+}
+
+// SetNotes will store each of the notes under its key, retrying failed attempts
+func (cache *retryingCache) SetNotes(ctx context.Context, notes map[string]CachedNote, ttl time.Duration) error {
+	return cache.retry(ctx, func() error {
+		return cache.cache.SetNotes(ctx, notes, ttl)
+	})
+}
+
+// DeleteKeys will delete the entries stored under the keys, retrying failed attempts
+func (cache *retryingCache) DeleteKeys(ctx context.Context, keys ...string) error {
+	return cache.retry(ctx, func() error {
+		return cache.cache.DeleteKeys(ctx, keys...)
+	})
+}
+
+// TTL will get the time left before the entry under key expires, retrying failed attempts
+func (cache *retryingCache) TTL(ctx context.Context, key string) (ttl time.Duration, err error) {
+	err = cache.retry(ctx, func() error {
+		ttl, err = cache.cache.TTL(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+// Expire will set the time left before the entry under key expires, retrying failed attempts
+func (cache *retryingCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return cache.retry(ctx, func() error {
+		return cache.cache.Expire(ctx, key, ttl)
+	})
+}
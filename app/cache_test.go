@@ -0,0 +1,1419 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
+	"html"
+	"log/slog"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// the repository and the redis caches depend on redis.UniversalClient so
+// they work with each of the clients go-redis provides
+var (
+	_ redis.UniversalClient = (*redis.Client)(nil)
+	_ redis.UniversalClient = (*redis.ClusterClient)(nil)
+	_ redis.UniversalClient = (*redis.Ring)(nil)
+)
+
+// recordingHandler is a slog handler that keeps the records it handles.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (handler *recordingHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (handler *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.records = append(handler.records, record)
+	return nil
+}
+
+func (handler *recordingHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return handler
+}
+
+func (handler *recordingHandler) WithGroup(string) slog.Handler {
+	return handler
+}
+
+// find will return the first record with the message
+func (handler *recordingHandler) find(message string) (slog.Record, bool) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	for _, record := range handler.records {
+		if record.Message == message {
+			return record, true
+		}
+	}
+	return slog.Record{}, false
+}
+
+// MemoryCacheTestSuite tests the caches, and the repository's use of them,
+// over a memory cache
+type MemoryCacheTestSuite struct {
+	mockRepositorySuite
+}
+
+// flakyCache is a Cache whose calls fail until failures calls have been
+// made, after which they are served by the wrapped cache
+type flakyCache struct {
+	Cache
+	failures int
+	calls    int
+}
+
+// call will count the call and return an error while the cache is failing
+func (cache *flakyCache) call() error {
+	cache.calls++
+	if cache.calls <= cache.failures {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (cache *flakyCache) GetNote(ctx context.Context, key string) (*CachedNote, error) {
+	if err := cache.call(); err != nil {
+		return nil, err
+	}
+	return cache.Cache.GetNote(ctx, key)
+}
+
+func (cache *flakyCache) SetNote(ctx context.Context, note CachedNote, ttl time.Duration, keys ...string) error {
+	if err := cache.call(); err != nil {
+		return err
+	}
+	return cache.Cache.SetNote(ctx, note, ttl, keys...)
+}
+
+func (suite *MemoryCacheTestSuite) TestSetGetAndDeleteNote() {
+	note := CachedNote{
+		Note: Note{Model: gorm.Model{ID: 1}, Title: "Cached", Content: "Cached content"},
+		HTML: "Cached content",
+	}
+	suite.NoError(suite.cache.SetNote(suite.ctx, note, 0, "notes:1", "notes:Cached"))
+
+	for _, key := range []string{"notes:1", "notes:Cached"} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.Equal(&note, cachedNote)
+	}
+
+	suite.NoError(suite.cache.DeleteKeys(suite.ctx, "notes:1", "notes:missing"))
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:1")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+	cachedNote, err = suite.cache.GetNote(suite.ctx, "notes:Cached")
+	suite.NoError(err)
+	suite.NotNil(cachedNote)
+}
+
+func (suite *MemoryCacheTestSuite) TestTTL() {
+	ttl, err := suite.cache.TTL(suite.ctx, "notes:1")
+	suite.NoError(err)
+	suite.Equal(time.Duration(-2), ttl)
+
+	suite.NoError(suite.cache.SetNote(suite.ctx, CachedNote{}, 0, "notes:1"))
+	ttl, err = suite.cache.TTL(suite.ctx, "notes:1")
+	suite.NoError(err)
+	suite.Equal(time.Duration(-1), ttl)
+
+	suite.NoError(suite.cache.Expire(suite.ctx, "notes:1", time.Minute))
+	ttl, err = suite.cache.TTL(suite.ctx, "notes:1")
+	suite.NoError(err)
+	suite.Greater(ttl, time.Duration(0))
+	suite.LessOrEqual(ttl, time.Minute)
+
+	// expired entries are treated as missing
+	suite.NoError(suite.cache.SetNote(suite.ctx, CachedNote{}, time.Millisecond, "notes:2"))
+	time.Sleep(5 * time.Millisecond)
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:2")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+	ttl, err = suite.cache.TTL(suite.ctx, "notes:2")
+	suite.NoError(err)
+	suite.Equal(time.Duration(-2), ttl)
+}
+
+func (suite *MemoryCacheTestSuite) TestRedisClientTopologies() {
+	// creating a client doesn't connect to redis so the repository can be
+	// built with each topology without a server
+	clients := map[string]redis.UniversalClient{
+		"Single node": redis.NewClient(&redis.Options{Addr: "localhost:6379"}),
+		"Sentinel": redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    "mymaster",
+			SentinelAddrs: []string{"localhost:26379", "localhost:26380"},
+		}),
+		"Cluster": redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"localhost:7000", "localhost:7001"}}),
+		"Universal options": redis.NewUniversalClient(&redis.UniversalOptions{
+			MasterName: "mymaster",
+			Addrs:      []string{"localhost:26379"},
+		}),
+	}
+	for name, client := range clients {
+		suite.Run(name, func() {
+			suite.T().Cleanup(func() {
+				client.Close()
+			})
+			repo := NewNoteRepository(nil, client)
+			suite.Equal(client, repo.redis)
+			// the redis cache is bounded by the default cache timeout
+			suite.Equal(&timeoutCache{cache: NewRedisCache(client), timeout: DefaultCacheTimeout}, repo.cache)
+		})
+	}
+}
+
+// pipelineRecorder is a redis hook that records the pipelines sent to redis
+// without sending them, so commands can be inspected without a server
+type pipelineRecorder struct {
+	pipelines [][]string
+}
+
+func (recorder *pipelineRecorder) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (recorder *pipelineRecorder) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (recorder *pipelineRecorder) ProcessPipelineHook(redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(_ context.Context, cmds []redis.Cmder) error {
+		pipeline := make([]string, 0, len(cmds))
+		for _, cmd := range cmds {
+			pipeline = append(pipeline, cmd.String())
+		}
+		recorder.pipelines = append(recorder.pipelines, pipeline)
+		return nil
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestClusterKeys() {
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"localhost:7000", "localhost:7001"}})
+	suite.T().Cleanup(func() {
+		client.Close()
+	})
+	recorder := &pipelineRecorder{}
+	client.AddHook(recorder)
+
+	// the keys hash to different slots, 1872 and 11708, so each is deleted
+	// by its own command, all sent in one round trip
+	for _, cache := range []Cache{NewRedisCache(client), NewRedisJSONCache(client)} {
+		recorder.pipelines = nil
+		suite.NoError(cache.DeleteKeys(suite.ctx, "notes:id:1", "notes:title:Foo"))
+		suite.Equal([][]string{{"del notes:id:1: 0", "del notes:title:Foo: 0"}}, recorder.pipelines)
+	}
+
+	recorder.pipelines = nil
+	_, err := NewRedisJSONCache(client).GetNotes(suite.ctx, "notes:id:1", "notes:id:2")
+	suite.NoError(err)
+	suite.Equal([][]string{{"get notes:id:1: ", "get notes:id:2: "}}, recorder.pipelines)
+
+	repo := NewNoteRepositoryWithCluster(nil, []string{"localhost:7000"})
+	suite.IsType(&redis.ClusterClient{}, repo.redis)
+	suite.NoError(repo.redis.Close())
+}
+
+func (suite *MemoryCacheTestSuite) TestConvertMapToNote() {
+	complete := map[string]string{
+		"id":         "1",
+		"title":      "Cached",
+		"content":    "Cached content",
+		"created_at": "2024-01-02T03:04:05.123456Z",
+		"updated_at": "2024-01-02T03:04:05.123456Z",
+	}
+	note, err := convertMapToNote(complete)
+	suite.NoError(err)
+	suite.Equal(uint(1), note.ID)
+	suite.Equal("Cached", note.Title)
+
+	// with returns a copy of the complete map with the field changed, an
+	// empty value deletes the field
+	with := func(field, value string) map[string]string {
+		noteMap := map[string]string{}
+		for k, v := range complete {
+			noteMap[k] = v
+		}
+		if value == "" {
+			delete(noteMap, field)
+		} else {
+			noteMap[field] = value
+		}
+		return noteMap
+	}
+	testCases := []struct {
+		name    string
+		noteMap map[string]string
+	}{
+		{"Empty map", map[string]string{}},
+		{"Only the html was written", map[string]string{"html": "Cached content"}},
+		{"Missing id", with("id", "")},
+		{"Missing title", with("title", "")},
+		{"Missing content", with("content", "")},
+		{"Missing updated_at", with("updated_at", "")},
+		{"Malformed id", with("id", "abc")},
+		{"Zero id", with("id", "0")},
+		{"Malformed created_at", with("created_at", "yesterday")},
+		{"Malformed updated_at", with("updated_at", "2024-13-45")},
+		{"Malformed word_count", with("word_count", "many")},
+		{"Malformed version", with("version", "v1")},
+		{"Malformed tags", with("tags", "[food")},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			_, err := convertMapToNote(tc.noteMap)
+			suite.ErrorIs(err, ErrCorruptCacheEntry)
+		})
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestTimestampsRoundTrip() {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.FixedZone("WAT", 3600))
+	note := CachedNote{Note: Note{
+		Model: gorm.Model{ID: 1, CreatedAt: createdAt, UpdatedAt: createdAt.Add(time.Nanosecond)},
+		Title: "Timed", Content: "Timed content",
+	}}
+
+	suite.Run("Hash", func() {
+		noteMap, err := convertNoteToMap(note)
+		suite.NoError(err)
+		decoded, err := convertMapToNote(noteMap)
+		suite.NoError(err)
+		suite.True(note.CreatedAt.Equal(decoded.CreatedAt), decoded.CreatedAt)
+		suite.True(note.UpdatedAt.Equal(decoded.UpdatedAt), decoded.UpdatedAt)
+	})
+
+	suite.Run("JSON", func() {
+		payload, err := encodeJSONNote(note, cacheSchemaVersion)
+		suite.NoError(err)
+		decoded, err := decodeJSONNote(payload, cacheSchemaVersion)
+		suite.NoError(err)
+		suite.True(note.CreatedAt.Equal(decoded.CreatedAt), decoded.CreatedAt)
+		suite.True(note.UpdatedAt.Equal(decoded.UpdatedAt), decoded.UpdatedAt)
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestDecodeJSONNote() {
+	for _, payload := range []string{"", "{", `{"title": "No id"}`, `{"id": "1"}`} {
+		_, err := decodeJSONNote([]byte(payload), cacheSchemaVersion)
+		suite.ErrorIs(err, ErrCorruptCacheEntry, payload)
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheCodecs() {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	note := CachedNote{
+		Note: Note{
+			Model:    gorm.Model{ID: 3, CreatedAt: now, UpdatedAt: now},
+			AuthorID: 2, Title: "Codec", Content: "Codec content", WordCount: 2, Version: 4, Tags: []string{"a", "b"},
+		},
+		HTML: "Codec content",
+	}
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	suite.T().Cleanup(func() {
+		client.Close()
+	})
+	recorder := &pipelineRecorder{}
+	client.AddHook(recorder)
+
+	for _, tc := range []struct {
+		name    string
+		codec   CacheCodec
+		corrupt CacheValue
+		// commands are the commands caching the note
+		commands []string
+	}{
+		{"Hash", NewHashCacheCodec(), CacheValue{Fields: map[string]string{"id": "3"}}, []string{"del", "hset", "expire"}},
+		{"JSON", NewJSONCacheCodec(), CacheValue{Payload: []byte("{")}, []string{"set"}},
+	} {
+		suite.Run(tc.name, func() {
+			value, err := tc.codec.Encode(note)
+			suite.NoError(err)
+			decoded, err := tc.codec.Decode(value)
+			suite.NoError(err)
+			suite.Equal(note, decoded)
+
+			_, err = tc.codec.Decode(tc.corrupt)
+			suite.ErrorIs(err, ErrCorruptCacheEntry)
+
+			recorder.pipelines = nil
+			cache := NewRedisCacheWithCodec(client, tc.codec)
+			suite.NoError(cache.SetNotes(suite.ctx, map[string]CachedNote{"notes:id:3": note}, time.Minute))
+			suite.Require().Len(recorder.pipelines, 1)
+			commands := make([]string, 0)
+			for _, cmd := range recorder.pipelines[0] {
+				commands = append(commands, strings.Fields(cmd)[0])
+			}
+			suite.Equal(tc.commands, commands)
+		})
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheSchemaVersion() {
+	now := time.Now().UTC()
+	note := CachedNote{Note: Note{Model: gorm.Model{ID: 1, CreatedAt: now, UpdatedAt: now}, Title: "Versioned", Content: "Versioned content"}}
+	for _, tc := range []struct {
+		name string
+		v1   CacheCodec
+		v2   CacheCodec
+		// unversioned is an entry cached before notes carried a version
+		unversioned CacheValue
+	}{
+		{
+			"Hash", NewHashCacheCodec(), hashCacheCodec{schemaVersion: 2},
+			CacheValue{Fields: map[string]string{
+				"id": "1", "title": "Versioned", "content": "Versioned content",
+				"created_at": now.Format(time.RFC3339Nano), "updated_at": now.Format(time.RFC3339Nano),
+			}},
+		},
+		{
+			"JSON", NewJSONCacheCodec(), jsonCacheCodec{schemaVersion: 2},
+			CacheValue{Payload: []byte(`{"id": 1, "title": "Versioned", "content": "Versioned content"}`)},
+		},
+	} {
+		suite.Run(tc.name, func() {
+			value, err := tc.v1.Encode(note)
+			suite.NoError(err)
+			decoded, err := tc.v1.Decode(value)
+			suite.NoError(err)
+			suite.Equal(note.Title, decoded.Title)
+
+			// an entry cached with another version is stale, a miss to the repository
+			_, err = tc.v2.Decode(value)
+			suite.ErrorIs(err, ErrStaleCacheEntry)
+			suite.ErrorIs(err, ErrCorruptCacheEntry)
+			suite.ErrorContains(err, "stale schema version 1, want 2")
+			value, err = tc.v2.Encode(note)
+			suite.NoError(err)
+			_, err = tc.v1.Decode(value)
+			suite.ErrorIs(err, ErrStaleCacheEntry)
+
+			// unversioned entries are version 1
+			decoded, err = tc.v1.Decode(tc.unversioned)
+			suite.NoError(err)
+			suite.Equal("Versioned content", decoded.Content)
+			_, err = tc.v2.Decode(tc.unversioned)
+			suite.ErrorIs(err, ErrStaleCacheEntry)
+		})
+	}
+
+	_, err := NewHashCacheCodec().Decode(CacheValue{Fields: map[string]string{"v": "x"}})
+	suite.ErrorIs(err, ErrCorruptCacheEntry)
+	suite.NotErrorIs(err, ErrStaleCacheEntry)
+}
+
+func (suite *MemoryCacheTestSuite) TestRepositoryServesCachedNote() {
+	repo, mock := suite.newMockRepo()
+	suite.NoError(repo.cacheNote(suite.ctx, Note{Model: gorm.Model{ID: 1}, Title: "Cached", Content: "Cached content"}))
+
+	note, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal("Cached", note.Title)
+	note, err = repo.GetNoteByTitle(suite.ctx, "Cached")
+	suite.NoError(err)
+	suite.Equal(uint(1), note.ID)
+
+	// no expectations were set so this only passes if the database wasn't queried
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestRepositoryCachesNoteOnMiss() {
+	repo, mock := suite.newMockRepo()
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(1, now, now, nil, "Uncached", "Uncached <b>content</b>", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+	expectTags(mock, NoteTag{NoteID: 1, Tag: "drafts"}, NoteTag{NoteID: 1, Tag: "work"})
+
+	note, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal("Uncached", note.Title)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	// the note is now served from the cache along with its rendered HTML
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:title:Uncached")
+	suite.NoError(err)
+	suite.NotNil(cachedNote)
+	suite.Equal(uint(1), cachedNote.ID)
+	suite.Equal([]string{"drafts", "work"}, cachedNote.Tags)
+	rendered, err := repo.GetNoteByIdRendered(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal("Uncached &lt;b&gt;content&lt;/b&gt;", rendered)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestBatchGetNotesByIds() {
+	repo, mock := suite.newMockRepo()
+	suite.NoError(repo.cacheNote(suite.ctx, Note{Model: gorm.Model{ID: 1}, Title: "Cached", Content: "Cached content"}))
+
+	// only the uncached ids are queried, in a single query
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(2, now, now, nil, "Uncached", "Uncached content", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes" WHERE id IN ($1,$2)`)).
+		WithArgs(2, 3).
+		WillReturnRows(rows)
+	expectTags(mock)
+
+	notes, err := repo.BatchGetNotesByIds(suite.ctx, []int{1, 2, 3})
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+	suite.Len(notes, 2)
+	suite.Equal("Cached", notes[1].Title)
+	suite.Equal("Uncached", notes[2].Title)
+	suite.NotContains(notes, 3)
+
+	// the notes loaded from the database are now cached
+	notes, err = repo.BatchGetNotesByIds(suite.ctx, []int{1, 2})
+	suite.NoError(err)
+	suite.Len(notes, 2)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestGetNotesByIdsOrdered() {
+	repo, mock := suite.newMockRepo()
+	suite.NoError(repo.cacheNote(suite.ctx, Note{Model: gorm.Model{ID: 3}, Title: "Cached", Content: "Cached content"}))
+
+	// the uncached ids are loaded with a single query, in any order
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(5, now, now, nil, "Fifth", "Fifth content", 2).
+		AddRow(1, now, now, nil, "First", "First content", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes" WHERE id IN ($1,$2,$3)`)).
+		WithArgs(5, 2, 1).
+		WillReturnRows(rows)
+	expectTags(mock)
+
+	notes, err := repo.GetNotesByIdsOrdered(suite.ctx, []int{5, 3, 2, 1})
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+	suite.Len(notes, 4)
+	suite.Equal("Fifth", notes[0].Title)
+	suite.Equal("Cached", notes[1].Title)
+	suite.Nil(notes[2])
+	suite.Equal("First", notes[3].Title)
+
+	notes, err = repo.GetNotesByIdsOrdered(suite.ctx, []int{})
+	suite.NoError(err)
+	suite.Empty(notes)
+}
+
+func (suite *MemoryCacheTestSuite) TestWarmCache() {
+	repo, mock := suite.newMockRepo()
+
+	// every id is loaded in a single query and missing ids are skipped
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(1, now, now, nil, "First", "First content", 2).
+		AddRow(2, now, now, nil, "Second", "Second content", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes" WHERE id IN ($1,$2,$3)`)).
+		WithArgs(1, 2, 3).
+		WillReturnRows(rows)
+	expectTags(mock, NoteTag{NoteID: 2, Tag: "warm"})
+
+	warmed, err := repo.WarmCache(suite.ctx, []int{1, 2, 3})
+	suite.NoError(err)
+	suite.Equal(2, warmed)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	for _, key := range []string{"notes:id:1", "notes:title:First", "notes:id:2", "notes:title:Second"} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.NotNil(cachedNote, key)
+	}
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:2")
+	suite.NoError(err)
+	suite.Equal([]string{"warm"}, cachedNote.Tags)
+	suite.Equal("Second content", cachedNote.HTML)
+	cachedNote, err = suite.cache.GetNote(suite.ctx, "notes:id:3")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+}
+
+func (suite *MemoryCacheTestSuite) TestTracing() {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	repo, mock := suite.newMockRepo(WithTracer(provider.Tracer("test")))
+
+	suite.Run("Cache miss spans", func() {
+		suite.T().Cleanup(exporter.Reset)
+
+		now := time.Now()
+		rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+			AddRow(1, now, now, nil, "Traced", "Traced content", 2)
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+		expectTags(mock)
+		_, err := repo.GetNoteById(suite.ctx, 1)
+		suite.NoError(err)
+
+		// spans are exported as they end so the parent comes last
+		spans := exporter.GetSpans()
+		suite.Len(spans, 4)
+		parent := spans[3]
+		suite.Equal("NoteRepository.GetNoteById", parent.Name)
+		suite.Contains(parent.Attributes, attribute.Int("note.id", 1))
+		suite.Equal(codes.Unset, parent.Status.Code)
+		for i, name := range []string{"cache.lookup", "postgres.query", "cache.store"} {
+			suite.Equal(name, spans[i].Name)
+			suite.Equal(parent.SpanContext.SpanID(), spans[i].Parent.SpanID())
+		}
+	})
+
+	suite.Run("Failed operation records the error", func() {
+		suite.T().Cleanup(exporter.Reset)
+
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		_, err := repo.GetNoteByTitle(suite.ctx, "Missing")
+		suite.ErrorIs(err, NoteNotFoundError)
+
+		spans := exporter.GetSpans()
+		suite.Len(spans, 3)
+		parent := spans[2]
+		suite.Equal("NoteRepository.GetNoteByTitle", parent.Name)
+		suite.Contains(parent.Attributes, attribute.String("note.title", "Missing"))
+		suite.Equal(codes.Error, parent.Status.Code)
+		suite.Equal(NoteNotFoundError.Error(), parent.Status.Description)
+		suite.Len(parent.Events, 1)
+	})
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestLogging() {
+	handler := &recordingHandler{}
+	repo, mock := suite.newMockRepo(WithLogger(slog.New(handler)))
+
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(1, now, now, nil, "Logged", "Logged content", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+	expectTags(mock)
+	_, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	_, err = repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	// ensure the miss and the hit were logged at debug level with the id and operation
+	for _, message := range []string{"Cache miss", "Cache hit"} {
+		record, found := handler.find(message)
+		suite.True(found, message)
+		suite.Equal(slog.LevelDebug, record.Level)
+		attrs := map[string]string{}
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs[attr.Key] = attr.Value.String()
+			return true
+		})
+		suite.Equal(map[string]string{"operation": "GetNoteById", "id": "1"}, attrs)
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestMissingNoteCache() {
+	repo, mock := suite.newMockRepo(WithMissingNoteTTL(time.Minute))
+
+	// the first read of a missing note queries postgres and caches a tombstone
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}))
+	_, err := repo.GetNoteById(suite.ctx, 2)
+	suite.ErrorIs(err, NoteNotFoundError)
+	suite.NoError(mock.ExpectationsWereMet())
+	_, err = suite.cache.GetNote(suite.ctx, "notes:id:2")
+	suite.ErrorIs(err, ErrNoteCachedAsMissing)
+	ttl, err := suite.cache.TTL(suite.ctx, "notes:id:2")
+	suite.NoError(err)
+	suite.InDelta(time.Minute, ttl, float64(time.Second))
+
+	// later reads are answered by the tombstone, no query is expected
+	_, err = repo.GetNoteById(suite.ctx, 2)
+	suite.ErrorIs(err, NoteNotFoundError)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	// creating the note clears its tombstone
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	suite.NoError(repo.SaveNote(suite.ctx, &Note{Title: "Created", Content: "Created content"}))
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:2")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	suite.Run("Missing notes aren't cached by default", func() {
+		repo, mock := suite.newMockRepo()
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}))
+			_, err := repo.GetNoteById(suite.ctx, 3)
+			suite.ErrorIs(err, NoteNotFoundError)
+		}
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestListNotePreviews() {
+	repo, mock := suite.newMockRepo()
+	now := time.Now()
+	// postgres returns one character more than the preview holds
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "author_id", "title", "content", "word_count", "version"}).
+		AddRow(1, now, now, nil, 0, "Short", "Fits", 1, 0).
+		AddRow(2, now, now, nil, 7, "Long", "Héllo", 1, 0)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, created_at, updated_at, deleted_at, author_id, title, LEFT(content, $1) AS content, word_count, version FROM "notes"`)).
+		WithArgs(5).
+		WillReturnRows(rows)
+	notes, err := repo.ListNotePreviews(suite.ctx, 0, 10, 4)
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+	suite.Len(notes, 2)
+	suite.Equal("Fits", notes[0].Content)
+	suite.Equal("Héll…", notes[1].Content)
+	suite.Equal(uint(7), notes[1].AuthorID)
+}
+
+func (suite *MemoryCacheTestSuite) TestTruncateContent() {
+	testCases := []struct {
+		name    string
+		content string
+		maxLen  int
+		preview string
+	}{
+		{"Shorter than the preview", "abc", 5, "abc"},
+		{"As long as the preview", "abcde", 5, "abcde"},
+		{"Longer than the preview", "abcdef", 5, "abcde…"},
+		{"Two byte characters", "ééééé", 3, "ééé…"},
+		{"Four byte characters", "😀😀😀", 2, "😀😀…"},
+		{"Mixed widths at the boundary", "aé😀b", 3, "aé😀…"},
+		{"Multibyte content that fits", "日本語", 3, "日本語"},
+		{"Empty preview", "abc", 0, "…"},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			preview := truncateContent(tc.content, tc.maxLen)
+			suite.Equal(tc.preview, preview)
+			suite.True(utf8.ValidString(preview))
+		})
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheWriteThrough() {
+	repo, mock := suite.newMockRepo(WithCacheWriteStrategy(CacheWriteThrough))
+
+	// create a note and ensure it is cached under its id and title
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	note := Note{Title: "Created", Content: "Created content"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	for _, key := range []string{"notes:id:1", "notes:title:Created"} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.NotNil(cachedNote, key)
+		suite.Equal("Created content", cachedNote.Content)
+	}
+
+	// rename the note and ensure the new version replaces the old one
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Created"))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count", "version"}).
+			AddRow(1, now, now, nil, "Renamed", "Updated content", 2, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	note.Title = "Renamed"
+	note.Content = "Updated content"
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.NoError(mock.ExpectationsWereMet())
+	for _, key := range []string{"notes:id:1", "notes:title:Renamed"} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.NotNil(cachedNote, key)
+		suite.Equal("Updated content", cachedNote.Content)
+	}
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:title:Created")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+
+	// the next read is served by the cache, no query is expected
+	read, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal("Updated content", read.Content)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	suite.Run("Newer cached versions are invalidated rather than overwritten", func() {
+		newer := CachedNote{Note: Note{Model: gorm.Model{ID: 1}, Title: "Renamed", Content: "Newer content", Version: 3}}
+		suite.NoError(suite.cache.SetNote(suite.ctx, newer, 0, "notes:id:1", "notes:title:Renamed"))
+		older := note
+		older.Version = 2
+		suite.NoError(repo.recacheNote(suite.ctx, older, older.Title))
+		for _, key := range []string{"notes:id:1", "notes:title:Renamed"} {
+			cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+			suite.NoError(err)
+			suite.Nil(cachedNote, key)
+		}
+	})
+
+	suite.Run("Saved notes are invalidated by default", func() {
+		repo, mock := suite.newMockRepo()
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectCommit()
+		suite.NoError(repo.SaveNote(suite.ctx, &Note{Title: "Invalidated", Content: "My content"}))
+		cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:2")
+		suite.NoError(err)
+		suite.Nil(cachedNote)
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestTitleTakenByDeletedNote() {
+	// expectDuplicate will expect a create violating the unique title and
+	// the lookup of the title among the deleted notes answered with deleted
+	expectDuplicate := func(mock sqlmock.Sqlmock, deleted bool) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnError(&pgconn.PgError{Code: uniqueViolationCode})
+		mock.ExpectRollback()
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT EXISTS (SELECT 1 FROM "notes" WHERE author_id = $1 AND title = $2 AND deleted_at IS NOT NULL LIMIT 1)`)).
+			WithArgs(0, "Taken").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(deleted))
+	}
+
+	suite.Run("Title of a deleted note", func() {
+		repo, mock := suite.newMockRepo()
+		expectDuplicate(mock, true)
+		err := repo.SaveNote(suite.ctx, &Note{Title: "Taken", Content: "My content"})
+		suite.ErrorIs(err, ErrTitleTakenByDeletedNote)
+		suite.ErrorIs(err, DuplicateNoteError)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Title of a live note", func() {
+		repo, mock := suite.newMockRepo()
+		expectDuplicate(mock, false)
+		err := repo.SaveNote(suite.ctx, &Note{Title: "Taken", Content: "My content"})
+		suite.ErrorIs(err, DuplicateNoteError)
+		suite.NotErrorIs(err, ErrTitleTakenByDeletedNote)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestAuthorTitleKeys() {
+	repo, mock := suite.newMockRepo()
+	suite.Equal("notes:title:Todo", repo.titleKey(0, "Todo"))
+	suite.Equal("notes:author:1:title:Todo", repo.titleKey(1, "Todo"))
+	suite.Equal("notes:author:2:title:Todo", repo.titleKey(2, "Todo"))
+
+	// the note of an author is cached under the author's title key only
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "author_id", "title", "content", "word_count"}).
+			AddRow(1, now, now, nil, 1, "Todo", "First author's todo", 3))
+	expectTags(mock)
+	note, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal(uint(1), note.AuthorID)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:author:1:title:Todo")
+	suite.NoError(err)
+	suite.Require().NotNil(cachedNote)
+	suite.Equal(uint(1), cachedNote.AuthorID)
+	cachedNote, err = suite.cache.GetNote(suite.ctx, "notes:title:Todo")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+
+	suite.Run("Author is kept by both cache formats", func() {
+		cached := CachedNote{Note: Note{Model: gorm.Model{ID: 1, CreatedAt: now, UpdatedAt: now}, AuthorID: 7, Title: "Todo"}}
+		noteMap, err := convertNoteToMap(cached)
+		suite.NoError(err)
+		decoded, err := convertMapToNote(noteMap)
+		suite.NoError(err)
+		suite.Equal(uint(7), decoded.AuthorID)
+
+		payload, err := encodeJSONNote(cached, cacheSchemaVersion)
+		suite.NoError(err)
+		decodedJSON, err := decodeJSONNote(payload, cacheSchemaVersion)
+		suite.NoError(err)
+		suite.Equal(uint(7), decodedJSON.AuthorID)
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheCompression() {
+	repo, mock := suite.newMockRepo(WithCacheCompression(100))
+	content := strings.Repeat("All work and no play makes Jack a dull boy. ", 100)
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(1, now, now, nil, "Large", content, 1000).
+		AddRow(2, now, now, nil, "Small", "Small content", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+	expectTags(mock)
+	_, err := repo.WarmCache(suite.ctx, []int{1, 2})
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	// ensure the large note is cached compressed and the small one as it is
+	large, err := suite.cache.GetNote(suite.ctx, "notes:id:1")
+	suite.NoError(err)
+	suite.Require().NotNil(large)
+	suite.Equal(contentEncodingGzip, large.ContentEncoding)
+	suite.Less(len(large.Content), len(content))
+	small, err := suite.cache.GetNote(suite.ctx, "notes:id:2")
+	suite.NoError(err)
+	suite.Require().NotNil(small)
+	suite.Empty(small.ContentEncoding)
+	suite.Equal("Small content", small.Content)
+
+	// ensure the large note is read back decompressed, no query is expected
+	note, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal(content, note.Content)
+	notes, err := repo.cache.GetNotes(suite.ctx, "notes:id:1", "notes:title:Large")
+	suite.NoError(err)
+	for _, cachedNote := range notes {
+		suite.Require().NotNil(cachedNote)
+		suite.Equal(content, cachedNote.Content)
+		suite.Equal(html.EscapeString(content), cachedNote.HTML)
+	}
+
+	suite.Run("Redis formats decompress what they read", func() {
+		noteMap, err := convertNoteToMap(*large)
+		suite.NoError(err)
+		decoded, err := convertMapToNote(noteMap)
+		suite.NoError(err)
+		suite.Equal(content, decoded.Content)
+		suite.Empty(decoded.ContentEncoding)
+
+		payload, err := encodeJSONNote(*large, cacheSchemaVersion)
+		suite.NoError(err)
+		suite.Less(len(payload), len(content))
+		decodedJSON, err := decodeJSONNote(payload, cacheSchemaVersion)
+		suite.NoError(err)
+		suite.Equal(content, decodedJSON.Content)
+	})
+
+	suite.Run("Unknown encoding is a corrupt entry", func() {
+		_, err := convertMapToNote(map[string]string{
+			"id": "1", "title": "Odd", "content": "Odd", "content_encoding": "brotli",
+			"created_at": now.Format(time.RFC3339Nano), "updated_at": now.Format(time.RFC3339Nano),
+		})
+		suite.ErrorIs(err, ErrCorruptCacheEntry)
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestListNotesByIDRange() {
+	repo, mock := suite.newMockRepo()
+	now := time.Now()
+	// a cached note isn't served from the cache
+	cached := CachedNote{Note: Note{Model: gorm.Model{ID: 2, CreatedAt: now, UpdatedAt: now}, Title: "Stale", Content: "Stale content"}}
+	suite.NoError(suite.cache.SetNote(suite.ctx, cached, 0, "notes:id:2"))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes" WHERE (id BETWEEN $1 AND $2) AND "notes"."deleted_at" IS NULL ORDER BY id`)).
+		WithArgs(1, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+			AddRow(1, now, now, nil, "First", "First content", 2).
+			AddRow(2, now, now, nil, "Second", "Second content", 2))
+	// the tags of the notes are loaded in a single query
+	expectTags(mock, NoteTag{NoteID: 2, Tag: "work"})
+	notes, err := repo.ListNotesByIDRange(suite.ctx, 1, 3)
+	suite.NoError(err)
+	suite.Len(notes, 2)
+	suite.Equal("Second content", notes[1].Content)
+	suite.Empty(notes[0].Tags)
+	suite.Equal([]string{"work"}, notes[1].Tags)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestUpdateNoteContentByTitle() {
+	suite.Run("Cached note", func() {
+		repo, mock := suite.newMockRepo()
+		now := time.Now()
+		cached := CachedNote{Note: Note{Model: gorm.Model{ID: 1, CreatedAt: now, UpdatedAt: now}, Title: "Todo", Content: "Old content", Version: 1}}
+		suite.NoError(suite.cache.SetNote(suite.ctx, cached, 0, "notes:id:1", "notes:title:Todo"))
+
+		// the note is resolved from the cache so postgres is only updated
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title", "author_id"}).AddRow(1, "Todo", 0))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count", "version"}).
+				AddRow(1, now, now, nil, "Todo", "New content", 2, 2))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectCommit()
+		note, err := repo.UpdateNoteContentByTitle(suite.ctx, "Todo", "New content")
+		suite.NoError(err)
+		suite.Equal(uint(1), note.ID)
+		suite.Equal("New content", note.Content)
+		suite.Equal(2, note.Version)
+		suite.NoError(mock.ExpectationsWereMet())
+
+		// the cached note is invalidated
+		for _, key := range []string{"notes:id:1", "notes:title:Todo"} {
+			cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+			suite.NoError(err)
+			suite.Nil(cachedNote)
+		}
+	})
+
+	suite.Run("Missing title", func() {
+		repo, mock := suite.newMockRepo()
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes" WHERE author_id = $1 AND title = $2`)).
+			WithArgs(0, "Missing").
+			WillReturnError(gorm.ErrRecordNotFound)
+		_, err := repo.UpdateNoteContentByTitle(suite.ctx, "Missing", "New content")
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestVerifyCache() {
+	repo, mock := suite.newMockRepo()
+	// postgres stores timestamps with microsecond precision
+	now := time.Now().Truncate(time.Microsecond)
+	expectNote := func() {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count", "version"}).
+				AddRow(1, now, now, nil, "Todo", "Current content", 2, 2))
+		expectTags(mock)
+	}
+	diverged := CachedNote{Note: Note{Model: gorm.Model{ID: 1, CreatedAt: now, UpdatedAt: now}, Title: "Todo", Content: "Diverged content", WordCount: 2, Version: 2}}
+	suite.NoError(suite.cache.SetNote(suite.ctx, diverged, 0, "notes:id:1", "notes:title:Todo"))
+
+	// the diverged entry is reported but left as is without repair
+	expectNote()
+	consistent, err := repo.VerifyCache(suite.ctx, 1)
+	suite.NoError(err)
+	suite.False(consistent)
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:1")
+	suite.NoError(err)
+	suite.Equal("Diverged content", cachedNote.Content)
+
+	// repairing reports the divergence and deletes the entries
+	expectNote()
+	consistent, err = repo.VerifyCache(suite.ctx, 1, WithRepair())
+	suite.NoError(err)
+	suite.False(consistent)
+	for _, key := range []string{"notes:id:1", "notes:title:Todo"} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.Nil(cachedNote)
+	}
+
+	expectNote()
+	consistent, err = repo.VerifyCache(suite.ctx, 1)
+	suite.NoError(err)
+	suite.True(consistent)
+
+	// the entry under the title is verified along with the one under the id
+	current := diverged
+	current.Content = "Current content"
+	suite.NoError(suite.cache.SetNote(suite.ctx, current, 0, "notes:id:1"))
+	suite.NoError(suite.cache.SetNote(suite.ctx, diverged, 0, "notes:title:Todo"))
+	expectNote()
+	consistent, err = repo.VerifyCache(suite.ctx, 1)
+	suite.NoError(err)
+	suite.False(consistent)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestDuplicateTitle() {
+	testCases := []struct {
+		name   string
+		detail string
+		title  string
+	}{
+		{"Title", "Key (title)=(Groceries) already exists.", "Groceries"},
+		{"Author and title", "Key (author_id, title)=(0, Groceries) already exists.", "Groceries"},
+		{"Title with a comma", "Key (author_id, title)=(3, Milk, eggs) already exists.", "Milk, eggs"},
+		{"Normalized title", "Key (author_id, normalized_title)=(1, groceries) already exists.", "groceries"},
+		{"Missing detail", "", ""},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			err := &pgconn.PgError{Code: uniqueViolationCode, Detail: tc.detail}
+			suite.Equal(tc.title, duplicateTitle(err))
+		})
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestTitleExists() {
+	repo, mock := suite.newMockRepo()
+	// expectExists will expect the existence query and answer it with exists
+	expectExists := func(exists bool) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT EXISTS (SELECT 1 FROM "notes" WHERE author_id = $1 AND title = $2 LIMIT 1)`)).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+	}
+
+	suite.Run("Existing title", func() {
+		expectExists(true)
+		exists, err := repo.TitleExists(suite.ctx, "Stored")
+		suite.NoError(err)
+		suite.True(exists)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Non-existing title", func() {
+		expectExists(false)
+		exists, err := repo.TitleExists(suite.ctx, "Missing")
+		suite.NoError(err)
+		suite.False(exists)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Cached title doesn't query postgres", func() {
+		cachedNote := CachedNote{Note: Note{Model: gorm.Model{ID: 1}, Title: "Cached"}}
+		suite.NoError(suite.cache.SetNote(suite.ctx, cachedNote, 0, "notes:title:Cached"))
+		exists, err := repo.TitleExists(suite.ctx, "Cached")
+		suite.NoError(err)
+		suite.True(exists)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestWithCacheWritesDisabled() {
+	repo, mock := suite.newMockRepo()
+	now := time.Now()
+	cached := CachedNote{Note: Note{Model: gorm.Model{ID: 1, CreatedAt: now, UpdatedAt: now}, Title: "Cached", Content: "Old content", Version: 1}}
+	suite.NoError(suite.cache.SetNote(suite.ctx, cached, 0, "notes:id:1", "notes:title:Cached"))
+	// expectRead will expect loading the second note from postgres
+	expectRead := func() {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+				AddRow(2, now, now, nil, "Uncached", "Uncached content", 2))
+		expectTags(mock)
+	}
+
+	err := repo.WithCacheWritesDisabled(suite.ctx, func(ctx context.Context) error {
+		// saving within the scope still invalidates the cached note
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title", "author_id"}).AddRow(1, "Cached", 0))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count", "version"}).
+				AddRow(1, now, now, nil, "Cached", "New content", 2, 2))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectCommit()
+		note := cached.Note
+		note.Content = "New content"
+		if err := repo.SaveNote(ctx, &note); err != nil {
+			return err
+		}
+
+		// reads made with the scope's context aren't cached
+		expectRead()
+		if _, err := repo.GetNoteById(ctx, 2); err != nil {
+			return err
+		}
+		cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:2")
+		suite.NoError(err)
+		suite.Nil(cachedNote)
+
+		// while reads made with any other context are
+		expectRead()
+		_, err = repo.GetNoteById(suite.ctx, 2)
+		return err
+	})
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+	for key, cachedAfter := range map[string]bool{"notes:id:1": false, "notes:title:Cached": false, "notes:id:2": true} {
+		cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+		suite.NoError(err)
+		suite.Equal(cachedAfter, cachedNote != nil, key)
+	}
+}
+
+func (suite *MemoryCacheTestSuite) TestWithoutCache() {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+	for name, repo := range map[string]*NoteRepository{
+		"Nil redis client": NewNoteRepository(nil, nil),
+		"Nil cache":        NewNoteRepositoryWithCache(nil, nil),
+		"WithoutCache":     NewNoteRepository(nil, client, WithoutCache()),
+	} {
+		suite.Run(name, func() {
+			suite.Nil(repo.redis)
+			suite.Equal(noCache{}, repo.cache)
+		})
+	}
+
+	// every read queries postgres and nothing is cached
+	repo, mock := suite.newMockRepo(WithoutCache())
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+				AddRow(1, now, now, nil, "Uncached", "Uncached content", 2))
+		expectTags(mock)
+		note, err := repo.GetNoteById(suite.ctx, 1)
+		suite.NoError(err)
+		suite.Equal("Uncached content", note.Content)
+	}
+	suite.NoError(mock.ExpectationsWereMet())
+	cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:1")
+	suite.NoError(err)
+	suite.Nil(cachedNote)
+}
+
+func (suite *MemoryCacheTestSuite) TestReservationTTL() {
+	repo, _ := suite.newMockRepo()
+	suite.Equal(idempotencyReservationTTL, repo.reservationTTL(suite.ctx))
+
+	// a request with a later deadline keeps the key reserved until then
+	ctx, cancel := context.WithTimeout(suite.ctx, 5*time.Minute)
+	defer cancel()
+	ttl := repo.reservationTTL(ctx)
+	suite.Greater(ttl, 4*time.Minute)
+	suite.LessOrEqual(ttl, 5*time.Minute)
+
+	// but never for longer than the id would be remembered
+	repo, _ = suite.newMockRepo(WithIdempotencyTTL(10 * time.Second))
+	suite.Equal(10*time.Second, repo.reservationTTL(ctx))
+}
+
+func (suite *MemoryCacheTestSuite) TestTitlesExist() {
+	repo, mock := suite.newMockRepo()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "title" FROM "notes" WHERE author_id = $1 AND title IN ($2,$3,$4)`)).
+		WithArgs(0, "First", "New", "Second").
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("First").AddRow("Second"))
+	exists, err := repo.TitlesExist(suite.ctx, []string{"First", "New", "Second"})
+	suite.NoError(err)
+	suite.Equal(map[string]bool{"First": true, "New": false, "Second": true}, exists)
+
+	// the titles are split across queries to stay under the parameter limit
+	titles := make([]string, maxTitlesPerQuery+1)
+	for i := range titles {
+		titles[i] = fmt.Sprintf("Title %d", i)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "title" FROM "notes" WHERE author_id = $1 AND title IN`)).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Title 0"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "title" FROM "notes" WHERE author_id = $1 AND title IN ($2)`)).
+		WithArgs(0, titles[maxTitlesPerQuery]).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow(titles[maxTitlesPerQuery]))
+	exists, err = repo.TitlesExist(suite.ctx, titles)
+	suite.NoError(err)
+	suite.Len(exists, len(titles))
+	suite.True(exists["Title 0"])
+	suite.False(exists["Title 1"])
+	suite.True(exists[titles[maxTitlesPerQuery]])
+
+	// no titles doesn't query postgres
+	exists, err = repo.TitlesExist(suite.ctx, nil)
+	suite.NoError(err)
+	suite.Empty(exists)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheRetry() {
+	suite.NoError(suite.cache.SetNote(suite.ctx, CachedNote{Note: Note{Model: gorm.Model{ID: 1}, Title: "Cached"}}, 0, "notes:id:1"))
+
+	suite.Run("Failed attempt is retried", func() {
+		cache := &flakyCache{Cache: suite.cache, failures: 1}
+		repo, mock := suite.newMockRepoWithCache(cache, WithCacheRetry(2, time.Millisecond))
+
+		note, err := repo.GetNoteById(suite.ctx, 1)
+		suite.NoError(err)
+		suite.Equal("Cached", note.Title)
+		suite.Equal(2, cache.calls)
+		// no expectations were set so this only passes if the database wasn't queried
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Persistent failure falls back to postgres", func() {
+		cache := &flakyCache{Cache: suite.cache, failures: 2}
+		repo, mock := suite.newMockRepoWithCache(cache, WithCacheRetry(2, time.Millisecond))
+		now := time.Now()
+		rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+			AddRow(1, now, now, nil, "Cached", "From postgres", 2)
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+		expectTags(mock)
+
+		note, err := repo.GetNoteById(suite.ctx, 1)
+		suite.NoError(err)
+		suite.Equal("From postgres", note.Content)
+		suite.NoError(mock.ExpectationsWereMet())
+		// two failed lookups and storing the note loaded from postgres
+		suite.Equal(3, cache.calls)
+	})
+
+	suite.Run("Backoff doubles between attempts", func() {
+		cache := &flakyCache{Cache: suite.cache, failures: 3}
+		retrying := &retryingCache{cache: cache, attempts: 3, backoff: 10 * time.Millisecond}
+
+		start := time.Now()
+		_, err := retrying.GetNote(suite.ctx, "notes:id:1")
+		suite.Error(err)
+		suite.Equal(3, cache.calls)
+		suite.GreaterOrEqual(time.Since(start), 30*time.Millisecond)
+	})
+
+	suite.Run("Corrupt entries aren't retried", func() {
+		cache := &corruptCache{}
+		retrying := &retryingCache{cache: cache, attempts: 3, backoff: time.Millisecond}
+
+		_, err := retrying.GetNote(suite.ctx, "notes:id:1")
+		suite.ErrorIs(err, ErrCorruptCacheEntry)
+		suite.Equal(1, cache.calls)
+	})
+}
+
+// corruptCache is a Cache whose every entry is corrupt
+type corruptCache struct {
+	Cache
+	calls int
+}
+
+func (cache *corruptCache) GetNote(context.Context, string) (*CachedNote, error) {
+	cache.calls++
+	return nil, ErrCorruptCacheEntry
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheUnavailable() {
+	cache := &flakyCache{Cache: suite.cache, failures: math.MaxInt}
+	repo, mock := suite.newMockRepoWithCache(cache)
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(1, now, now, nil, "Uncached", "From postgres", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+	expectTags(mock)
+
+	// the failed lookup and the failed write of the loaded note don't fail the read
+	note, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal("From postgres", note.Content)
+	suite.Equal(2, cache.calls)
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+// slowCache is a Cache whose lookups hang for delay unless their
+// context is done first
+type slowCache struct {
+	Cache
+	delay time.Duration
+}
+
+func (cache *slowCache) GetNote(ctx context.Context, key string) (*CachedNote, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(cache.delay):
+	}
+	return cache.Cache.GetNote(ctx, key)
+}
+
+func (suite *MemoryCacheTestSuite) TestCacheTimeout() {
+	suite.Run("Slow lookup falls back to postgres", func() {
+		cache := &slowCache{Cache: suite.cache, delay: 5 * time.Second}
+		repo, mock := suite.newMockRepoWithCache(cache, WithCacheTimeout(20*time.Millisecond))
+		now := time.Now()
+		rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+			AddRow(1, now, now, nil, "Slow", "From postgres", 2)
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+		expectTags(mock)
+
+		start := time.Now()
+		note, err := repo.GetNoteById(suite.ctx, 1)
+		suite.NoError(err)
+		suite.Equal("From postgres", note.Content)
+		suite.Less(time.Since(start), time.Second)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Calls are bounded by default", func() {
+		repo, _ := suite.newMockRepo()
+		suite.Equal(DefaultCacheTimeout, repo.cacheTimeout)
+		suite.IsType(&timeoutCache{}, repo.cache)
+	})
+
+	suite.Run("A zero timeout leaves calls unbounded", func() {
+		repo, _ := suite.newMockRepo(WithCacheTimeout(0))
+		suite.Same(suite.cache, repo.cache)
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestContextCancellation() {
+	suite.Run("Cancelled before the call", func() {
+		repo, mock := suite.newMockRepo()
+		ctx, cancel := context.WithCancel(suite.ctx)
+		cancel()
+
+		start := time.Now()
+		note, err := repo.GetNoteById(ctx, 1)
+		suite.ErrorIs(err, context.Canceled)
+		suite.Nil(note)
+		note, err = repo.GetNoteByTitle(ctx, "Cancelled")
+		suite.ErrorIs(err, context.Canceled)
+		suite.Nil(note)
+		_, err = repo.TitleExists(ctx, "Cancelled")
+		suite.ErrorIs(err, context.Canceled)
+		err = repo.SaveNote(ctx, &Note{Title: "Cancelled", Content: "Never saved"})
+		suite.ErrorIs(err, context.Canceled)
+		suite.ErrorIs(repo.DeleteNote(ctx, 1), context.Canceled)
+		suite.Less(time.Since(start), time.Second)
+		// postgres was never queried
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Cancelled during a cache lookup", func() {
+		cache := &slowCache{Cache: suite.cache, delay: 5 * time.Second}
+		handler := &recordingHandler{}
+		repo, mock := suite.newMockRepoWithCache(cache, WithCacheTimeout(0), WithLogger(slog.New(handler)))
+		ctx, cancel := context.WithCancel(suite.ctx)
+		time.AfterFunc(20*time.Millisecond, cancel)
+
+		// unlike a timed out lookup, the read doesn't fall back to postgres
+		// and the cancellation isn't logged as the cache failing
+		start := time.Now()
+		note, err := repo.GetNoteById(ctx, 1)
+		suite.ErrorIs(err, context.Canceled)
+		suite.Nil(note)
+		suite.Less(time.Since(start), time.Second)
+		_, found := handler.find("Error in reading cached note")
+		suite.False(found)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+}
+
+func (suite *MemoryCacheTestSuite) TestClose() {
+	repo, mock := suite.newMockRepo()
+	mock.ExpectClose()
+	suite.NoError(repo.Close())
+	suite.NoError(mock.ExpectationsWereMet())
+
+	_, err := repo.GetNoteById(suite.ctx, 1)
+	suite.Error(err)
+	suite.Error(repo.HealthCheck(suite.ctx))
+}
+
+func TestMemoryCache(t *testing.T) {
+	suite.Run(t, new(MemoryCacheTestSuite))
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultCacheTimeout is how long a cache call may take unless
+// WithCacheTimeout sets another timeout
+const DefaultCacheTimeout = 200 * time.Millisecond
+
+// timeoutCache decorates a Cache by giving each call a context with a
+// timeout. go-redis only honors the deadline of a command already sent when
+// the client is created with ContextTimeoutEnabled, otherwise the client's
+// read and write timeouts bound it. A call that times out fails and reads
+// fall back to postgres.
+type timeoutCache struct {
+	cache   Cache
+	timeout time.Duration
+}
+
+// WithCacheTimeout sets how long each call to the cache, and every other
+// redis call the repository makes, may take before it is abandoned. With
+// WithCacheRetry the timeout applies to each attempt rather than to the
+// whole call. A redis call in flight is only abandoned when the client is
+// created with ContextTimeoutEnabled, as NewNoteRepositoryWithRedisOptions
+// and NewNoteRepositoryWithCluster create it, otherwise it runs until the
+// client's read or write timeout. Reads whose cache lookup times out are
+// served by postgres instead. A timeout of zero or less doesn't bound the
+// calls. By default it is DefaultCacheTimeout.
+func WithCacheTimeout(timeout time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.cacheTimeout = timeout
+	}
+}
+
+// withTimeout will wrap the cache so its calls are bounded by the timeout
+// set by WithCacheTimeout, or return it as it is when they aren't bounded
+func (repo *NoteRepository) withTimeout(cache Cache) Cache {
+	if repo.cacheTimeout <= 0 {
+		return cache
+	}
+	return &timeoutCache{cache: cache, timeout: repo.cacheTimeout}
+}
+
+// redisContext will derive the context of a redis call made by the
+// repository, bounded by the cache timeout when there is one
+func (repo *NoteRepository) redisContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if repo.cacheTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, repo.cacheTimeout)
+}
+
+// GetNote will get the note stored under key within the timeout
+func (cache *timeoutCache) GetNote(ctx context.Context, key string) (*CachedNote, error) {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.GetNote(ctx, key)
+}
+
+// GetNotes will get the notes stored under the keys within the timeout
+func (cache *timeoutCache) GetNotes(ctx context.Context, keys ...string) ([]*CachedNote, error) {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.GetNotes(ctx, keys...)
+}
+
+// SetNote will store the note under each of the keys within the timeout
+func (cache *timeoutCache) SetNote(ctx context.Context, note CachedNote, ttl time.Duration, keys ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.SetNote(ctx, note, ttl, keys...)
+}
+
+// SetMissing will store a tombstone under key within the timeout
+func (cache *timeoutCache) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.SetMissing(ctx, key, ttl)
+}
+
+// SetNotes will store each of the notes under its key within the timeout
+func (cache *timeoutCache) SetNotes(ctx context.Context, notes map[string]CachedNote, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.SetNotes(ctx, notes, ttl)
+}
+
+// DeleteKeys will delete the entries stored under the keys within the timeout
+func (cache *timeoutCache) DeleteKeys(ctx context.Context, keys ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.DeleteKeys(ctx, keys...)
+}
+
+// TTL will get the time left before the entry under key expires within the timeout
+func (cache *timeoutCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.TTL(ctx, key)
+}
+
+// Expire will set the time left before the entry under key expires within the timeout
+func (cache *timeoutCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, cache.timeout)
+	defer cancel()
+	return cache.cache.Expire(ctx, key, ttl)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"errors"
+)
+
+// noteStore is the repository a NoteRepository stores the notes in and
+// caches the notes of
+type noteStore interface {
+	NoteRepositoryInterface
+	// prepareNote will fill in the derived fields of the note and
+	// validate it before it is stored
+	prepareNote(note *Note) error
+	// storedNote will load the id, title and author of the note as
+	// stored, or nil when there is no note with the id
+	storedNote(ctx context.Context, id int) (*Note, error)
+	// deleteNote will delete the note and report whether there was a
+	// note to delete
+	deleteNote(ctx context.Context, id int) (bool, error)
+	// notesByIds will load the notes with the ids, ignoring the ids of
+	// notes that don't exist
+	notesByIds(ctx context.Context, ids []int) ([]Note, error)
+}
+
+// repositoryStore adapts any NoteRepositoryInterface to a noteStore
+// through its exported methods
+type repositoryStore struct {
+	NoteRepositoryInterface
+}
+
+// asNoteStore will return the repository as a noteStore, wrapping it
+// when it isn't one
+func asNoteStore(repo NoteRepositoryInterface) noteStore {
+	if store, ok := repo.(noteStore); ok {
+		return store
+	}
+	return repositoryStore{NoteRepositoryInterface: repo}
+}
+
+// prepareNote is a no-op, the wrapped repository prepares the notes it stores
+func (store repositoryStore) prepareNote(*Note) error {
+	return nil
+}
+
+// storedNote will return the note with the id, or nil when the wrapped
+// repository doesn't have it
+func (store repositoryStore) storedNote(ctx context.Context, id int) (*Note, error) {
+	note, err := store.GetNoteById(ctx, id)
+	if errors.Is(err, NoteNotFoundError) {
+		return nil, nil
+	}
+	return note, err
+}
+
+// deleteNote will delete the note with the id from the wrapped repository,
+// reporting whether it existed. The lookup and the delete are separate
+// calls, so use WithTransaction when they must be atomic.
+func (store repositoryStore) deleteNote(ctx context.Context, id int) (bool, error) {
+	note, err := store.storedNote(ctx, id)
+	if err != nil || note == nil {
+		return false, err
+	}
+	return true, store.DeleteNote(ctx, id)
+}
+
+// notesByIds will return the notes with the ids, skipping the ids the
+// wrapped repository doesn't have. NoteRepositoryInterface has no batch
+// lookup, so this makes one GetNoteById call per id; only postgres backed
+// stores load the notes in a single query.
+func (store repositoryStore) notesByIds(ctx context.Context, ids []int) ([]Note, error) {
+	notes := make([]Note, 0, len(ids))
+	for _, id := range ids {
+		note, err := store.storedNote(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if note != nil {
+			notes = append(notes, *note)
+		}
+	}
+	return notes, nil
+}
+
+// NewCachingNoteRepository is the factory function to wrap a note
+// repository with a cache. The returned repository caches the notes of
+// next the way NewNoteRepositoryWithCache caches the notes stored in
+// postgres, so the options apply to it as they do there.
+// Parameters:
+// -  next: the repository the notes are stored in
+// -  cache: cache to store the notes in
+// -  opts: optional configuration for the repository
+//
+// Returns:
+// - NoteRepositoryInterface: the caching repository
+func NewCachingNoteRepository(next NoteRepositoryInterface, cache Cache, opts ...NoteRepositoryOption) NoteRepositoryInterface {
+	repo := NewNoteRepositoryWithCache(nil, cache, opts...)
+	repo.store = asNoteStore(next)
+	return repo
+}
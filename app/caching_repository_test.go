@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// mapNoteRepository is a NoteRepositoryInterface backed by a map that
+// counts the reads it serves, so the caching layer can be tested without
+// postgres. Only the methods the caching layer decorates are implemented.
+type mapNoteRepository struct {
+	NoteRepositoryInterface
+	notes map[uint]Note
+	reads int
+}
+
+func (repo *mapNoteRepository) SaveNote(_ context.Context, note *Note) error {
+	for _, existing := range repo.notes {
+		if existing.Title == note.Title && existing.ID != note.ID {
+			return DuplicateNoteError
+		}
+	}
+	if note.ID == 0 {
+		note.ID = uint(len(repo.notes) + 1)
+	}
+	note.UpdatedAt = time.Now()
+	repo.notes[note.ID] = *note
+	return nil
+}
+
+func (repo *mapNoteRepository) GetNoteById(_ context.Context, id int) (*Note, error) {
+	repo.reads++
+	note, ok := repo.notes[uint(id)]
+	if !ok {
+		return nil, NoteNotFoundError
+	}
+	return &note, nil
+}
+
+func (repo *mapNoteRepository) GetNoteByTitle(_ context.Context, title string, _ ...TitleOption) (*Note, error) {
+	repo.reads++
+	for _, note := range repo.notes {
+		if note.Title == title {
+			return &note, nil
+		}
+	}
+	return nil, NoteNotFoundError
+}
+
+func (repo *mapNoteRepository) DeleteNote(_ context.Context, id int) error {
+	delete(repo.notes, uint(id))
+	return nil
+}
+
+func (repo *mapNoteRepository) InspectNote(ctx context.Context, id int) (InspectResult, error) {
+	note, err := repo.GetNoteById(ctx, id)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	return InspectResult{DbNote: note}, nil
+}
+
+// CachingNoteRepositoryTestSuite tests the caching layer in isolation,
+// over a map backed repository and the memory cache.
+type CachingNoteRepositoryTestSuite struct {
+	suite.Suite
+	ctx   context.Context
+	store *mapNoteRepository
+	cache *MemoryCache
+	repo  NoteRepositoryInterface
+}
+
+func (suite *CachingNoteRepositoryTestSuite) SetupTest() {
+	suite.ctx = context.Background()
+	suite.store = &mapNoteRepository{notes: map[uint]Note{}}
+	suite.cache = NewMemoryCache()
+	suite.repo = NewCachingNoteRepository(suite.store, suite.cache)
+}
+
+// assertCached will assert whether a note is cached under the key
+func (suite *CachingNoteRepositoryTestSuite) assertCached(key string, cached bool) {
+	cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+	suite.NoError(err)
+	suite.Equal(cached, cachedNote != nil, key)
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestReadThrough() {
+	suite.store.notes[1] = Note{Model: gorm.Model{ID: 1}, Title: "Cached", Content: "Cached content"}
+
+	for i := 0; i < 3; i++ {
+		note, err := suite.repo.GetNoteById(suite.ctx, 1)
+		suite.NoError(err)
+		suite.Equal("Cached", note.Title)
+	}
+	// only the first read reached the store, which also cached the title
+	suite.Equal(1, suite.store.reads)
+	note, err := suite.repo.GetNoteByTitle(suite.ctx, "Cached")
+	suite.NoError(err)
+	suite.Equal(uint(1), note.ID)
+	suite.Equal(1, suite.store.reads)
+
+	suite.Run("Missing notes aren't cached", func() {
+		_, err := suite.repo.GetNoteById(suite.ctx, 2)
+		suite.ErrorIs(err, NoteNotFoundError)
+		_, err = suite.repo.GetNoteByTitle(suite.ctx, "Missing")
+		suite.ErrorIs(err, NoteNotFoundError)
+		suite.assertCached("notes:id:2", false)
+		suite.assertCached("notes:title:Missing", false)
+	})
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestSaveNoteInvalidates() {
+	suite.store.notes[1] = Note{Model: gorm.Model{ID: 1}, Title: "Original", Content: "Original content"}
+	note, err := suite.repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.assertCached("notes:id:1", true)
+	suite.assertCached("notes:title:Original", true)
+
+	note.Title = "Renamed"
+	note.Content = "Updated content"
+	suite.NoError(suite.repo.SaveNote(suite.ctx, note))
+	suite.assertCached("notes:id:1", false)
+	suite.assertCached("notes:title:Original", false)
+
+	note, err = suite.repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	suite.Equal("Renamed", note.Title)
+	suite.Equal("Updated content", note.Content)
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestDeleteNoteInvalidates() {
+	suite.store.notes[1] = Note{Model: gorm.Model{ID: 1}, Title: "Doomed", Content: "Doomed content"}
+	_, err := suite.repo.GetNoteByTitle(suite.ctx, "Doomed")
+	suite.NoError(err)
+
+	suite.NoError(suite.repo.DeleteNote(suite.ctx, 1))
+	suite.assertCached("notes:id:1", false)
+	suite.assertCached("notes:title:Doomed", false)
+	_, err = suite.repo.GetNoteById(suite.ctx, 1)
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestWarmCache() {
+	suite.store.notes[1] = Note{Model: gorm.Model{ID: 1}, Title: "First", Content: "First content"}
+	suite.store.notes[2] = Note{Model: gorm.Model{ID: 2}, Title: "Second", Content: "Second content"}
+
+	warmed, err := suite.repo.WarmCache(suite.ctx, []int{1, 2, 3})
+	suite.NoError(err)
+	suite.Equal(2, warmed)
+	for _, key := range []string{"notes:id:1", "notes:title:First", "notes:id:2", "notes:title:Second"} {
+		suite.assertCached(key, true)
+	}
+	suite.assertCached("notes:id:3", false)
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestInvalidateNotes() {
+	for id, title := range map[uint]string{1: "First", 2: "Second", 3: "Third"} {
+		suite.store.notes[id] = Note{Model: gorm.Model{ID: id}, Title: title}
+		_, err := suite.repo.GetNoteById(suite.ctx, int(id))
+		suite.NoError(err)
+	}
+
+	// an id that isn't cached is ignored
+	suite.NoError(suite.repo.InvalidateNotes(suite.ctx, []int{1, 3, 4}))
+	suite.assertCached("notes:id:1", false)
+	suite.assertCached("notes:title:First", false)
+	suite.assertCached("notes:id:3", false)
+	suite.assertCached("notes:title:Third", false)
+	suite.assertCached("notes:id:2", true)
+	suite.assertCached("notes:title:Second", true)
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestImportNotesClearsTombstones() {
+	repo := NewCachingNoteRepository(NewInMemoryNoteRepository(), suite.cache)
+	// the ids of the imported notes were looked up while they were missing
+	suite.NoError(suite.cache.SetMissing(suite.ctx, "notes:id:1", time.Minute))
+	suite.NoError(suite.cache.SetMissing(suite.ctx, "notes:id:2", time.Minute))
+	_, err := repo.GetNoteById(suite.ctx, 1)
+	suite.ErrorIs(err, NoteNotFoundError)
+
+	batches := [][]*Note{
+		{{Title: "First", Content: "First content"}},
+		{{Title: "Second", Content: "Second content"}},
+	}
+	imported, err := repo.ImportNotes(suite.ctx, func() ([]*Note, error) {
+		if len(batches) == 0 {
+			return nil, nil
+		}
+		batch := batches[0]
+		batches = batches[1:]
+		return batch, nil
+	}, false)
+	suite.NoError(err)
+	suite.Equal(2, imported)
+
+	for id, title := range map[int]string{1: "First", 2: "Second"} {
+		note, err := repo.GetNoteById(suite.ctx, id)
+		suite.NoError(err)
+		suite.Equal(title, note.Title)
+	}
+}
+
+func (suite *CachingNoteRepositoryTestSuite) TestInspectNote() {
+	suite.store.notes[1] = Note{Model: gorm.Model{ID: 1}, Title: "Inspected", Content: "Inspected content"}
+	_, err := suite.repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+
+	result, err := suite.repo.InspectNote(suite.ctx, 1)
+	suite.NoError(err)
+	suite.NotNil(result.DbNote)
+	suite.NotNil(result.CachedNote)
+	suite.True(result.Matches)
+	suite.Equal(time.Duration(-1), result.CacheTTL)
+
+	_, err = suite.repo.InspectNote(suite.ctx, 2)
+	suite.ErrorIs(err, NoteNotFoundError)
+}
+
+func TestCachingNoteRepository(t *testing.T) {
+	suite.Run(t, new(CachingNoteRepositoryTestSuite))
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+)
+
+// NoteChangedCallback is an in-process listener of note mutations. It is
+// given the note as it was stored by the mutation.
+type NoteChangedCallback func(Note)
+
+// noteCallbacks holds the in-process listeners of a NoteRepository
+type noteCallbacks struct {
+	onCreated []NoteChangedCallback
+	onUpdated []NoteChangedCallback
+	onDeleted []NoteChangedCallback
+	// async makes the callbacks run in their own goroutine
+	async bool
+}
+
+// WithOnCreated makes the repository call the callback with each note it
+// creates, once the note is stored in postgres. It is an in-process
+// alternative to subscribing to the event channel. Callbacks run
+// synchronously, in the order they were added, unless WithAsyncCallbacks
+// is set. Notes created by BulkCreateNotes and ImportNotes aren't notified.
+func WithOnCreated(callback NoteChangedCallback) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.callbacks.onCreated = append(repo.callbacks.onCreated, callback)
+	}
+}
+
+// WithOnUpdated makes the repository call the callback with each note it
+// updates, once the update is stored in postgres. See WithOnCreated.
+func WithOnUpdated(callback NoteChangedCallback) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.callbacks.onUpdated = append(repo.callbacks.onUpdated, callback)
+	}
+}
+
+// WithOnDeleted makes the repository call the callback with each note it
+// deletes, once the deletion is stored in postgres. The note only has its
+// id and title set. See WithOnCreated.
+func WithOnDeleted(callback NoteChangedCallback) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.callbacks.onDeleted = append(repo.callbacks.onDeleted, callback)
+	}
+}
+
+// WithAsyncCallbacks makes the repository run each of the callbacks added
+// with WithOnCreated, WithOnUpdated and WithOnDeleted in its own goroutine,
+// so a slow callback doesn't delay the mutation. By default callbacks run
+// before the mutating method returns.
+func WithAsyncCallbacks() NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.callbacks.async = true
+	}
+}
+
+// notify will call the callbacks of the mutation with the note
+func (repo *NoteRepository) notify(eventType string, note Note) {
+	var callbacks []NoteChangedCallback
+	switch eventType {
+	case AuditActionCreated:
+		callbacks = repo.callbacks.onCreated
+	case AuditActionUpdated:
+		callbacks = repo.callbacks.onUpdated
+	case AuditActionDeleted:
+		callbacks = repo.callbacks.onDeleted
+	}
+	for _, callback := range callbacks {
+		if repo.callbacks.async {
+			go repo.runCallback(callback, eventType, note)
+		} else {
+			repo.runCallback(callback, eventType, note)
+		}
+	}
+}
+
+// runCallback will call the callback with the note. The mutation is stored
+// at this point so a callback that panics is logged rather than failing it.
+func (repo *NoteRepository) runCallback(callback NoteChangedCallback, eventType string, note Note) {
+	defer func() {
+		if r := recover(); r != nil {
+			repo.logger.Error("Callback panicked", "event", eventType, "id", note.ID, "error", fmt.Sprint(r))
+		}
+	}()
+	callback(note)
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/suite"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// CallbacksTestSuite tests the callbacks notified of the repository's
+// mutations
+type CallbacksTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *CallbacksTestSuite) TestCallbacks() {
+	var created, updated, deleted []Note
+	repo, mock := suite.newMockRepo(
+		WithOnCreated(func(note Note) { created = append(created, note) }),
+		WithOnUpdated(func(note Note) { updated = append(updated, note) }),
+		WithOnDeleted(func(note Note) { deleted = append(deleted, note) }),
+		// a panicking callback doesn't fail the mutation or stop the others
+		WithOnUpdated(func(Note) { panic("listener failed") }),
+	)
+
+	// create a note
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	note := Note{Title: "Created", Content: "Created content"}
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.Len(created, 1)
+	suite.Equal(uint(1), created[0].ID)
+	suite.Equal("Created", created[0].Title)
+	suite.Empty(updated)
+
+	// update the note
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Created"))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count", "version"}).
+			AddRow(1, now, now, nil, "Created", "Updated content", 2, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	note.Content = "Updated content"
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+	suite.Len(created, 1)
+	suite.Len(updated, 1)
+	suite.Equal("Updated content", updated[0].Content)
+	suite.Equal(2, updated[0].Version)
+
+	// delete the note
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Created"))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "deleted_at"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+	suite.NoError(repo.DeleteNote(suite.ctx, 1))
+	suite.Len(deleted, 1)
+	suite.Equal(uint(1), deleted[0].ID)
+	suite.Equal("Created", deleted[0].Title)
+	suite.Len(updated, 1)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	suite.Run("Failed mutation isn't notified", func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnError(errors.New("connection reset by peer"))
+		mock.ExpectRollback()
+		suite.Error(repo.SaveNote(suite.ctx, &Note{Title: "Failed", Content: "Failed content"}))
+		suite.Len(created, 1)
+		suite.NoError(mock.ExpectationsWereMet())
+	})
+
+	suite.Run("Async callbacks run in a goroutine", func() {
+		notified := make(chan Note, 1)
+		repo, mock := suite.newMockRepo(WithAsyncCallbacks(), WithOnCreated(func(note Note) { notified <- note }))
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+		mock.ExpectCommit()
+		suite.NoError(repo.SaveNote(suite.ctx, &Note{Title: "Async", Content: "Async content"}))
+		select {
+		case note := <-notified:
+			suite.Equal("Async", note.Title)
+		case <-time.After(time.Second):
+			suite.Fail("callback wasn't called")
+		}
+	})
+}
+
+func TestCallbacks(t *testing.T) {
+	suite.Run(t, new(CallbacksTestSuite))
+}
@@ -0,0 +1,638 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+// dbNoteRepository implements the NoteRepositoryInterface on top of
+// postgres alone. It doesn't cache, trace, log or publish events, so every
+// read is served by postgres. It is the persistence layer the NoteRepository
+// is built on.
+type dbNoteRepository struct {
+	db *gorm.DB
+	// caseInsensitiveTitles makes titles unique and looked up regardless
+	// of case, through the note's NormalizedTitle
+	caseInsensitiveTitles bool
+}
+
+// NewDBNoteRepository is the factory function to create a note repository
+// that stores notes in postgres without caching them
+// Parameters:
+// -  db: gorm database client
+//
+// Returns:
+// - NoteRepositoryInterface: the postgres backed repository
+func NewDBNoteRepository(db *gorm.DB) NoteRepositoryInterface {
+	return &dbNoteRepository{db: db}
+}
+
+// prepareNote will count the words in the note's content, normalize its
+// tags, set its normalized title and validate the note before it is stored
+func (repo *dbNoteRepository) prepareNote(note *Note) error {
+	note.WordCount = countWords(note.Content)
+	note.Tags = normalizeTags(note.Tags)
+	note.NormalizedTitle = nil
+	if repo.caseInsensitiveTitles {
+		normalizedTitle := foldTitle(note.Title)
+		note.NormalizedTitle = &normalizedTitle
+	}
+	return note.Validate()
+}
+
+// foldTitle will return the lowercased title that titles are compared
+// with when they are case insensitive
+func foldTitle(title string) string {
+	return strings.ToLower(title)
+}
+
+// whereTitle will scope the query to the notes of the author whose title
+// is the title, ignoring case when titles are case insensitive. Titles are
+// only unique per author, zero scopes the query to the notes without an author.
+func (repo *dbNoteRepository) whereTitle(query *gorm.DB, authorID uint, title string) *gorm.DB {
+	query = query.Where("author_id = ?", authorID)
+	if repo.caseInsensitiveTitles {
+		return query.Where("normalized_title = ?", foldTitle(title))
+	}
+	return query.Where("title = ?", title)
+}
+
+// SaveNote will count the words in the note's content, validate the note
+// and store it along with its tags and an audit entry for the mutation.
+// It returns DuplicateNoteError when the title is already taken,
+// ErrTitleTakenByDeletedNote when it is taken by a soft-deleted note and
+// ErrVersionConflict when an existing note was updated by someone else
+// since it was loaded.
+func (repo *dbNoteRepository) SaveNote(ctx context.Context, note *Note) error {
+	if err := repo.prepareNote(note); err != nil {
+		return err
+	}
+	action := AuditActionUpdated
+	if note.ID == 0 {
+		action = AuditActionCreated
+	}
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if note.ID == 0 {
+			err = tx.Create(note).Error
+		} else {
+			err = updateNote(tx, note)
+		}
+		if err != nil {
+			if isUniqueViolation(err) {
+				return DuplicateNoteError
+			}
+			return err
+		}
+		if err := replaceTags(tx, note); err != nil {
+			return err
+		}
+		return tx.Create(&AuditEntry{NoteID: note.ID, Action: action}).Error
+	})
+	if errors.Is(err, DuplicateNoteError) {
+		// the failed transaction is rolled back at this point so the
+		// title can be looked up among the deleted notes
+		deleted, lookupErr := repo.titleTakenByDeletedNote(ctx, note.AuthorID, note.Title)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if deleted {
+			return ErrTitleTakenByDeletedNote
+		}
+	}
+	return err
+}
+
+// titleTakenByDeletedNote will report whether a soft-deleted note of the
+// author has the title
+func (repo *dbNoteRepository) titleTakenByDeletedNote(ctx context.Context, authorID uint, title string) (bool, error) {
+	var exists bool
+	query := repo.whereTitle(repo.db.WithContext(ctx).Unscoped().Model(&Note{}).Select("1"), authorID, title).
+		Where("deleted_at IS NOT NULL").Limit(1)
+	err := repo.db.WithContext(ctx).Raw("SELECT EXISTS (?)", query).Scan(&exists).Error
+	return exists, err
+}
+
+// updateNote will update the note's title and content and bump its version,
+// provided the version stored in postgres is still the one the note was
+// loaded with. The note is reloaded afterwards so it carries the new
+// version and updated_at.
+// Returns:
+// - error: ErrVersionConflict when the note was updated since it was loaded
+// and NoteNotFoundError when it no longer exists
+func updateNote(tx *gorm.DB, note *Note) error {
+	result := tx.Model(&Note{}).
+		Where("id = ? AND version = ?", note.ID, note.Version).
+		Updates(map[string]any{
+			"title":            note.Title,
+			"normalized_title": note.NormalizedTitle,
+			"content":          note.Content,
+			"word_count":       note.WordCount,
+			"version":          gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		err := tx.Model(&Note{}).Where("id = ?", note.ID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return NoteNotFoundError
+		}
+		return ErrVersionConflict
+	}
+	return tx.First(note, note.ID).Error
+}
+
+// GetNoteById will get the note with the id, along with its tags. It
+// returns NoteNotFoundError when the note doesn't exist.
+func (repo *dbNoteRepository) GetNoteById(ctx context.Context, id int) (*Note, error) {
+	note := Note{Model: gorm.Model{ID: uint(id)}}
+	err := repo.db.WithContext(ctx).First(&note).Error
+	if err == nil {
+		err = loadTags(repo.db.WithContext(ctx), &note)
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, NoteNotFoundError
+		}
+		return nil, err
+	}
+	return &note, nil
+}
+
+// TitleExists will report whether a note of the author, deleted or not,
+// has the title, querying only whether a matching row exists rather than
+// loading it. Deleted notes are included since the unique constraint keeps
+// their titles taken. Without ForAuthor the author is the one of the notes
+// without an author.
+func (repo *dbNoteRepository) TitleExists(ctx context.Context, title string, opts ...TitleOption) (bool, error) {
+	config := newTitleConfig(opts)
+	var exists bool
+	query := repo.whereTitle(repo.db.WithContext(ctx).Unscoped().Model(&Note{}).Select("1"), config.authorID, title).Limit(1)
+	err := repo.db.WithContext(ctx).Raw("SELECT EXISTS (?)", query).Scan(&exists).Error
+	return exists, err
+}
+
+// maxTitlesPerQuery is the number of titles TitlesExist checks per query,
+// which keeps the IN list well under postgres's limit of 65535 parameters
+const maxTitlesPerQuery = 10000
+
+// TitlesExist will report which of the titles are held by a note of the
+// author, deleted or not as for TitleExists, selecting the existing titles
+// in a single query per maxTitlesPerQuery titles.
+func (repo *dbNoteRepository) TitlesExist(ctx context.Context, titles []string, opts ...TitleOption) (map[string]bool, error) {
+	config := newTitleConfig(opts)
+	exists := make(map[string]bool, len(titles))
+	if len(titles) == 0 {
+		return exists, nil
+	}
+	column, compared := "title", titles
+	if repo.caseInsensitiveTitles {
+		column, compared = "normalized_title", make([]string, len(titles))
+		for i, title := range titles {
+			compared[i] = foldTitle(title)
+		}
+	}
+	found := make(map[string]bool)
+	for start := 0; start < len(compared); start += maxTitlesPerQuery {
+		chunk := compared[start:min(start+maxTitlesPerQuery, len(compared))]
+		var existing []string
+		err := repo.db.WithContext(ctx).Unscoped().Model(&Note{}).
+			Where("author_id = ?", config.authorID).
+			Where(column+" IN ?", chunk).
+			Pluck(column, &existing).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, title := range existing {
+			found[title] = true
+		}
+	}
+	for i, title := range titles {
+		exists[title] = found[compared[i]]
+	}
+	return exists, nil
+}
+
+// GetRandomNote will get a note picked at random, along with its tags.
+// It returns NoteNotFoundError when there are no notes.
+func (repo *dbNoteRepository) GetRandomNote(ctx context.Context) (*Note, error) {
+	var note Note
+	err := repo.db.WithContext(ctx).Order("RANDOM()").Take(&note).Error
+	if err == nil {
+		err = loadTags(repo.db.WithContext(ctx), &note)
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, NoteNotFoundError
+		}
+		return nil, err
+	}
+	return &note, nil
+}
+
+// GetNoteByTitle will get the note of the author with the title, along with
+// its tags. It returns NoteNotFoundError when the note doesn't exist or has
+// been deleted.
+func (repo *dbNoteRepository) GetNoteByTitle(ctx context.Context, title string, opts ...TitleOption) (*Note, error) {
+	config := newTitleConfig(opts)
+	var note Note
+	err := repo.whereTitle(repo.db.WithContext(ctx), config.authorID, title).First(&note).Error
+	if err == nil {
+		err = loadTags(repo.db.WithContext(ctx), &note)
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, NoteNotFoundError
+		}
+		return nil, err
+	}
+	// soft-deleted notes are excluded by gorm's default scope, but the
+	// title is unique across deleted notes too so make sure a deleted
+	// note is never served
+	if note.DeletedAt.Valid {
+		return nil, NoteNotFoundError
+	}
+	return &note, nil
+}
+
+// DeleteNote will soft delete the note, recording the deletion in the
+// audit trail. Deleting a note that doesn't exist is a no-op.
+func (repo *dbNoteRepository) DeleteNote(ctx context.Context, id int) error {
+	_, err := repo.deleteNote(ctx, id)
+	return err
+}
+
+// deleteNote will soft delete the note like DeleteNote and report
+// whether there was a note to delete
+func (repo *dbNoteRepository) deleteNote(ctx context.Context, id int) (bool, error) {
+	deleted := false
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&Note{}, id)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		deleted = true
+		return tx.Create(&AuditEntry{NoteID: uint(id), Action: AuditActionDeleted}).Error
+	})
+	return deleted, err
+}
+
+// storedNote will load the id, title and author of the note as stored,
+// or nil when there is no note with the id
+func (repo *dbNoteRepository) storedNote(ctx context.Context, id int) (*Note, error) {
+	var note Note
+	err := repo.db.WithContext(ctx).Select("id", "title", "author_id").First(&note, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// notesByIds will load the notes with the ids, along with their tags.
+// Ids of notes that don't exist are ignored.
+func (repo *dbNoteRepository) notesByIds(ctx context.Context, ids []int) ([]Note, error) {
+	var notes []Note
+	if err := repo.db.WithContext(ctx).Where("id IN ?", ids).Find(&notes).Error; err != nil {
+		return nil, err
+	}
+	return notes, loadTags(repo.db.WithContext(ctx), pointersTo(notes)...)
+}
+
+// GetOrCreateNote will insert the note unless a note with its title
+// already exists, in which case the existing note is loaded into note.
+// The insert skips conflicting titles rather than checking for the title
+// first, so concurrent calls with the same title create the note once.
+// Returns:
+// - bool: true when the note was created
+// - error: DuplicateNoteError when the title belongs to a deleted note
+func (repo *dbNoteRepository) GetOrCreateNote(ctx context.Context, note *Note) (bool, error) {
+	if err := repo.prepareNote(note); err != nil {
+		return false, err
+	}
+	created := false
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(note)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			err := repo.whereTitle(tx, note.AuthorID, note.Title).First(note).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// the title is held by a soft deleted note
+				return DuplicateNoteError
+			}
+			if err != nil {
+				return err
+			}
+			return loadTags(tx, note)
+		}
+		created = true
+		if err := replaceTags(tx, note); err != nil {
+			return err
+		}
+		return tx.Create(&AuditEntry{NoteID: note.ID, Action: AuditActionCreated}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// CreateNoteIdempotent will create the note as SaveNote does. There is no
+// redis to remember idempotency keys in so creates aren't deduplicated.
+func (repo *dbNoteRepository) CreateNoteIdempotent(ctx context.Context, _ string, note *Note) error {
+	return repo.SaveNote(ctx, note)
+}
+
+// GetNoteByIdempotencyKey will return NoteNotFoundError as there is no
+// redis to remember idempotency keys in
+func (repo *dbNoteRepository) GetNoteByIdempotencyKey(_ context.Context, _ uint, _ string) (*Note, error) {
+	return nil, NoteNotFoundError
+}
+
+// ListNotesAfter will return up to limit notes with an id greater than
+// afterID in ascending id order, with the tags of the page loaded in a
+// single query. See NoteRepository.ListNotesAfter.
+func (repo *dbNoteRepository) ListNotesAfter(ctx context.Context, afterID uint, limit int) ([]Note, error) {
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("id > ?", afterID).
+		Order("id").
+		Limit(limit).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, loadTags(repo.db.WithContext(ctx), pointersTo(notes)...)
+}
+
+// ListNotesUpdatedSince will return up to limit notes after the
+// (since, afterID) cursor in ascending updated_at and id order. See
+// NoteRepository.ListNotesUpdatedSince.
+func (repo *dbNoteRepository) ListNotesUpdatedSince(ctx context.Context, since time.Time, afterID uint, limit int) ([]Note, error) {
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("(updated_at, id) > (?, ?)", since, afterID).
+		Order("updated_at, id").
+		Limit(limit).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// ListRecentlyUpdated will return up to limit notes in descending
+// updated_at order. See NoteRepository.ListRecentlyUpdated.
+func (repo *dbNoteRepository) ListRecentlyUpdated(ctx context.Context, limit int) ([]Note, error) {
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Order("updated_at DESC, id DESC").
+		Limit(limit).
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// ListNotesCreatedBetween will return the notes created from start up to,
+// but excluding, end in ascending created_at order.
+// See NoteRepository.ListNotesCreatedBetween.
+func (repo *dbNoteRepository) ListNotesCreatedBetween(ctx context.Context, start time.Time, end time.Time) ([]Note, error) {
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("created_at >= ? AND created_at < ?", start, end).
+		Order("created_at, id").
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, nil
+}
+
+// ListNotesByIDRange will return the notes whose id is from minID up to
+// and including maxID in ascending id order, with their tags loaded in a
+// single query. See NoteRepository.ListNotesByIDRange.
+func (repo *dbNoteRepository) ListNotesByIDRange(ctx context.Context, minID uint, maxID uint) ([]Note, error) {
+	notes := make([]Note, 0)
+	result := repo.db.WithContext(ctx).
+		Where("id BETWEEN ? AND ?", minID, maxID).
+		Order("id").
+		Find(&notes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notes, loadTags(repo.db.WithContext(ctx), pointersTo(notes)...)
+}
+
+// ForEachNote will page through all the notes in ascending id order,
+// with their tags loaded, and call fn with each page. It stops at the
+// first error returned by fn.
+func (repo *dbNoteRepository) ForEachNote(ctx context.Context, batchSize int, fn func([]Note) error) error {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	var lastID uint
+	for {
+		notes, err := repo.ListNotesAfter(ctx, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(notes) == 0 {
+			return nil
+		}
+		if err := fn(notes); err != nil {
+			return err
+		}
+		if len(notes) < batchSize {
+			return nil
+		}
+		lastID = notes[len(notes)-1].ID
+	}
+}
+
+// ImportNotes will insert the batches of notes returned by nextBatch until
+// it returns an empty batch, all within a single transaction so a failed
+// import inserts nothing. See NoteRepository.ImportNotes.
+func (repo *dbNoteRepository) ImportNotes(ctx context.Context, nextBatch func() ([]*Note, error), skipDuplicates bool) (int, error) {
+	imported := 0
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for {
+			notes, err := nextBatch()
+			if err != nil {
+				return err
+			}
+			if len(notes) == 0 {
+				return nil
+			}
+			for _, note := range notes {
+				if err := repo.prepareNote(note); err != nil {
+					return err
+				}
+			}
+			if skipDuplicates {
+				notes, err = repo.withoutTakenTitles(tx, notes)
+				if err != nil {
+					return err
+				}
+				if len(notes) == 0 {
+					continue
+				}
+			}
+			if err := createNotes(tx, notes); err != nil {
+				return err
+			}
+			imported += len(notes)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+// createNotes will insert the notes in batches along with their tags and
+// audit entries
+// Returns:
+// - error: DuplicateNoteError wrapped with the offending title when any
+// title is already taken
+func createNotes(tx *gorm.DB, notes []*Note) error {
+	err := tx.CreateInBatches(notes, defaultBatchSize).Error
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%w: %s", DuplicateNoteError, duplicateTitle(err))
+		}
+		return err
+	}
+	if err := replaceTags(tx, notes...); err != nil {
+		return err
+	}
+	entries := make([]AuditEntry, len(notes))
+	for i, note := range notes {
+		entries[i] = AuditEntry{NoteID: note.ID, Action: AuditActionCreated}
+	}
+	return tx.CreateInBatches(entries, defaultBatchSize).Error
+}
+
+// withoutTakenTitles will return the notes whose title isn't taken by a
+// note of the same author in postgres, deleted or not, nor by an earlier
+// note of the same author in notes. Titles are unique per author so the
+// titles are looked up for each author, as TitlesExist looks them up.
+func (repo *dbNoteRepository) withoutTakenTitles(tx *gorm.DB, notes []*Note) ([]*Note, error) {
+	column := "title"
+	comparedTitle := func(note *Note) string {
+		return note.Title
+	}
+	if repo.caseInsensitiveTitles {
+		column = "normalized_title"
+		comparedTitle = func(note *Note) string {
+			return *note.NormalizedTitle
+		}
+	}
+	// authorTitle is a title of an author, as the unique indexes see it
+	type authorTitle struct {
+		authorID uint
+		title    string
+	}
+	titlesByAuthor := make(map[uint][]string)
+	for _, note := range notes {
+		titlesByAuthor[note.AuthorID] = append(titlesByAuthor[note.AuthorID], comparedTitle(note))
+	}
+	taken := make(map[authorTitle]bool, len(notes))
+	for authorID, titles := range titlesByAuthor {
+		for start := 0; start < len(titles); start += maxTitlesPerQuery {
+			chunk := titles[start:min(start+maxTitlesPerQuery, len(titles))]
+			var takenTitles []string
+			err := tx.Unscoped().Model(&Note{}).
+				Where("author_id = ?", authorID).
+				Where(column+" IN ?", chunk).
+				Pluck(column, &takenTitles).Error
+			if err != nil {
+				return nil, err
+			}
+			for _, title := range takenTitles {
+				taken[authorTitle{authorID: authorID, title: title}] = true
+			}
+		}
+	}
+	available := make([]*Note, 0, len(notes))
+	for _, note := range notes {
+		title := authorTitle{authorID: note.AuthorID, title: comparedTitle(note)}
+		if !taken[title] {
+			taken[title] = true
+			available = append(available, note)
+		}
+	}
+	return available, nil
+}
+
+// WarmCache has no cache to warm, it caches nothing and returns zero.
+func (repo *dbNoteRepository) WarmCache(context.Context, []int) (int, error) {
+	return 0, nil
+}
+
+// InvalidateNotes has no cache to invalidate, it does nothing.
+func (repo *dbNoteRepository) InvalidateNotes(context.Context, []int) error {
+	return nil
+}
+
+// InspectNote will load the note from postgres. There is no cache so the
+// result never holds a cached note.
+// Returns:
+// - InspectResult: the postgres version of the note
+// - error: NoteNotFoundError when the note isn't in postgres
+func (repo *dbNoteRepository) InspectNote(ctx context.Context, id int) (InspectResult, error) {
+	note, err := repo.GetNoteById(ctx, id)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	return InspectResult{DbNote: note}, nil
+}
+
+// CountNotes will return the number of notes that haven't been deleted
+func (repo *dbNoteRepository) CountNotes(ctx context.Context) (int64, error) {
+	var count int64
+	result := repo.db.WithContext(ctx).Model(&Note{}).Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
+
+// HealthCheck will ping postgres
+func (repo *dbNoteRepository) HealthCheck(ctx context.Context) error {
+	sqlDB, err := repo.db.DB()
+	if err != nil {
+		return fmt.Errorf("postgres health check failed: %w", err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("postgres health check failed: %w", err)
+	}
+	return nil
+}
+
+// Close will close the underlying postgres connection pool
+func (repo *dbNoteRepository) Close() error {
+	sqlDB, err := repo.db.DB()
+	if err != nil {
+		return fmt.Errorf("closing postgres: %w", err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		return fmt.Errorf("closing postgres: %w", err)
+	}
+	return nil
+}
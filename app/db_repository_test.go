@@ -0,0 +1,81 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/suite"
+	pg "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"regexp"
+	"testing"
+)
+
+// DbNoteRepositoryTestSuite tests the postgres backed store over a database
+// mocked with sqlmock
+type DbNoteRepositoryTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *DbNoteRepositoryTestSuite) TestUniqueViolation() {
+	suite.True(isUniqueViolation(&pgconn.PgError{Code: uniqueViolationCode}))
+	suite.True(isUniqueViolation(fmt.Errorf("creating note: %w", &pgconn.PgError{Code: uniqueViolationCode})))
+	suite.True(isUniqueViolation(gorm.ErrDuplicatedKey))
+	suite.False(isUniqueViolation(&pgconn.PgError{Code: "23503"}))
+	suite.False(isUniqueViolation(errors.New("connection reset by peer")))
+
+	for _, tc := range []struct {
+		name   string
+		config gorm.Config
+	}{
+		{"Driver error", gorm.Config{}},
+		{"Translated error", gorm.Config{TranslateError: true}},
+	} {
+		suite.Run(tc.name, func() {
+			mockDb, mock, err := sqlmock.New()
+			suite.NoError(err)
+			defer mockDb.Close()
+			db, err := gorm.Open(pg.New(pg.Config{Conn: mockDb, DriverName: "postgres"}), &tc.config)
+			suite.NoError(err)
+			app := NewApplication(NewNoteRepositoryWithCache(db, suite.cache))
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).
+				WillReturnError(&pgconn.PgError{Code: uniqueViolationCode, Detail: "Key (author_id, title)=(0, Taken) already exists."})
+			mock.ExpectRollback()
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT EXISTS (SELECT 1 FROM "notes" WHERE author_id = $1 AND title = $2 AND deleted_at IS NOT NULL LIMIT 1)`)).
+				WithArgs(0, "Taken").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			_, err = app.CreateNote(suite.ctx, "Taken", "My content")
+			suite.ErrorIs(err, DuplicateNoteError)
+			suite.NotErrorIs(err, SomethingWentWrongError)
+			suite.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func (suite *DbNoteRepositoryTestSuite) TestBackfillNormalizedTitles() {
+	mockDb, mock, err := sqlmock.New()
+	suite.NoError(err)
+	defer mockDb.Close()
+	db, err := gorm.Open(pg.New(pg.Config{Conn: mockDb, DriverName: "postgres"}), &gorm.Config{})
+	suite.NoError(err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title" FROM "notes" WHERE normalized_title IS NULL ORDER BY "notes"."id" LIMIT 100`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "ÉTUDE").AddRow(2, "Groceries"))
+	// the titles are folded in Go, as the repositories fold them
+	for i, folded := range []string{"étude", "groceries"} {
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "normalized_title"=$1 WHERE id = $2`)).
+			WithArgs(folded, i+1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	suite.NoError(BackfillNormalizedTitles(db))
+	suite.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDbNoteRepository(t *testing.T) {
+	suite.Run(t, new(DbNoteRepositoryTestSuite))
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// NoteDTO is the JSON representation of a note exposed to clients, e.g.
+// over HTTP. Its fields are encoded in a fixed order with snake_case names
+// and DeletedAt is only encoded when the note is deleted, unlike Note whose
+// embedded gorm.Model encodes a gorm.DeletedAt object on every note.
+// Decoding matches names case-insensitively, so bodies with the Note
+// field names, e.g. {"Title": "..."}, decode as well.
+type NoteDTO struct {
+	ID        uint       `json:"id"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// NewNoteDTO will return the JSON representation of the note
+func NewNoteDTO(note Note) NoteDTO {
+	dto := NoteDTO{
+		ID:        note.ID,
+		Title:     note.Title,
+		Content:   note.Content,
+		CreatedAt: note.CreatedAt,
+		UpdatedAt: note.UpdatedAt,
+	}
+	if note.DeletedAt.Valid {
+		deletedAt := note.DeletedAt.Time
+		dto.DeletedAt = &deletedAt
+	}
+	return dto
+}
+
+// ToNote will return the note the DTO represents. Fields the DTO doesn't
+// carry, like the word count, version and tags, are left zero.
+func (dto NoteDTO) ToNote() Note {
+	note := Note{
+		Model: gorm.Model{
+			ID:        dto.ID,
+			CreatedAt: dto.CreatedAt,
+			UpdatedAt: dto.UpdatedAt,
+		},
+		Title:   dto.Title,
+		Content: dto.Content,
+	}
+	if dto.DeletedAt != nil {
+		note.DeletedAt = gorm.DeletedAt{Time: *dto.DeletedAt, Valid: true}
+	}
+	return note
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+type NoteDTOTestSuite struct {
+	suite.Suite
+}
+
+func (suite *NoteDTOTestSuite) TestMarshal() {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	note := Note{
+		Model:     gorm.Model{ID: 1, CreatedAt: createdAt, UpdatedAt: createdAt.Add(time.Hour)},
+		Title:     "My note",
+		Content:   "My content",
+		WordCount: 2,
+	}
+	encoded, err := json.Marshal(NewNoteDTO(note))
+	suite.NoError(err)
+	suite.JSONEq(`{
+		"id": 1,
+		"title": "My note",
+		"content": "My content",
+		"created_at": "2024-01-02T03:04:05Z",
+		"updated_at": "2024-01-02T04:04:05Z"
+	}`, string(encoded))
+
+	suite.Run("Deleted note", func() {
+		deleted := note
+		deleted.DeletedAt = gorm.DeletedAt{Time: createdAt.Add(2 * time.Hour), Valid: true}
+		encoded, err := json.Marshal(NewNoteDTO(deleted))
+		suite.NoError(err)
+		var fields map[string]any
+		suite.NoError(json.Unmarshal(encoded, &fields))
+		suite.Equal("2024-01-02T05:04:05Z", fields["deleted_at"])
+	})
+}
+
+func (suite *NoteDTOTestSuite) TestRoundTrip() {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := map[string]Note{
+		"Live note": {
+			Model:   gorm.Model{ID: 1, CreatedAt: createdAt, UpdatedAt: createdAt},
+			Title:   "Live",
+			Content: "Live content",
+		},
+		"Deleted note": {
+			Model: gorm.Model{
+				ID:        2,
+				CreatedAt: createdAt,
+				UpdatedAt: createdAt,
+				DeletedAt: gorm.DeletedAt{Time: createdAt.Add(time.Hour), Valid: true},
+			},
+			Title:   "Deleted",
+			Content: "Deleted content",
+		},
+	}
+	for name, note := range notes {
+		suite.Run(name, func() {
+			encoded, err := json.Marshal(NewNoteDTO(note))
+			suite.NoError(err)
+			var dto NoteDTO
+			suite.NoError(json.Unmarshal(encoded, &dto))
+			suite.Equal(note, dto.ToNote())
+		})
+	}
+
+	suite.Run("Note field names decode", func() {
+		var dto NoteDTO
+		suite.NoError(json.Unmarshal([]byte(`{"Title": "My note", "Content": "My content"}`), &dto))
+		suite.Equal(Note{Title: "My note", Content: "My content"}, dto.ToNote())
+	})
+}
+
+func TestNoteDTO(t *testing.T) {
+	suite.Run(t, new(NoteDTOTestSuite))
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"time"
+)
+
+// DefaultIdempotencyTTL is how long an idempotency key is remembered unless
+// WithIdempotencyTTL sets another TTL
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyPending is the value an idempotency key holds while the
+// request that reserved it is creating its note
+const idempotencyPending = "0"
+
+// idempotencyReservationTTL is how long an idempotency key stays reserved
+// by a request without a deadline, so a request that dies while creating
+// its note only holds up the retries with the key for that long
+const idempotencyReservationTTL = time.Minute
+
+// WithIdempotencyTTL sets how long the id of a note created with an
+// idempotency key is remembered. A retry with the same key within the TTL
+// gets the note back, after it the key is forgotten and a retry creates the
+// note again. By default it is DefaultIdempotencyTTL.
+func WithIdempotencyTTL(ttl time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.idempotencyTTL = ttl
+	}
+}
+
+// idempotencyKey will return the redis key the id of the note the author
+// created with the idempotency key is stored under. Clients choose their
+// keys so the key is scoped to the author, otherwise an author reusing
+// another's key would be handed the other author's note.
+func (repo *NoteRepository) idempotencyKey(authorID uint, key string) string {
+	return fmt.Sprintf("%s:idempotency:%d:%s", repo.keyPrefix, authorID, key)
+}
+
+// reservationTTL will return how long an idempotency key is reserved for
+// the request while it creates its note: until the request's deadline, but
+// at least idempotencyReservationTTL and at most the idempotency TTL
+func (repo *NoteRepository) reservationTTL(ctx context.Context) time.Duration {
+	ttl := idempotencyReservationTTL
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > ttl {
+		ttl = time.Until(deadline)
+	}
+	if repo.idempotencyTTL > 0 && repo.idempotencyTTL < ttl {
+		ttl = repo.idempotencyTTL
+	}
+	return ttl
+}
+
+// CreateNoteIdempotent will create the note as SaveNote does unless a note
+// was already created with the idempotency key, in which case the note is
+// set to the one created first, so a client retrying a create that timed out
+// doesn't create the note twice. Keys are scoped to the note's author, so
+// only a create by the same author is deduplicated. The key is reserved
+// with SET NX for as long as the request may take before the note is
+// stored, and only set to the note's id for the idempotency TTL once the
+// note is stored. A key that can't be set to the id is released rather
+// than left reserved.
+// Without a redis client, within WithTransaction or when redis fails, the
+// note is created without being deduplicated.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    key: the idempotency key chosen by the client for the request
+// -    note: the note to create, set to the created note
+//
+// Returns:
+// - error: ErrRequestInProgress when a request with the key is still
+// creating its note, otherwise any error returned by SaveNote
+func (repo *NoteRepository) CreateNoteIdempotent(ctx context.Context, key string, note *Note) (err error) {
+	ctx, span := repo.startSpan(ctx, "CreateNoteIdempotent", attribute.String("idempotency.key", key))
+	defer func() { endSpan(span, err) }()
+	if repo.redis == nil || repo.changes != nil || key == "" {
+		return repo.SaveNote(ctx, note)
+	}
+	redisKey := repo.idempotencyKey(note.AuthorID, key)
+	redisCtx, cancel := repo.redisContext(ctx)
+	reserved, err := repo.redis.SetNX(redisCtx, redisKey, idempotencyPending, repo.reservationTTL(ctx)).Result()
+	cancel()
+	if err != nil {
+		repo.logger.Error("Error in reserving idempotency key", "key", key, "error", err.Error())
+		return repo.SaveNote(ctx, note)
+	}
+	if !reserved {
+		return repo.getIdempotentNote(ctx, key, note)
+	}
+	if err := repo.SaveNote(ctx, note); err != nil {
+		// release the key so a retry can attempt the create again
+		repo.releaseIdempotencyKey(ctx, note.AuthorID, key)
+		return err
+	}
+	redisCtx, cancel = repo.redisContext(ctx)
+	err = repo.redis.Set(redisCtx, redisKey, strconv.Itoa(int(note.ID)), repo.idempotencyTTL).Err()
+	cancel()
+	if err != nil {
+		// the note is stored at this point so failing to remember
+		// it is logged rather than reported as a failed create, and the
+		// key is released rather than left reserved for the retries
+		repo.logger.Error("Error in storing idempotency key", "key", key, "id", note.ID, "error", err.Error())
+		repo.releaseIdempotencyKey(ctx, note.AuthorID, key)
+	}
+	return nil
+}
+
+// GetNoteByIdempotencyKey will return the note created by CreateNoteIdempotent
+// for the author with the idempotency key, e.g. to tell a retried create
+// from a new one before creating it. Without a redis client or within
+// WithTransaction no key is remembered.
+// Parameters:
+// -    ctx: context for the database and redis calls
+// -    authorID: the author the note was created for
+// -    key: the idempotency key chosen by the client for the request
+//
+// Returns:
+// - *Note: the note created with the key
+// - error: NoteNotFoundError when no note has been created for the author
+// with the key, including while a request with the key is still creating
+// its note
+func (repo *NoteRepository) GetNoteByIdempotencyKey(ctx context.Context, authorID uint, key string) (_ *Note, err error) {
+	ctx, span := repo.startSpan(ctx, "GetNoteByIdempotencyKey", attribute.String("idempotency.key", key))
+	defer func() { endSpan(span, err) }()
+	if repo.redis == nil || repo.changes != nil || key == "" {
+		return nil, NoteNotFoundError
+	}
+	redisCtx, cancel := repo.redisContext(ctx)
+	value, err := repo.redis.Get(redisCtx, repo.idempotencyKey(authorID, key)).Result()
+	cancel()
+	if errors.Is(err, redis.Nil) || (err == nil && value == idempotencyPending) {
+		return nil, NoteNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetNoteById(ctx, id)
+}
+
+// releaseIdempotencyKey will delete the author's reservation of the
+// idempotency key
+func (repo *NoteRepository) releaseIdempotencyKey(ctx context.Context, authorID uint, key string) {
+	redisCtx, cancel := repo.redisContext(context.WithoutCancel(ctx))
+	defer cancel()
+	if err := repo.redis.Del(redisCtx, repo.idempotencyKey(authorID, key)).Err(); err != nil {
+		repo.logger.Error("Error in releasing idempotency key", "key", key, "error", err.Error())
+	}
+}
+
+// getIdempotentNote will set the note to the one created for its author
+// with the idempotency key, which another request has reserved
+func (repo *NoteRepository) getIdempotentNote(ctx context.Context, key string, note *Note) error {
+	redisCtx, cancel := repo.redisContext(ctx)
+	value, err := repo.redis.Get(redisCtx, repo.idempotencyKey(note.AuthorID, key)).Result()
+	cancel()
+	if errors.Is(err, redis.Nil) {
+		// the key expired or was released since it was reserved
+		return repo.CreateNoteIdempotent(ctx, key, note)
+	}
+	if err != nil {
+		return err
+	}
+	if value == idempotencyPending {
+		return ErrRequestInProgress
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	created, err := repo.GetNoteById(ctx, id)
+	if err != nil {
+		return err
+	}
+	repo.logger.Info("Replayed idempotent create", "operation", "CreateNoteIdempotent", "key", key, "id", id)
+	*note = *created
+	return nil
+}
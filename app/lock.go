@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// releaseLockScript deletes the lock only while it still holds the token of
+// the holder releasing it, so a holder whose lock expired and was acquired
+// by someone else doesn't release their lock
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// newLockToken will return a random token identifying the holder of a lock
+func newLockToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// acquireLock will set the lock's key to a new token with SET NX PX, so
+// only one holder acquires it until it is released or ttl elapses
+// Returns:
+// - string: the token the lock is released with, empty unless acquired
+// - bool: whether the lock was acquired
+// - error: any error returned by redis
+func acquireLock(ctx context.Context, client redis.UniversalClient, key string, ttl time.Duration) (string, bool, error) {
+	token, err := newLockToken()
+	if err != nil {
+		return "", false, err
+	}
+	acquired, err := client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !acquired {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// releaseLock will delete the lock's key if it still holds the token. It
+// returns ErrLockNotHeld when the lock expired and may have been acquired
+// by someone else since.
+func releaseLock(ctx context.Context, client redis.UniversalClient, key string, token string) error {
+	released, err := releaseLockScript.Run(ctx, client, []string{key}, token).Int()
+	if err != nil {
+		return err
+	}
+	if released == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// appLockKey will return the redis key of the lock acquired with AcquireLock
+func (repo *NoteRepository) appLockKey(key string) string {
+	return repo.keyPrefix + ":lock:app:" + key
+}
+
+// AcquireLock will acquire the distributed lock named key, e.g. to serialize
+// a critical section such as a rename touching two titles across every
+// instance of the application. The lock is a redis key set with SET NX PX
+// which expires after ttl if it is never released, so a crashed holder
+// doesn't keep it forever. The caller must release the lock, which deletes
+// it only while it is still the caller's. A lock that isn't acquired isn't
+// waited on, the caller decides whether to retry.
+// Parameters:
+// -    ctx: context for the redis calls, release outlives its cancellation
+// -    key: the name of the lock, namespaced by the repository's key prefix
+// -    ttl: how long the lock lives unless it is released
+//
+// Returns:
+// - func() error: releases the lock, returning ErrLockNotHeld when it
+// expired before being released. It is nil unless the lock was acquired.
+// - bool: whether the lock was acquired, false when someone else holds it
+// - error: ErrInvalidLockTTL when ttl isn't positive, ErrLockingUnavailable
+// without a redis client, otherwise any error returned by redis
+func (repo *NoteRepository) AcquireLock(ctx context.Context, key string, ttl time.Duration) (release func() error, ok bool, err error) {
+	if ttl <= 0 {
+		return nil, false, ErrInvalidLockTTL
+	}
+	if repo.redis == nil {
+		return nil, false, ErrLockingUnavailable
+	}
+	lockKey := repo.appLockKey(key)
+	token, acquired, err := acquireLock(ctx, repo.redis, lockKey, ttl)
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+	releaseCtx := context.WithoutCancel(ctx)
+	release = func() error {
+		return releaseLock(releaseCtx, repo.redis, lockKey, token)
+	}
+	return release, true, nil
+}
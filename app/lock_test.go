@@ -0,0 +1,32 @@
+package app
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+// LockTestSuite tests the distributed locks without redis
+type LockTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *LockTestSuite) TestAcquireLockWithoutRedis() {
+	repo, _ := suite.newMockRepo()
+	release, ok, err := repo.AcquireLock(suite.ctx, "rename", time.Second)
+	suite.ErrorIs(err, ErrLockingUnavailable)
+	suite.False(ok)
+	suite.Nil(release)
+
+	// a lock that would never expire isn't acquired
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		release, ok, err = repo.AcquireLock(suite.ctx, "rename", ttl)
+		suite.ErrorIs(err, ErrInvalidLockTTL)
+		suite.False(ok)
+		suite.Nil(release)
+	}
+}
+
+func TestLock(t *testing.T) {
+	suite.Run(t, new(LockTestSuite))
+}
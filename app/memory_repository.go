@@ -0,0 +1,503 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMemoryNoteRepository implements the NoteRepositoryInterface with the
+// notes held in memory, so the application can be tested without postgres
+// or redis. It behaves like the postgres backed repository: ids are
+// assigned in increasing order, titles are unique per author across
+// deleted notes too, updates are guarded by the note's version and deletes
+// are soft. It is safe for concurrent use.
+type InMemoryNoteRepository struct {
+	mu    sync.Mutex
+	store memoryNoteStore
+}
+
+// memoryNoteStore holds the notes of an InMemoryNoteRepository. Its notes
+// are never modified in place so a store is copied by copying its maps.
+type memoryNoteStore struct {
+	// notes maps the id of each note, deleted or not, to the note
+	notes map[uint]Note
+	// titles maps the author and title of each note, deleted or not, to its id
+	titles map[memoryTitle]uint
+	// lastID is the id of the most recently created note
+	lastID uint
+}
+
+// memoryTitle is the key of the unique title constraint, titles are unique per author
+type memoryTitle struct {
+	authorID uint
+	title    string
+}
+
+// NewInMemoryNoteRepository is the factory function to create an empty
+// note repository that holds the notes in memory
+// Returns:
+// - *InMemoryNoteRepository: the in-memory repository
+func NewInMemoryNoteRepository() *InMemoryNoteRepository {
+	return &InMemoryNoteRepository{store: newMemoryNoteStore()}
+}
+
+// newMemoryNoteStore will create an empty store
+func newMemoryNoteStore() memoryNoteStore {
+	return memoryNoteStore{notes: map[uint]Note{}, titles: map[memoryTitle]uint{}}
+}
+
+// clone will return a copy of the store that can be changed independently
+func (store memoryNoteStore) clone() memoryNoteStore {
+	clone := memoryNoteStore{
+		notes:  make(map[uint]Note, len(store.notes)),
+		titles: make(map[memoryTitle]uint, len(store.titles)),
+		lastID: store.lastID,
+	}
+	for id, note := range store.notes {
+		clone.notes[id] = note
+	}
+	for title, id := range store.titles {
+		clone.titles[title] = id
+	}
+	return clone
+}
+
+// liveNote will return the note with the id unless it doesn't exist or is deleted
+func (store memoryNoteStore) liveNote(id uint) (Note, bool) {
+	note, ok := store.notes[id]
+	if !ok || note.DeletedAt.Valid {
+		return Note{}, false
+	}
+	return note, true
+}
+
+// titleHolder will return the note, deleted or not, of the author with the title
+func (store memoryNoteStore) titleHolder(authorID uint, title string) (Note, bool) {
+	id, ok := store.titles[memoryTitle{authorID: authorID, title: title}]
+	if !ok {
+		return Note{}, false
+	}
+	return store.notes[id], true
+}
+
+// limitNotes will return the first limit notes. Like gorm's Limit, a
+// negative limit doesn't limit the notes.
+func limitNotes(notes []Note, limit int) []Note {
+	if limit < 0 || limit > len(notes) {
+		return notes
+	}
+	return notes[:limit]
+}
+
+// liveNotes will return the notes that aren't deleted and satisfy keep, in
+// ascending id order and without their tags as the postgres listings are
+func (store memoryNoteStore) liveNotes(keep func(Note) bool) []Note {
+	notes := make([]Note, 0)
+	for _, note := range store.notes {
+		if !note.DeletedAt.Valid && keep(note) {
+			note.Tags = nil
+			notes = append(notes, note)
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].ID < notes[j].ID
+	})
+	return notes
+}
+
+// withTags will set the tags of the listed notes, as the postgres listings
+// that load the tags of their notes do
+func (store memoryNoteStore) withTags(notes []Note) []Note {
+	for i := range notes {
+		notes[i].Tags = slices.Clone(store.notes[notes[i].ID].Tags)
+	}
+	return notes
+}
+
+// create will store the note as a new note and set its id and timestamps
+// Returns:
+// - error: DuplicateNoteError when the title is taken, ErrTitleTakenByDeletedNote
+// when it is taken by a deleted note
+func (store *memoryNoteStore) create(note *Note) error {
+	if holder, taken := store.titleHolder(note.AuthorID, note.Title); taken {
+		if holder.DeletedAt.Valid {
+			return ErrTitleTakenByDeletedNote
+		}
+		return DuplicateNoteError
+	}
+	now := time.Now()
+	store.lastID++
+	note.ID = store.lastID
+	note.CreatedAt, note.UpdatedAt = now, now
+	note.Version = 0
+	store.put(*note)
+	return nil
+}
+
+// update will store the note's title, content and tags and bump its
+// version, provided it still has the version the note was loaded with.
+// The note is set to the stored note.
+// Returns:
+// - error: NoteNotFoundError when the note doesn't exist, ErrVersionConflict
+// when it was updated since it was loaded and DuplicateNoteError when its
+// new title is taken
+func (store *memoryNoteStore) update(note *Note) error {
+	stored, ok := store.liveNote(note.ID)
+	if !ok {
+		return NoteNotFoundError
+	}
+	if stored.Version != note.Version {
+		return ErrVersionConflict
+	}
+	if holder, taken := store.titleHolder(stored.AuthorID, note.Title); taken && holder.ID != stored.ID {
+		if holder.DeletedAt.Valid {
+			return ErrTitleTakenByDeletedNote
+		}
+		return DuplicateNoteError
+	}
+	delete(store.titles, memoryTitle{authorID: stored.AuthorID, title: stored.Title})
+	stored.Title = note.Title
+	stored.Content = note.Content
+	stored.WordCount = note.WordCount
+	stored.Tags = note.Tags
+	stored.Version++
+	stored.UpdatedAt = time.Now()
+	store.put(stored)
+	*note = stored
+	return nil
+}
+
+// put will store a copy of the note and index its title
+func (store *memoryNoteStore) put(note Note) {
+	note.Tags = slices.Clone(note.Tags)
+	store.notes[note.ID] = note
+	store.titles[memoryTitle{authorID: note.AuthorID, title: note.Title}] = note.ID
+}
+
+// copyNote will return a copy of the note the caller can change freely
+func copyNote(note Note) *Note {
+	note.Tags = slices.Clone(note.Tags)
+	return &note
+}
+
+// prepareMemoryNote will count the words in the note's content, normalize
+// its tags and validate the note before it is stored, as postgres would
+func prepareMemoryNote(note *Note) error {
+	note.WordCount = countWords(note.Content)
+	note.Tags = normalizeTags(note.Tags)
+	note.NormalizedTitle = nil
+	return note.Validate()
+}
+
+// SaveNote will create the note when it has no id and update it otherwise.
+// It returns DuplicateNoteError when the title is already taken,
+// ErrTitleTakenByDeletedNote when it is taken by a deleted note,
+// ErrVersionConflict when the note was updated since it was loaded and
+// NoteNotFoundError when the updated note doesn't exist.
+func (repo *InMemoryNoteRepository) SaveNote(_ context.Context, note *Note) error {
+	if err := prepareMemoryNote(note); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if note.ID == 0 {
+		return repo.store.create(note)
+	}
+	return repo.store.update(note)
+}
+
+// GetNoteById will get the note with the id. It returns NoteNotFoundError
+// when the note doesn't exist or has been deleted.
+func (repo *InMemoryNoteRepository) GetNoteById(_ context.Context, id int) (*Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	note, ok := repo.store.liveNote(uint(id))
+	if !ok {
+		return nil, NoteNotFoundError
+	}
+	return copyNote(note), nil
+}
+
+// GetNoteByTitle will get the note of the author with the title. It
+// returns NoteNotFoundError when the note doesn't exist or has been deleted.
+func (repo *InMemoryNoteRepository) GetNoteByTitle(_ context.Context, title string, opts ...TitleOption) (*Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	note, ok := repo.store.titleHolder(newTitleConfig(opts).authorID, title)
+	if !ok || note.DeletedAt.Valid {
+		return nil, NoteNotFoundError
+	}
+	return copyNote(note), nil
+}
+
+// TitleExists will report whether a note of the author, deleted or not,
+// has the title
+func (repo *InMemoryNoteRepository) TitleExists(_ context.Context, title string, opts ...TitleOption) (bool, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	_, ok := repo.store.titleHolder(newTitleConfig(opts).authorID, title)
+	return ok, nil
+}
+
+// TitlesExist will report which of the titles are held by a note of the
+// author, deleted or not
+func (repo *InMemoryNoteRepository) TitlesExist(_ context.Context, titles []string, opts ...TitleOption) (map[string]bool, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	authorID := newTitleConfig(opts).authorID
+	exists := make(map[string]bool, len(titles))
+	for _, title := range titles {
+		_, exists[title] = repo.store.titleHolder(authorID, title)
+	}
+	return exists, nil
+}
+
+// GetRandomNote will get a note picked at random. It returns
+// NoteNotFoundError when there are no notes.
+func (repo *InMemoryNoteRepository) GetRandomNote(_ context.Context) (*Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	notes := repo.store.liveNotes(func(Note) bool { return true })
+	if len(notes) == 0 {
+		return nil, NoteNotFoundError
+	}
+	picked, _ := repo.store.liveNote(notes[rand.Intn(len(notes))].ID)
+	return copyNote(picked), nil
+}
+
+// DeleteNote will soft delete the note, keeping its title taken. Deleting
+// a note that doesn't exist is a no-op.
+func (repo *InMemoryNoteRepository) DeleteNote(_ context.Context, id int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	note, ok := repo.store.liveNote(uint(id))
+	if !ok {
+		return nil
+	}
+	note.DeletedAt.Time, note.DeletedAt.Valid = time.Now(), true
+	repo.store.put(note)
+	return nil
+}
+
+// GetOrCreateNote will create the note unless a note with its title
+// already exists, in which case the existing note is loaded into note.
+// Returns:
+// - bool: true when the note was created
+// - error: DuplicateNoteError when the title belongs to a deleted note
+func (repo *InMemoryNoteRepository) GetOrCreateNote(_ context.Context, note *Note) (bool, error) {
+	if err := prepareMemoryNote(note); err != nil {
+		return false, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if holder, taken := repo.store.titleHolder(note.AuthorID, note.Title); taken {
+		if holder.DeletedAt.Valid {
+			return false, DuplicateNoteError
+		}
+		*note = *copyNote(holder)
+		return false, nil
+	}
+	if err := repo.store.create(note); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateNoteIdempotent will create the note as SaveNote does. Idempotency
+// keys aren't remembered so creates aren't deduplicated.
+func (repo *InMemoryNoteRepository) CreateNoteIdempotent(ctx context.Context, _ string, note *Note) error {
+	return repo.SaveNote(ctx, note)
+}
+
+// GetNoteByIdempotencyKey will return NoteNotFoundError as idempotency keys
+// aren't remembered
+func (repo *InMemoryNoteRepository) GetNoteByIdempotencyKey(_ context.Context, _ uint, _ string) (*Note, error) {
+	return nil, NoteNotFoundError
+}
+
+// ListNotesAfter will return up to limit notes with an id greater than
+// afterID in ascending id order, with their tags
+func (repo *InMemoryNoteRepository) ListNotesAfter(_ context.Context, afterID uint, limit int) ([]Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	notes := repo.store.liveNotes(func(note Note) bool { return note.ID > afterID })
+	return repo.store.withTags(limitNotes(notes, limit)), nil
+}
+
+// ListNotesUpdatedSince will return up to limit notes after the
+// (since, afterID) cursor in ascending updated_at and id order
+func (repo *InMemoryNoteRepository) ListNotesUpdatedSince(_ context.Context, since time.Time, afterID uint, limit int) ([]Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	notes := repo.store.liveNotes(func(note Note) bool {
+		return note.UpdatedAt.After(since) || note.UpdatedAt.Equal(since) && note.ID > afterID
+	})
+	sort.SliceStable(notes, func(i, j int) bool {
+		if !notes[i].UpdatedAt.Equal(notes[j].UpdatedAt) {
+			return notes[i].UpdatedAt.Before(notes[j].UpdatedAt)
+		}
+		return notes[i].ID < notes[j].ID
+	})
+	return limitNotes(notes, limit), nil
+}
+
+// ListRecentlyUpdated will return up to limit notes in descending
+// updated_at and id order
+func (repo *InMemoryNoteRepository) ListRecentlyUpdated(_ context.Context, limit int) ([]Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	notes := repo.store.liveNotes(func(Note) bool { return true })
+	sort.SliceStable(notes, func(i, j int) bool {
+		if !notes[i].UpdatedAt.Equal(notes[j].UpdatedAt) {
+			return notes[i].UpdatedAt.After(notes[j].UpdatedAt)
+		}
+		return notes[i].ID > notes[j].ID
+	})
+	return limitNotes(notes, limit), nil
+}
+
+// ListNotesCreatedBetween will return the notes created from start up to,
+// but excluding, end in ascending created_at order
+func (repo *InMemoryNoteRepository) ListNotesCreatedBetween(_ context.Context, start time.Time, end time.Time) ([]Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	notes := repo.store.liveNotes(func(note Note) bool {
+		return !note.CreatedAt.Before(start) && note.CreatedAt.Before(end)
+	})
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].CreatedAt.Before(notes[j].CreatedAt)
+	})
+	return notes, nil
+}
+
+// ListNotesByIDRange will return the notes whose id is from minID up to
+// and including maxID in ascending id order, with their tags
+func (repo *InMemoryNoteRepository) ListNotesByIDRange(_ context.Context, minID uint, maxID uint) ([]Note, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	notes := repo.store.liveNotes(func(note Note) bool { return note.ID >= minID && note.ID <= maxID })
+	return repo.store.withTags(notes), nil
+}
+
+// ForEachNote will page through all the notes in ascending id order,
+// with their tags, and call fn with each page. It stops at the first
+// error returned by fn.
+func (repo *InMemoryNoteRepository) ForEachNote(ctx context.Context, batchSize int, fn func([]Note) error) error {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	var lastID uint
+	for {
+		notes, err := repo.ListNotesAfter(ctx, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(notes) == 0 {
+			return nil
+		}
+		if err := fn(notes); err != nil {
+			return err
+		}
+		if len(notes) < batchSize {
+			return nil
+		}
+		lastID = notes[len(notes)-1].ID
+	}
+}
+
+// ImportNotes will create the batches of notes returned by nextBatch until
+// it returns an empty batch. A failed import creates nothing. With
+// skipDuplicates the notes whose title is already taken are skipped,
+// otherwise they fail the import with DuplicateNoteError.
+func (repo *InMemoryNoteRepository) ImportNotes(_ context.Context, nextBatch func() ([]*Note, error), skipDuplicates bool) (int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	store := repo.store.clone()
+	imported := 0
+	for {
+		notes, err := nextBatch()
+		if err != nil {
+			return 0, err
+		}
+		if len(notes) == 0 {
+			break
+		}
+		for _, note := range notes {
+			if err := prepareMemoryNote(note); err != nil {
+				return 0, err
+			}
+			if _, taken := store.titleHolder(note.AuthorID, note.Title); taken {
+				if skipDuplicates {
+					continue
+				}
+				return 0, fmt.Errorf("%w: %s", DuplicateNoteError, note.Title)
+			}
+			if err := store.create(note); err != nil {
+				return 0, err
+			}
+			imported++
+		}
+	}
+	repo.store = store
+	return imported, nil
+}
+
+// WarmCache has no cache to warm, it caches nothing and returns zero.
+func (repo *InMemoryNoteRepository) WarmCache(context.Context, []int) (int, error) {
+	return 0, nil
+}
+
+// InvalidateNotes has no cache to invalidate, it does nothing.
+func (repo *InMemoryNoteRepository) InvalidateNotes(context.Context, []int) error {
+	return nil
+}
+
+// InspectNote will get the note. There is no cache so the result never
+// holds a cached note.
+// Returns:
+// - InspectResult: the stored note
+// - error: NoteNotFoundError when the note doesn't exist
+func (repo *InMemoryNoteRepository) InspectNote(ctx context.Context, id int) (InspectResult, error) {
+	note, err := repo.GetNoteById(ctx, id)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	return InspectResult{DbNote: note}, nil
+}
+
+// CountNotes will return the number of notes that haven't been deleted
+func (repo *InMemoryNoteRepository) CountNotes(context.Context) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return int64(len(repo.store.liveNotes(func(Note) bool { return true }))), nil
+}
+
+// HealthCheck has nothing to check, the repository is always healthy.
+func (repo *InMemoryNoteRepository) HealthCheck(context.Context) error {
+	return nil
+}
+
+// Close has nothing to close.
+func (repo *InMemoryNoteRepository) Close() error {
+	return nil
+}
+
+// WithTransaction will run fn against a copy of the notes, which replaces
+// the notes when fn returns nil and is dropped when it returns an error.
+// Other calls wait until the transaction finishes, so fn must only use the
+// repository it is given.
+func (repo *InMemoryNoteRepository) WithTransaction(ctx context.Context, fn func(NoteRepositoryInterface) error) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	txRepo := &InMemoryNoteRepository{store: repo.store.clone()}
+	if err := fn(txRepo); err != nil {
+		return err
+	}
+	repo.store = txRepo.store
+	return nil
+}
@@ -0,0 +1,269 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ NoteRepositoryInterface = (*InMemoryNoteRepository)(nil)
+
+// InMemoryNoteRepositoryTestSuite runs the application use cases against
+// the InMemoryNoteRepository.
+type InMemoryNoteRepositoryTestSuite struct {
+	suite.Suite
+	ctx  context.Context
+	repo *InMemoryNoteRepository
+	app  *Application
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) SetupTest() {
+	suite.ctx = context.Background()
+	suite.repo = NewInMemoryNoteRepository()
+	suite.app = NewApplication(suite.repo)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestCreateNote() {
+	first, err := suite.app.CreateNote(suite.ctx, "First", "Some content")
+	suite.NoError(err)
+	suite.Equal(uint(1), first.ID)
+	suite.Equal(2, first.WordCount)
+	suite.False(first.CreatedAt.IsZero())
+
+	second, err := suite.app.CreateNote(suite.ctx, "Second", "More content")
+	suite.NoError(err)
+	suite.Equal(uint(2), second.ID)
+
+	_, err = suite.app.CreateNote(suite.ctx, "First", "Other content")
+	suite.ErrorIs(err, DuplicateNoteError)
+
+	// titles are unique per author
+	authored, err := suite.app.CreateNote(suite.ctx, "First", "Other content", WithAuthor(7))
+	suite.NoError(err)
+	suite.Equal(uint(7), authored.AuthorID)
+
+	note, err := suite.app.GetNoteByTitle(suite.ctx, "First")
+	suite.NoError(err)
+	suite.Equal(first.ID, note.ID)
+	suite.NoError(suite.app.ValidateNewNote(suite.ctx, "Third"))
+	suite.ErrorIs(suite.app.ValidateNewNote(suite.ctx, "Second"), DuplicateNoteError)
+
+	// the author's titles are looked up with ForAuthor
+	note, err = suite.app.GetNoteByTitle(suite.ctx, "First", ForAuthor(7))
+	suite.NoError(err)
+	suite.Equal(authored.ID, note.ID)
+	suite.ErrorIs(suite.app.ValidateNewNote(suite.ctx, "First", ForAuthor(7)), DuplicateNoteError)
+	suite.NoError(suite.app.ValidateNewNote(suite.ctx, "Second", ForAuthor(7)))
+	exists, err := suite.repo.TitlesExist(suite.ctx, []string{"First", "Second"}, ForAuthor(7))
+	suite.NoError(err)
+	suite.Equal(map[string]bool{"First": true, "Second": false}, exists)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestUpdateNote() {
+	note, err := suite.app.CreateNote(suite.ctx, "Title", "Some content")
+	suite.NoError(err)
+
+	updated, err := suite.app.UpdateNote(suite.ctx, int(note.ID), "Updated content")
+	suite.NoError(err)
+	suite.Equal(1, updated.Version)
+	suite.Equal("Updated content", updated.Content)
+
+	// saving the note as it was loaded before the update conflicts
+	note.Content = "Stale content"
+	suite.ErrorIs(suite.repo.SaveNote(suite.ctx, &note), ErrVersionConflict)
+
+	_, err = suite.app.UpdateNote(suite.ctx, int(note.ID), "Not the owner's", WithOwner(3))
+	suite.ErrorIs(err, NoteNotFoundError)
+	_, err = suite.app.UpdateNote(suite.ctx, 100, "Some content")
+	suite.ErrorIs(err, NoteNotFoundError)
+
+	stored, err := suite.app.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal("Updated content", stored.Content)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestRenameNote() {
+	note, err := suite.app.CreateNote(suite.ctx, "Old title", "Some content")
+	suite.NoError(err)
+	_, err = suite.app.CreateNote(suite.ctx, "Taken", "Some content")
+	suite.NoError(err)
+
+	_, err = suite.app.RenameNote(suite.ctx, int(note.ID), "Taken")
+	suite.ErrorIs(err, DuplicateNoteError)
+
+	renamed, err := suite.app.RenameNote(suite.ctx, int(note.ID), "New title")
+	suite.NoError(err)
+	suite.Equal("New title", renamed.Title)
+
+	_, err = suite.app.GetNoteByTitle(suite.ctx, "Old title")
+	suite.ErrorIs(err, NoteNotFoundError)
+	// the old title is free again
+	_, err = suite.app.CreateNote(suite.ctx, "Old title", "Some content")
+	suite.NoError(err)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestDeleteNote() {
+	note, err := suite.app.CreateNote(suite.ctx, "Title", "Some content")
+	suite.NoError(err)
+	suite.NoError(suite.app.DeleteNote(suite.ctx, int(note.ID)))
+
+	_, err = suite.app.GetNoteById(suite.ctx, int(note.ID))
+	suite.ErrorIs(err, NoteNotFoundError)
+	suite.ErrorIs(suite.app.DeleteNote(suite.ctx, int(note.ID)), NoteNotFoundError)
+
+	// the deleted note keeps its title taken
+	_, err = suite.app.CreateNote(suite.ctx, "Title", "Some content")
+	suite.ErrorIs(err, ErrTitleTakenByDeletedNote)
+	_, _, err = suite.app.GetOrCreateNote(suite.ctx, "Title", "Some content")
+	suite.ErrorIs(err, DuplicateNoteError)
+	suite.ErrorIs(suite.app.ValidateNewNote(suite.ctx, "Title"), DuplicateNoteError)
+
+	count, err := suite.repo.CountNotes(suite.ctx)
+	suite.NoError(err)
+	suite.Equal(int64(0), count)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestGetOrCreateNote() {
+	note, created, err := suite.app.GetOrCreateNote(suite.ctx, "Title", "Some content")
+	suite.NoError(err)
+	suite.True(created)
+
+	existing, created, err := suite.app.GetOrCreateNote(suite.ctx, "Title", "Other content")
+	suite.NoError(err)
+	suite.False(created)
+	suite.Equal(note.ID, existing.ID)
+	suite.Equal("Some content", existing.Content)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestWithTransaction() {
+	note, err := suite.app.CreateNote(suite.ctx, "Title", "Some content")
+	suite.NoError(err)
+
+	errAbort := errors.New("abort")
+	err = suite.app.WithTransaction(suite.ctx, func(txApp *Application) error {
+		if _, err := txApp.CreateNote(suite.ctx, "Created", "Some content"); err != nil {
+			return err
+		}
+		if _, err := txApp.UpdateNote(suite.ctx, int(note.ID), "Updated content"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	suite.ErrorIs(err, errAbort)
+	_, err = suite.app.GetNoteByTitle(suite.ctx, "Created")
+	suite.ErrorIs(err, NoteNotFoundError)
+	stored, err := suite.app.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	suite.Equal("Some content", stored.Content)
+
+	err = suite.app.WithTransaction(suite.ctx, func(txApp *Application) error {
+		_, err := txApp.CreateNote(suite.ctx, "Created", "Some content")
+		return err
+	})
+	suite.NoError(err)
+	_, err = suite.app.GetNoteByTitle(suite.ctx, "Created")
+	suite.NoError(err)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestImportAndExportNotes() {
+	_, err := suite.app.CreateNote(suite.ctx, "Existing", "Some content")
+	suite.NoError(err)
+
+	input := `{"Title": "Imported", "Content": "Some content", "Tags": ["b", " a"]}` + "\n" +
+		`{"Title": "Existing", "Content": "Other content"}` + "\n" +
+		`{"AuthorID": 7, "Title": "Existing", "Content": "Another author's content"}` + "\n"
+	imported, err := suite.app.ImportNotes(suite.ctx, strings.NewReader(input))
+	suite.ErrorIs(err, DuplicateNoteError)
+	suite.Equal(0, imported)
+	// a failed import creates nothing
+	_, err = suite.app.GetNoteByTitle(suite.ctx, "Imported")
+	suite.ErrorIs(err, NoteNotFoundError)
+
+	// a title of another author isn't a duplicate
+	imported, err = suite.app.ImportNotes(suite.ctx, strings.NewReader(input), SkipDuplicateTitles())
+	suite.NoError(err)
+	suite.Equal(2, imported)
+
+	var exported strings.Builder
+	suite.NoError(suite.app.ExportNotes(suite.ctx, &exported))
+	lines := strings.Split(strings.TrimSpace(exported.String()), "\n")
+	suite.Len(lines, 3)
+	suite.Contains(lines[0], `"Existing"`)
+	suite.Contains(lines[1], `"Imported"`)
+	suite.Contains(lines[1], `["a","b"]`)
+	suite.Contains(lines[2], `"AuthorID":7`)
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestListings() {
+	ids := make([]uint, 0, 3)
+	for _, title := range []string{"First", "Second", "Third"} {
+		note := Note{Title: title, Content: "Some content", Tags: []string{title}}
+		suite.NoError(suite.repo.SaveNote(suite.ctx, &note))
+		ids = append(ids, note.ID)
+	}
+	// give every note the same updated_at so they are ordered by id
+	updatedAt := time.Now()
+	for _, id := range ids {
+		note := suite.repo.store.notes[id]
+		note.UpdatedAt = updatedAt
+		suite.repo.store.notes[id] = note
+	}
+	noteIDs := func(notes []Note) []uint {
+		listed := make([]uint, 0, len(notes))
+		for _, note := range notes {
+			listed = append(listed, note.ID)
+		}
+		return listed
+	}
+
+	notes, err := suite.repo.ListRecentlyUpdated(suite.ctx, 2)
+	suite.NoError(err)
+	suite.Equal([]uint{ids[2], ids[1]}, noteIDs(notes))
+
+	// a negative limit doesn't limit the notes, as with gorm
+	notes, err = suite.repo.ListNotesAfter(suite.ctx, 0, -1)
+	suite.NoError(err)
+	suite.Equal(ids, noteIDs(notes))
+	suite.Equal([]string{"Second"}, notes[1].Tags)
+	notes, err = suite.repo.ListNotesByIDRange(suite.ctx, ids[2], ids[2])
+	suite.NoError(err)
+	suite.Equal([]string{"Third"}, notes[0].Tags)
+	notes, err = suite.repo.ListRecentlyUpdated(suite.ctx, -1)
+	suite.NoError(err)
+	suite.Equal([]uint{ids[2], ids[1], ids[0]}, noteIDs(notes))
+	notes, err = suite.repo.ListNotesUpdatedSince(suite.ctx, updatedAt, ids[0], -1)
+	suite.NoError(err)
+	suite.Equal([]uint{ids[1], ids[2]}, noteIDs(notes))
+}
+
+func (suite *InMemoryNoteRepositoryTestSuite) TestConcurrentCreates() {
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := suite.app.CreateNote(suite.ctx, "Same title", "Some content")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		suite.ErrorIs(err, DuplicateNoteError)
+	}
+	suite.Equal(1, created)
+}
+
+func TestInMemoryNoteRepository(t *testing.T) {
+	suite.Run(t, new(InMemoryNoteRepositoryTestSuite))
+}
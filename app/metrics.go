@@ -0,0 +1,153 @@
+package app
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Label values of the repository's latency histogram
+const (
+	// metricsOperationGetByID labels the calls made by GetNoteById
+	metricsOperationGetByID = "get_by_id"
+	// metricsOperationSave labels the calls made by SaveNote
+	metricsOperationSave = "save"
+	// metricsOperationDelete labels the calls made by DeleteNote
+	metricsOperationDelete = "delete"
+	// metricsOperationList labels the calls made by the listings, e.g.
+	// ListAllNotes and ListNotesAfter
+	metricsOperationList = "list"
+	// metricsOperationSearch labels the calls made by SearchNotes,
+	// GetNotesByTitlePrefix and FindNotesByTag
+	metricsOperationSearch = "search"
+	// metricsOperationAppend labels the calls made by AppendToNote
+	metricsOperationAppend = "append"
+	// metricsOperationPurge labels the calls made by PurgeDeletedNotes
+	metricsOperationPurge = "purge"
+	// metricsBackendRedis labels the calls made to the cache
+	metricsBackendRedis = "redis"
+	// metricsBackendPostgres labels the calls made to postgres
+	metricsBackendPostgres = "postgres"
+)
+
+// repositoryMetrics holds the prometheus collectors of a NoteRepository
+type repositoryMetrics struct {
+	// duration observes how long each backend call takes, labeled by
+	// the repository operation and the backend called
+	duration *prometheus.HistogramVec
+	// dbErrors counts the postgres calls that failed, labeled by the
+	// repository operation
+	dbErrors *prometheus.CounterVec
+}
+
+// newRepositoryMetrics will create the repository's collectors and register
+// them with the registerer. Collectors already registered by another
+// repository are reused so several repositories can share a registry. A
+// collector that can't be registered is still returned, unregistered, along
+// with the error.
+func newRepositoryMetrics(registerer prometheus.Registerer) (*repositoryMetrics, error) {
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "notes",
+		Subsystem: "repository",
+		Name:      "backend_duration_seconds",
+		Help:      "Duration of the postgres and redis calls made by the note repository.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "backend"})
+	dbErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "notes",
+		Subsystem: "repository",
+		Name:      "db_errors_total",
+		Help:      "Number of postgres calls made by the note repository that failed.",
+	}, []string{"operation"})
+	duration, durationErr := register(registerer, duration)
+	dbErrors, dbErrorsErr := register(registerer, dbErrors)
+	return &repositoryMetrics{duration: duration, dbErrors: dbErrors}, errors.Join(durationErr, dbErrorsErr)
+}
+
+// register will register the collector with the registerer, returning the
+// collector registered before it when there is one of the same type. Any
+// other registration error is returned along with the unregistered collector.
+func register[C prometheus.Collector](registerer prometheus.Registerer, collector C) (C, error) {
+	err := registerer.Register(collector)
+	if err == nil {
+		return collector, nil
+	}
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		if existing, ok := alreadyRegistered.ExistingCollector.(C); ok {
+			return existing, nil
+		}
+	}
+	return collector, err
+}
+
+// WithMetrics makes the repository observe the duration of the postgres and
+// redis calls made by GetNoteById, SaveNote and DeleteNote, and of the
+// postgres calls made by the listings, the searches, AppendToNote and
+// PurgeDeletedNotes, into the notes_repository_backend_duration_seconds
+// histogram, labeled by operation and backend, and count the postgres calls
+// that fail into the notes_repository_db_errors_total counter, labeled by
+// operation, both registered with the registerer. A note that isn't found,
+// fails validation, has a duplicate title or a version conflict isn't
+// counted as a failure. A collector that can't be registered, e.g. because
+// another collector is registered under its name, is logged and observed
+// without being exported. By default nothing is observed.
+func WithMetrics(registerer prometheus.Registerer) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		metrics, err := newRepositoryMetrics(registerer)
+		if err != nil {
+			repo.logger.Error("Error in registering repository metrics", "error", err.Error())
+		}
+		repo.metrics = metrics
+	}
+}
+
+// observe will record the time elapsed since start as the duration of a
+// call to the backend made by the operation, when metrics are enabled
+func (repo *NoteRepository) observe(operation string, backend string, start time.Time) {
+	if repo.metrics == nil {
+		return
+	}
+	repo.metrics.duration.WithLabelValues(operation, backend).Observe(time.Since(start).Seconds())
+}
+
+// WithSlowQueryThreshold makes the repository log a warning for each of the
+// postgres calls observed by WithMetrics that takes longer than threshold. By default slow calls aren't logged.
+func WithSlowQueryThreshold(threshold time.Duration) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.slowQueryThreshold = threshold
+	}
+}
+
+// observeQuery will record the time elapsed since start as the duration of
+// a postgres call made by the operation, count the call when it failed with
+// err and log it when it took longer than the slow query threshold
+func (repo *NoteRepository) observeQuery(operation string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	repo.observe(operation, metricsBackendPostgres, start)
+	if repo.metrics != nil && err != nil && !isDomainError(err) {
+		repo.metrics.dbErrors.WithLabelValues(operation).Inc()
+	}
+	if repo.slowQueryThreshold > 0 && elapsed > repo.slowQueryThreshold {
+		repo.logger.Warn("Slow query", "operation", operation, "duration", elapsed, "threshold", repo.slowQueryThreshold)
+	}
+}
+
+// observeQueryResult will observe, as observeQuery does, the postgres calls
+// made by the operation since start once they returned the error err points
+// to. It is deferred by the operations that only call postgres.
+func (repo *NoteRepository) observeQueryResult(operation string, start time.Time, err *error) {
+	repo.observeQuery(operation, start, *err)
+}
+
+// isDomainError will report whether err is one the repository returns for
+// the request rather than for postgres failing, so it isn't counted as a
+// failed call
+func isDomainError(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound) ||
+		errors.Is(err, NoteNotFoundError) ||
+		errors.Is(err, ErrInvalidNote) ||
+		errors.Is(err, DuplicateNoteError) ||
+		errors.Is(err, ErrVersionConflict)
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/suite"
+	"log/slog"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// MetricsTestSuite tests the metrics and slow query logging of the
+// repository's backend calls
+type MetricsTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *MetricsTestSuite) TestMetrics() {
+	registry := prometheus.NewRegistry()
+	repo, mock := suite.newMockRepo(WithMetrics(registry))
+
+	// get a note that isn't cached, then get it again from the cache
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+		AddRow(1, now, now, nil, "Measured", "Measured content", 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnRows(rows)
+	expectTags(mock)
+	_, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	_, err = repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+
+	// save a new note
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "note_tags"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	suite.NoError(repo.SaveNote(suite.ctx, &Note{Title: "Saved", Content: "Saved content"}))
+
+	// delete the first note
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Measured"))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "deleted_at"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	suite.NoError(repo.DeleteNote(suite.ctx, 1))
+	suite.NoError(mock.ExpectationsWereMet())
+
+	families, err := registry.Gather()
+	suite.NoError(err)
+	suite.Len(families, 1)
+	suite.Equal("notes_repository_backend_duration_seconds", families[0].GetName())
+	counts := map[string]uint64{}
+	for _, metric := range families[0].GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		counts[labels["operation"]+"/"+labels["backend"]] = metric.GetHistogram().GetSampleCount()
+	}
+	suite.Equal(map[string]uint64{
+		// two lookups and storing the note loaded on the miss
+		"get_by_id/redis":    3,
+		"get_by_id/postgres": 1,
+		// invalidating before and after the write
+		"save/redis":      2,
+		"save/postgres":   2,
+		"delete/redis":    1,
+		"delete/postgres": 2,
+	}, counts)
+
+	suite.Run("Repositories share a registry", func() {
+		other, _ := suite.newMockRepo(WithMetrics(registry))
+		suite.Same(repo.metrics.duration, other.metrics.duration)
+	})
+
+	suite.Run("Conflicting collector is logged", func() {
+		registry := prometheus.NewRegistry()
+		// a counter registered under the histogram's name and labels
+		registry.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "notes_repository_backend_duration_seconds",
+			Help: "Duration of the postgres and redis calls made by the note repository.",
+		}, []string{"operation", "backend"}))
+		handler := &recordingHandler{}
+		repo, _ := suite.newMockRepo(WithLogger(slog.New(handler)), WithMetrics(registry))
+		_, found := handler.find("Error in registering repository metrics")
+		suite.True(found)
+		suite.NotNil(repo.metrics.duration)
+		suite.NotNil(repo.metrics.dbErrors)
+	})
+}
+
+func (suite *MetricsTestSuite) TestDBErrorMetrics() {
+	registry := prometheus.NewRegistry()
+	repo, mock := suite.newMockRepo(WithMetrics(registry))
+
+	// a failed query is counted under its operation
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnError(errors.New("connection reset"))
+	_, err := repo.GetNoteById(suite.ctx, 1)
+	suite.Error(err)
+
+	// a note that isn't found isn't a failure
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}))
+	_, err = repo.GetNoteById(suite.ctx, 2)
+	suite.ErrorIs(err, NoteNotFoundError)
+
+	// nor is a duplicate title
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "notes"`)).
+		WillReturnError(&pgconn.PgError{Code: uniqueViolationCode})
+	mock.ExpectRollback()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT EXISTS`)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	err = repo.SaveNote(suite.ctx, &Note{Title: "Taken", Content: "My content"})
+	suite.ErrorIs(err, DuplicateNoteError)
+
+	// a failed listing is counted too
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).WillReturnError(errors.New("connection reset"))
+	_, err = repo.ListAllNotes(suite.ctx, false, 10, 0)
+	suite.Error(err)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	families, err := registry.Gather()
+	suite.NoError(err)
+	counts := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "notes_repository_db_errors_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			counts[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	suite.Equal(map[string]float64{"get_by_id": 1, "list": 1}, counts)
+}
+
+func (suite *MetricsTestSuite) TestSlowQueryLog() {
+	handler := &recordingHandler{}
+	repo, mock := suite.newMockRepo(WithLogger(slog.New(handler)), WithSlowQueryThreshold(10*time.Millisecond))
+
+	// a query that returns within the threshold isn't logged
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+			AddRow(1, now, now, nil, "Fast", "Fast content", 2))
+	expectTags(mock)
+	_, err := repo.GetNoteById(suite.ctx, 1)
+	suite.NoError(err)
+	_, found := handler.find("Slow query")
+	suite.False(found)
+
+	// a query delayed past the threshold is logged at warn level
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}).
+			AddRow(2, now, now, nil, "Slow", "Slow content", 2))
+	expectTags(mock)
+	_, err = repo.GetNoteById(suite.ctx, 2)
+	suite.NoError(err)
+	suite.NoError(mock.ExpectationsWereMet())
+
+	record, found := handler.find("Slow query")
+	suite.True(found)
+	suite.Equal(slog.LevelWarn, record.Level)
+	attrs := map[string]slog.Value{}
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value
+		return true
+	})
+	suite.Equal("get_by_id", attrs["operation"].String())
+	suite.GreaterOrEqual(attrs["duration"].Duration(), 50*time.Millisecond)
+	suite.Equal(10*time.Millisecond, attrs["threshold"].Duration())
+}
+
+func TestMetrics(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"gorm.io/gorm"
+)
+
+// legacyTitleConstraints are the unique constraints on the title columns
+// alone that notes had before titles were made unique per author. Postgres
+// named them after the table and column when gorm created them inline.
+var legacyTitleConstraints = []string{"notes_title_key", "notes_normalized_title_key"}
+
+// Migrate will bring the database schema up to date with the models,
+// creating the tables on a new database. AutoMigrate only ever adds unique
+// constraints, so the constraints making titles unique across all the
+// authors are dropped first, otherwise two authors still couldn't both
+// have a note with the same title on a database created before notes had
+// authors.
+// Parameters:
+// -    db: gorm database client
+//
+// Returns:
+// - error: any error returned by the database
+func Migrate(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if migrator.HasTable(&Note{}) {
+		for _, name := range legacyTitleConstraints {
+			if !migrator.HasConstraint(&Note{}, name) {
+				continue
+			}
+			if err := migrator.DropConstraint(&Note{}, name); err != nil {
+				return err
+			}
+		}
+	}
+	return db.AutoMigrate(&Note{}, &AuditEntry{}, &NoteTag{})
+}
+
+// BackfillNormalizedTitles will set the normalized title of the notes saved
+// without one, which is every note saved before the repositories were
+// created WithCaseInsensitiveTitles. Run it once when switching an existing
+// database to case insensitive titles, otherwise the notes saved before the
+// switch aren't found by their titles. Deleted notes are backfilled too
+// since they keep their titles. The titles are folded in Go with the same
+// foldTitle the repositories save new notes with, rather than postgres'
+// lower which can disagree with it on non-ASCII titles, so the notes are
+// updated one at a time in a single transaction.
+// Parameters:
+// -    db: gorm database client
+//
+// Returns:
+// - error: a unique violation when two notes of an author have titles
+// differing only in case, or any other error returned by the database
+func BackfillNormalizedTitles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var notes []Note
+		// the batches are paged by id so the updated notes
+		// don't shift the pages still to be loaded
+		return tx.Unscoped().Select("id", "title").Where("normalized_title IS NULL").
+			FindInBatches(&notes, defaultBatchSize, func(*gorm.DB, int) error {
+				for _, note := range notes {
+					err := tx.Unscoped().Model(&Note{}).Where("id = ?", note.ID).
+						UpdateColumn("normalized_title", foldTitle(note.Title)).Error
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}).Error
+	})
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/suite"
+	pg "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"regexp"
+)
+
+// mockRepositorySuite is embedded by the suites that test the repository
+// over a database mocked with sqlmock and a memory cache, so no postgres
+// or redis is needed.
+type mockRepositorySuite struct {
+	suite.Suite
+	ctx   context.Context
+	cache *MemoryCache
+}
+
+func (suite *mockRepositorySuite) SetupTest() {
+	suite.ctx = context.Background()
+	suite.cache = NewMemoryCache()
+}
+
+// newMockRepo will create a repository that caches in the suite's memory
+// cache and whose database is mocked with sqlmock.
+func (suite *mockRepositorySuite) newMockRepo(opts ...NoteRepositoryOption) (*NoteRepository, sqlmock.Sqlmock) {
+	return suite.newMockRepoWithCache(suite.cache, opts...)
+}
+
+// newMockRepoWithCache will create a repository that caches in the cache
+// and whose database is mocked with sqlmock.
+func (suite *mockRepositorySuite) newMockRepoWithCache(cache Cache, opts ...NoteRepositoryOption) (*NoteRepository, sqlmock.Sqlmock) {
+	mockDb, mock, err := sqlmock.New()
+	suite.NoError(err)
+	suite.T().Cleanup(func() {
+		mockDb.Close()
+	})
+	dialector := pg.New(pg.Config{
+		Conn:       mockDb,
+		DriverName: "postgres",
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	suite.NoError(err)
+	return NewNoteRepositoryWithCache(db, cache, opts...), mock
+}
+
+// expectTags will expect the query loading the tags of the notes and
+// return the tags as note_id, tag pairs
+func expectTags(mock sqlmock.Sqlmock, noteTags ...NoteTag) {
+	rows := sqlmock.NewRows([]string{"note_id", "tag"})
+	for _, noteTag := range noteTags {
+		rows.AddRow(noteTag.NoteID, noteTag.Tag)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "note_tags"`)).WillReturnRows(rows)
+}
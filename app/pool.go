@@ -0,0 +1,78 @@
+package app
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// PoolConfig configures the pool of connections the database client keeps
+// open to postgres. A zero field is set to its value in DefaultPoolConfig.
+type PoolConfig struct {
+	// MaxOpenConns is the maximum number of connections open at once, in
+	// use or idle. Queries wait for a connection once it is reached.
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections kept open
+	MaxIdleConns int
+	// ConnMaxLifetime is how long a connection may be reused before it is closed
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime is how long a connection may be idle before it is closed
+	ConnMaxIdleTime time.Duration
+}
+
+// DefaultPoolConfig is the pool configuration the zero fields of a
+// PoolConfig are set to. It bounds the connections a repository opens
+// well below the default max_connections of postgres.
+var DefaultPoolConfig = PoolConfig{
+	MaxOpenConns:    25,
+	MaxIdleConns:    25,
+	ConnMaxLifetime: 30 * time.Minute,
+	ConnMaxIdleTime: 5 * time.Minute,
+}
+
+// withDefaults will return the config with its zero fields set to their
+// value in DefaultPoolConfig
+func (config PoolConfig) withDefaults() PoolConfig {
+	if config.MaxOpenConns == 0 {
+		config.MaxOpenConns = DefaultPoolConfig.MaxOpenConns
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = DefaultPoolConfig.MaxIdleConns
+	}
+	if config.ConnMaxLifetime == 0 {
+		config.ConnMaxLifetime = DefaultPoolConfig.ConnMaxLifetime
+	}
+	if config.ConnMaxIdleTime == 0 {
+		config.ConnMaxIdleTime = DefaultPoolConfig.ConnMaxIdleTime
+	}
+	return config
+}
+
+// ConfigurePool will apply the pool configuration to the connection pool
+// of the database client, setting its zero fields to their default first.
+// Parameters:
+// -  db: gorm database client
+// -  config: the configuration of the pool
+//
+// Returns:
+// - error: any error returned when getting the client's connection pool
+func ConfigurePool(db *gorm.DB, config PoolConfig) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	config = config.withDefaults()
+	sqlDB.SetMaxOpenConns(config.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(config.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(config.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	return nil
+}
+
+// WithPoolConfig makes the repository apply the pool configuration to the
+// connection pool of its database client, see ConfigurePool. By default
+// the pool is left as the client was configured.
+func WithPoolConfig(config PoolConfig) NoteRepositoryOption {
+	return func(repo *NoteRepository) {
+		repo.poolConfig = &config
+	}
+}
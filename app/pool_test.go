@@ -0,0 +1,40 @@
+package app
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+// PoolConfigTestSuite tests configuring the connection pool of the
+// repository's database client
+type PoolConfigTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *PoolConfigTestSuite) TestPoolConfig() {
+	repo, _ := suite.newMockRepo(WithPoolConfig(PoolConfig{MaxOpenConns: 2}))
+	sqlDB, err := repo.db.DB()
+	suite.NoError(err)
+	suite.Equal(2, sqlDB.Stats().MaxOpenConnections)
+
+	suite.Run("Zero fields are set to their default", func() {
+		config := PoolConfig{MaxIdleConns: 1}.withDefaults()
+		suite.Equal(PoolConfig{
+			MaxOpenConns:    DefaultPoolConfig.MaxOpenConns,
+			MaxIdleConns:    1,
+			ConnMaxLifetime: DefaultPoolConfig.ConnMaxLifetime,
+			ConnMaxIdleTime: DefaultPoolConfig.ConnMaxIdleTime,
+		}, config)
+	})
+
+	suite.Run("Pool is left as it is by default", func() {
+		repo, _ := suite.newMockRepo()
+		sqlDB, err := repo.db.DB()
+		suite.NoError(err)
+		suite.Equal(0, sqlDB.Stats().MaxOpenConnections)
+	})
+}
+
+func TestPoolConfig(t *testing.T) {
+	suite.Run(t, new(PoolConfigTestSuite))
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"time"
+)
+
+// RateLimiter limits how many requests each client makes
+type RateLimiter interface {
+	// Allow records a request of the client and reports whether it is
+	// within the client's limit.
+	Allow(ctx context.Context, clientID string) (bool, error)
+}
+
+// redisRateLimiter is a RateLimiter that counts the requests of each client
+// in fixed windows, with one redis counter per client and window
+type redisRateLimiter struct {
+	client redis.UniversalClient
+	// limit is the number of requests a client may make in a window
+	limit int64
+	// window is the length of the windows requests are counted in
+	window time.Duration
+	// keyPrefix namespaces the counters
+	keyPrefix string
+}
+
+// NewRedisRateLimiter is the factory function to create a RateLimiter that
+// allows each client limit requests per window. Requests are counted with
+// INCR in a counter per client and window which EXPIRE removes once the
+// window is over, so a client's count starts again at every window.
+// Parameters:
+// -  client: redis client the counters are stored in
+// -  limit: the number of requests a client may make in a window
+// -  window: the length of the windows requests are counted in
+//
+// Returns:
+// - RateLimiter: the redis backed rate limiter
+// - error: when limit or window isn't positive
+func NewRedisRateLimiter(client redis.UniversalClient, limit int, window time.Duration) (RateLimiter, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("rate limit must be positive, got %d", limit)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("rate limit window must be positive, got %s", window)
+	}
+	return &redisRateLimiter{client: client, limit: int64(limit), window: window, keyPrefix: DefaultKeyPrefix}, nil
+}
+
+// counterKey will return the key of the counter of the client's requests
+// in the window the time falls in
+func (limiter *redisRateLimiter) counterKey(clientID string, now time.Time) string {
+	return fmt.Sprintf("%s:ratelimit:%s:%d", limiter.keyPrefix, clientID, now.UnixNano()/int64(limiter.window))
+}
+
+// Allow will count the request of the client in the current window and
+// report whether the client has made no more than limit requests in it
+func (limiter *redisRateLimiter) Allow(ctx context.Context, clientID string) (bool, error) {
+	key := limiter.counterKey(clientID, time.Now())
+	var count *redis.IntCmd
+	_, err := limiter.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, limiter.window)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return count.Val() <= limiter.limit, nil
+}
+
+// WithRateLimiter makes CreateNote consult the limiter for the client set
+// with WithClientID and return ErrRateLimited once the client exceeds its
+// limit. The limiter is only consulted for valid notes. Creates without a
+// client id aren't limited, nor are the retries of an idempotent create that
+// get the note created first back, nor creates made while the limiter fails.
+// By default creates aren't limited.
+func WithRateLimiter(limiter RateLimiter) ApplicationOption {
+	return func(app *Application) {
+		app.rateLimiter = limiter
+	}
+}
+
+// WithClientID sets the client the create is made by, whose requests are
+// limited by the rate limiter set with WithRateLimiter
+func WithClientID(clientID string) CreateOption {
+	return func(config *createConfig) {
+		config.clientID = clientID
+	}
+}
+
+// allowCreate will report whether the client of the create may create a
+// note, failing open when the rate limiter can't be consulted. A create whose
+// idempotency key already has a note is a replay rather than a new note so
+// it isn't counted against the client's limit.
+func (app *Application) allowCreate(ctx context.Context, config createConfig) bool {
+	if app.rateLimiter == nil || config.clientID == "" {
+		return true
+	}
+	if config.idempotencyKey != "" {
+		if _, err := app.noteRepository.GetNoteByIdempotencyKey(ctx, config.authorID, config.idempotencyKey); err == nil {
+			return true
+		}
+	}
+	allowed, err := app.rateLimiter.Allow(ctx, config.clientID)
+	if err != nil {
+		slog.Error("Error in rate limiting create", "client", config.clientID, "error", err.Error())
+		return true
+	}
+	return allowed
+}
@@ -0,0 +1,140 @@
+package app_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app/testutil"
+	rd "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/modules/redis"
+	"github.com/testcontainers/testcontainers-go/wait"
+	pg "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// SeededNoteTestSuite runs the note repository against postgres and redis
+// from outside the app package, starting each test from a note seeded
+// with testutil.SeedNote.
+type SeededNoteTestSuite struct {
+	suite.Suite
+	ctx         context.Context
+	db          *gorm.DB
+	pgContainer *postgres.PostgresContainer
+	rdContainer *redis.RedisContainer
+	rdClient    *rd.Client
+	// note is the seeded note
+	note app.Note
+}
+
+func (suite *SeededNoteTestSuite) SetupSuite() {
+	suite.ctx = context.Background()
+	pgContainer, err := postgres.RunContainer(
+		suite.ctx,
+		testcontainers.WithImage("postgres:15.3-alpine"),
+		postgres.WithDatabase("notesdb"),
+		postgres.WithUsername("postgres"),
+		postgres.WithPassword("postgres"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).WithStartupTimeout(5*time.Second)),
+	)
+	suite.Require().NoError(err)
+	suite.pgContainer = pgContainer
+	connStr, err := pgContainer.ConnectionString(suite.ctx, "sslmode=disable")
+	suite.Require().NoError(err)
+	suite.db, err = gorm.Open(pg.Open(connStr), &gorm.Config{})
+	suite.Require().NoError(err)
+
+	redisContainer, err := redis.RunContainer(suite.ctx, testcontainers.WithImage("redis:6"))
+	suite.Require().NoError(err)
+	suite.rdContainer = redisContainer
+	rdConnStr, err := redisContainer.ConnectionString(suite.ctx)
+	suite.Require().NoError(err)
+	rdConnOptions, err := rd.ParseURL(rdConnStr)
+	suite.Require().NoError(err)
+	suite.rdClient = rd.NewClient(rdConnOptions)
+	suite.Require().NoError(suite.rdClient.Ping(suite.ctx).Err())
+}
+
+func (suite *SeededNoteTestSuite) TearDownSuite() {
+	suite.NoError(suite.pgContainer.Terminate(suite.ctx))
+	suite.NoError(suite.rdContainer.Terminate(suite.ctx))
+}
+
+func (suite *SeededNoteTestSuite) SetupTest() {
+	suite.Require().NoError(app.Migrate(suite.db))
+	note, err := testutil.SeedNote(suite.ctx, suite.db, suite.rdClient, app.Note{Title: "Test Update", Content: "This note will be inserted now"})
+	suite.Require().NoError(err)
+	suite.note = note
+}
+
+func (suite *SeededNoteTestSuite) TearDownTest() {
+	suite.db.Exec("DROP TABLE IF EXISTS notes CASCADE;")
+	suite.db.Exec("DROP TABLE IF EXISTS audit_entries CASCADE;")
+	suite.db.Exec("DROP TABLE IF EXISTS note_tags CASCADE;")
+	suite.rdClient.FlushAll(suite.ctx)
+}
+
+// assertNotCached will assert that nothing is cached under the note's id and title
+func (suite *SeededNoteTestSuite) assertNotCached(note app.Note) {
+	idKey := fmt.Sprintf("notes:id:%d", note.ID)
+	titleKey := fmt.Sprintf("notes:title:%s", note.Title)
+	res, err := suite.rdClient.Exists(suite.ctx, idKey, titleKey).Result()
+	suite.NoError(err)
+	suite.Equal(int64(0), res)
+}
+
+func (suite *SeededNoteTestSuite) TestSaveUpdatedNote() {
+	// ensure that the seeded note is cached under its id and title
+	testutil.AssertCached(suite.T(), suite.ctx, suite.db, suite.rdClient, suite.note)
+
+	// update the note and save it
+	repo := app.NewNoteRepository(suite.db, suite.rdClient)
+	note := suite.note
+	note.Content = "This is the updated note"
+	suite.NoError(repo.SaveNote(suite.ctx, &note))
+
+	// ensure the cache is invalidated
+	suite.assertNotCached(note)
+
+	// ensure the note has been updated in the database
+	var notes []app.Note
+	suite.NoError(suite.db.Find(&notes).Error)
+	suite.Len(notes, 1)
+	suite.Equal(note.ID, notes[0].ID)
+	suite.Equal(note.Title, notes[0].Title)
+	suite.Equal(note.Content, notes[0].Content)
+
+	// reading the note caches the updated note again
+	_, err := repo.GetNoteById(suite.ctx, int(note.ID))
+	suite.NoError(err)
+	_, err = repo.GetNoteByTitle(suite.ctx, note.Title)
+	suite.NoError(err)
+	testutil.AssertCached(suite.T(), suite.ctx, suite.db, suite.rdClient, note)
+}
+
+func (suite *SeededNoteTestSuite) TestDeleteNote() {
+	// ensure that the seeded note is cached under its id and title
+	testutil.AssertCached(suite.T(), suite.ctx, suite.db, suite.rdClient, suite.note)
+
+	// delete the note
+	repo := app.NewNoteRepository(suite.db, suite.rdClient)
+	suite.NoError(repo.DeleteNote(suite.ctx, int(suite.note.ID)))
+
+	// ensure that the cache has been cleared
+	suite.assertNotCached(suite.note)
+
+	// ensure that the note has been deleted in postgres
+	var notes []app.Note
+	suite.NoError(suite.db.Find(&notes).Error)
+	suite.Empty(notes)
+}
+
+func TestSeededNotes(t *testing.T) {
+	suite.Run(t, new(SeededNoteTestSuite))
+}
@@ -0,0 +1,76 @@
+// Package testutil provides fixtures for tests that run the notes
+// repository against postgres and redis. Notes are seeded and inspected
+// through the repository itself, so the fixtures always use the cache
+// format and keys the repository reads.
+package testutil
+
+import (
+	"context"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// SeedNote will store the note in postgres and cache it under its id and
+// title as a repository created with NewNoteRepository and the options
+// caches it, so a test can start from a note that is both stored and cached.
+// Parameters:
+// -  ctx: context for the database and redis calls
+// -  db: gorm database client the note is stored with
+// -  rd: redis client the note is cached with
+// -  note: the note to seed
+// -  opts: options of the repository the note is seeded with, e.g. WithJSONCache
+//
+// Returns:
+// - app.Note: the note as it is stored in postgres
+// - error: any error returned by postgres or redis
+func SeedNote(ctx context.Context, db *gorm.DB, rd redis.UniversalClient, note app.Note, opts ...app.NoteRepositoryOption) (app.Note, error) {
+	repo := app.NewNoteRepository(db, rd, opts...)
+	if err := repo.SaveNote(ctx, &note); err != nil {
+		return app.Note{}, err
+	}
+	if _, err := repo.WarmCache(ctx, []int{int(note.ID)}); err != nil {
+		return app.Note{}, err
+	}
+	// reload the note so its timestamps have the precision postgres stores
+	inspectResult, err := repo.InspectNote(ctx, int(note.ID))
+	if err != nil {
+		return app.Note{}, err
+	}
+	return *inspectResult.DbNote, nil
+}
+
+// AssertCached will assert that the note is cached under both its id and
+// its title and that the cached notes match the note stored in postgres,
+// reporting a test error otherwise.
+// Returns:
+// - bool: whether the assertion holds
+func AssertCached(t testing.TB, ctx context.Context, db *gorm.DB, rd redis.UniversalClient, note app.Note, opts ...app.NoteRepositoryOption) bool {
+	t.Helper()
+	repo := app.NewNoteRepository(db, rd, opts...)
+	inspectResult, err := repo.InspectNote(ctx, int(note.ID))
+	if err != nil {
+		t.Errorf("inspecting note %d: %s", note.ID, err)
+		return false
+	}
+	if inspectResult.CachedNote == nil {
+		t.Errorf("note %d isn't cached under its id", note.ID)
+		return false
+	}
+	if inspectResult.TitleCachedNote == nil {
+		t.Errorf("note %d isn't cached under its title", note.ID)
+		return false
+	}
+	// VerifyCache compares the entries under both the id and the title
+	consistent, err := repo.VerifyCache(ctx, int(note.ID))
+	if err != nil {
+		t.Errorf("verifying note %d: %s", note.ID, err)
+		return false
+	}
+	if !consistent {
+		t.Errorf("cached note %d doesn't match the stored note: %+v != %+v", note.ID, *inspectResult.CachedNote, inspectResult.DbNote)
+		return false
+	}
+	return true
+}
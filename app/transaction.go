@@ -0,0 +1,204 @@
+package app
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"slices"
+	"sync"
+	"time"
+)
+
+// pendingChanges collects the cache keys written and the events published
+// by the operations of a transaction, which are only applied once the
+// transaction commits so a rollback leaves neither the cache nor the event
+// subscribers aware of the rolled back changes.
+type pendingChanges struct {
+	mu     sync.Mutex
+	keys   map[string]struct{}
+	events []noteChange
+}
+
+// noteChange is a mutation of a note whose event is held back until the
+// transaction commits
+type noteChange struct {
+	// eventType is the kind of mutation, one of the AuditAction constants
+	eventType string
+	note      Note
+}
+
+// touch will record that the entries under the keys were changed
+func (changes *pendingChanges) touch(keys ...string) {
+	changes.mu.Lock()
+	defer changes.mu.Unlock()
+	if changes.keys == nil {
+		changes.keys = make(map[string]struct{}, len(keys))
+	}
+	for _, key := range keys {
+		changes.keys[key] = struct{}{}
+	}
+}
+
+// touched will report whether the entry under key was changed
+func (changes *pendingChanges) touched(key string) bool {
+	changes.mu.Lock()
+	defer changes.mu.Unlock()
+	_, ok := changes.keys[key]
+	return ok
+}
+
+// touchedKeys will return the keys of the entries that were changed
+func (changes *pendingChanges) touchedKeys() []string {
+	changes.mu.Lock()
+	defer changes.mu.Unlock()
+	keys := make([]string, 0, len(changes.keys))
+	for key := range changes.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// queue will record the mutation whose event is published once the
+// transaction commits
+func (changes *pendingChanges) queue(eventType string, note Note) {
+	changes.mu.Lock()
+	defer changes.mu.Unlock()
+	changes.events = append(changes.events, noteChange{eventType: eventType, note: note})
+}
+
+// queuedEvents will return the mutations to publish in the order they were queued
+func (changes *pendingChanges) queuedEvents() []noteChange {
+	changes.mu.Lock()
+	defer changes.mu.Unlock()
+	return slices.Clone(changes.events)
+}
+
+// transactionCache decorates the Cache used within a transaction. Writes
+// and deletes aren't applied, the keys they touch are recorded instead so
+// they can be invalidated once the transaction commits, and reads of the
+// touched keys miss so the operations of the transaction never see an entry
+// the transaction has changed. Every other read is served by the cache.
+type transactionCache struct {
+	cache   Cache
+	changes *pendingChanges
+}
+
+// GetNote will get the note stored under key, or nil when the
+// transaction changed the entry under key
+func (cache *transactionCache) GetNote(ctx context.Context, key string) (*CachedNote, error) {
+	if cache.changes.touched(key) {
+		return nil, nil
+	}
+	return cache.cache.GetNote(ctx, key)
+}
+
+// GetNotes will get the notes stored under the keys, with a nil note for
+// each key whose entry the transaction changed
+func (cache *transactionCache) GetNotes(ctx context.Context, keys ...string) ([]*CachedNote, error) {
+	notes, err := cache.cache.GetNotes(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if cache.changes.touched(key) {
+			notes[i] = nil
+		}
+	}
+	return notes, nil
+}
+
+// SetNote will record the keys the note would be stored under
+func (cache *transactionCache) SetNote(_ context.Context, _ CachedNote, _ time.Duration, keys ...string) error {
+	cache.changes.touch(keys...)
+	return nil
+}
+
+// SetMissing will record the key the tombstone would be stored under
+func (cache *transactionCache) SetMissing(_ context.Context, key string, _ time.Duration) error {
+	cache.changes.touch(key)
+	return nil
+}
+
+// SetNotes will record the keys the notes would be stored under
+func (cache *transactionCache) SetNotes(_ context.Context, notes map[string]CachedNote, _ time.Duration) error {
+	for key := range notes {
+		cache.changes.touch(key)
+	}
+	return nil
+}
+
+// DeleteKeys will record the keys whose entries would be deleted
+func (cache *transactionCache) DeleteKeys(_ context.Context, keys ...string) error {
+	cache.changes.touch(keys...)
+	return nil
+}
+
+// TTL will get the time left before the entry under key expires
+func (cache *transactionCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return cache.cache.TTL(ctx, key)
+}
+
+// Expire will set the time left before the entry under key expires
+func (cache *transactionCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return cache.cache.Expire(ctx, key, ttl)
+}
+
+// WithTransaction will run fn against a repository whose reads and writes
+// go through a single postgres transaction, committed when fn returns nil
+// and rolled back when it returns an error. The cache invalidations and
+// events of the transaction are held back until it commits, and dropped
+// when it is rolled back. Idempotency keys aren't honoured within the
+// transaction since the note they would be remembered with may be rolled back.
+// Parameters:
+// -    ctx: context for the transaction
+// -    fn: the operations to run atomically, against the repository it is given
+//
+// Returns:
+// - error: the error returned by fn or any error returned by postgres
+func (repo *NoteRepository) WithTransaction(ctx context.Context, fn func(NoteRepositoryInterface) error) (err error) {
+	ctx, span := repo.startSpan(ctx, "WithTransaction")
+	defer func() { endSpan(span, err) }()
+	changes := &pendingChanges{}
+	err = repo.store.WithTransaction(ctx, func(tx NoteRepositoryInterface) error {
+		return fn(repo.inTransaction(asNoteStore(tx), changes))
+	})
+	if err != nil {
+		repo.logger.Error("Error in transaction", "operation", "WithTransaction", "error", err.Error())
+		return err
+	}
+	// the transaction is committed at this point so failing to invalidate
+	// is logged rather than reported as a failed transaction
+	if keys := changes.touchedKeys(); len(keys) > 0 {
+		if err := repo.cache.DeleteKeys(ctx, keys...); err != nil {
+			repo.logger.Error("Error in invalidating committed notes", "operation", "WithTransaction", "error", err.Error())
+		}
+	}
+	for _, change := range changes.queuedEvents() {
+		repo.publishEvent(ctx, change.eventType, change.note)
+	}
+	return nil
+}
+
+// inTransaction will return a copy of the repository that stores the notes
+// through the transaction's store and records its cache changes and events
+// in changes. Every other field is copied so the options the repository was
+// created with apply within the transaction too.
+func (repo *NoteRepository) inTransaction(store noteStore, changes *pendingChanges) *NoteRepository {
+	txRepo := *repo
+	txRepo.db = nil
+	if dbStore, ok := store.(*dbNoteRepository); ok {
+		txRepo.db = dbStore.db
+	}
+	txRepo.store = store
+	txRepo.cache = &transactionCache{cache: repo.cache, changes: changes}
+	txRepo.changes = changes
+	return &txRepo
+}
+
+// WithTransaction will run fn against a repository whose reads and writes
+// go through a single postgres transaction, committed when fn returns nil
+// and rolled back when it returns an error.
+func (repo *dbNoteRepository) WithTransaction(ctx context.Context, fn func(NoteRepositoryInterface) error) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&dbNoteRepository{db: tx, caseInsensitiveTitles: repo.caseInsensitiveTitles})
+	})
+}
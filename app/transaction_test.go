@@ -0,0 +1,94 @@
+package app
+
+import (
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// TransactionTestSuite tests running the repository's operations within a
+// transaction over a database mocked with sqlmock
+type TransactionTestSuite struct {
+	mockRepositorySuite
+}
+
+func (suite *TransactionTestSuite) TestWithTransaction() {
+	cached := CachedNote{Note: Note{Model: gorm.Model{ID: 1}, Title: "Cached"}}
+	// expectDelete will expect deleting the cached note within the transaction
+	expectDelete := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id","title","author_id" FROM "notes"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Cached"))
+		mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "notes" SET "deleted_at"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "audit_entries"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	}
+
+	suite.Run("Invalidations are applied once committed", func() {
+		suite.NoError(suite.cache.SetNote(suite.ctx, cached, 0, "notes:id:1", "notes:title:Cached"))
+		repo, mock := suite.newMockRepo()
+		mock.ExpectBegin()
+		expectDelete(mock)
+		mock.ExpectCommit()
+		err := repo.WithTransaction(suite.ctx, func(tx NoteRepositoryInterface) error {
+			if err := tx.DeleteNote(suite.ctx, 1); err != nil {
+				return err
+			}
+			// the entry is still cached until the transaction commits
+			cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:1")
+			suite.NoError(err)
+			suite.NotNil(cachedNote)
+			return nil
+		})
+		suite.NoError(err)
+		suite.NoError(mock.ExpectationsWereMet())
+		for _, key := range []string{"notes:id:1", "notes:title:Cached"} {
+			cachedNote, err := suite.cache.GetNote(suite.ctx, key)
+			suite.NoError(err)
+			suite.Nil(cachedNote, key)
+		}
+	})
+
+	suite.Run("Invalidations are dropped when rolled back", func() {
+		suite.NoError(suite.cache.SetNote(suite.ctx, cached, 0, "notes:id:1", "notes:title:Cached"))
+		repo, mock := suite.newMockRepo()
+		mock.ExpectBegin()
+		expectDelete(mock)
+		// the note deleted within the transaction isn't served from the cache
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notes"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "title", "content", "word_count"}))
+		mock.ExpectRollback()
+		splitErr := errors.New("split failed")
+		err := repo.WithTransaction(suite.ctx, func(tx NoteRepositoryInterface) error {
+			if err := tx.DeleteNote(suite.ctx, 1); err != nil {
+				return err
+			}
+			_, err := tx.GetNoteById(suite.ctx, 1)
+			suite.ErrorIs(err, NoteNotFoundError)
+			return splitErr
+		})
+		suite.ErrorIs(err, splitErr)
+		suite.NoError(mock.ExpectationsWereMet())
+		cachedNote, err := suite.cache.GetNote(suite.ctx, "notes:id:1")
+		suite.NoError(err)
+		suite.Equal(&cached, cachedNote)
+	})
+
+	suite.Run("Options apply within the transaction", func() {
+		repo, _ := suite.newMockRepo(WithPoolConfig(PoolConfig{MaxOpenConns: 2}), WithMissingNoteTTL(time.Minute), WithKeyPrefix("tx"))
+		changes := &pendingChanges{}
+		txRepo := repo.inTransaction(repo.store, changes)
+		suite.Same(repo.poolConfig, txRepo.poolConfig)
+		suite.Equal(time.Minute, txRepo.missingNoteTTL)
+		suite.Equal("tx", txRepo.keyPrefix)
+		suite.Same(changes, txRepo.changes)
+		suite.NotSame(repo.cache, txRepo.cache)
+	})
+}
+
+func TestTransaction(t *testing.T) {
+	suite.Run(t, new(TransactionTestSuite))
+}
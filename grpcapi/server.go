@@ -0,0 +1,132 @@
+// Package grpcapi exposes the notes application over gRPC. The service is
+// defined in notes.proto and the generated code is regenerated with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative notes.proto
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+)
+
+// Page sizes of the List RPC
+const (
+	// defaultPageSize is the number of notes listed when the request has no limit
+	defaultPageSize = 100
+	// maxPageSize is the largest number of notes listed in a single page
+	maxPageSize = 1000
+)
+
+// NoteServer implements the NoteServiceServer by delegating to the Application
+type NoteServer struct {
+	UnimplementedNoteServiceServer
+	app *app.Application
+}
+
+// NewNoteServer is the factory function to create a new NoteServer
+// Parameters:
+// -  app: the application whose use cases are exposed
+//
+// Returns:
+// - *NoteServer: A pointer to the newly created NoteServer
+func NewNoteServer(app *app.Application) *NoteServer {
+	return &NoteServer{app: app}
+}
+
+// Create will create a note with the title and content of the request
+func (server *NoteServer) Create(ctx context.Context, request *CreateNoteRequest) (*Note, error) {
+	note, err := server.app.CreateNote(ctx, request.GetTitle(), request.GetContent())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(note), nil
+}
+
+// Get will get the note with the id of the request
+func (server *NoteServer) Get(ctx context.Context, request *GetNoteRequest) (*Note, error) {
+	note, err := server.app.GetNoteById(ctx, int(request.GetId()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(note), nil
+}
+
+// Update will update the content of the note with the id of the request
+func (server *NoteServer) Update(ctx context.Context, request *UpdateNoteRequest) (*Note, error) {
+	note, err := server.app.UpdateNote(ctx, int(request.GetId()), request.GetContent())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(note), nil
+}
+
+// Delete will delete the note with the id of the request
+func (server *NoteServer) Delete(ctx context.Context, request *DeleteNoteRequest) (*DeleteNoteResponse, error) {
+	if err := server.app.DeleteNote(ctx, int(request.GetId())); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteNoteResponse{}, nil
+}
+
+// List will list the page of notes after the after_id of the request
+func (server *NoteServer) List(ctx context.Context, request *ListNotesRequest) (*ListNotesResponse, error) {
+	limit := int(request.GetLimit())
+	if limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+	notes, err := server.app.ListNotes(ctx, uint(request.GetAfterId()), limit)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	response := &ListNotesResponse{Notes: make([]*Note, len(notes))}
+	for i, note := range notes {
+		response.Notes[i] = toProto(note)
+	}
+	// a full page may be followed by more notes
+	if len(notes) == limit {
+		response.NextAfterId = uint64(notes[len(notes)-1].ID)
+	}
+	return response, nil
+}
+
+// toProto will convert the note to its protobuf message
+func toProto(note app.Note) *Note {
+	return &Note{
+		Id:        uint64(note.ID),
+		Title:     note.Title,
+		Content:   note.Content,
+		WordCount: int64(note.WordCount),
+		Version:   int64(note.Version),
+		Tags:      note.Tags,
+		CreatedAt: timestamppb.New(note.CreatedAt),
+		UpdatedAt: timestamppb.New(note.UpdatedAt),
+	}
+}
+
+// toStatus will translate the error returned by the application to the
+// gRPC status with the matching code
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, app.NoteNotFoundError):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, app.DuplicateNoteError):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, app.ErrVersionConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, app.ErrInvalidNote):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		slog.Error("Error in handling note RPC", "error", err.Error())
+		return status.Error(codes.Internal, app.SomethingWentWrongError.Error())
+	}
+}
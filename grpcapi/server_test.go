@@ -0,0 +1,235 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gorm.io/gorm"
+	"net"
+	"sort"
+	"testing"
+)
+
+// fakeNoteRepository is a NoteRepositoryInterface backed by a map so the
+// server can be tested without postgres or redis. Only the methods the
+// server's use cases need are implemented.
+type fakeNoteRepository struct {
+	app.NoteRepositoryInterface
+	notes map[uint]app.Note
+	// err, when set, is returned by every method
+	err error
+}
+
+func (repo *fakeNoteRepository) SaveNote(_ context.Context, note *app.Note) error {
+	if repo.err != nil {
+		return repo.err
+	}
+	for _, existing := range repo.notes {
+		if existing.Title == note.Title && existing.ID != note.ID {
+			return app.DuplicateNoteError
+		}
+	}
+	if note.ID == 0 {
+		note.ID = uint(len(repo.notes) + 1)
+	}
+	repo.notes[note.ID] = *note
+	return nil
+}
+
+func (repo *fakeNoteRepository) GetNoteById(_ context.Context, id int) (*app.Note, error) {
+	if repo.err != nil {
+		return nil, repo.err
+	}
+	note, ok := repo.notes[uint(id)]
+	if !ok {
+		return nil, app.NoteNotFoundError
+	}
+	return &note, nil
+}
+
+func (repo *fakeNoteRepository) DeleteNote(_ context.Context, id int) error {
+	if repo.err != nil {
+		return repo.err
+	}
+	delete(repo.notes, uint(id))
+	return nil
+}
+
+func (repo *fakeNoteRepository) ListNotesAfter(_ context.Context, afterID uint, limit int) ([]app.Note, error) {
+	if repo.err != nil {
+		return nil, repo.err
+	}
+	notes := make([]app.Note, 0)
+	for _, note := range repo.notes {
+		if note.ID > afterID {
+			notes = append(notes, note)
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].ID < notes[j].ID
+	})
+	return notes[:min(limit, len(notes))], nil
+}
+
+type NoteServerTestSuite struct {
+	suite.Suite
+	ctx    context.Context
+	repo   *fakeNoteRepository
+	client NoteServiceClient
+}
+
+func (suite *NoteServerTestSuite) SetupTest() {
+	suite.ctx = context.Background()
+	suite.repo = &fakeNoteRepository{notes: map[uint]app.Note{}}
+
+	// serve over an in-process listener
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	RegisterNoteServiceServer(server, NewNoteServer(app.NewApplication(suite.repo)))
+	go server.Serve(listener)
+	conn, err := grpc.DialContext(suite.ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	suite.Require().NoError(err)
+	suite.T().Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	suite.client = NewNoteServiceClient(conn)
+}
+
+// assertCode will assert the error is a gRPC status with the code
+func (suite *NoteServerTestSuite) assertCode(err error, code codes.Code) {
+	suite.Error(err)
+	suite.Equal(code, status.Code(err), err)
+}
+
+func (suite *NoteServerTestSuite) TestCreate() {
+	note, err := suite.client.Create(suite.ctx, &CreateNoteRequest{Title: "My note", Content: "My content"})
+	suite.NoError(err)
+	suite.Equal(uint64(1), note.GetId())
+	suite.Equal("My note", note.GetTitle())
+	suite.Equal("My content", note.GetContent())
+
+	suite.Run("Duplicate title", func() {
+		_, err := suite.client.Create(suite.ctx, &CreateNoteRequest{Title: "My note", Content: "Other content"})
+		suite.assertCode(err, codes.AlreadyExists)
+	})
+
+	suite.Run("Invalid note", func() {
+		_, err := suite.client.Create(suite.ctx, &CreateNoteRequest{Title: " ", Content: "Other content"})
+		suite.assertCode(err, codes.InvalidArgument)
+	})
+}
+
+func (suite *NoteServerTestSuite) TestGet() {
+	suite.repo.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content", Tags: []string{"work"}}
+
+	note, err := suite.client.Get(suite.ctx, &GetNoteRequest{Id: 1})
+	suite.NoError(err)
+	suite.Equal("My note", note.GetTitle())
+	suite.Equal([]string{"work"}, note.GetTags())
+
+	suite.Run("Not found", func() {
+		_, err := suite.client.Get(suite.ctx, &GetNoteRequest{Id: 2})
+		suite.assertCode(err, codes.NotFound)
+	})
+}
+
+func (suite *NoteServerTestSuite) TestUpdate() {
+	suite.repo.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content"}
+
+	note, err := suite.client.Update(suite.ctx, &UpdateNoteRequest{Id: 1, Content: "Updated content"})
+	suite.NoError(err)
+	suite.Equal("Updated content", note.GetContent())
+	suite.Equal("Updated content", suite.repo.notes[1].Content)
+
+	suite.Run("Not found", func() {
+		_, err := suite.client.Update(suite.ctx, &UpdateNoteRequest{Id: 2, Content: "Updated content"})
+		suite.assertCode(err, codes.NotFound)
+	})
+
+	suite.Run("Empty content", func() {
+		_, err := suite.client.Update(suite.ctx, &UpdateNoteRequest{Id: 1, Content: ""})
+		suite.assertCode(err, codes.InvalidArgument)
+	})
+}
+
+func (suite *NoteServerTestSuite) TestDelete() {
+	suite.repo.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content"}
+
+	_, err := suite.client.Delete(suite.ctx, &DeleteNoteRequest{Id: 1})
+	suite.NoError(err)
+	suite.NotContains(suite.repo.notes, uint(1))
+}
+
+func (suite *NoteServerTestSuite) TestList() {
+	for id := uint(1); id <= 3; id++ {
+		suite.repo.notes[id] = app.Note{Model: gorm.Model{ID: id}, Title: "Note", Content: "Content"}
+	}
+
+	page, err := suite.client.List(suite.ctx, &ListNotesRequest{Limit: 2})
+	suite.NoError(err)
+	suite.Len(page.GetNotes(), 2)
+	suite.Equal(uint64(1), page.GetNotes()[0].GetId())
+	suite.Equal(uint64(2), page.GetNextAfterId())
+
+	page, err = suite.client.List(suite.ctx, &ListNotesRequest{AfterId: page.GetNextAfterId(), Limit: 2})
+	suite.NoError(err)
+	suite.Len(page.GetNotes(), 1)
+	suite.Equal(uint64(3), page.GetNotes()[0].GetId())
+	suite.Zero(page.GetNextAfterId())
+
+	suite.Run("Default limit", func() {
+		page, err := suite.client.List(suite.ctx, &ListNotesRequest{})
+		suite.NoError(err)
+		suite.Len(page.GetNotes(), 3)
+	})
+
+	suite.Run("Negative limit", func() {
+		_, err := suite.client.List(suite.ctx, &ListNotesRequest{Limit: -1})
+		suite.assertCode(err, codes.InvalidArgument)
+	})
+}
+
+func (suite *NoteServerTestSuite) TestErrorMapping() {
+	testCases := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"Not found", app.NoteNotFoundError, codes.NotFound},
+		{"Duplicate note", app.DuplicateNoteError, codes.AlreadyExists},
+		{"Invalid note", app.ErrTitleTooLong, codes.InvalidArgument},
+		{"Version conflict", app.ErrVersionConflict, codes.Aborted},
+		{"Something went wrong", app.SomethingWentWrongError, codes.Internal},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			suite.assertCode(toStatus(tc.err), tc.code)
+		})
+	}
+
+	suite.Run("Unexpected errors aren't leaked", func() {
+		suite.repo.err = errors.New("connection reset")
+		suite.T().Cleanup(func() {
+			suite.repo.err = nil
+		})
+		_, err := suite.client.Create(suite.ctx, &CreateNoteRequest{Title: "My note", Content: "My content"})
+		suite.assertCode(err, codes.Internal)
+		suite.NotContains(err.Error(), "connection reset")
+	})
+}
+
+func TestNoteServer(t *testing.T) {
+	suite.Run(t, new(NoteServerTestSuite))
+}
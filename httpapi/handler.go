@@ -0,0 +1,205 @@
+// Package httpapi exposes the notes application over HTTP.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NoteService is the set of application use cases the handler exposes.
+// It is implemented by *app.Application.
+type NoteService interface {
+	CreateNote(ctx context.Context, title string, content string, opts ...app.CreateOption) (app.Note, error)
+	UpdateNote(ctx context.Context, id int, content string, opts ...app.UpdateOption) (app.Note, error)
+	GetNoteById(ctx context.Context, id int) (app.Note, error)
+	GetNoteByTitle(ctx context.Context, title string, opts ...app.TitleOption) (app.Note, error)
+	DeleteNote(ctx context.Context, id int) error
+}
+
+// errorResponse is the JSON body returned when a request fails
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the note endpoints:
+//
+//	POST   /notes          create a note, deduplicated by its Idempotency-Key header
+//	                       and rate limited by its X-Client-ID header
+//	GET    /notes?title=   get a note by its title
+//	GET    /notes/{id}     get a note by its id
+//	PUT    /notes/{id}     update a note's content
+//	DELETE /notes/{id}     delete a note
+//
+// Request and response bodies are JSON encoded notes, see app.NoteDTO.
+type Handler struct {
+	service NoteService
+}
+
+// NewHandler is the factory function to create a new Handler
+// Parameters:
+// -  service: the application use cases to expose
+//
+// Returns:
+// - *Handler: A pointer to the newly created Handler
+func NewHandler(service NoteService) *Handler {
+	return &Handler{service: service}
+}
+
+// ServeHTTP will route the request to the endpoint matching its path and method
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/notes" {
+		switch r.Method {
+		case http.MethodPost:
+			handler.createNote(w, r)
+		case http.MethodGet:
+			handler.getNoteByTitle(w, r)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+	rawID, found := strings.CutPrefix(r.URL.Path, "/notes/")
+	if !found || rawID == "" || strings.Contains(rawID, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	id, err := strconv.Atoi(rawID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		handler.getNoteById(w, r, id)
+	case http.MethodPut:
+		handler.updateNote(w, r, id)
+	case http.MethodDelete:
+		handler.deleteNote(w, r, id)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// idempotencyKeyHeader is the request header a client retrying a create
+// sets to the same value on every attempt so the note is created once
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// clientIDHeader is the request header identifying the client whose
+// creates are rate limited
+const clientIDHeader = "X-Client-ID"
+
+// createNote will create the note in the request body
+func (handler *Handler) createNote(w http.ResponseWriter, r *http.Request) {
+	var body app.NoteDTO
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var opts []app.CreateOption
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		opts = append(opts, app.WithIdempotencyKey(key))
+	}
+	if clientID := r.Header.Get(clientIDHeader); clientID != "" {
+		opts = append(opts, app.WithClientID(clientID))
+	}
+	note, err := handler.service.CreateNote(r.Context(), body.Title, body.Content, opts...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, app.NewNoteDTO(note))
+}
+
+// getNoteByTitle will get the note whose title is in the title query parameter
+func (handler *Handler) getNoteByTitle(w http.ResponseWriter, r *http.Request) {
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		writeError(w, http.StatusBadRequest, "title query parameter is required")
+		return
+	}
+	note, err := handler.service.GetNoteByTitle(r.Context(), title)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, app.NewNoteDTO(note))
+}
+
+// getNoteById will get the note with the id
+func (handler *Handler) getNoteById(w http.ResponseWriter, r *http.Request, id int) {
+	note, err := handler.service.GetNoteById(r.Context(), id)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, app.NewNoteDTO(note))
+}
+
+// updateNote will update the content of the note with the id to the
+// content in the request body
+func (handler *Handler) updateNote(w http.ResponseWriter, r *http.Request, id int) {
+	var body app.NoteDTO
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	note, err := handler.service.UpdateNote(r.Context(), id, body.Content)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, app.NewNoteDTO(note))
+}
+
+// deleteNote will delete the note with the id
+func (handler *Handler) deleteNote(w http.ResponseWriter, r *http.Request, id int) {
+	if err := handler.service.DeleteNote(r.Context(), id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeServiceError will translate the error returned by the application
+// to the matching status code
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, app.NoteNotFoundError):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, app.DuplicateNoteError), errors.Is(err, app.ErrVersionConflict), errors.Is(err, app.ErrRequestInProgress):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, app.ErrInvalidNote):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, app.ErrRateLimited):
+		writeError(w, http.StatusTooManyRequests, err.Error())
+	default:
+		slog.Error("Error in handling note request", "error", err.Error())
+		writeError(w, http.StatusInternalServerError, app.SomethingWentWrongError.Error())
+	}
+}
+
+// writeMethodNotAllowed will respond that the method isn't supported on the path
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeError will write the message as a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+// writeJSON will write the value as a JSON response with the status
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("Error in encoding response", "error", err.Error())
+	}
+}
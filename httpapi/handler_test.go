@@ -0,0 +1,301 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shaibujnr/integration_testing_with_test_containers_go/app"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeNoteService is a NoteService backed by a map so the handler can be
+// tested without postgres or redis.
+type fakeNoteService struct {
+	notes  map[int]app.Note
+	nextID int
+	// err, when set, is returned by every method
+	err error
+	// createOpts are the options of the last create
+	createOpts []app.CreateOption
+}
+
+// the handler is meant to serve the application's use cases
+var _ NoteService = (*app.Application)(nil)
+
+func newFakeNoteService() *fakeNoteService {
+	return &fakeNoteService{notes: map[int]app.Note{}, nextID: 1}
+}
+
+func (service *fakeNoteService) CreateNote(_ context.Context, title string, content string, opts ...app.CreateOption) (app.Note, error) {
+	service.createOpts = opts
+	if service.err != nil {
+		return app.Note{}, service.err
+	}
+	for _, note := range service.notes {
+		if note.Title == title {
+			return app.Note{}, app.DuplicateNoteError
+		}
+	}
+	note := app.Note{Model: gorm.Model{ID: uint(service.nextID)}, Title: title, Content: content}
+	service.notes[service.nextID] = note
+	service.nextID++
+	return note, nil
+}
+
+func (service *fakeNoteService) UpdateNote(_ context.Context, id int, content string, _ ...app.UpdateOption) (app.Note, error) {
+	if service.err != nil {
+		return app.Note{}, service.err
+	}
+	note, ok := service.notes[id]
+	if !ok {
+		return app.Note{}, app.NoteNotFoundError
+	}
+	note.Content = content
+	service.notes[id] = note
+	return note, nil
+}
+
+func (service *fakeNoteService) GetNoteById(_ context.Context, id int) (app.Note, error) {
+	if service.err != nil {
+		return app.Note{}, service.err
+	}
+	note, ok := service.notes[id]
+	if !ok {
+		return app.Note{}, app.NoteNotFoundError
+	}
+	return note, nil
+}
+
+func (service *fakeNoteService) GetNoteByTitle(_ context.Context, title string, _ ...app.TitleOption) (app.Note, error) {
+	if service.err != nil {
+		return app.Note{}, service.err
+	}
+	for _, note := range service.notes {
+		if note.Title == title {
+			return note, nil
+		}
+	}
+	return app.Note{}, app.NoteNotFoundError
+}
+
+func (service *fakeNoteService) DeleteNote(_ context.Context, id int) error {
+	if service.err != nil {
+		return service.err
+	}
+	if _, ok := service.notes[id]; !ok {
+		return app.NoteNotFoundError
+	}
+	delete(service.notes, id)
+	return nil
+}
+
+type HandlerTestSuite struct {
+	suite.Suite
+	service *fakeNoteService
+	handler *Handler
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.service = newFakeNoteService()
+	suite.handler = NewHandler(suite.service)
+}
+
+// do will serve the request and return the recorded response
+func (suite *HandlerTestSuite) do(method string, target string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	suite.handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// decodeNote will decode the note in the response body
+func (suite *HandlerTestSuite) decodeNote(recorder *httptest.ResponseRecorder) app.Note {
+	suite.Equal("application/json", recorder.Header().Get("Content-Type"))
+	var note app.NoteDTO
+	suite.NoError(json.NewDecoder(recorder.Body).Decode(&note))
+	return note.ToNote()
+}
+
+// assertError will assert the response is a JSON error with the status
+func (suite *HandlerTestSuite) assertError(recorder *httptest.ResponseRecorder, status int) {
+	suite.Equal(status, recorder.Code)
+	suite.Equal("application/json", recorder.Header().Get("Content-Type"))
+	var body errorResponse
+	suite.NoError(json.NewDecoder(recorder.Body).Decode(&body))
+	suite.NotEmpty(body.Error)
+}
+
+func (suite *HandlerTestSuite) TestCreateNote() {
+	recorder := suite.do(http.MethodPost, "/notes", `{"Title": "My note", "Content": "My content"}`)
+	suite.Equal(http.StatusCreated, recorder.Code)
+	note := suite.decodeNote(recorder)
+	suite.Equal(uint(1), note.ID)
+	suite.Equal("My note", note.Title)
+	suite.Equal("My content", note.Content)
+
+	suite.Run("Duplicate title", func() {
+		recorder := suite.do(http.MethodPost, "/notes", `{"Title": "My note", "Content": "Other content"}`)
+		suite.assertError(recorder, http.StatusConflict)
+	})
+
+	suite.Run("Invalid body", func() {
+		recorder := suite.do(http.MethodPost, "/notes", `{"Title":`)
+		suite.assertError(recorder, http.StatusBadRequest)
+	})
+
+	suite.Run("Idempotency key", func() {
+		suite.Empty(suite.service.createOpts)
+		request := httptest.NewRequest(http.MethodPost, "/notes", strings.NewReader(`{"Title": "Keyed", "Content": "My content"}`))
+		request.Header.Set("Idempotency-Key", "request-1")
+		recorder := httptest.NewRecorder()
+		suite.handler.ServeHTTP(recorder, request)
+		suite.Equal(http.StatusCreated, recorder.Code)
+		suite.Len(suite.service.createOpts, 1)
+	})
+
+	suite.Run("Client id", func() {
+		request := httptest.NewRequest(http.MethodPost, "/notes", strings.NewReader(`{"Title": "Limited", "Content": "My content"}`))
+		request.Header.Set("X-Client-ID", "client-1")
+		recorder := httptest.NewRecorder()
+		suite.handler.ServeHTTP(recorder, request)
+		suite.Equal(http.StatusCreated, recorder.Code)
+		suite.Len(suite.service.createOpts, 1)
+	})
+
+	suite.Run("Request in progress", func() {
+		suite.service.err = app.ErrRequestInProgress
+		recorder := suite.do(http.MethodPost, "/notes", `{"Title": "Other note", "Content": "My content"}`)
+		suite.assertError(recorder, http.StatusConflict)
+	})
+}
+
+func (suite *HandlerTestSuite) TestGetNoteById() {
+	suite.service.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content"}
+
+	recorder := suite.do(http.MethodGet, "/notes/1", "")
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal("My note", suite.decodeNote(recorder).Title)
+
+	suite.Run("Body is a note DTO", func() {
+		recorder := suite.do(http.MethodGet, "/notes/1", "")
+		suite.JSONEq(`{
+			"id": 1,
+			"title": "My note",
+			"content": "My content",
+			"created_at": "0001-01-01T00:00:00Z",
+			"updated_at": "0001-01-01T00:00:00Z"
+		}`, recorder.Body.String())
+	})
+
+	suite.Run("Not found", func() {
+		suite.assertError(suite.do(http.MethodGet, "/notes/2", ""), http.StatusNotFound)
+	})
+
+	suite.Run("Invalid id", func() {
+		suite.assertError(suite.do(http.MethodGet, "/notes/abc", ""), http.StatusBadRequest)
+	})
+}
+
+func (suite *HandlerTestSuite) TestGetNoteByTitle() {
+	suite.service.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content"}
+
+	recorder := suite.do(http.MethodGet, "/notes?title=My+note", "")
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal(uint(1), suite.decodeNote(recorder).ID)
+
+	suite.Run("Not found", func() {
+		suite.assertError(suite.do(http.MethodGet, "/notes?title=Missing", ""), http.StatusNotFound)
+	})
+
+	suite.Run("Missing title", func() {
+		suite.assertError(suite.do(http.MethodGet, "/notes", ""), http.StatusBadRequest)
+	})
+}
+
+func (suite *HandlerTestSuite) TestUpdateNote() {
+	suite.service.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content"}
+
+	recorder := suite.do(http.MethodPut, "/notes/1", `{"Content": "Updated content"}`)
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal("Updated content", suite.decodeNote(recorder).Content)
+
+	suite.Run("Not found", func() {
+		suite.assertError(suite.do(http.MethodPut, "/notes/2", `{"Content": "Updated content"}`), http.StatusNotFound)
+	})
+
+	suite.Run("Invalid body", func() {
+		suite.assertError(suite.do(http.MethodPut, "/notes/1", `not json`), http.StatusBadRequest)
+	})
+}
+
+func (suite *HandlerTestSuite) TestDeleteNote() {
+	suite.service.notes[1] = app.Note{Model: gorm.Model{ID: 1}, Title: "My note", Content: "My content"}
+
+	recorder := suite.do(http.MethodDelete, "/notes/1", "")
+	suite.Equal(http.StatusNoContent, recorder.Code)
+	suite.Empty(recorder.Body.String())
+	suite.NotContains(suite.service.notes, 1)
+
+	suite.Run("Not found", func() {
+		suite.assertError(suite.do(http.MethodDelete, "/notes/1", ""), http.StatusNotFound)
+	})
+}
+
+func (suite *HandlerTestSuite) TestServiceErrors() {
+	testCases := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"Validation error", fmt.Errorf("%w: title is empty", app.ErrInvalidNote), http.StatusBadRequest},
+		{"Empty title", app.ErrEmptyTitle, http.StatusBadRequest},
+		{"Duplicate note", app.DuplicateNoteError, http.StatusConflict},
+		{"Version conflict", app.ErrVersionConflict, http.StatusConflict},
+		{"Not found", app.NoteNotFoundError, http.StatusNotFound},
+		{"Rate limited", app.ErrRateLimited, http.StatusTooManyRequests},
+		{"Something went wrong", app.SomethingWentWrongError, http.StatusInternalServerError},
+		{"Unexpected error", errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		suite.Run(tc.name, func() {
+			suite.service.err = tc.err
+			suite.T().Cleanup(func() {
+				suite.service.err = nil
+			})
+			recorder := suite.do(http.MethodPost, "/notes", `{"Title": "My note", "Content": "My content"}`)
+			suite.assertError(recorder, tc.status)
+		})
+	}
+
+	suite.Run("Unexpected errors aren't leaked", func() {
+		suite.service.err = errors.New("connection reset")
+		suite.T().Cleanup(func() {
+			suite.service.err = nil
+		})
+		recorder := suite.do(http.MethodGet, "/notes/1", "")
+		suite.NotContains(recorder.Body.String(), "connection reset")
+	})
+}
+
+func (suite *HandlerTestSuite) TestRouting() {
+	recorder := suite.do(http.MethodPatch, "/notes/1", "")
+	suite.assertError(recorder, http.StatusMethodNotAllowed)
+	suite.Equal("GET, PUT, DELETE", recorder.Header().Get("Allow"))
+
+	recorder = suite.do(http.MethodDelete, "/notes", "")
+	suite.assertError(recorder, http.StatusMethodNotAllowed)
+	suite.Equal("GET, POST", recorder.Header().Get("Allow"))
+
+	suite.assertError(suite.do(http.MethodGet, "/notes/1/extra", ""), http.StatusNotFound)
+	suite.assertError(suite.do(http.MethodGet, "/other", ""), http.StatusNotFound)
+}
+
+func TestHandler(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}